@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/wostzone/hubclient-go/pkg/config"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+	thingdirpb "github.com/wostzone/thingdir/pkg/thingdir-pb"
+)
+
+// commands that can be run instead of the service, eg: thingdir export -o things.ndjson
+var commands = map[string]func(args []string) int{
+	"export": runExport,
+	"import": runImport,
+}
+
+// connectDirectory connects to the directory server using the plugin client certificate
+//  server address:port of the directory server. "" to use the configured address and port
+//  homeFolder with the hub config and certificates. "" for the default
+func connectDirectory(server string, homeFolder string) (*dirclient.DirClient, error) {
+	thingdirConfig := &thingdirpb.ThingDirPBConfig{}
+	hubConfig, err := config.LoadAllConfig([]string{os.Args[0]}, homeFolder, thingdirpb.PluginID, &thingdirConfig)
+	if err != nil {
+		return nil, err
+	}
+	if server == "" {
+		address := thingdirConfig.DirAddress
+		if address == "" {
+			address = hubConfig.MqttAddress
+		}
+		port := thingdirConfig.DirPort
+		if port == 0 {
+			port = dirclient.DefaultPort
+		}
+		server = fmt.Sprintf("%s:%d", address, port)
+	}
+	dirClient := dirclient.NewDirClient(server, hubConfig.CaCert)
+	err = dirClient.ConnectWithClientCert(hubConfig.PluginCert)
+	return dirClient, err
+}
+
+// runExport exports the TDs of the directory to file or stdout
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	server := flags.String("server", "", "Directory server address:port. Default is the configured server")
+	homeFolder := flags.String("home", "", "Hub home folder with the config and certs folders")
+	format := flags.String("format", dirclient.FormatNDJSON, "Export format: ndjson or json")
+	outputFile := flags.String("o", "", "File to write the TDs to. Default is stdout")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	dirClient, err := connectDirectory(*server, *homeFolder)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to the directory: %s\n", err)
+		return 1
+	}
+	defer dirClient.Close()
+
+	var writer io.Writer = os.Stdout
+	if *outputFile != "" {
+		fp, err := os.Create(*outputFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create '%s': %s\n", *outputFile, err)
+			return 1
+		}
+		defer fp.Close()
+		writer = fp
+	}
+	err = dirClient.ExportTDs(*format, writer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runImport imports the TDs from a NDJSON or JSON array file and prints the import report
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	server := flags.String("server", "", "Directory server address:port. Default is the configured server")
+	homeFolder := flags.String("home", "", "Hub home folder with the config and certs folders")
+	mode := flags.String("mode", dirclient.ImportModeUpsert, "What to do with existing TDs: upsert, skip or replace")
+	dryRun := flags.Bool("dryrun", false, "Report the result without importing")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: thingdir import [options] file.ndjson|file.json\n")
+		flags.PrintDefaults()
+		return 2
+	}
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read '%s': %s\n", flags.Arg(0), err)
+		return 1
+	}
+	tdList, err := dirclient.DecodeTDs(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid TDs in '%s': %s\n", flags.Arg(0), err)
+		return 1
+	}
+	dirClient, err := connectDirectory(*server, *homeFolder)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to the directory: %s\n", err)
+		return 1
+	}
+	defer dirClient.Close()
+
+	report, err := dirClient.ImportTDs(tdList, *mode, *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %s\n", err)
+		return 1
+	}
+	msg, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(msg))
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"os"
+	"path"
 
 	"github.com/sirupsen/logrus"
 	"github.com/wostzone/hubclient-go/pkg/config"
@@ -15,6 +17,14 @@ func Main() {
 
 // main entry point for the thingdir protocol binding service
 func main() {
+	// run a command instead of the service, eg export or import
+	if len(os.Args) > 1 {
+		if command, found := commands[os.Args[1]]; found {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+	// the hub commandline is parsed when loading the config
+	standalone := flag.Bool("standalone", false, "Only run the directory server, without the message bus")
 	// with defaults
 	thingdirConfig := &thingdirpb.ThingDirPBConfig{}
 	hubConfig, err := config.LoadAllConfig(os.Args, "", thingdirpb.PluginID, &thingdirConfig)
@@ -22,14 +32,17 @@ func main() {
 		logrus.Printf("bye bye")
 		os.Exit(1)
 	}
-	// commandline overrides configfile
-	// flag.Parse()
-
 	pb := thingdirpb.NewThingDirPB(thingdirConfig, hubConfig)
+	// commandline overrides configfile
+	if *standalone {
+		pb.SetStandalone()
+	}
+	// reload the configuration when it changes
+	pb.SetConfigFile(path.Join(hubConfig.ConfigFolder, thingdirpb.PluginID+".yaml"))
 	err = pb.Start()
 
 	if err != nil {
-		logrus.Printf("Failed starting Thing Directory server. Is the mosquitto broker running?: %s\n", err)
+		logrus.Printf("Failed starting Thing Directory server: %s\n", err)
 		os.Exit(1)
 	}
 	logrus.Printf("Successful started Thing Directory server\n")
@@ -0,0 +1,81 @@
+package dirclient
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// API key paths. These are only available to administrators.
+const RouteAPIKeys = "/admin/apikeys"          // list or create API keys
+const RouteAPIKeyID = "/admin/apikeys/{keyID}" // get or revoke an API key
+
+// APIKeyPrefix is the prefix of API keys. This distinguishes API keys from other bearer tokens.
+const APIKeyPrefix = "wostdir_"
+
+// API key scopes
+const (
+	APIKeyScopeRead      = "read"      // read TDs
+	APIKeyScopeReadWrite = "readwrite" // read, update and delete TDs
+)
+
+// APIKey describes an API key of a service account
+// The key itself is only returned when the API key is created. The directory only keeps its hash.
+type APIKey struct {
+	ID           string `json:"id"`                // ID of the API key
+	Name         string `json:"name"`              // name of the service account
+	Scope        string `json:"scope"`             // APIKeyScopeRead or APIKeyScopeReadWrite
+	ThingPattern string `json:"thingPattern"`      // things the key can access, eg "urn:zone1:*". "" for all things
+	Expires      string `json:"expires,omitempty"` // expiry in ISO8601 format, "" if the key doesn't expire
+	Created      string `json:"created"`           // time the key was created in ISO8601 format
+	CreatedBy    string `json:"createdBy"`         // administrator that created the key
+	Key          string `json:"key,omitempty"`     // the key to connect with, only set on creation
+}
+
+// ConnectWithAPIKey opens the connection to the directory server using an API key
+// The key is sent as a bearer token.
+//  apiKey as returned by CreateAPIKey
+func (dc *DirClient) ConnectWithAPIKey(apiKey string) error {
+	return dc.ConnectWithToken(apiKey, nil)
+}
+
+// CreateAPIKey creates a new API key for a service account
+// This requires an administrator client certificate. Returns the API key with the key to
+// connect with. Store the key safely as it can't be obtained again.
+//  name of the service account
+//  scope is APIKeyScopeRead or APIKeyScopeReadWrite
+//  thingPattern of the things the key can access, eg "urn:zone1:*". Use "" for all things.
+//  expires is the expiry of the key. Use the zero time for keys that don't expire.
+func (dc *DirClient) CreateAPIKey(name string, scope string, thingPattern string, expires time.Time) (*APIKey, error) {
+	apiKey := APIKey{Name: name, Scope: scope, ThingPattern: thingPattern}
+	if !expires.IsZero() {
+		apiKey.Expires = expires.Format(time.RFC3339)
+	}
+	resp, err := dc.invoke("POST", RouteAPIKeys, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &apiKey)
+	return &apiKey, err
+}
+
+// ListAPIKeys returns the API keys without the keys themselves
+// This requires an administrator client certificate.
+func (dc *DirClient) ListAPIKeys() ([]APIKey, error) {
+	var apiKeys []APIKey
+	resp, err := dc.invoke("GET", RouteAPIKeys, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &apiKeys)
+	return apiKeys, err
+}
+
+// RevokeAPIKey revokes an API key. The key can no longer be used to connect.
+// This requires an administrator client certificate.
+//  keyID is the ID of the API key
+func (dc *DirClient) RevokeAPIKey(keyID string) error {
+	path := strings.Replace(RouteAPIKeyID, "{keyID}", keyID, 1)
+	_, err := dc.invoke("DELETE", path, nil)
+	return err
+}
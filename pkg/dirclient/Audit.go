@@ -0,0 +1,66 @@
+package dirclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// RouteAudit is the path of the audit log API. This is only available to administrators.
+const RouteAudit = "/audit"
+
+// query parameters of the audit log API
+const ParamUserID = "userID"
+const ParamThingID = "thingID"
+const ParamMethod = "method"
+const ParamUntil = "until"
+
+// AuditRecord describes a modification of the directory
+// The revisions identify the content of the TD before and after the change. An empty revision
+// means the TD didn't exist.
+type AuditRecord struct {
+	Time       string `json:"time"`       // time of the request in ISO8601 format
+	UserID     string `json:"userID"`     // authenticated user or client ID
+	CertOU     string `json:"certOU"`     // OU of the client certificate, if authenticated with a certificate
+	ClientAddr string `json:"clientAddr"` // remote address of the client
+	Method     string `json:"method"`     // HTTP method of the request
+	Path       string `json:"path"`       // path of the request
+	ThingID    string `json:"thingID"`    // ID of the modified thing
+	RevBefore  string `json:"revBefore"`  // revision of the TD before the request
+	RevAfter   string `json:"revAfter"`   // revision of the TD after the request
+	Result     int    `json:"result"`     // HTTP status code of the result
+}
+
+// AuditFilter selects the audit records to return. Empty fields match all records.
+type AuditFilter struct {
+	UserID  string // only records of this user
+	ThingID string // only records of this thing
+	Method  string // only records with this HTTP method
+	Since   string // only records at or after this ISO8601 time
+	Until   string // only records before this ISO8601 time
+}
+
+// GetAuditRecords returns the audit records that match the filter, newest first
+// This requires an administrator client certificate.
+//  filter with the records to return
+//  offset of the first record to return
+//  limit the nr of records. Use 0 for default.
+func (dc *DirClient) GetAuditRecords(filter AuditFilter, offset int, limit int) ([]AuditRecord, error) {
+	var records []AuditRecord
+	params := url.Values{}
+	params.Set(ParamOffset, fmt.Sprint(offset))
+	params.Set(ParamLimit, fmt.Sprint(limit))
+	for key, value := range map[string]string{
+		ParamUserID: filter.UserID, ParamThingID: filter.ThingID, ParamMethod: filter.Method,
+		ParamSince: filter.Since, ParamUntil: filter.Until} {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+	resp, err := dc.invoke("GET", RouteAudit+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &records)
+	return records, err
+}
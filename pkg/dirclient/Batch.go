@@ -0,0 +1,75 @@
+package dirclient
+
+import (
+	"encoding/json"
+
+	"github.com/wostzone/hubclient-go/pkg/td"
+)
+
+// RouteThingsBatch is the path of the batch write API
+// This must be registered before RouteThingID as it matches the same pattern.
+const RouteThingsBatch = "/things/batch"
+
+// Batch operations
+const (
+	BatchOpPut    = "put"    // create or replace the TD
+	BatchOpPatch  = "patch"  // merge the TD into the existing TD
+	BatchOpDelete = "delete" // delete the thing
+)
+
+// Batch item results
+const (
+	BatchResultCreated = "created"
+	BatchResultUpdated = "updated"
+	BatchResultDeleted = "deleted"
+	BatchResultFailed  = "failed"
+)
+
+// BatchOperation is a single write operation in a batch
+type BatchOperation struct {
+	Op      string     `json:"op"`           // BatchOpPut, BatchOpPatch or BatchOpDelete
+	ThingID string     `json:"thingID"`      // ID of the thing to write
+	TD      td.ThingTD `json:"td,omitempty"` // TD to put or patch. Not used with delete
+}
+
+// BatchRequest is a list of write operations that are applied together
+// If Atomic is set then either all operations are applied or none are.
+type BatchRequest struct {
+	Atomic     bool             `json:"atomic"`     // apply all or nothing
+	Operations []BatchOperation `json:"operations"` // operations in the order they are applied
+}
+
+// BatchItemResult is the result of a single operation in a batch
+type BatchItemResult struct {
+	Index   int    `json:"index"`           // index of the operation in the batch, starting at 0
+	ThingID string `json:"thingID"`         // ID of the written thing
+	Op      string `json:"op"`              // the operation
+	Result  string `json:"result"`          // created, updated, deleted or failed
+	Error   string `json:"error,omitempty"` // reason the operation failed
+}
+
+// BatchResponse is the result of a batch write
+// If Applied is false then none of the operations were applied. This happens when an atomic
+// batch has a failed operation.
+type BatchResponse struct {
+	Atomic  bool              `json:"atomic"`  // the batch was applied as all or nothing
+	Applied bool              `json:"applied"` // the successful operations were applied
+	Failed  int               `json:"failed"`  // nr of failed operations
+	Results []BatchItemResult `json:"results"` // result of each operation
+}
+
+// WriteBatch applies a list of put, patch and delete operations in a single request
+// Use this instead of multiple UpdateTD calls when writing many TDs at once, eg for a gateway.
+//  operations to apply in order
+//  atomic applies all operations or none. If false then the successful operations are applied
+// Returns the result of each operation
+func (dc *DirClient) WriteBatch(operations []BatchOperation, atomic bool) (*BatchResponse, error) {
+	var batchResp BatchResponse
+	batchReq := BatchRequest{Atomic: atomic, Operations: operations}
+	resp, err := dc.invoke("POST", RouteThingsBatch, batchReq)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &batchResp)
+	return &batchResp, err
+}
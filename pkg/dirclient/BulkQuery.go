@@ -0,0 +1,46 @@
+package dirclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/wostzone/hubclient-go/pkg/td"
+)
+
+// BulkResponse is the result of a bulk delete or bulk patch of the things matching a query
+// With a dry-run, ThingIDs holds the things that would be changed.
+type BulkResponse struct {
+	DryRun   bool     `json:"dryRun"`   // the change was not applied
+	Matched  int      `json:"matched"`  // nr of things matching the query
+	ThingIDs []string `json:"thingIDs"` // IDs of the matching things, sorted
+}
+
+// bulkByQuery invokes a bulk operation on the things matching the query
+func (dc *DirClient) bulkByQuery(method string, jsonpath string, patch td.ThingTD, dryRun bool) (*BulkResponse, error) {
+	var bulkResp BulkResponse
+	path := fmt.Sprintf("%s?%s=%s&%s=%t", RouteThings, ParamQuery, url.QueryEscape(jsonpath), ParamDryRun, dryRun)
+	resp, err := dc.invoke(method, path, patch)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &bulkResp)
+	return &bulkResp, err
+}
+
+// DeleteByQuery deletes all things matching the JSONPATH query
+// This requires write authorization for each of the matching things.
+//  jsonpath query of the things to delete. This is required.
+//  dryRun returns the matching thing IDs without deleting them
+func (dc *DirClient) DeleteByQuery(jsonpath string, dryRun bool) (*BulkResponse, error) {
+	return dc.bulkByQuery("DELETE", jsonpath, nil, dryRun)
+}
+
+// PatchByQuery merges the patch into the TD of all things matching the JSONPATH query
+// This requires write authorization for each of the matching things.
+//  jsonpath query of the things to patch. This is required.
+//  patch with the attributes to merge into each TD
+//  dryRun returns the matching thing IDs without patching them
+func (dc *DirClient) PatchByQuery(jsonpath string, patch td.ThingTD, dryRun bool) (*BulkResponse, error) {
+	return dc.bulkByQuery("PATCH", jsonpath, patch, dryRun)
+}
@@ -2,15 +2,21 @@
 package dirclient
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/wostzone/hubclient-go/pkg/td"
-	"github.com/wostzone/hubclient-go/pkg/tlsclient"
 )
 
 // Constants for use by server and applications
@@ -23,58 +29,257 @@ const (
 const RouteThings = "/things"            // list or query path
 const RouteThingID = "/things/{thingID}" // for methods get, post, patch, delete
 
+// path of the directory's own Thing Description, as defined in WoT Discovery
+const RouteWellKnownWoT = "/.well-known/wot"
+
+// paths of the Thing Model catalog
+const RouteModels = "/models"                                 // list Thing Models
+const RouteModelID = "/models/{modelID}"                      // for methods get, post, put, delete
+const RouteModelInstantiate = "/models/{modelID}/instantiate" // create a TD from a Thing Model
+
 // query parameters
 const ParamOffset = "offset"
 const ParamLimit = "limit"
 const ParamQuery = "queryparams"
+const ParamVersion = "version"
+const ParamModel = "model" // only the TDs derived from the Thing Model with this ID
+const ParamScope = "scope"
+
+// query scope values
+const ScopeLocal = "local"         // only query this directory. This is the default
+const ScopeFederated = "federated" // also query the peer directories
+
+// VisibilityAnnotation is the TD attribute with the visibility of the TD
+// Publishers set it to one of the visibility values below. The default is private.
+const VisibilityAnnotation = "wost:visibility"
+
+// TD visibility values
+const VisibilityPrivate = "private"             // readable by users that are authorized for the thing
+const VisibilityAuthenticated = "authenticated" // readable by all authenticated users
+const VisibilityPublic = "public"               // readable by anyone, including anonymous clients if allowed
 
 const DefaultLimit = 100
 const MaxLimit = 1000
 
+// InstantiateRequest is the message body for creating a TD from a Thing Model
+type InstantiateRequest struct {
+	ThingID      string            `json:"thingID"`           // ID of the new TD
+	Version      string            `json:"version,omitempty"` // model version, default is the latest
+	Placeholders map[string]string `json:"placeholders"`      // values of the {{NAME}} placeholders in the model
+}
+
+// PeerResult reports the outcome of a federated query on a peer directory
+type PeerResult struct {
+	Peer  string `json:"peer"`            // address:port of the peer directory
+	Count int    `json:"count"`           // nr of TDs received from the peer
+	Error string `json:"error,omitempty"` // error or timeout of the query, if any
+}
+
+// FederatedResult is the response of a query with scope federated
+type FederatedResult struct {
+	Things  []td.ThingTD `json:"things"`  // merged TDs of this directory and its peers
+	Peers   []PeerResult `json:"peers"`   // result of the query on each peer
+	Partial bool         `json:"partial"` // one or more peers failed to respond in time
+}
+
 // DirClient is a client for the WoST Directory service
 // Intended for updating and reading TDs
 type DirClient struct {
-	hostport  string // address:port of the directory server, "" if unknown
-	tlsClient *tlsclient.TLSClient
+	hostport   string // address:port of the directory server, "" if unknown
+	caCert     *x509.Certificate
+	httpClient *http.Client // client of the connection, nil if not connected
+
+	// credentials of the connection
+	clientCert *tls.Certificate // client certificate, nil if not used
+	loginID    string           // login ID for basic authentication, "" if not used
+	password   string
+
+	// failover between discovered directory servers
+	candidates     []DirectoryCandidate
+	candidateIndex int // index of the candidate in use
+
+	// bearer token authentication
+	token        string
+	tokenRefresh TokenRefresher
+	mutex        sync.RWMutex
 }
 
 // Close the connection to the directory server
 func (dc *DirClient) Close() {
-	if dc.tlsClient != nil {
-		dc.tlsClient.Close()
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	if dc.httpClient != nil {
+		dc.httpClient.CloseIdleConnections()
 	}
 }
 
+// newHTTPClient returns a client that verifies the server with the CA certificate
+//  caCert to verify the server certificate
+//  clientCert to authenticate with, nil to not use a client certificate
+func newHTTPClient(caCert *x509.Certificate, clientCert *tls.Certificate) *http.Client {
+	caCertPool := x509.NewCertPool()
+	if caCert != nil {
+		caCertPool.AddCert(caCert)
+	}
+	tlsConfig := &tls.Config{RootCAs: caCertPool}
+	if clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	return &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+}
+
+// setBasicAuth returns the function that adds the login ID and password to a request
+// Returns nil if the connection doesn't use a login ID. The caller must hold the lock.
+func (dc *DirClient) setBasicAuth() func(req *http.Request) {
+	if dc.loginID == "" {
+		return nil
+	}
+	loginID, password := dc.loginID, dc.password
+	return func(req *http.Request) {
+		req.SetBasicAuth(loginID, password)
+	}
+}
+
+// connect opens the connection with the credentials of the client
+// With discovered candidates, the first reachable candidate is used, starting with the current one.
+// A candidate is reachable if it serves the directory TD.
+func (dc *DirClient) connect() error {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	httpClient := newHTTPClient(dc.caCert, dc.clientCert)
+	if len(dc.candidates) == 0 {
+		if dc.httpClient != nil {
+			dc.httpClient.CloseIdleConnections()
+		}
+		dc.httpClient = httpClient
+		return nil
+	}
+	var err error
+	for i := 0; i < len(dc.candidates); i++ {
+		index := (dc.candidateIndex + i) % len(dc.candidates)
+		hostport := dc.candidates[index].HostPort
+		resp, respData, err2 := sendRequest(httpClient, hostport, "GET", RouteWellKnownWoT, nil, dc.setBasicAuth())
+		err = err2
+		if err == nil {
+			err = newStatusError("GET", RouteWellKnownWoT, resp, respData)
+		}
+		if err == nil {
+			if dc.httpClient != nil {
+				dc.httpClient.CloseIdleConnections()
+			}
+			dc.httpClient = httpClient
+			dc.hostport = hostport
+			dc.candidateIndex = index
+			logrus.Infof("DirClient.connect: connected to directory '%s' at %s",
+				dc.candidates[index].InstanceID, hostport)
+			return nil
+		}
+		logrus.Warningf("DirClient.connect: directory at %s is not available: %s", hostport, err)
+	}
+	httpClient.CloseIdleConnections()
+	return err
+}
+
 // ConnectWithCertificate open the connection to the directory server using a client certificate for authentication
-//  clientCertFile  client certificate to authenticate the client with the broker
-//  clientKeyFile   client key to authenticate the client with the broker
+//  tlsClientCert client certificate to authenticate the client with the directory
 func (dc *DirClient) ConnectWithClientCert(tlsClientCert *tls.Certificate) error {
-	err := dc.tlsClient.ConnectWithClientCert(tlsClientCert)
-	return err
+	dc.mutex.Lock()
+	dc.clientCert = tlsClientCert
+	dc.loginID, dc.password = "", ""
+	dc.token, dc.tokenRefresh = "", nil
+	dc.mutex.Unlock()
+	return dc.connect()
 }
 
 // ConnectWithLoginID open the connection to the directory server using a login ID and password for authentication
-//  clientCertFile  client certificate to authenticate the client with the broker
-//  clientKeyFile   client key to authenticate the client with the broker
+//  loginID to authenticate the client with the directory
+//  password of the login ID
 func (dc *DirClient) ConnectWithLoginID(loginID string, password string) error {
-	err := dc.tlsClient.ConnectWithLoginID(loginID, password)
-	return err
+	dc.mutex.Lock()
+	dc.clientCert = nil
+	dc.loginID, dc.password = loginID, password
+	dc.token, dc.tokenRefresh = "", nil
+	dc.mutex.Unlock()
+	return dc.connect()
+}
+
+// CreateTD adds a TD without an ID to the directory.
+// The server assigns a new 'urn:uuid:' ID to the TD.
+// Returns the ID of the new TD
+func (dc *DirClient) CreateTD(td td.ThingTD) (thingID string, err error) {
+	resp, err := dc.invoke("POST", RouteThings, td)
+	if err != nil {
+		return "", err
+	}
+	newTD := make(map[string]interface{})
+	err = json.Unmarshal(resp, &newTD)
+	if err == nil {
+		thingID, _ = newTD["id"].(string)
+		if thingID == "" {
+			err = fmt.Errorf("CreateTD: server didn't return a thing ID")
+		}
+	}
+	return thingID, err
 }
 
 // Delete a TD.
+// The TD is moved to the trash and can be restored with RestoreTD until it is purged.
+// Returns an error if the TD doesn't exist.
 func (dc *DirClient) Delete(id string) error {
 	path := strings.Replace(RouteThingID, "{thingID}", id, 1)
 
-	_, err := dc.tlsClient.Delete(path, nil)
+	_, err := dc.invoke("DELETE", path, nil)
+	return err
+}
+
+// DeleteModel deletes a version of a Thing Model
+//  modelID of the model to delete
+//  version to delete, or "" to delete all versions
+func (dc *DirClient) DeleteModel(modelID string, version string) error {
+	path := strings.Replace(RouteModelID, "{modelID}", modelID, 1)
+	if version != "" {
+		path = fmt.Sprintf("%s?%s=%s", path, ParamVersion, version)
+	}
+	_, err := dc.invoke("DELETE", path, nil)
 	return err
 }
 
+// GetModel returns the Thing Model with the given ID
+//  modelID of the model to get
+//  version of the model, or "" for the latest version
+func (dc *DirClient) GetModel(modelID string, version string) (tm map[string]interface{}, err error) {
+	path := strings.Replace(RouteModelID, "{modelID}", modelID, 1)
+	if version != "" {
+		path = fmt.Sprintf("%s?%s=%s", path, ParamVersion, version)
+	}
+	resp, err := dc.invoke("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &tm)
+	return tm, err
+}
+
+// GetDirectoryTD returns the Thing Description of the directory server
+// This describes the directory API and its security schemes.
+func (dc *DirClient) GetDirectoryTD() (td td.ThingTD, err error) {
+	resp, err := dc.invoke("GET", RouteWellKnownWoT, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &td)
+	return td, err
+}
+
 // GetTD the TD with the given ID
 //  id is the ThingID whose TD to get
 func (dc *DirClient) GetTD(id string) (td td.ThingTD, err error) {
 
 	path := strings.Replace(RouteThingID, "{thingID}", id, 1)
-	resp, err := dc.tlsClient.Get(path)
+	resp, err := dc.invoke("GET", path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -82,6 +287,69 @@ func (dc *DirClient) GetTD(id string) (td td.ThingTD, err error) {
 	return td, err
 }
 
+// InstantiateModel creates a TD from a Thing Model and adds it to the directory
+//  modelID of the model to create the TD from
+//  version of the model, or "" for the latest version
+//  thingID of the new TD
+//  placeholders with the values of the {{NAME}} placeholders used in the model
+// Returns the new TD
+func (dc *DirClient) InstantiateModel(modelID string, version string, thingID string,
+	placeholders map[string]string) (td td.ThingTD, err error) {
+
+	path := strings.Replace(RouteModelInstantiate, "{modelID}", modelID, 1)
+	instReq := InstantiateRequest{
+		ThingID:      thingID,
+		Version:      version,
+		Placeholders: placeholders,
+	}
+	resp, err := dc.invoke("POST", path, instReq)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &td)
+	return td, err
+}
+
+// ListModels returns the latest version of the available Thing Models
+//  offset of the list to query from
+//  limit result to nr of models. Use 0 for default.
+func (dc *DirClient) ListModels(offset int, limit int) ([]map[string]interface{}, error) {
+	var tmList []map[string]interface{}
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+	path := fmt.Sprintf("%s?offset=%d&limit=%d", RouteModels, offset, limit)
+	response, err := dc.invoke("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(response, &tmList)
+	return tmList, err
+}
+
+// ListModelTDs returns the TDs that are derived from a Thing Model
+// These TDs refer to the model with a link of type 'type', which is added when the model is instantiated.
+//  modelID of the model
+//  version of the model, or "" for all versions
+//  offset of the list to query from
+//  limit result to nr of TDs. Use 0 for default.
+func (dc *DirClient) ListModelTDs(modelID string, version string, offset int, limit int) ([]td.ThingTD, error) {
+	var tdList []td.ThingTD
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+	path := fmt.Sprintf("%s?%s=%s&offset=%d&limit=%d", RouteThings, ParamModel, url.QueryEscape(modelID), offset, limit)
+	if version != "" {
+		path += fmt.Sprintf("&%s=%s", ParamVersion, url.QueryEscape(version))
+	}
+	response, err := dc.invoke("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(response, &tdList)
+	return tdList, err
+}
+
 // ListTDs
 // Returns a list of TDs starting at the offset. The result is limited to the nr of records provided
 // with the limit parameter. The server can choose to apply its own limit, in which case the lowest
@@ -94,7 +362,7 @@ func (dc *DirClient) ListTDs(offset int, limit int) ([]td.ThingTD, error) {
 		limit = DefaultLimit
 	}
 	path := fmt.Sprintf("%s?offset=%d&limit=%d", RouteThings, offset, limit)
-	response, err := dc.tlsClient.Get(path)
+	response, err := dc.invoke("GET", path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -103,12 +371,127 @@ func (dc *DirClient) ListTDs(offset int, limit int) ([]td.ThingTD, error) {
 	return tdList, err
 }
 
+// HostPort returns the address:port of the directory server in use
+func (dc *DirClient) HostPort() string {
+	dc.mutex.RLock()
+	defer dc.mutex.RUnlock()
+	return dc.hostport
+}
+
+// StatusError is returned when the directory server responds with an error status
+type StatusError struct {
+	StatusCode int    // HTTP status code of the response, eg 503
+	Message    string // error message with the status and the response body
+}
+
+// Error returns the error message
+func (err *StatusError) Error() string {
+	return err.Message
+}
+
+// newStatusError returns a StatusError for a response with an error status
+// Returns nil if the response status is successful.
+func newStatusError(method string, path string, resp *http.Response, respData []byte) error {
+	if resp.StatusCode < 400 {
+		return nil
+	}
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Message:    fmt.Sprintf("%s %s: %s: %s", method, path, resp.Status, respData),
+	}
+}
+
+// sendRequest sends a request to a directory server and reads the response
+//  httpClient to send the request with
+//  hostport is the address:port of the directory server
+//  method and path of the request
+//  bodyData with the JSON encoded body of the request, nil without body
+//  setAuth adds the credentials to the request, nil if the client certificate is used
+// Returns the response and its body, or an error if the server can't be reached
+func sendRequest(httpClient *http.Client, hostport string, method string, path string,
+	bodyData []byte, setAuth func(req *http.Request)) (*http.Response, []byte, error) {
+
+	url := fmt.Sprintf("https://%s%s", hostport, path)
+	req, err := http.NewRequest(method, url, bytes.NewReader(bodyData))
+	if err != nil {
+		return nil, nil, err
+	}
+	if setAuth != nil {
+		setAuth(req)
+	}
+	if bodyData != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	return resp, respData, err
+}
+
+// invoke a request on the directory server
+// Error responses are returned as a StatusError.
+// If the server can't be reached and other discovered servers are available, then fail over
+// to the next server and retry the request.
+func (dc *DirClient) invoke(method string, path string, body interface{}) ([]byte, error) {
+	var bodyData []byte
+	var err error
+	if body != nil {
+		bodyData, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dc.mutex.RLock()
+	httpClient := dc.httpClient
+	hostport := dc.hostport
+	canFailover := len(dc.candidates) > 1
+	useToken := dc.token != ""
+	setAuth := dc.setBasicAuth()
+	dc.mutex.RUnlock()
+
+	if httpClient == nil {
+		return nil, fmt.Errorf("DirClient: not connected")
+	} else if useToken {
+		return dc.invokeWithToken(method, path, bodyData)
+	}
+	resp, respData, err := sendRequest(httpClient, hostport, method, path, bodyData, setAuth)
+	if err == nil {
+		return respData, newStatusError(method, path, resp, respData)
+	}
+	var urlErr *url.Error
+	if !canFailover || !errors.As(err, &urlErr) {
+		return nil, err
+	}
+	logrus.Warningf("DirClient.invoke: directory at %s can't be reached: %s. Failing over.", hostport, err)
+	dc.mutex.Lock()
+	if dc.hostport == hostport {
+		dc.candidateIndex = (dc.candidateIndex + 1) % len(dc.candidates)
+	}
+	dc.mutex.Unlock()
+	err2 := dc.connect()
+	if err2 != nil {
+		return nil, err
+	}
+	dc.mutex.RLock()
+	httpClient = dc.httpClient
+	hostport = dc.hostport
+	dc.mutex.RUnlock()
+	resp, respData, err = sendRequest(httpClient, hostport, method, path, bodyData, setAuth)
+	if err != nil {
+		return nil, err
+	}
+	return respData, newStatusError(method, path, resp, respData)
+}
+
 // PatchTD changes a TD with the attributes of the given TD
 func (dc *DirClient) PatchTD(id string, td td.ThingTD) error {
 	var resp []byte
 	var err error
 	path := strings.Replace(RouteThingID, "{thingID}", id, 1)
-	resp, err = dc.tlsClient.Patch(path, td)
+	resp, err = dc.invoke("PATCH", path, td)
 	_ = resp
 	return err
 }
@@ -122,7 +505,7 @@ func (dc *DirClient) PatchTD(id string, td td.ThingTD) error {
 func (dc *DirClient) QueryTDs(jsonpath string, offset int, limit int) ([]td.ThingTD, error) {
 	var tdList []td.ThingTD
 	path := fmt.Sprintf("%s?queryparams=%s&offset=%d&limit=%d", RouteThings, jsonpath, offset, limit)
-	response, err := dc.tlsClient.Get(path)
+	response, err := dc.invoke("GET", path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -131,13 +514,45 @@ func (dc *DirClient) QueryTDs(jsonpath string, offset int, limit int) ([]td.Thin
 	return tdList, err
 }
 
+// QueryFederated runs a query on the directory and on its peer directories
+// The results are merged and de-duplicated by thing ID. If peers fail or don't respond in
+// time the result is marked as partial and the peer result holds the error.
+//  jsonpath with the query, or "" to list all TDs
+//  offset of the merged list to query from
+//  limit result to nr of TDs. Use 0 for default.
+func (dc *DirClient) QueryFederated(jsonpath string, offset int, limit int) (*FederatedResult, error) {
+	var result FederatedResult
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+	path := fmt.Sprintf("%s?%s=%s&offset=%d&limit=%d", RouteThings, ParamScope, ScopeFederated, offset, limit)
+	if jsonpath != "" {
+		path = fmt.Sprintf("%s&%s=%s", path, ParamQuery, url.QueryEscape(jsonpath))
+	}
+	response, err := dc.invoke("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(response, &result)
+	logrus.Infof("DirClient.QueryFederated. Returned %d TD(s) from %d peer(s)", len(result.Things), len(result.Peers))
+	return &result, err
+}
+
+// UpdateModel adds a new version of a Thing Model
+// The version is taken from the 'version.model' attribute of the model. Without a version the
+// server assigns the next revision number.
+func (dc *DirClient) UpdateModel(modelID string, tm map[string]interface{}) error {
+	path := strings.Replace(RouteModelID, "{modelID}", modelID, 1)
+	_, err := dc.invoke("POST", path, tm)
+	return err
+}
+
 // UpdateTD updates the TD with the given ID, eg create/update
 func (dc *DirClient) UpdateTD(id string, td td.ThingTD) error {
 	var resp []byte
 	var err error
 	path := strings.Replace(RouteThingID, "{thingID}", id, 1)
-	resp, err = dc.tlsClient.Post(path, td)
-	// resp, err = dc.tlsClient.Post(path, doc)
+	resp, err = dc.invoke("POST", path, td)
 	_ = resp
 	return err
 }
@@ -147,10 +562,22 @@ func (dc *DirClient) UpdateTD(id string, td td.ThingTD) error {
 //  port to connect to
 //  caCertPath server CA certificate for verification, obtained during provisioning using idprov
 func NewDirClient(hostport string, caCert *x509.Certificate) *DirClient {
-	tlsClient := tlsclient.NewTLSClient(hostport, caCert)
 	dc := &DirClient{
-		hostport:  hostport,
-		tlsClient: tlsClient,
+		hostport: hostport,
+		caCert:   caCert,
+	}
+	return dc
+}
+
+// NewDirClientWithCandidates creates a directory client that fails over between directory servers
+// The candidates are usually obtained with DiscoverDirectory. The first reachable candidate is
+// used when connecting.
+//  candidates with the directory servers to connect to
+//  caCertPath server CA certificate for verification, obtained during provisioning using idprov
+func NewDirClientWithCandidates(candidates []DirectoryCandidate, caCert *x509.Certificate) *DirClient {
+	dc := &DirClient{
+		caCert:     caCert,
+		candidates: candidates,
 	}
 	return dc
 }
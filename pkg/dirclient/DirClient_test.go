@@ -1,14 +1,18 @@
 package dirclient_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/grandcat/zeroconf"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -17,6 +21,7 @@ import (
 	"github.com/wostzone/hubclient-go/pkg/vocab"
 	"github.com/wostzone/hubserve-go/pkg/tlsserver"
 	"github.com/wostzone/thingdir/pkg/dirclient"
+	"github.com/wostzone/thingdir/pkg/dirserver"
 )
 
 var testDirectoryAddr string
@@ -141,6 +146,38 @@ func TestUpdateTD(t *testing.T) {
 
 }
 
+func TestCreateTD(t *testing.T) {
+	const newID = "urn:uuid:1234"
+	var receivedTD td.ThingTD
+
+	server := startTestServer()
+	server.AddHandler(dirclient.RouteThings, func(userID string, response http.ResponseWriter, request *http.Request) {
+		if request.Method == "POST" {
+			body, _ := ioutil.ReadAll(request.Body)
+			json.Unmarshal(body, &receivedTD)
+			receivedTD["id"] = newID
+			msg, _ := json.Marshal(receivedTD)
+			response.WriteHeader(http.StatusCreated)
+			response.Write(msg)
+		} else {
+			server.WriteBadRequest(response, "wrong method: "+request.Method)
+		}
+	})
+
+	hostPort := fmt.Sprintf("%s:%d", testDirectoryAddr, testDirectoryPort)
+	dirClient := dirclient.NewDirClient(hostPort, testCerts.CaCert)
+	err := dirClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+
+	thingID, err := dirClient.CreateTD(td.ThingTD{"title": "new thing"})
+	require.NoError(t, err)
+	assert.Equal(t, newID, thingID)
+	assert.Equal(t, "new thing", receivedTD["title"])
+
+	dirClient.Close()
+	server.Stop()
+}
+
 func TestQueryAndList(t *testing.T) {
 	const query = "$.hello.world"
 	server := startTestServer()
@@ -210,6 +247,93 @@ func TestDelete(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, thingID1, idToDelete)
 
+	// error responses are returned with their status
+	_, err = dirClient.GetTD(thingID1)
+	var statusErr *dirclient.StatusError
+	require.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+
 	dirClient.Close()
 	server.Stop()
 }
+
+func TestDiscoverDirectory(t *testing.T) {
+	const instanceID = "discoverytest"
+	const serviceName = "thingdirtest"
+	server := startTestServer()
+	server.AddHandler(dirclient.RouteWellKnownWoT, func(userID string, response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte(`{"@type":"ThingDirectory"}`))
+	})
+	server.AddHandler(dirclient.RouteThings, func(userID string, response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("[]"))
+	})
+	txt := []string{"td=" + dirclient.RouteWellKnownWoT, "type=Directory", "scheme=https"}
+	discoServer, err := zeroconf.RegisterProxy(instanceID, "_"+serviceName+"._tcp", "local.",
+		testDirectoryPort, "discoverytest", []string{testDirectoryAddr}, txt, nil)
+	require.NoError(t, err)
+	defer discoServer.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	candidates, err := dirclient.DiscoverDirectory(ctx, serviceName)
+	cancel()
+	require.NoError(t, err)
+	var found *dirclient.DirectoryCandidate
+	for i, candidate := range candidates {
+		if candidate.InstanceID == instanceID {
+			found = &candidates[i]
+		}
+	}
+	require.NotNil(t, found)
+	hostPort := fmt.Sprintf("%s:%d", testDirectoryAddr, testDirectoryPort)
+	assert.Equal(t, hostPort, found.HostPort)
+	assert.Equal(t, dirclient.RouteWellKnownWoT, found.TXT["td"])
+	assert.Equal(t, "Directory", found.TXT["type"])
+
+	// WoT directories are found through the '_directory' subtype of '_wot._tcp'. Other WoT
+	// services aren't directories. Instance names with spaces are escaped in the DNS records.
+	const wotServiceName = "thingdirwottest"
+	const wotInstanceID = "wot directory"
+	dd := dirserver.NewDirDiscovery(wotInstanceID, wotServiceName, testDirectoryAddr, testDirectoryPort,
+		nil, false, true)
+	err = dd.Start()
+	require.NoError(t, err)
+	defer dd.Stop()
+	thingServer, err := zeroconf.RegisterProxy("wotthing", dirclient.WoTServiceType, "local.",
+		testDirectoryPort+1, "wotthing", []string{testDirectoryAddr}, nil, nil)
+	require.NoError(t, err)
+	defer thingServer.Shutdown()
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	wotCandidates, err := dirclient.DiscoverDirectory(ctx, wotServiceName)
+	cancel()
+	require.NoError(t, err)
+	var wotFound *dirclient.DirectoryCandidate
+	for i, candidate := range wotCandidates {
+		assert.NotEqual(t, "wotthing", candidate.InstanceID)
+		if candidate.InstanceID == wotInstanceID {
+			wotFound = &wotCandidates[i]
+		}
+	}
+	require.NotNil(t, wotFound)
+	// each service type is listed once
+	assert.Equal(t, []string{dirclient.WoTDirectoryServiceType, "_" + wotServiceName + "._tcp"},
+		wotFound.ServiceTypes)
+
+	// fail over from an unreachable directory to the test server
+	unreachable := dirclient.DirectoryCandidate{InstanceID: "unreachable", HostPort: "127.0.0.1:1"}
+	dirClient := dirclient.NewDirClientWithCandidates(
+		[]dirclient.DirectoryCandidate{unreachable, *found}, testCerts.CaCert)
+	err = dirClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	assert.Equal(t, hostPort, dirClient.HostPort())
+	_, err = dirClient.ListTDs(0, 0)
+	assert.NoError(t, err)
+	dirClient.Close()
+
+	// no reachable directory
+	dirClient = dirclient.NewDirClientWithCandidates(
+		[]dirclient.DirectoryCandidate{unreachable}, testCerts.CaCert)
+	err = dirClient.ConnectWithClientCert(testCerts.PluginCert)
+	assert.Error(t, err)
+
+	server.Stop()
+}
@@ -0,0 +1,271 @@
+package dirclient
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// WoT Discovery DNS-SD service type of Things and its subtype of a Thing Directory
+const (
+	WoTServiceType          = "_wot._tcp"
+	WoTDirectoryServiceType = "_directory._sub._wot._tcp"
+)
+
+// subtypeQueryInterval is the interval to repeat the subtype query while discovering
+const subtypeQueryInterval = time.Second
+
+// DirectoryCandidate describes a directory server found with DNS-SD
+type DirectoryCandidate struct {
+	InstanceID   string            // service instance ID of the directory, without DNS escapes
+	ServiceTypes []string          // DNS-SD service types the directory was found under
+	HostName     string            // host name of the server
+	HostPort     string            // address:port to connect to
+	TXT          map[string]string // TXT record parameters, eg td=/.well-known/wot
+}
+
+// parseTXT converts the key=value TXT records into a map
+func parseTXT(text []string) map[string]string {
+	txt := make(map[string]string)
+	for _, record := range text {
+		parts := strings.SplitN(record, "=", 2)
+		if len(parts) == 2 {
+			txt[parts[0]] = parts[1]
+		} else if parts[0] != "" {
+			txt[parts[0]] = ""
+		}
+	}
+	return txt
+}
+
+// unescapeDNSLabel returns the label of a domain name in presentation format without escapes
+// Special characters in labels are escaped as '\X' or '\DDD' with the decimal value, eg the
+// instance name 'my dir' is 'my\ dir' in a PTR record.
+func unescapeDNSLabel(label string) string {
+	if !strings.Contains(label, "\\") {
+		return label
+	}
+	unescaped := make([]byte, 0, len(label))
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' || i+1 >= len(label) {
+			unescaped = append(unescaped, label[i])
+			continue
+		}
+		if i+3 < len(label) && isDigit(label[i+1]) && isDigit(label[i+2]) && isDigit(label[i+3]) {
+			value := int(label[i+1]-'0')*100 + int(label[i+2]-'0')*10 + int(label[i+3]-'0')
+			if value <= 255 {
+				unescaped = append(unescaped, byte(value))
+				i += 3
+				continue
+			}
+		}
+		unescaped = append(unescaped, label[i+1])
+		i++
+	}
+	return string(unescaped)
+}
+
+// isDigit returns true if the character is a decimal digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// browseSubtype queries the instances of a DNS-SD subtype until the context is done
+// The subtype PTR records point at instances of the parent service, eg
+// '_directory._sub._wot._tcp.local.' -> 'instance._wot._tcp.local.'. zeroconf can't browse these
+// so a one-shot mDNS query is sent as described in RFC 6762 section 5.1, and repeated each
+// subtypeQueryInterval. Responders answer one-shot queries by unicast.
+//  subtype to query, eg '_directory._sub._wot._tcp'
+//  serviceType of the instances, eg '_wot._tcp'
+// Returns the set of instance names that have the subtype, without DNS escapes
+func browseSubtype(ctx context.Context, subtype string, serviceType string) (map[string]bool, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	query := &dns.Msg{}
+	query.SetQuestion(subtype+".local.", dns.TypePTR)
+	query.RecursionDesired = false
+	queryMsg, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	mdnsAddr := &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	instanceSuffix := "." + serviceType + ".local."
+	instances := make(map[string]bool)
+	buf := make([]byte, 65536)
+	for ctx.Err() == nil {
+		_, err = conn.WriteToUDP(queryMsg, mdnsAddr)
+		if err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(subtypeQueryInterval)
+		if ctxDeadline, hasDeadline := ctx.Deadline(); hasDeadline && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		_ = conn.SetReadDeadline(deadline)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			resp := dns.Msg{}
+			if resp.Unpack(buf[:n]) != nil {
+				continue
+			}
+			for _, rr := range append(resp.Answer, resp.Extra...) {
+				ptr, isPTR := rr.(*dns.PTR)
+				if isPTR && strings.EqualFold(ptr.Hdr.Name, subtype+".local.") &&
+					strings.HasSuffix(ptr.Ptr, instanceSuffix) && ptr.Hdr.Ttl > 0 {
+					instances[unescapeDNSLabel(strings.TrimSuffix(ptr.Ptr, instanceSuffix))] = true
+				}
+			}
+		}
+	}
+	return instances, nil
+}
+
+// containsString returns true if the list contains the value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// DiscoverDirectory browses the local network for directory servers
+// This looks for both the '_{serviceName}._tcp' service and the '_wot._tcp' instances with the
+// WoT Discovery '_directory' subtype until the context is done. Use context.WithTimeout to
+// limit the search time.
+// A server announced under both service types is merged into a single candidate for each of
+// its addresses. IPv4 addresses are listed before IPv6.
+//  ctx is the context that ends the search
+//  serviceName for use in '_{serviceName}._tcp'. Use "" for the default 'thingdir'.
+// Returns the candidates in order of discovery, or an error if the search could not be started
+func DiscoverDirectory(ctx context.Context, serviceName string) ([]DirectoryCandidate, error) {
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	serviceTypes := []string{"_" + serviceName + "._tcp", WoTServiceType}
+	// the browsing ends when the search fails, without waiting for the caller's context
+	browseCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	candidates := make([]DirectoryCandidate, 0)
+	wotEntries := make([]*zeroconf.ServiceEntry, 0)
+	mutex := sync.Mutex{}
+	waitGroup := sync.WaitGroup{}
+
+	// addCandidate adds or merges the candidates of a service entry
+	addCandidate := func(serviceType string, entry *zeroconf.ServiceEntry) {
+		instanceID := unescapeDNSLabel(entry.Instance)
+		addresses := append(append([]net.IP{}, entry.AddrIPv4...), entry.AddrIPv6...)
+		txt := parseTXT(entry.Text)
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, ip := range addresses {
+			hostPort := net.JoinHostPort(ip.String(), fmt.Sprint(entry.Port))
+			merged := false
+			for i := range candidates {
+				if candidates[i].HostPort == hostPort {
+					if !containsString(candidates[i].ServiceTypes, serviceType) {
+						candidates[i].ServiceTypes = append(candidates[i].ServiceTypes, serviceType)
+					}
+					for key, value := range txt {
+						candidates[i].TXT[key] = value
+					}
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				candidate := DirectoryCandidate{
+					InstanceID:   instanceID,
+					ServiceTypes: []string{serviceType},
+					HostName:     entry.HostName,
+					HostPort:     hostPort,
+					TXT:          make(map[string]string),
+				}
+				for key, value := range txt {
+					candidate.TXT[key] = value
+				}
+				candidates = append(candidates, candidate)
+				logrus.Infof("DiscoverDirectory: found directory '%s' at %s", instanceID, hostPort)
+			}
+		}
+	}
+
+	for _, serviceType := range serviceTypes {
+		entries := make(chan *zeroconf.ServiceEntry)
+		resolver, err := zeroconf.NewResolver(nil)
+		if err == nil {
+			err = resolver.Browse(browseCtx, serviceType, "local.", entries)
+		}
+		if err != nil {
+			logrus.Errorf("DiscoverDirectory: failed browsing for '%s': %s", serviceType, err)
+			// stop the browsing of the previous service types
+			cancel()
+			waitGroup.Wait()
+			return nil, err
+		}
+		waitGroup.Add(1)
+		go func(serviceType string) {
+			defer waitGroup.Done()
+			for entry := range entries {
+				if serviceType == WoTServiceType {
+					// only the instances with the directory subtype are directories
+					mutex.Lock()
+					wotEntries = append(wotEntries, entry)
+					mutex.Unlock()
+				} else {
+					addCandidate(serviceType, entry)
+				}
+			}
+		}(serviceType)
+	}
+	directories, err := browseSubtype(browseCtx, WoTDirectoryServiceType, WoTServiceType)
+	if err != nil {
+		logrus.Errorf("DiscoverDirectory: failed browsing for '%s': %s", WoTDirectoryServiceType, err)
+	}
+	<-browseCtx.Done()
+	waitGroup.Wait()
+	for _, entry := range wotEntries {
+		if directories[unescapeDNSLabel(entry.Instance)] {
+			addCandidate(WoTDirectoryServiceType, entry)
+		}
+	}
+	for _, candidate := range candidates {
+		sort.Strings(candidate.ServiceTypes)
+	}
+	return candidates, nil
+}
+
+// NewDirClientFromDiscovery creates a directory client for the directory servers found with DNS-SD.
+// The client connects to the first candidate that is reachable and fails over to the next
+// candidate when the server can no longer be reached.
+//  ctx is the context that limits the discovery time, eg context.WithTimeout
+//  serviceName for use in '_{serviceName}._tcp'. Use "" for the default 'thingdir'.
+//  caCert server CA certificate for verification, obtained during provisioning using idprov
+// Returns an error if no directory is found
+func NewDirClientFromDiscovery(ctx context.Context, serviceName string, caCert *x509.Certificate) (*DirClient, error) {
+	candidates, err := DiscoverDirectory(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	} else if len(candidates) == 0 {
+		err = fmt.Errorf("NewDirClientFromDiscovery: no directory found for service '%s'", serviceName)
+		logrus.Warning(err)
+		return nil, err
+	}
+	return NewDirClientWithCandidates(candidates, caCert), nil
+}
@@ -0,0 +1,19 @@
+package dirclient
+
+// Paths of the event streams of the directory, as defined in WoT Discovery
+// The events are sent as server-sent events (SSE). The event ID is a sync token that can be
+// provided in the Last-Event-ID header to resume the stream.
+const RouteEvents = "/events"                // all events
+const RouteEventType = "/events/{eventType}" // events of a single type
+
+// Event types of the directory
+const (
+	EventThingCreated = "thing_created" // a TD is added to the directory
+	EventThingUpdated = "thing_updated" // a TD is replaced or patched
+	EventThingDeleted = "thing_deleted" // a TD is deleted
+)
+
+// ThingEvent is the data of an event
+type ThingEvent struct {
+	ID string `json:"id"` // ID of the thing
+}
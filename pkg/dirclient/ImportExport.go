@@ -0,0 +1,133 @@
+package dirclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/wostzone/hubclient-go/pkg/td"
+)
+
+// paths of the bulk import and export API
+// These must be registered before RouteThingID as they match the same pattern.
+const RouteThingsExport = "/things/export"
+const RouteThingsImport = "/things/import"
+
+// query parameters of the bulk import and export API
+const ParamFormat = "format"
+const ParamMode = "mode"
+const ParamDryRun = "dryrun"
+
+// Export formats
+const (
+	FormatNDJSON    = "ndjson" // newline delimited JSON, one TD per line. This is the default
+	FormatJSONArray = "json"   // JSON array of TDs
+)
+
+// Import conflict modes, used when a TD with the same ID already exists
+const (
+	ImportModeUpsert  = "upsert"  // merge the imported TD into the existing TD. This is the default
+	ImportModeSkip    = "skip"    // keep the existing TD
+	ImportModeReplace = "replace" // replace the existing TD with the imported TD
+)
+
+// Import item results
+const (
+	ImportResultCreated = "created"
+	ImportResultUpdated = "updated"
+	ImportResultSkipped = "skipped"
+	ImportResultFailed  = "failed"
+)
+
+// ImportItemResult is the result of importing a single TD
+type ImportItemResult struct {
+	Index   int    `json:"index"`           // index of the TD in the import, starting at 0
+	ThingID string `json:"thingID"`         // ID of the imported TD
+	Result  string `json:"result"`          // created, updated, skipped or failed
+	Error   string `json:"error,omitempty"` // reason the import failed
+}
+
+// ImportReport is the result of a bulk import
+type ImportReport struct {
+	Mode    string             `json:"mode"`    // conflict mode used
+	DryRun  bool               `json:"dryRun"`  // the import was not applied
+	Created int                `json:"created"` // nr of TDs created
+	Updated int                `json:"updated"` // nr of TDs updated
+	Skipped int                `json:"skipped"` // nr of TDs skipped
+	Failed  int                `json:"failed"`  // nr of TDs that failed to import
+	Items   []ImportItemResult `json:"items"`   // result of each TD
+}
+
+// SplitTDs splits a JSON array or NDJSON document into the raw JSON of each TD
+// Empty lines in NDJSON are ignored. The TDs themselves are not parsed.
+func SplitTDs(data []byte) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err := json.Unmarshal(trimmed, &items)
+		return items, err
+	}
+	items = make([]json.RawMessage, 0)
+	for _, line := range bytes.Split(trimmed, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			items = append(items, json.RawMessage(line))
+		}
+	}
+	return items, nil
+}
+
+// DecodeTDs parses a JSON array or NDJSON document with TDs
+// Returns an error if one of the TDs is not valid JSON
+func DecodeTDs(data []byte) ([]td.ThingTD, error) {
+	items, err := SplitTDs(data)
+	if err != nil {
+		return nil, err
+	}
+	tdList := make([]td.ThingTD, 0, len(items))
+	for i, item := range items {
+		var thingTD td.ThingTD
+		err = json.Unmarshal(item, &thingTD)
+		if err != nil {
+			return nil, fmt.Errorf("TD %d: %s", i, err)
+		}
+		tdList = append(tdList, thingTD)
+	}
+	return tdList, nil
+}
+
+// ExportTDs writes the TDs the client can read to the writer
+//  format is FormatNDJSON or FormatJSONArray
+//  writer to write the exported TDs to
+func (dc *DirClient) ExportTDs(format string, writer io.Writer) error {
+	if format == "" {
+		format = FormatNDJSON
+	}
+	path := fmt.Sprintf("%s?%s=%s", RouteThingsExport, ParamFormat, format)
+	resp, err := dc.invoke("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(resp)
+	return err
+}
+
+// ImportTDs adds a list of TDs to the directory
+//  tdList with the TDs to import. Each TD must have an ID
+//  mode determines what happens when a TD already exists: ImportModeUpsert, ImportModeSkip or ImportModeReplace
+//  dryRun reports the result without applying the import
+// Returns the report with the result of each TD
+func (dc *DirClient) ImportTDs(tdList []td.ThingTD, mode string, dryRun bool) (*ImportReport, error) {
+	var report ImportReport
+	if mode == "" {
+		mode = ImportModeUpsert
+	}
+	path := fmt.Sprintf("%s?%s=%s&%s=%t", RouteThingsImport, ParamMode, mode, ParamDryRun, dryRun)
+	resp, err := dc.invoke("POST", path, tdList)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &report)
+	return &report, err
+}
@@ -0,0 +1,59 @@
+package dirclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/wostzone/hubclient-go/pkg/td"
+)
+
+// RouteThingOwner is the path to get or transfer the owner of a thing
+const RouteThingOwner = "/things/{thingID}/owner"
+
+// ParamPublisher is the query parameter with the publisher on whose behalf a plugin writes a TD
+const ParamPublisher = "publisher"
+
+// ThingOwner describes the publisher that owns a TD
+// Only the owner can update or delete the TD when the directory verifies publishers.
+type ThingOwner struct {
+	ThingID string `json:"thingID"` // ID of the thing
+	Owner   string `json:"owner"`   // ID of the owning publisher, "" if the thing has no owner
+	Since   string `json:"since"`   // time the owner was assigned in ISO8601 format
+}
+
+// GetOwner returns the publisher that owns a thing
+func (dc *DirClient) GetOwner(thingID string) (*ThingOwner, error) {
+	var owner ThingOwner
+	path := strings.Replace(RouteThingOwner, "{thingID}", thingID, 1)
+	resp, err := dc.invoke("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &owner)
+	return &owner, err
+}
+
+// SetOwner transfers the ownership of a thing to another publisher
+// This requires an administrator client certificate.
+//  thingID of the thing to transfer
+//  owner is the ID of the new owning publisher, or "" to let the next publisher claim it
+func (dc *DirClient) SetOwner(thingID string, owner string) error {
+	path := strings.Replace(RouteThingOwner, "{thingID}", thingID, 1)
+	_, err := dc.invoke("PUT", path, ThingOwner{ThingID: thingID, Owner: owner})
+	return err
+}
+
+// UpdateTDAsPublisher updates the TD on behalf of the publisher of the TD
+// This is intended for plugins that pass on TDs published on the message bus. The server
+// verifies that the publisher owns the TD. It requires a plugin client certificate.
+//  thingID of the TD to update
+//  td with the new TD
+//  publisherID of the publisher of the TD
+func (dc *DirClient) UpdateTDAsPublisher(thingID string, td td.ThingTD, publisherID string) error {
+	path := strings.Replace(RouteThingID, "{thingID}", thingID, 1)
+	path = fmt.Sprintf("%s?%s=%s", path, ParamPublisher, url.QueryEscape(publisherID))
+	_, err := dc.invoke("POST", path, td)
+	return err
+}
@@ -0,0 +1,78 @@
+package dirclient
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// paths of the replication API, used by replicas to follow the primary directory
+const RouteReplicationChanges = "/replication/changes"   // ordered change log
+const RouteReplicationSnapshot = "/replication/snapshot" // full copy of the directory
+
+// ParamSince is the query parameter with the sequence number after which to return changes
+const ParamSince = "since"
+
+// Change operations recorded in the change log
+const (
+	ChangeOpPut    = "put"    // the TD is created or updated
+	ChangeOpDelete = "delete" // the TD is removed
+)
+
+// ThingChange is an entry in the ordered change log of a directory
+type ThingChange struct {
+	Seq            uint64                 `json:"seq"`                      // sequence number of the change, starting at 1
+	Op             string                 `json:"op"`                       // ChangeOpPut or ChangeOpDelete
+	ThingID        string                 `json:"thingID"`                  // ID of the changed thing
+	TD             map[string]interface{} `json:"td,omitempty"`             // the TD after the change, nil when deleted
+	Created        bool                   `json:"created,omitempty"`        // the put created the thing
+	PrevVisibility string                 `json:"prevVisibility,omitempty"` // visibility of the thing before the change
+	Time           string                 `json:"time"`                     // time of the change in ISO8601 format
+}
+
+// ChangesResponse is the response to a request for changes of the change log
+// If the requested position is no longer in the log then Truncated is set and no changes are
+// returned. The replica must then bootstrap from a snapshot.
+type ChangesResponse struct {
+	Primary   string        `json:"primary"`   // instance ID of the directory
+	First     uint64        `json:"first"`     // sequence number of the oldest change in the log
+	Last      uint64        `json:"last"`      // sequence number of the latest change
+	Truncated bool          `json:"truncated"` // the changes since the requested position are not available
+	Changes   []ThingChange `json:"changes"`   // ordered changes since the requested position
+}
+
+// SnapshotResponse is a full copy of the directory at a position in the change log
+type SnapshotResponse struct {
+	Primary string                            `json:"primary"` // instance ID of the directory
+	Seq     uint64                            `json:"seq"`     // sequence number of the last change included
+	Things  map[string]map[string]interface{} `json:"things"`  // TDs by thing ID
+}
+
+// GetChanges returns the changes of the directory change log after the given sequence number
+// This requires a plugin or administrator client certificate.
+//  since is the sequence number of the last change already received, 0 for all changes
+//  limit the nr of changes. Use 0 for default.
+func (dc *DirClient) GetChanges(since uint64, limit int) (*ChangesResponse, error) {
+	var changes ChangesResponse
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+	path := fmt.Sprintf("%s?%s=%d&%s=%d", RouteReplicationChanges, ParamSince, since, ParamLimit, limit)
+	resp, err := dc.invoke("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &changes)
+	return &changes, err
+}
+
+// GetSnapshot returns a full copy of the directory and the position in its change log
+// This requires a plugin or administrator client certificate.
+func (dc *DirClient) GetSnapshot() (*SnapshotResponse, error) {
+	var snapshot SnapshotResponse
+	resp, err := dc.invoke("GET", RouteReplicationSnapshot, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &snapshot)
+	return &snapshot, err
+}
@@ -0,0 +1,82 @@
+package dirclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/wostzone/hubclient-go/pkg/td"
+)
+
+// RouteThingChanges is the path of the delta sync API
+// This must be registered before RouteThingID as it matches the same pattern.
+const RouteThingChanges = "/things/changes"
+
+// ParamSyncToken is the query parameter with the sync token of the previous sync
+const ParamSyncToken = "since"
+
+// SyncResponse is the response of the delta sync API
+// Changed holds the TDs by the ID of the thing in the directory, which is also used in Deleted.
+// If Reset is set then Changed holds all TDs and the client must discard its cached TDs first.
+// If More is set then more changes are available using the new SyncToken.
+type SyncResponse struct {
+	SyncToken string                `json:"syncToken"` // token for the next sync
+	Reset     bool                  `json:"reset"`     // the changes since the token are not available. Changed has all TDs
+	More      bool                  `json:"more"`      // more changes are available
+	Changed   map[string]td.ThingTD `json:"changed"`   // created or updated TDs by thing ID
+	Deleted   []string              `json:"deleted"`   // IDs of deleted things
+}
+
+// SyncCache is a local copy of the directory that is kept up to date with Sync
+type SyncCache struct {
+	SyncToken string                `json:"syncToken"` // token of the last sync, "" before the first sync
+	Things    map[string]td.ThingTD `json:"things"`    // TDs by thing ID
+}
+
+// GetChangesSince returns the TDs that changed and the things that were deleted since the sync token
+//  syncToken of the previous sync, or "" to get all TDs
+//  limit the nr of changes. Use 0 for default.
+func (dc *DirClient) GetChangesSince(syncToken string, limit int) (*SyncResponse, error) {
+	var syncResp SyncResponse
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+	path := fmt.Sprintf("%s?%s=%s&%s=%d", RouteThingChanges, ParamSyncToken, url.QueryEscape(syncToken), ParamLimit, limit)
+	resp, err := dc.invoke("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &syncResp)
+	return &syncResp, err
+}
+
+// Sync applies the changes since the last sync to the local cache
+// This updates the cache TDs and sync token. If the server can't provide the changes since the
+// last sync then the cache is replaced with the current TDs.
+// Returns the nr of TDs changed or deleted
+func (dc *DirClient) Sync(localCache *SyncCache) (int, error) {
+	count := 0
+	if localCache.Things == nil {
+		localCache.Things = make(map[string]td.ThingTD)
+	}
+	for {
+		syncResp, err := dc.GetChangesSince(localCache.SyncToken, MaxLimit)
+		if err != nil {
+			return count, err
+		}
+		if syncResp.Reset {
+			localCache.Things = make(map[string]td.ThingTD)
+		}
+		for thingID, thingTD := range syncResp.Changed {
+			localCache.Things[thingID] = thingTD
+		}
+		for _, thingID := range syncResp.Deleted {
+			delete(localCache.Things, thingID)
+		}
+		count += len(syncResp.Changed) + len(syncResp.Deleted)
+		localCache.SyncToken = syncResp.SyncToken
+		if !syncResp.More {
+			return count, nil
+		}
+	}
+}
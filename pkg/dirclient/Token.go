@@ -0,0 +1,81 @@
+package dirclient
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// TokenRefresher obtains a new access token, eg from an OAuth2 token endpoint
+type TokenRefresher func() (token string, err error)
+
+// ConnectWithToken opens the connection to the directory server using a bearer access token
+// When the server rejects the token, refresh is called to obtain a new token and the request is
+// retried once.
+//  token is the access token. Use "" to obtain the first token with refresh
+//  refresh obtains a new token. nil if the token can't be refreshed
+func (dc *DirClient) ConnectWithToken(token string, refresh TokenRefresher) error {
+	if token == "" && refresh != nil {
+		var err error
+		token, err = refresh()
+		if err != nil {
+			return err
+		}
+	}
+	if token == "" {
+		return fmt.Errorf("DirClient.ConnectWithToken: missing token")
+	}
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	if dc.hostport == "" && len(dc.candidates) > 0 {
+		dc.hostport = dc.candidates[dc.candidateIndex].HostPort
+	}
+	if dc.httpClient != nil {
+		dc.httpClient.CloseIdleConnections()
+	}
+	dc.httpClient = newHTTPClient(dc.caCert, nil)
+	dc.clientCert = nil
+	dc.loginID, dc.password = "", ""
+	dc.token = token
+	dc.tokenRefresh = refresh
+	return nil
+}
+
+// invokeWithToken invokes a request on the directory server with the bearer token
+// The token is refreshed once if the server doesn't accept it.
+//  bodyData with the JSON encoded body of the request, nil without body
+func (dc *DirClient) invokeWithToken(method string, path string, bodyData []byte) ([]byte, error) {
+	dc.mutex.RLock()
+	token := dc.token
+	refresh := dc.tokenRefresh
+	dc.mutex.RUnlock()
+
+	resp, respData, err := dc.sendWithToken(method, path, bodyData, token)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && refresh != nil {
+		token, err = refresh()
+		if err != nil {
+			return nil, fmt.Errorf("DirClient: unable to refresh token: %s", err)
+		}
+		dc.mutex.Lock()
+		dc.token = token
+		dc.mutex.Unlock()
+		resp, respData, err = dc.sendWithToken(method, path, bodyData, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return respData, newStatusError(method, path, resp, respData)
+}
+
+// sendWithToken sends a request with the bearer token and returns the response and its body
+func (dc *DirClient) sendWithToken(method string, path string, bodyData []byte, token string) (
+	*http.Response, []byte, error) {
+
+	dc.mutex.RLock()
+	hostport := dc.hostport
+	httpClient := dc.httpClient
+	dc.mutex.RUnlock()
+
+	return sendRequest(httpClient, hostport, method, path, bodyData, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	})
+}
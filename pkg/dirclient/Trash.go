@@ -0,0 +1,58 @@
+package dirclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/wostzone/hubclient-go/pkg/td"
+)
+
+// paths of the trash API
+const RouteTrash = "/trash"                          // list or empty the trash
+const RouteTrashID = "/trash/{thingID}"              // purge a deleted TD
+const RouteTrashRestore = "/trash/{thingID}/restore" // restore a deleted TD
+
+// TrashEntry is a deleted TD in the trash
+type TrashEntry struct {
+	ThingID   string     `json:"thingID"`   // ID of the deleted thing
+	TD        td.ThingTD `json:"td"`        // the TD at the time it was deleted
+	Deleted   string     `json:"deleted"`   // time of deletion in ISO8601 format
+	DeletedBy string     `json:"deletedBy"` // user that deleted the TD
+	Owner     string     `json:"owner"`     // publisher that owned the thing, if publishers are verified
+}
+
+// ListTrash returns the deleted TDs that can still be restored, sorted by thing ID
+//  offset of the list to return
+//  limit result to nr of entries. Use 0 for default.
+func (dc *DirClient) ListTrash(offset int, limit int) ([]TrashEntry, error) {
+	var entries []TrashEntry
+	path := fmt.Sprintf("%s?%s=%d&%s=%d", RouteTrash, ParamOffset, offset, ParamLimit, limit)
+	resp, err := dc.invoke("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(resp, &entries)
+	return entries, err
+}
+
+// RestoreTD restores a deleted TD from the trash
+// This fails if a thing with the same ID has been added since it was deleted.
+func (dc *DirClient) RestoreTD(thingID string) error {
+	path := strings.Replace(RouteTrashRestore, "{thingID}", thingID, 1)
+	_, err := dc.invoke("POST", path, nil)
+	return err
+}
+
+// PurgeTD permanently removes a deleted TD from the trash
+func (dc *DirClient) PurgeTD(thingID string) error {
+	path := strings.Replace(RouteTrashID, "{thingID}", thingID, 1)
+	_, err := dc.invoke("DELETE", path, nil)
+	return err
+}
+
+// EmptyTrash permanently removes all deleted TDs the client is allowed to write
+func (dc *DirClient) EmptyTrash() error {
+	_, err := dc.invoke("DELETE", RouteTrash, nil)
+	return err
+}
@@ -0,0 +1,180 @@
+package dirserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wostzone/thingdir/pkg/dirclient"
+	"github.com/wostzone/thingdir/pkg/dirstore/dirfilestore"
+)
+
+// DefaultAPIKeyStoreFile is the file with the hashed API keys
+const DefaultAPIKeyStoreFile = "directory-apikeys.json"
+
+// APIKeyUserPrefix is the prefix of the user ID of clients that authenticate with an API key
+const APIKeyUserPrefix = "apikey:"
+
+// apiKeyRecord is the stored API key. Only the hash of the secret is kept.
+type apiKeyRecord struct {
+	dirclient.APIKey
+	Hash string `json:"hash"` // sha256 hash of the secret part of the key
+}
+
+// APIKeyStore holds the API keys of service accounts
+// Keys have the format {prefix}{keyID}.{secret}. The key ID is used to look up the key and the
+// secret is verified against its hash.
+type APIKeyStore struct {
+	store *dirfilestore.DirFileStore
+}
+
+// hashSecret returns the hash of the secret part of a key
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// randomHex returns a random hex string of nrBytes bytes
+func randomHex(nrBytes int) (string, error) {
+	data := make([]byte, nrBytes)
+	_, err := rand.Read(data)
+	return hex.EncodeToString(data), err
+}
+
+// getRecord returns the stored record of an API key
+func (keyStore *APIKeyStore) getRecord(keyID string) (*apiKeyRecord, error) {
+	var record apiKeyRecord
+	doc, err := keyStore.store.Get(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("API key '%s' not found", keyID)
+	}
+	data, err := json.Marshal(doc)
+	if err == nil {
+		err = json.Unmarshal(data, &record)
+	}
+	return &record, err
+}
+
+// Close the store
+func (keyStore *APIKeyStore) Close() {
+	keyStore.store.Close()
+}
+
+// Create creates a new API key
+// Returns the API key including the key itself. The key can't be obtained again.
+// Returns an error if the scope, thing pattern or expiry is invalid.
+//  apiKey with the name, scope, thing pattern and optional expiry of the key
+//  createdBy is the ID of the administrator creating the key
+func (keyStore *APIKeyStore) Create(apiKey dirclient.APIKey, createdBy string) (*dirclient.APIKey, error) {
+	if apiKey.Scope != dirclient.APIKeyScopeRead && apiKey.Scope != dirclient.APIKeyScopeReadWrite {
+		return nil, fmt.Errorf("invalid scope '%s'", apiKey.Scope)
+	} else if _, err := path.Match(apiKey.ThingPattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid thing pattern '%s'", apiKey.ThingPattern)
+	}
+	if apiKey.Expires != "" {
+		expires, err := time.Parse(time.RFC3339, apiKey.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry '%s'", apiKey.Expires)
+		} else if expires.Before(time.Now()) {
+			return nil, fmt.Errorf("expiry '%s' is in the past", apiKey.Expires)
+		}
+	}
+	keyID, err := randomHex(8)
+	var secret string
+	if err == nil {
+		secret, err = randomHex(32)
+	}
+	if err != nil {
+		return nil, err
+	}
+	apiKey.ID = keyID
+	apiKey.Created = time.Now().Format(time.RFC3339)
+	apiKey.CreatedBy = createdBy
+	apiKey.Key = ""
+	record := apiKeyRecord{APIKey: apiKey, Hash: hashSecret(secret)}
+	var doc map[string]interface{}
+	data, _ := json.Marshal(record)
+	json.Unmarshal(data, &doc)
+	err = keyStore.store.Replace(keyID, doc)
+	if err != nil {
+		return nil, err
+	}
+	apiKey.Key = dirclient.APIKeyPrefix + keyID + "." + secret
+	return &apiKey, nil
+}
+
+// Get returns the API key with the given ID, without the key itself
+func (keyStore *APIKeyStore) Get(keyID string) (*dirclient.APIKey, error) {
+	record, err := keyStore.getRecord(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return &record.APIKey, nil
+}
+
+// List returns the API keys sorted by ID, without the keys themselves
+func (keyStore *APIKeyStore) List() []dirclient.APIKey {
+	apiKeys := make([]dirclient.APIKey, 0)
+	for keyID := range keyStore.store.Snapshot() {
+		record, err := keyStore.getRecord(keyID)
+		if err == nil {
+			apiKeys = append(apiKeys, record.APIKey)
+		}
+	}
+	sort.Slice(apiKeys, func(i, j int) bool { return apiKeys[i].ID < apiKeys[j].ID })
+	return apiKeys
+}
+
+// Open the store
+func (keyStore *APIKeyStore) Open() error {
+	return keyStore.store.Open()
+}
+
+// Revoke removes an API key
+// Returns an error if the key doesn't exist
+func (keyStore *APIKeyStore) Revoke(keyID string) error {
+	_, err := keyStore.getRecord(keyID)
+	if err != nil {
+		return err
+	}
+	keyStore.store.Remove(keyID)
+	return nil
+}
+
+// Verify returns the API key of a key if it is valid
+// Returns an error if the key is malformed, unknown, revoked or expired.
+//  key as returned on creation
+func (keyStore *APIKeyStore) Verify(key string) (*dirclient.APIKey, error) {
+	parts := strings.SplitN(strings.TrimPrefix(key, dirclient.APIKeyPrefix), ".", 2)
+	if !strings.HasPrefix(key, dirclient.APIKeyPrefix) || len(parts) != 2 {
+		return nil, fmt.Errorf("malformed API key")
+	}
+	record, err := keyStore.getRecord(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(record.Hash)) != 1 {
+		return nil, fmt.Errorf("invalid API key '%s'", parts[0])
+	}
+	if record.Expires != "" {
+		expires, err := time.Parse(time.RFC3339, record.Expires)
+		if err != nil || expires.Before(time.Now()) {
+			return nil, fmt.Errorf("API key '%s' is expired", parts[0])
+		}
+	}
+	return &record.APIKey, nil
+}
+
+// NewAPIKeyStore creates a store for API keys
+//  storePath is the file to store the hashed keys in
+func NewAPIKeyStore(storePath string) *APIKeyStore {
+	keyStore := &APIKeyStore{store: dirfilestore.NewDirFileStore(storePath)}
+	return keyStore
+}
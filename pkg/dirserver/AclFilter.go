@@ -1,39 +1,296 @@
 package dirserver
 
 import (
+	"path"
+	"sync"
+
 	"github.com/wostzone/hubauth/pkg/authorize"
+	"github.com/wostzone/hubclient-go/pkg/td"
 	"github.com/wostzone/hubserve-go/pkg/certsetup"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// Roles of a user in a group. Each role includes the rights of the previous role.
+const (
+	RoleNone    = ""
+	RoleViewer  = "viewer"  // read TDs
+	RoleEditor  = "editor"  // read and patch TDs
+	RoleManager = "manager" // read, patch, replace and delete TDs
+)
+
+// Rights to access a TD
+const (
+	RightRead    = "read"
+	RightPatch   = "patch"
+	RightReplace = "replace"
+	RightDelete  = "delete"
 )
 
+// roleRights holds the rights of each role
+var roleRights = map[string]map[string]bool{
+	RoleViewer:  {RightRead: true},
+	RoleEditor:  {RightRead: true, RightPatch: true},
+	RoleManager: {RightRead: true, RightPatch: true, RightReplace: true, RightDelete: true},
+}
+
+// roleLevel orders the roles from least to most rights
+var roleLevel = map[string]int{RoleNone: 0, RoleViewer: 1, RoleEditor: 2, RoleManager: 3}
+
+// IGroupAcl provides the group membership and roles that determine access to things
+// This is implemented by the hub ACL store.
+type IGroupAcl interface {
+	// GetGroups returns the groups a user or thing is a member of
+	GetGroups(clientID string) []string
+	// GetRole returns the highest role of a user in the given groups
+	GetRole(clientID string, groupIDs []string) string
+}
+
 // ACL filter function for authorization of thing access
-// Todo: include groups the user is a member of to
+// The filter is intended for use during a single request. The groups and roles of the user are
+// resolved once and the decision for each thing is cached. Without a group ACL each decision is
+// made by the authorizer.
 type AclFilter struct {
 	userID     string
 	certOU     string // user OU when certificate authenticated
 	authorizer authorize.VerifyAuthorization
+	groupAcl   IGroupAcl
+
+	publisherID   string                      // publisher on whose behalf a plugin writes
+	getOwner      func(thingID string) string // owner of a thing, nil to not verify ownership
+	getVisibility func(thingID string) string // visibility of a thing, nil if all things are private
+	tokenGroups   []string                    // groups of a token user, nil to use the group ACL
+	tokenRole     string                      // role of a token user, "" to use the group ACL
+	apiKeyRole    string                      // role of an API key user in all things, "" if not an API key
+	thingPattern  string                      // pattern of the things the user is limited to, "" for all things
+
+	userRoles map[string]string // role of the user by group ID, nil until resolved
+	decisions map[string]bool   // cached decisions by right and thing ID
+	mutex     *sync.Mutex
+}
+
+// Authorize returns true if the user has the right to access the Thing with ID thingID
+// Plugin certificates have full read access. With a group ACL, plugin and admin certificates
+// have full access and other users have the rights of their highest role in the groups of the
+// thing. Roles other than viewer, editor or manager, eg the role of a thing publishing its own
+// TD, are left to the authorizer and are denied without an authorizer. When ownership is
+// verified, only the owner of a thing can write it.
+// Public things can be read by anyone, including anonymous users, and things with authenticated
+// visibility by all authenticated users. Users limited to a thing pattern, eg API keys, can only
+// access the things that match the pattern.
+//  thingID of the thing to access
+//  right is one of RightRead, RightPatch, RightReplace or RightDelete
+func (aclFilter *AclFilter) Authorize(thingID string, right string) bool {
+	visibility := dirclient.VisibilityPrivate
+	if right == RightRead && aclFilter.getVisibility != nil {
+		visibility = aclFilter.getVisibility(thingID)
+	}
+	return aclFilter.authorize(thingID, right, visibility)
+}
+
+// authorize returns true if the user has the right to access a thing with the given visibility
+func (aclFilter *AclFilter) authorize(thingID string, right string, visibility string) bool {
+	if aclFilter.thingPattern != "" {
+		if isMatch, _ := path.Match(aclFilter.thingPattern, thingID); !isMatch {
+			return false
+		}
+	}
+	if right != RightRead && !aclFilter.isOwner(thingID) {
+		return false
+	} else if right == RightRead && aclFilter.isVisible(visibility) {
+		return true
+	}
+	if aclFilter.certOU == certsetup.OUPlugin &&
+		(right == RightRead || aclFilter.groupAcl != nil) {
+		return true
+	} else if aclFilter.certOU == certsetup.OUAdmin && aclFilter.groupAcl != nil {
+		return true
+	}
+	if aclFilter.userID == "" || thingID == "" {
+		return false
+	}
+	aclFilter.mutex.Lock()
+	defer aclFilter.mutex.Unlock()
+	key := right + "/" + thingID
+	if decision, found := aclFilter.decisions[key]; found {
+		return decision
+	}
+	var decision bool
+	role, isKnown := aclFilter.getRole(thingID)
+	if isKnown {
+		decision = roleRights[role][right]
+	} else if aclFilter.authorizer == nil {
+		decision = false
+	} else if right == RightRead {
+		decision = aclFilter.authorizer(aclFilter.userID, aclFilter.certOU, thingID, false, "")
+	} else {
+		decision = aclFilter.authorizer(aclFilter.userID, aclFilter.certOU, thingID, true, td.MessageTypeTD)
+	}
+	aclFilter.decisions[key] = decision
+	return decision
 }
 
 // FilterThing returns true if user can read the Thing with ID thingID
 // plugin certificates have full read access
 func (aclFilter *AclFilter) FilterThing(thingID string) bool {
-	if aclFilter.certOU == certsetup.OUPlugin {
+	return aclFilter.Authorize(thingID, RightRead)
+}
+
+// FilterThingWithVisibility returns true if the user can read the thing if it had the given visibility
+// This is used to tell whether the user could read a thing before it was changed or deleted.
+//  thingID of the thing
+//  visibility of the thing, eg dirclient.VisibilityPublic
+func (aclFilter *AclFilter) FilterThingWithVisibility(thingID string, visibility string) bool {
+	if aclFilter.getVisibility == nil {
+		visibility = dirclient.VisibilityPrivate
+	}
+	return aclFilter.authorize(thingID, RightRead, visibility)
+}
+
+// isOwner returns true if the publisher owns the thing or the thing has no owner
+// Administrators, and plugins that don't write on behalf of a publisher, own all things.
+func (aclFilter *AclFilter) isOwner(thingID string) bool {
+	if aclFilter.getOwner == nil {
 		return true
 	}
-	if aclFilter.userID == "" || thingID == "" {
-		return false
+	publisherID := aclFilter.Publisher()
+	if publisherID == "" {
+		return true
+	}
+	owner := aclFilter.getOwner(thingID)
+	return owner == "" || owner == publisherID
+}
+
+// isVisible returns true if a thing with the visibility is visible to the user regardless of its ACL
+func (aclFilter *AclFilter) isVisible(visibility string) bool {
+	switch visibility {
+	case dirclient.VisibilityPublic:
+		return true
+	case dirclient.VisibilityAuthenticated:
+		return aclFilter.userID != ""
 	}
-	// authorize read access
-	hasAccess := aclFilter.authorizer(aclFilter.userID, aclFilter.certOU, thingID, false, "")
-	return hasAccess
+	return false
+}
+
+// Publisher returns the ID of the publisher whose ownership applies to writes
+// This is the publisher a plugin writes on behalf of, or the user itself. Returns "" for
+// administrators and for plugins that write on their own behalf.
+func (aclFilter *AclFilter) Publisher() string {
+	if aclFilter.publisherID != "" {
+		return aclFilter.publisherID
+	} else if aclFilter.certOU == certsetup.OUAdmin || aclFilter.certOU == certsetup.OUPlugin {
+		return ""
+	}
+	return aclFilter.userID
+}
+
+// Role returns the highest role of the user in the groups of the thing
+// Returns RoleNone if there is no group ACL or the user isn't a member of the thing's groups.
+func (aclFilter *AclFilter) Role(thingID string) string {
+	aclFilter.mutex.Lock()
+	defer aclFilter.mutex.Unlock()
+	role, _ := aclFilter.getRole(thingID)
+	return role
+}
+
+// getRole returns the highest role of the user in the groups of the thing
+// The roles of the user are resolved on first use. Returns false if there is no group ACL or
+// the user has a role that isn't viewer, editor or manager. The groups and role of a token user
+// take precedence over those of the group ACL. A token without groups has its role in the groups
+// of the user in the group ACL. API keys have their role in all things.
+func (aclFilter *AclFilter) getRole(thingID string) (role string, isKnown bool) {
+	if aclFilter.apiKeyRole != "" {
+		// the things of an API key are limited by its thing pattern
+		_, isKnown = roleLevel[aclFilter.apiKeyRole]
+		return aclFilter.apiKeyRole, isKnown
+	} else if aclFilter.groupAcl == nil {
+		return RoleNone, false
+	}
+	if aclFilter.userRoles == nil {
+		groupIDs := aclFilter.tokenGroups
+		if groupIDs == nil {
+			groupIDs = aclFilter.groupAcl.GetGroups(aclFilter.userID)
+		}
+		aclFilter.userRoles = make(map[string]string)
+		for _, groupID := range groupIDs {
+			role := aclFilter.tokenRole
+			if role == "" {
+				role = aclFilter.groupAcl.GetRole(aclFilter.userID, []string{groupID})
+			}
+			aclFilter.userRoles[groupID] = role
+		}
+	}
+	role = RoleNone
+	for _, groupID := range aclFilter.groupAcl.GetGroups(thingID) {
+		groupRole, isMember := aclFilter.userRoles[groupID]
+		if !isMember {
+			continue
+		} else if _, isRole := roleLevel[groupRole]; !isRole {
+			return groupRole, false
+		} else if roleLevel[groupRole] > roleLevel[role] {
+			role = groupRole
+		}
+	}
+	return role, true
+}
+
+// SetAPIKeyRole sets the role of a user that authenticated with an API key
+// The role applies to all things. Use SetThingPattern to limit the things of the key.
+//  role of the API key
+func (aclFilter *AclFilter) SetAPIKeyRole(role string) {
+	aclFilter.apiKeyRole = role
+}
+
+// SetThingPattern limits the user to the things with an ID that matches the pattern
+//  thingPattern with the syntax of path.Match, eg "urn:zone1:*". "" for all things
+func (aclFilter *AclFilter) SetThingPattern(thingPattern string) {
+	aclFilter.thingPattern = thingPattern
+}
+
+// SetVisibility lets all users read things that are public, or authenticated if the user is authenticated
+//  getVisibility returns the visibility of a thing, eg dirclient.VisibilityPublic
+func (aclFilter *AclFilter) SetVisibility(getVisibility func(thingID string) string) {
+	aclFilter.getVisibility = getVisibility
+}
+
+// SetTokenClaims sets the groups and role of a user that authenticated with a token
+// Without groups the groups of the user in the group ACL are used. Without a role the group ACL
+// determines the role of the user in the groups.
+//  groups of the user. nil to use the groups of the group ACL
+//  role of the user in the groups. "" to use the roles of the group ACL
+func (aclFilter *AclFilter) SetTokenClaims(groups []string, role string) {
+	aclFilter.tokenGroups = groups
+	aclFilter.tokenRole = role
+}
+
+// VerifyOwner only authorizes writes by the owner of a thing
+//  publisherID on whose behalf a plugin writes. Ignored if the user isn't a plugin.
+//  getOwner returns the owner of a thing, or "" if the thing has no owner
+func (aclFilter *AclFilter) VerifyOwner(publisherID string, getOwner func(thingID string) string) {
+	if aclFilter.certOU == certsetup.OUPlugin {
+		aclFilter.publisherID = publisherID
+	}
+	aclFilter.getOwner = getOwner
 }
 
 // NewAclFilter. Provide authorization context needed to authorize requests
 // userID to filter on. An empty userID always fails.
-// authorizer is the function that performs the actual authorization
+// authorizer is the function that performs the actual authorization. nil denies all users.
 func NewAclFilter(userID string, certOU string, authorizer authorize.VerifyAuthorization) AclFilter {
+	return NewGroupAclFilter(userID, certOU, authorizer, nil)
+}
+
+// NewGroupAclFilter creates a filter that authorizes with the roles of the user in a thing's groups
+//  userID to filter on. An empty userID always fails.
+//  authorizer authorizes the roles other than viewer, editor or manager. nil to deny them
+//  groupAcl with the groups and roles. nil to use the authorizer for all decisions
+func NewGroupAclFilter(userID string, certOU string, authorizer authorize.VerifyAuthorization,
+	groupAcl IGroupAcl) AclFilter {
 	return AclFilter{
 		authorizer: authorizer,
+		groupAcl:   groupAcl,
 		userID:     userID,
 		certOU:     certOU,
+		decisions:  make(map[string]bool),
+		mutex:      &sync.Mutex{},
 	}
 }
@@ -0,0 +1,207 @@
+package dirserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+const DefaultAuditLogFile = "directory-audit.ndjson"
+
+// DefaultAuditLogSize is the size in bytes at which the audit log is rotated
+const DefaultAuditLogSize = 10 * 1024 * 1024
+
+// DefaultAuditLogFiles is the nr of rotated audit log files that are kept
+const DefaultAuditLogFiles = 5
+
+// AuditLog is a rotating log file with audit records, one JSON record per line
+// When the log reaches its max size, {path} is renamed to {path}.1 after {path}.1 is renamed to
+// {path}.2 and so on. The oldest file is removed when there are more than maxFiles rotated files.
+type AuditLog struct {
+	logPath  string
+	maxSize  int64 // size at which the log is rotated
+	maxFiles int   // nr of rotated files to keep
+	file     *os.File
+	size     int64 // current size of the log file
+	mutex    sync.Mutex
+}
+
+// Append a record to the audit log and rotate the log if it is full
+// The record time is set if it is empty.
+func (al *AuditLog) Append(record dirclient.AuditRecord) error {
+	if record.Time == "" {
+		record.Time = time.Now().Format(time.RFC3339)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	if al.file == nil {
+		return fmt.Errorf("AuditLog.Append: log '%s' is not open", al.logPath)
+	}
+	if al.size > 0 && al.size+int64(len(line)) > al.maxSize {
+		err = al.rotate()
+		if err != nil {
+			logrus.Errorf("AuditLog.Append: Unable to rotate '%s': %s", al.logPath, err)
+		}
+	}
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	return err
+}
+
+// Close the audit log
+func (al *AuditLog) Close() {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	if al.file != nil {
+		al.file.Close()
+		al.file = nil
+	}
+}
+
+// Open the audit log for appending records
+func (al *AuditLog) Open() error {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	return al.openFile()
+}
+
+// openFile opens the log file for appending
+func (al *AuditLog) openFile() error {
+	file, err := os.OpenFile(al.logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		logrus.Errorf("AuditLog.Open: Unable to open audit log '%s': %s", al.logPath, err)
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		al.size = info.Size()
+	}
+	al.file = file
+	return nil
+}
+
+// Query returns the records that match the filter, newest first
+//  filter with the records to return
+//  offset of the first matching record to return
+//  limit the nr of records to return, 0 for all
+func (al *AuditLog) Query(filter dirclient.AuditFilter, offset int, limit int) ([]dirclient.AuditRecord, error) {
+	var since, until time.Time
+	var err error
+	if filter.Since != "" {
+		since, err = time.Parse(time.RFC3339, filter.Since)
+	}
+	if err == nil && filter.Until != "" {
+		until, err = time.Parse(time.RFC3339, filter.Until)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid time filter: %s", err)
+	}
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	// read the files from new to old
+	matched := make([]dirclient.AuditRecord, 0)
+	for i := 0; i <= al.maxFiles; i++ {
+		records := readAuditFile(al.rotatedPath(i))
+		for j := len(records) - 1; j >= 0; j-- {
+			record := records[j]
+			recordTime, _ := time.Parse(time.RFC3339, record.Time)
+			if (filter.UserID != "" && record.UserID != filter.UserID) ||
+				(filter.ThingID != "" && record.ThingID != filter.ThingID) ||
+				(filter.Method != "" && record.Method != filter.Method) ||
+				(!since.IsZero() && recordTime.Before(since)) ||
+				(!until.IsZero() && !recordTime.Before(until)) {
+				continue
+			}
+			matched = append(matched, record)
+			if limit > 0 && len(matched) >= offset+limit {
+				return matched[offset:], nil
+			}
+		}
+	}
+	if offset >= len(matched) {
+		return []dirclient.AuditRecord{}, nil
+	}
+	return matched[offset:], nil
+}
+
+// readAuditFile returns the records in an audit log file, oldest first
+// Lines that can't be parsed are skipped. A missing file has no records.
+func readAuditFile(filePath string) []dirclient.AuditRecord {
+	records := make([]dirclient.AuditRecord, 0)
+	file, err := os.Open(filePath)
+	if err != nil {
+		return records
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record dirclient.AuditRecord
+		if json.Unmarshal(scanner.Bytes(), &record) == nil {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// rotate renames the log files and starts a new log file
+func (al *AuditLog) rotate() error {
+	al.file.Close()
+	al.file = nil
+	os.Remove(al.rotatedPath(al.maxFiles))
+	for i := al.maxFiles - 1; i >= 0; i-- {
+		if _, err := os.Stat(al.rotatedPath(i)); err == nil {
+			os.Rename(al.rotatedPath(i), al.rotatedPath(i+1))
+		}
+	}
+	logrus.Infof("AuditLog.rotate: rotated audit log '%s'", al.logPath)
+	return al.openFile()
+}
+
+// rotatedPath returns the path of the n-th rotated log file. 0 is the current log.
+func (al *AuditLog) rotatedPath(n int) string {
+	if n == 0 {
+		return al.logPath
+	}
+	return fmt.Sprintf("%s.%d", al.logPath, n)
+}
+
+// SetRotation sets the size at which the log is rotated and the nr of rotated files to keep
+//  maxSize in bytes. Use 0 for the default
+//  maxFiles to keep. Use 0 for the default
+func (al *AuditLog) SetRotation(maxSize int64, maxFiles int) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	if maxSize <= 0 {
+		maxSize = DefaultAuditLogSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultAuditLogFiles
+	}
+	al.maxSize = maxSize
+	al.maxFiles = maxFiles
+}
+
+// NewAuditLog creates a rotating audit log
+//  logPath is the path of the audit log file
+func NewAuditLog(logPath string) *AuditLog {
+	al := &AuditLog{
+		logPath:  logPath,
+		maxSize:  DefaultAuditLogSize,
+		maxFiles: DefaultAuditLogFiles,
+	}
+	return al
+}
@@ -0,0 +1,138 @@
+package dirserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// tokenClaimsKey is the request context key of the claims of a bearer token
+type tokenClaimsKey struct{}
+
+// acceptsBearer returns true if clients can authenticate with a bearer token or API key
+// Bearer tokens aren't supported by the TLS server so these requests are authenticated by the directory.
+func (srv *DirectoryServer) acceptsBearer() bool {
+	return srv.tokenVerifier != nil || srv.apiKeysEnabled
+}
+
+// authenticatesRequests returns true if the directory authenticates requests instead of the TLS server
+// The TLS server doesn't support bearer tokens, API keys or certificate revocation.
+func (srv *DirectoryServer) authenticatesRequests() bool {
+	return srv.acceptsBearer() || srv.revocation != nil
+}
+
+// authenticateRequest returns the ID of the user that authenticated the request
+// Clients authenticate with a client certificate signed by the CA, with basic authentication,
+// or with a bearer token or API key if these are enabled. Revoked client certificates are
+// rejected and recorded in the audit log.
+// Returns hasCredentials false if the request has no credentials, and the claims if a token is used.
+func (srv *DirectoryServer) authenticateRequest(request *http.Request) (
+	userID string, hasCredentials bool, authenticated bool, claims *TokenClaims) {
+
+	if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 {
+		cert := request.TLS.PeerCertificates[0]
+		if srv.revocation != nil && srv.revocation.IsRevoked(cert) {
+			logrus.Warningf("authenticateRequest: revoked certificate of '%s' with serial %s from %s",
+				cert.Subject.CommonName, cert.SerialNumber.Text(16), request.RemoteAddr)
+			srv.audit(cert.Subject.CommonName, request, "", "", "", http.StatusUnauthorized)
+			return "", true, false, nil
+		}
+		return cert.Subject.CommonName, true, true, nil
+	}
+	authHeader := request.Header.Get("Authorization")
+	bearer := strings.TrimPrefix(authHeader, "Bearer ")
+	if srv.apiKeysEnabled && strings.HasPrefix(bearer, dirclient.APIKeyPrefix) {
+		var err error
+		claims, err = srv.verifyAPIKey(bearer)
+		if err != nil {
+			logrus.Infof("authenticateRequest: API key from %s rejected: %s", request.RemoteAddr, err)
+			return "", true, false, nil
+		}
+		return claims.UserID, true, true, claims
+	} else if srv.tokenVerifier != nil && strings.HasPrefix(authHeader, "Bearer ") {
+		var err error
+		claims, err = srv.tokenVerifier.Verify(bearer)
+		if err != nil {
+			logrus.Infof("authenticateRequest: token from %s rejected: %s", request.RemoteAddr, err)
+			return "", true, false, nil
+		}
+		return claims.UserID, true, true, claims
+	}
+	username, password, hasCredentials := request.BasicAuth()
+	if !hasCredentials {
+		return "", false, false, nil
+	}
+	authenticated = srv.authenticator != nil && srv.authenticator(username, password)
+	return username, true, authenticated, nil
+}
+
+// getTokenClaims returns the claims of the bearer token used to authenticate the request
+// Returns nil if the request isn't authenticated with a token.
+func getTokenClaims(request *http.Request) *TokenClaims {
+	claims, _ := request.Context().Value(tokenClaimsKey{}).(*TokenClaims)
+	return claims
+}
+
+// withAuthentication returns a handler that authenticates the request before calling handler
+// The handler is called with an empty userID for anonymous requests, which can only read public
+// things. Requests with invalid credentials, anonymous writes and tokens without the scope
+// needed for the request are rejected.
+//  allowAnonymous serves GET requests without credentials as anonymous
+func (srv *DirectoryServer) withAuthentication(
+	handler func(userID string, response http.ResponseWriter, request *http.Request),
+	allowAnonymous bool) func(http.ResponseWriter, *http.Request) {
+
+	return func(response http.ResponseWriter, request *http.Request) {
+		userID, hasCredentials, authenticated, claims := srv.authenticateRequest(request)
+		if hasCredentials && !authenticated {
+			srv.tlsServer.WriteUnauthorized(response, "Invalid credentials")
+			return
+		} else if !hasCredentials && (!allowAnonymous || request.Method != "GET") {
+			srv.tlsServer.WriteUnauthorized(response, "Authentication required")
+			return
+		}
+		if claims != nil {
+			if (request.Method == "GET" && !claims.CanRead) || (request.Method != "GET" && !claims.CanWrite) {
+				srv.tlsServer.WriteUnauthorized(response, "Token or API key scope doesn't allow this request")
+				return
+			}
+			request = request.WithContext(context.WithValue(request.Context(), tokenClaimsKey{}, claims))
+		}
+		handler(userID, response, request)
+	}
+}
+
+// addHandler adds the handler for a path that requires authentication
+func (srv *DirectoryServer) addHandler(path string,
+	handler func(userID string, response http.ResponseWriter, request *http.Request)) {
+	if srv.authenticatesRequests() {
+		srv.tlsServer.AddHandlerNoAuth(path, srv.withAuthentication(handler, false))
+	} else {
+		srv.tlsServer.AddHandler(path, handler)
+	}
+}
+
+// addPrimaryHandler adds the handler for a path of a store that is kept by the primary only
+// Replicas only replicate the TDs. The requests for thing models, owners, trash, audit records
+// and API keys are redirected to the primary, including reads, as the replica doesn't have these.
+func (srv *DirectoryServer) addPrimaryHandler(path string,
+	handler func(userID string, response http.ResponseWriter, request *http.Request)) {
+	if srv.replica != nil {
+		srv.tlsServer.AddHandlerNoAuth(path, srv.replica.RedirectToPrimary)
+	} else {
+		srv.addHandler(path, handler)
+	}
+}
+
+// addReadHandler adds the handler for a path that can be read anonymously if allowed
+func (srv *DirectoryServer) addReadHandler(path string,
+	handler func(userID string, response http.ResponseWriter, request *http.Request)) {
+	if srv.anonymousRead || srv.authenticatesRequests() {
+		srv.tlsServer.AddHandlerNoAuth(path, srv.withAuthentication(handler, srv.anonymousRead))
+	} else {
+		srv.tlsServer.AddHandler(path, handler)
+	}
+}
@@ -0,0 +1,435 @@
+package dirserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+	"github.com/wostzone/thingdir/pkg/dirstore"
+	"github.com/wostzone/thingdir/pkg/dirstore/dirfilestore"
+)
+
+const DefaultChangeLogFile = "directory-changes.ndjson"
+
+// DefaultChangeLogSize is the nr of changes kept in the change log
+// Replicas that fall further behind must bootstrap from a snapshot.
+const DefaultChangeLogSize = 10000
+
+// DefaultTombstoneRetention is the time changes, including deleted thing IDs, are kept in the log
+// Clients that sync less frequently receive the full directory.
+const DefaultTombstoneRetention = 30 * 24 * time.Hour
+
+// ChangeLog is an ordered log of changes to the directory
+// Changes are numbered with an increasing sequence number and appended to a newline delimited
+// JSON file. Only the most recent changes are kept.
+type ChangeLog struct {
+	logPath   string
+	maxSize   int           // nr of changes to keep
+	retention time.Duration // max age of changes to keep, 0 to keep maxSize changes
+
+	mutex   sync.RWMutex
+	changes []dirclient.ThingChange // ordered by sequence number
+	lastSeq uint64                  // sequence number of the latest change
+	logFile *os.File
+}
+
+// Append adds a change to the log
+//  op is the change operation, dirclient.ChangeOpPut or dirclient.ChangeOpDelete
+//  thingID of the changed thing
+//  doc with the TD after the change. This is copied. nil when deleted.
+// Returns the sequence number of the change
+func (cl *ChangeLog) Append(op string, thingID string, doc map[string]interface{}) uint64 {
+	return cl.AppendChange(dirclient.ThingChange{Op: op, ThingID: thingID, TD: doc})
+}
+
+// AppendChange adds a change to the log
+// The sequence number and time of the change are set by the log.
+//  change with the operation, thing ID, TD and whether the thing was created. The TD is copied.
+// Returns the sequence number of the change
+func (cl *ChangeLog) AppendChange(change dirclient.ThingChange) uint64 {
+	if change.TD != nil {
+		change.TD, _ = deepCopy(change.TD)
+	}
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.lastSeq++
+	change.Seq = cl.lastSeq
+	change.Time = time.Now().Format(time.RFC3339)
+	cl.changes = append(cl.changes, change)
+	if cl.logFile != nil {
+		line, _ := json.Marshal(change)
+		_, err := cl.logFile.Write(append(line, '\n'))
+		if err != nil {
+			logrus.Errorf("ChangeLog.Append: failed writing to '%s': %s", cl.logPath, err)
+		}
+	}
+	// trim the log when it grows to twice its size to avoid rewriting it on each change
+	if len(cl.changes) >= 2*cl.maxSize {
+		cl.changes = append([]dirclient.ThingChange{}, cl.changes[len(cl.changes)-cl.maxSize:]...)
+		cl.rewrite()
+	}
+	cl.expire()
+	return cl.lastSeq
+}
+
+// expire removes the changes that are older than the retention period
+// To avoid rewriting the log on each change, changes are removed once the oldest change is 10%
+// past the retention period. The latest change is always kept so the log continues from its
+// sequence number after a restart.
+func (cl *ChangeLog) expire() {
+	if cl.retention <= 0 || len(cl.changes) < 2 {
+		return
+	}
+	expiry := time.Now().Add(-cl.retention)
+	oldest, err := time.Parse(time.RFC3339, cl.changes[0].Time)
+	if err == nil && !oldest.Before(expiry.Add(-cl.retention/10)) {
+		return
+	}
+	count := 0
+	for count < len(cl.changes)-1 {
+		changeTime, err := time.Parse(time.RFC3339, cl.changes[count].Time)
+		if err == nil && !changeTime.Before(expiry) {
+			break
+		}
+		count++
+	}
+	if count > 0 {
+		logrus.Infof("ChangeLog.expire: removing %d changes older than %s", count, cl.retention)
+		cl.changes = append([]dirclient.ThingChange{}, cl.changes[count:]...)
+		cl.rewrite()
+	}
+}
+
+// Close the change log file
+func (cl *ChangeLog) Close() {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if cl.logFile != nil {
+		cl.logFile.Close()
+		cl.logFile = nil
+	}
+}
+
+// FirstSeq returns the sequence number of the oldest change in the log
+// Returns LastSeq()+1 if the log is empty.
+func (cl *ChangeLog) FirstSeq() uint64 {
+	cl.mutex.RLock()
+	defer cl.mutex.RUnlock()
+	if len(cl.changes) == 0 {
+		return cl.lastSeq + 1
+	}
+	return cl.changes[0].Seq
+}
+
+// LastSeq returns the sequence number of the latest change
+func (cl *ChangeLog) LastSeq() uint64 {
+	cl.mutex.RLock()
+	defer cl.mutex.RUnlock()
+	return cl.lastSeq
+}
+
+// Open the change log and load the most recent changes
+// The log file is created if it doesn't exist.
+func (cl *ChangeLog) Open() error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.changes = make([]dirclient.ThingChange, 0)
+	logFile, err := os.OpenFile(cl.logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		logrus.Errorf("ChangeLog.Open: failed opening '%s': %s", cl.logPath, err)
+		return err
+	}
+	scanner := bufio.NewScanner(logFile)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var change dirclient.ThingChange
+		if err2 := json.Unmarshal(scanner.Bytes(), &change); err2 != nil || change.Seq <= cl.lastSeq {
+			continue
+		}
+		cl.changes = append(cl.changes, change)
+		cl.lastSeq = change.Seq
+	}
+	cl.logFile = logFile
+	if len(cl.changes) > cl.maxSize {
+		cl.changes = cl.changes[len(cl.changes)-cl.maxSize:]
+		cl.rewrite()
+	}
+	cl.expire()
+	logrus.Infof("ChangeLog.Open: loaded %d changes from '%s'. Last change is %d", len(cl.changes), cl.logPath, cl.lastSeq)
+	return nil
+}
+
+// rewrite the log file with the changes in memory
+// The new file is written first and renamed so a failure leaves the old file intact.
+func (cl *ChangeLog) rewrite() {
+	tmpPath := cl.logPath + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err == nil {
+		writer := bufio.NewWriter(tmpFile)
+		for _, change := range cl.changes {
+			line, _ := json.Marshal(change)
+			writer.Write(append(line, '\n'))
+		}
+		err = writer.Flush()
+		tmpFile.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, cl.logPath)
+	}
+	if err == nil && cl.logFile != nil {
+		cl.logFile.Close()
+		cl.logFile, err = os.OpenFile(cl.logPath, os.O_RDWR|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		logrus.Errorf("ChangeLog.rewrite: failed rewriting '%s': %s", cl.logPath, err)
+	}
+}
+
+// SetRetention sets the max age of the changes in the log, including the deleted thing IDs
+// Older changes are removed when a change is added or the log is opened.
+//  retention is the max age. Use 0 to only limit the nr of changes.
+func (cl *ChangeLog) SetRetention(retention time.Duration) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.retention = retention
+	cl.expire()
+}
+
+// Since returns the changes after the given sequence number
+//  seq is the sequence number of the last known change, 0 for all changes
+//  limit is the maximum nr of changes to return
+// Returns the changes, or an error if changes after seq are no longer in the log
+func (cl *ChangeLog) Since(seq uint64, limit int) ([]dirclient.ThingChange, error) {
+	cl.mutex.RLock()
+	defer cl.mutex.RUnlock()
+	result := make([]dirclient.ThingChange, 0)
+	if seq >= cl.lastSeq {
+		return result, nil
+	}
+	if len(cl.changes) == 0 || seq+1 < cl.changes[0].Seq {
+		return nil, fmt.Errorf("changes since %d are no longer available", seq)
+	}
+	// the log is ordered without gaps
+	start := int(seq + 1 - cl.changes[0].Seq)
+	for i := start; i < len(cl.changes) && len(result) < limit; i++ {
+		result = append(result, cl.changes[i])
+	}
+	return result, nil
+}
+
+// NewChangeLog creates a change log stored in the given file
+//  logPath is the path to the log file
+//  maxSize is the nr of changes to keep. Use 0 for DefaultChangeLogSize
+func NewChangeLog(logPath string, maxSize int) *ChangeLog {
+	if maxSize <= 0 {
+		maxSize = DefaultChangeLogSize
+	}
+	cl := &ChangeLog{
+		logPath:   logPath,
+		maxSize:   maxSize,
+		retention: DefaultTombstoneRetention,
+		changes:   make([]dirclient.ThingChange, 0),
+	}
+	return cl
+}
+
+// ChangeLogStore is a directory file store that records its changes in a change log
+// Writes are serialized so the order in the change log matches the order of the writes.
+// The store also keeps an index of the visibility of things, as the ACL filter can't read the
+// store while it is being listed or queried.
+type ChangeLogStore struct {
+	*dirfilestore.DirFileStore
+	changeLog  *ChangeLog
+	writeMutex sync.Mutex
+
+	visibility      map[string]string // visibility of things that aren't private, by thing ID
+	visibilityMutex sync.RWMutex
+}
+
+// ChangeLog returns the log with the changes of this store
+func (store *ChangeLogStore) ChangeLog() *ChangeLog {
+	return store.changeLog
+}
+
+// Close the store and its change log
+func (store *ChangeLogStore) Close() {
+	store.DirFileStore.Close()
+	store.changeLog.Close()
+}
+
+// Open the store and its change log
+func (store *ChangeLogStore) Open() error {
+	err := store.DirFileStore.Open()
+	if err == nil {
+		err = store.changeLog.Open()
+	}
+	for id, doc := range store.DirFileStore.Snapshot() {
+		docMap, _ := doc.(map[string]interface{})
+		store.updateVisibility(id, docMap)
+	}
+	return err
+}
+
+// Patch a document and record the resulting document in the change log
+func (store *ChangeLogStore) Patch(id string, doc map[string]interface{}) error {
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+	err := store.DirFileStore.Patch(id, doc)
+	if err == nil {
+		patched, _ := store.DirFileStore.Get(id)
+		patchedMap, _ := patched.(map[string]interface{})
+		store.appendChange(dirclient.ThingChange{Op: dirclient.ChangeOpPut, ThingID: id, TD: patchedMap})
+	}
+	return err
+}
+
+// Remove a document and record the removal in the change log
+// Nothing is recorded if the document doesn't exist.
+func (store *ChangeLogStore) Remove(id string) {
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+	_, err := store.DirFileStore.Get(id)
+	store.DirFileStore.Remove(id)
+	if err == nil {
+		store.appendChange(dirclient.ThingChange{Op: dirclient.ChangeOpDelete, ThingID: id})
+	}
+}
+
+// Replace a document and record it in the change log
+func (store *ChangeLogStore) Replace(id string, doc map[string]interface{}) error {
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+	_, notFound := store.DirFileStore.Get(id)
+	err := store.DirFileStore.Replace(id, doc)
+	if err == nil {
+		store.appendChange(dirclient.ThingChange{
+			Op: dirclient.ChangeOpPut, ThingID: id, TD: doc, Created: notFound != nil})
+	}
+	return err
+}
+
+// Transaction applies a group of changes and records them in the change log after commit
+// The changes are recorded in the order they were made. Nothing is recorded if the transaction fails.
+func (store *ChangeLogStore) Transaction(txFunc func(tx dirstore.IDirTx) error) error {
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+	var logTx *changeLogTx
+	err := store.DirFileStore.Transaction(func(tx dirstore.IDirTx) error {
+		logTx = &changeLogTx{IDirTx: tx}
+		return txFunc(logTx)
+	})
+	if err == nil {
+		for _, change := range logTx.changes {
+			store.appendChange(change)
+		}
+	}
+	return err
+}
+
+// changeLogTx is a store transaction that keeps track of the changes for the change log
+type changeLogTx struct {
+	dirstore.IDirTx
+	changes []dirclient.ThingChange
+}
+
+// Patch a document and keep the resulting document
+func (tx *changeLogTx) Patch(id string, doc map[string]interface{}) error {
+	err := tx.IDirTx.Patch(id, doc)
+	if err == nil {
+		patched, _ := tx.IDirTx.Get(id)
+		patchedMap, _ := patched.(map[string]interface{})
+		tx.changes = append(tx.changes, dirclient.ThingChange{Op: dirclient.ChangeOpPut, ThingID: id, TD: patchedMap})
+	}
+	return err
+}
+
+// Remove a document and keep the removal if the document existed
+func (tx *changeLogTx) Remove(id string) {
+	_, err := tx.IDirTx.Get(id)
+	tx.IDirTx.Remove(id)
+	if err == nil {
+		tx.changes = append(tx.changes, dirclient.ThingChange{Op: dirclient.ChangeOpDelete, ThingID: id})
+	}
+}
+
+// Replace a document and keep the new document
+func (tx *changeLogTx) Replace(id string, doc map[string]interface{}) error {
+	_, notFound := tx.IDirTx.Get(id)
+	err := tx.IDirTx.Replace(id, doc)
+	if err == nil {
+		tx.changes = append(tx.changes, dirclient.ThingChange{
+			Op: dirclient.ChangeOpPut, ThingID: id, TD: doc, Created: notFound != nil})
+	}
+	return err
+}
+
+// appendChange records a change in the change log and updates the visibility index
+// The visibility of the thing before the change is recorded with the change, so the change feed
+// can tell whether a user could read the thing before it was changed.
+//  change with the operation, thing ID, TD and whether the thing was created
+func (store *ChangeLogStore) appendChange(change dirclient.ThingChange) {
+	change.PrevVisibility = store.Visibility(change.ThingID)
+	store.changeLog.AppendChange(change)
+	store.updateVisibility(change.ThingID, change.TD)
+}
+
+// updateVisibility updates the visibility index with the visibility of a thing
+//  id of the thing
+//  doc with the TD after the change. nil when deleted.
+func (store *ChangeLogStore) updateVisibility(id string, doc map[string]interface{}) {
+	visibility := tdVisibility(doc)
+	store.visibilityMutex.Lock()
+	defer store.visibilityMutex.Unlock()
+	if visibility != dirclient.VisibilityPrivate {
+		store.visibility[id] = visibility
+	} else {
+		delete(store.visibility, id)
+	}
+}
+
+// tdVisibility returns the visibility annotation of a TD
+// Returns dirclient.VisibilityPrivate if the TD is nil or has no valid visibility.
+func tdVisibility(doc map[string]interface{}) string {
+	visibility, _ := doc[dirclient.VisibilityAnnotation].(string)
+	if visibility != dirclient.VisibilityAuthenticated && visibility != dirclient.VisibilityPublic {
+		return dirclient.VisibilityPrivate
+	}
+	return visibility
+}
+
+// Visibility returns the visibility of a thing
+// Returns dirclient.VisibilityPrivate if the thing doesn't exist or has no valid visibility.
+func (store *ChangeLogStore) Visibility(id string) string {
+	store.visibilityMutex.RLock()
+	defer store.visibilityMutex.RUnlock()
+	visibility, found := store.visibility[id]
+	if !found {
+		return dirclient.VisibilityPrivate
+	}
+	return visibility
+}
+
+// Snapshot returns the documents by ID and the sequence number of the last change included
+// The map is a copy. The documents are shared with the store and must not be modified.
+func (store *ChangeLogStore) Snapshot() (docs map[string]interface{}, seq uint64) {
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+	return store.DirFileStore.Snapshot(), store.changeLog.LastSeq()
+}
+
+// NewChangeLogStore creates a directory file store with change log
+//  storePath is the path to the JSON store file
+//  changeLogPath is the path to the change log file
+func NewChangeLogStore(storePath string, changeLogPath string) *ChangeLogStore {
+	store := &ChangeLogStore{
+		DirFileStore: dirfilestore.NewDirFileStore(storePath),
+		changeLog:    NewChangeLog(changeLogPath, DefaultChangeLogSize),
+		visibility:   make(map[string]string),
+	}
+	return store
+}
@@ -4,20 +4,23 @@ package dirserver
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
+	"net/http"
 	"path"
+	"sync"
 	"time"
 
-	"github.com/grandcat/zeroconf"
 	"github.com/sirupsen/logrus"
 	"github.com/wostzone/hubauth/pkg/authenticate"
 	"github.com/wostzone/hubauth/pkg/authorize"
-	"github.com/wostzone/hubserve-go/pkg/tlsserver"
+	"github.com/wostzone/hubserve-go/pkg/certsetup"
 	"github.com/wostzone/thingdir/pkg/dirclient"
 	"github.com/wostzone/thingdir/pkg/dirstore/dirfilestore"
 )
 
 const DirectoryPluginID = "directory"
 const DefaultDirectoryStoreFile = "directory.json"
+const DefaultModelStoreFile = "models.json"
 
 // const RouteUpdateTD = "/things/{thingID}"
 // const RouteGetTD = "/things/{thingID}"
@@ -36,15 +39,82 @@ type DirectoryServer struct {
 	serverCert    *tls.Certificate  // path to server certificate PEM file
 	authenticator authenticate.VerifyUsernamePassword
 	authorizer    authorize.VerifyAuthorization
+	groupAcl      IGroupAcl // group roles for authorization, nil to use the authorizer
 
 	// the service name. Use dirclient.DirectoryServiceName for default or "" to disable DNS discovery
 	discoveryName string
+	// DNS-SD options
+	discoveryInterfaces []string // network interfaces to publish on, nil for all
+	discoveryIPv6       bool     // publish IPv6 addresses
+	wotDiscovery        bool     // publish the WoT Discovery service records
+	// validation of TDs on replace and patch
+	validationMode ValidationMode
+	tdSchema       *TDSchema // TD 1.1 JSON schema, required for validation
+	// peer directories for federated queries, nil if not federated
+	federation *Federation
+	// replication of a primary directory, nil if this is not a replica
+	replica *Replica
+	// time deleted TDs are kept in the trash, 0 to keep them until purged
+	trashRetention time.Duration
+	// only the publisher that owns a TD can write it
+	verifyPublisher bool
+	// removal of fields from TDs for callers that can't edit them, nil to not redact
+	redactor *Redactor
+	// allow reading public things without authentication
+	anonymousRead bool
+	// verification of bearer tokens, nil if tokens aren't accepted
+	tokenVerifier *TokenVerifier
+	// accept API keys of service accounts
+	apiKeysEnabled bool
+	// revoked client certificates, nil to accept all certificates signed by the CA
+	revocation *RevocationList
 
 	// runtime status
-	running     bool
-	tlsServer   *tlsserver.TLSServer
-	discoServer *zeroconf.Server
-	store       *dirfilestore.DirFileStore
+	running    bool
+	tlsServer  *dirTLSServer
+	discovery  *DirDiscovery
+	store      *ChangeLogStore
+	modelStore *dirfilestore.DirFileStore // Thing Models by model ID
+	modelMutex sync.Mutex                 // serializes changes to the model records
+	trashStore *dirfilestore.DirFileStore // deleted TDs by thing ID
+	ownerStore *dirfilestore.DirFileStore // owning publisher by thing ID
+	auditLog   *AuditLog                  // record of modifications
+	apiKeys    *APIKeyStore               // hashed API keys by key ID
+}
+
+// isReplicaWrite returns true if this is a replica and the request modifies the directory
+// Writes to a replica are redirected to the primary.
+func (srv *DirectoryServer) isReplicaWrite(request *http.Request) bool {
+	return srv.replica != nil && request.Method != "GET"
+}
+
+// newAclFilter returns the filter to authorize access to things during a request
+// Users that authenticated with a bearer token have the groups and role of the token. API keys
+// have their role in the things that match the pattern of the key.
+func (srv *DirectoryServer) newAclFilter(userID string, request *http.Request) *AclFilter {
+	aclFilter := NewGroupAclFilter(userID, getCertOU(request), srv.authorizer, srv.groupAcl)
+	aclFilter.SetVisibility(srv.store.Visibility)
+	if claims := getTokenClaims(request); claims != nil && claims.IsAPIKey {
+		aclFilter.SetAPIKeyRole(claims.Role)
+		aclFilter.SetThingPattern(claims.ThingPattern)
+	} else if claims != nil {
+		aclFilter.SetTokenClaims(claims.Groups, claims.Role)
+		aclFilter.SetThingPattern(claims.ThingPattern)
+	}
+	return &aclFilter
+}
+
+// getCertOU returns the OU of the client certificate used to authenticate the request
+// Returns certsetup.OUNone if the client didn't authenticate with a certificate
+func getCertOU(request *http.Request) string {
+	certOU := certsetup.OUNone
+	if request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+		cert := request.TLS.PeerCertificates[0]
+		if len(cert.Subject.OrganizationalUnit) > 0 {
+			certOU = cert.Subject.OrganizationalUnit[0]
+		}
+	}
+	return certOU
 }
 
 // Return the address that the server listens on
@@ -53,6 +123,324 @@ func (srv *DirectoryServer) Address() string {
 	return srv.address
 }
 
+// SetAPIKeys enables the API keys of service accounts
+// Administrators manage the keys through dirclient.RouteAPIKeys. Clients use the key as bearer
+// token. This must be set before Start.
+//  enabled accepts API keys
+func (srv *DirectoryServer) SetAPIKeys(enabled bool) {
+	srv.apiKeysEnabled = enabled
+}
+
+// SetAnonymousRead allows clients without credentials to read the public things.
+// Anonymous clients can list, query and get the TDs with public visibility. Writes always
+// require authentication. This must be set before Start.
+//  enabled allows anonymous reads
+func (srv *DirectoryServer) SetAnonymousRead(enabled bool) {
+	srv.anonymousRead = enabled
+}
+
+// SetDiscoveryOptions sets the DNS-SD discovery options. Discovery must be enabled with a discovery name.
+//  wotDiscovery also publishes the '_wot._tcp' service with the '_directory' subtype as defined in WoT Discovery
+//  interfaces with the names of the network interfaces to publish on, or nil for all multicast interfaces
+//  enableIPv6 also publishes the IPv6 addresses of the interfaces
+func (srv *DirectoryServer) SetDiscoveryOptions(wotDiscovery bool, interfaces []string, enableIPv6 bool) {
+	srv.wotDiscovery = wotDiscovery
+	srv.discoveryInterfaces = interfaces
+	srv.discoveryIPv6 = enableIPv6
+}
+
+// SetFederation enables federated queries with peer directories.
+// Federated queries are requested with the scope=federated query parameter.
+//  peers with the address:port of static peer directories
+//  discoverPeers also uses the peers found with DNS-SD
+//  clientCert to authenticate with the peers. The peers must accept this certificate
+//  timeout to wait for a peer response. Use 0 for the default
+func (srv *DirectoryServer) SetFederation(peers []string, discoverPeers bool,
+	clientCert *tls.Certificate, timeout time.Duration) {
+	srv.federation = NewFederation(srv.address, srv.port, srv.discoveryName, peers, discoverPeers,
+		clientCert, srv.caCert, timeout)
+}
+
+// SetGroupAcl enables authorization using the roles of users in the groups of things.
+// Viewers can read, editors can also patch and managers can also replace and delete TDs.
+// Users with other roles are authorized by the authorizer.
+//  groupAcl with the group membership and roles. nil to use only the authorizer.
+func (srv *DirectoryServer) SetGroupAcl(groupAcl IGroupAcl) {
+	srv.groupAcl = groupAcl
+}
+
+// SetRedactionRules sets the rules to remove fields from the TDs that are returned to callers
+// that can't edit them. Callers with patch rights see the full TD.
+// Returns an error if a rule is invalid
+//  rules describing the fields to remove. nil to not redact TDs
+func (srv *DirectoryServer) SetRedactionRules(rules []RedactionRule) error {
+	if len(rules) == 0 {
+		srv.redactor = nil
+		return nil
+	}
+	redactor, err := NewRedactor(rules)
+	if err != nil {
+		return err
+	}
+	srv.redactor = redactor
+	return nil
+}
+
+// SetReplicaOf makes this directory a read-only replica of a primary directory.
+// The replica follows the change log of the primary and redirects writes to the primary. Only the
+// TDs are replicated. Thing models, owners, trash, audit records and API keys are primary-only and
+// all their requests are redirected to the primary. API keys are only accepted by the primary.
+//  primary is the address:port of the primary directory server
+//  clientCert to authenticate with the primary. This must be a plugin certificate
+//  interval to poll the primary for changes. Use 0 for the default
+func (srv *DirectoryServer) SetReplicaOf(primary string, clientCert *tls.Certificate, interval time.Duration) {
+	positionPath := path.Join(path.Dir(srv.store.ChangeLog().logPath), DefaultReplicaPositionFile)
+	srv.replica = NewReplica(primary, clientCert, srv.caCert, interval, srv.store, positionPath)
+}
+
+// SetTokenAuth enables authentication with JWT bearer tokens signed by a key in a local key set.
+// The token subject is the userID and the groups and role claims are used for authorization.
+// Reading requires the read or write scope and writing the write scope. This must be set before Start.
+// Returns an error if the key set can't be loaded
+//  config with the key set and the required issuer, audience and scopes
+func (srv *DirectoryServer) SetTokenAuth(config TokenAuthConfig) error {
+	tokenVerifier, err := NewTokenVerifier(config)
+	if err != nil {
+		return err
+	}
+	srv.tokenVerifier = tokenVerifier
+	return nil
+}
+
+// SetRevocation rejects the client certificates that are revoked by the CRL file or the
+// configured serial numbers. The CRL file is reloaded when it changes. This must be set before Start.
+// Returns an error if the CRL can't be loaded or a serial number is invalid.
+//  config with the CRL file and revoked serial numbers
+func (srv *DirectoryServer) SetRevocation(config RevocationConfig) error {
+	revocation, err := NewRevocationList(srv.caCert, config)
+	if err != nil {
+		return err
+	}
+	srv.revocation = revocation
+	return nil
+}
+
+// SetRevokedSerials replaces the configured serial numbers of revoked client certificates
+// This can be used while the server is running, eg when the configuration is reloaded.
+// Returns an error if revocation isn't enabled or a serial number is invalid.
+//  serials of revoked certificates in hex, eg "1f:a0:03"
+func (srv *DirectoryServer) SetRevokedSerials(serials []string) error {
+	if srv.revocation == nil {
+		return fmt.Errorf("SetRevokedSerials: revocation is not enabled")
+	}
+	return srv.revocation.SetRevokedSerials(serials)
+}
+
+// SetServerCert replaces the server certificate and CA, eg after the certificates are renewed
+// If the server is running then new connections use the new certificate and CA. The listener
+// and open connections are not interrupted.
+// Returns an error if the certificate or CA is missing.
+//  serverCert is the renewed server certificate
+//  caCert is the CA that signs the client certificates
+func (srv *DirectoryServer) SetServerCert(serverCert *tls.Certificate, caCert *x509.Certificate) error {
+	if serverCert == nil || caCert == nil {
+		return fmt.Errorf("SetServerCert: missing server certificate or CA")
+	}
+	if srv.tlsServer != nil {
+		err := srv.tlsServer.SetCerts(serverCert, caCert)
+		if err != nil {
+			return err
+		}
+		logrus.Warningf("SetServerCert: Using the renewed certificate on %s:%d", srv.address, srv.port)
+	}
+	srv.serverCert = serverCert
+	srv.caCert = caCert
+	if srv.revocation != nil {
+		srv.revocation.SetCACert(caCert)
+	}
+	return nil
+}
+
+// SetTombstoneRetention sets how long changes, including the IDs of deleted things, are kept for
+// delta sync. Clients that sync less frequently receive all TDs. The default is 30 days.
+//  retention is the max age of the changes. Use 0 to keep a fixed nr of changes.
+func (srv *DirectoryServer) SetTombstoneRetention(retention time.Duration) {
+	srv.store.ChangeLog().SetRetention(retention)
+}
+
+// SetAuditLogRotation sets the size at which the audit log is rotated and the nr of rotated files to keep
+//  maxSize in bytes. Use 0 for the default of 10MB
+//  maxFiles to keep. Use 0 for the default of 5
+func (srv *DirectoryServer) SetAuditLogRotation(maxSize int64, maxFiles int) {
+	srv.auditLog.SetRotation(maxSize, maxFiles)
+}
+
+// SetTrashRetention sets how long deleted TDs are kept in the trash before they are purged.
+// The default is 7 days.
+//  retention is the max age of deleted TDs. Use 0 to keep them until purged.
+func (srv *DirectoryServer) SetTrashRetention(retention time.Duration) {
+	srv.trashRetention = retention
+}
+
+// SetVerifyPublisher enables verification of the publisher that writes a TD.
+// The first publisher that writes a TD becomes its owner. Writes by other publishers are
+// rejected. Administrators can transfer the ownership and aren't restricted.
+//  verify enables the verification
+func (srv *DirectoryServer) SetVerifyPublisher(verify bool) {
+	srv.verifyPublisher = verify
+}
+
+// SetTDSchema loads the W3C TD 1.1 JSON schema that TDs are validated against
+//  schemaPath is the path to the schema file, eg {configFolder}/td-json-schema-validation.json
+// Returns an error if the schema can't be loaded
+func (srv *DirectoryServer) SetTDSchema(schemaPath string) error {
+	schema, err := LoadTDSchema(schemaPath)
+	if err != nil {
+		return err
+	}
+	srv.tdSchema = schema
+	return nil
+}
+
+// SetValidationMode sets the validation of TDs that are replaced or patched.
+// The default is ValidationModeOff. The warn and reject modes require the TD schema, see SetTDSchema.
+// Returns an error if the mode is not one of off, warn or reject, or if the schema isn't loaded
+func (srv *DirectoryServer) SetValidationMode(mode ValidationMode) error {
+	switch mode {
+	case ValidationModeOff:
+		srv.validationMode = mode
+		return nil
+	case ValidationModeWarn, ValidationModeReject:
+		if srv.tdSchema == nil {
+			return fmt.Errorf("SetValidationMode: validation mode '%s' requires the TD schema", mode)
+		}
+		srv.validationMode = mode
+		return nil
+	}
+	return fmt.Errorf("SetValidationMode: invalid validation mode '%s'", mode)
+}
+
+// addRoutes adds the handlers for the paths of the directory API to the TLS server
+func (srv *DirectoryServer) addRoutes() {
+	// setup the handlers for the paths. The GET/PUT/... operations are resolved by the handler
+	srv.addReadHandler(dirclient.RouteThings, srv.ServeThings)
+	// these routes must be added before the thing ID route as they match the same pattern
+	srv.addHandler(dirclient.RouteThingChanges, srv.ServeThingChanges)
+	srv.addHandler(dirclient.RouteThingsExport, srv.ServeThingsExport)
+	srv.addHandler(dirclient.RouteThingsImport, srv.ServeThingsImport)
+	srv.addHandler(dirclient.RouteThingsBatch, srv.ServeThingsBatch)
+	srv.addPrimaryHandler(dirclient.RouteThingOwner, srv.ServeThingOwner)
+	srv.addReadHandler(dirclient.RouteThingID, srv.ServeThingByID)
+	srv.addPrimaryHandler(dirclient.RouteTrash, srv.ServeTrash)
+	srv.addPrimaryHandler(dirclient.RouteTrashID, srv.ServeTrashByID)
+	srv.addPrimaryHandler(dirclient.RouteTrashRestore, srv.ServeTrashByID)
+	srv.addPrimaryHandler(dirclient.RouteAudit, srv.ServeAudit)
+	srv.addHandler(dirclient.RouteEvents, srv.ServeEvents)
+	srv.addHandler(dirclient.RouteEventType, srv.ServeEvents)
+	if srv.apiKeysEnabled {
+		srv.addPrimaryHandler(dirclient.RouteAPIKeys, srv.ServeAPIKeys)
+		srv.addPrimaryHandler(dirclient.RouteAPIKeyID, srv.ServeAPIKeyByID)
+	}
+	srv.addPrimaryHandler(dirclient.RouteModels, srv.ServeModels)
+	srv.addPrimaryHandler(dirclient.RouteModelID, srv.ServeModelByID)
+	srv.addPrimaryHandler(dirclient.RouteModelInstantiate, srv.ServeInstantiateModel)
+	srv.tlsServer.AddHandlerNoAuth(dirclient.RouteWellKnownWoT, srv.ServeDirectoryTD)
+	srv.addHandler(dirclient.RouteReplicationChanges, srv.ServeReplicationChanges)
+	srv.addHandler(dirclient.RouteReplicationSnapshot, srv.ServeReplicationSnapshot)
+}
+
+// startTLSServer starts the TLS server with the server certificate and adds the handlers
+// The certificate can be replaced while running with SetServerCert.
+func (srv *DirectoryServer) startTLSServer() error {
+	// srv.address = hubconfig.GetOutboundIP("").String()
+	srv.tlsServer = newDirTLSServer(srv.address, srv.port, srv.authenticator)
+	err := srv.tlsServer.SetCerts(srv.serverCert, srv.caCert)
+	if err == nil {
+		err = srv.tlsServer.Start()
+	}
+	if err != nil {
+		return err
+	}
+	srv.addRoutes()
+	return nil
+}
+
+// openStores loads the saved directory content from file
+func (srv *DirectoryServer) openStores() error {
+	err := srv.store.Open()
+	if err != nil {
+		return err
+	}
+	err = srv.modelStore.Open()
+	if err != nil {
+		return err
+	}
+	err = srv.trashStore.Open()
+	if err != nil {
+		return err
+	}
+	srv.purgeExpiredTrash()
+	err = srv.ownerStore.Open()
+	if err != nil {
+		return err
+	}
+	err = srv.auditLog.Open()
+	if err != nil {
+		return err
+	}
+	return srv.apiKeys.Open()
+}
+
+// closeStores saves and closes the directory content
+func (srv *DirectoryServer) closeStores() {
+	srv.store.Close()
+	srv.modelStore.Close()
+	srv.trashStore.Close()
+	srv.ownerStore.Close()
+	srv.auditLog.Close()
+	srv.apiKeys.Close()
+}
+
+// startServices starts discovery, federation, replication and the revocation list, if enabled
+func (srv *DirectoryServer) startServices() {
+	// DNS-SD service discovery is optional
+	if srv.discoveryName != "" {
+		srv.discovery = NewDirDiscovery(srv.instanceID, srv.discoveryName, srv.address, srv.port,
+			srv.discoveryInterfaces, srv.discoveryIPv6, srv.wotDiscovery)
+		err := srv.discovery.Start()
+		if err != nil {
+			logrus.Errorf("Start: DNS-SD discovery failed: %s", err)
+			srv.discovery = nil
+		}
+	}
+	if srv.federation != nil {
+		srv.federation.Start()
+	}
+	if srv.replica != nil {
+		srv.replica.Start()
+	}
+	if srv.revocation != nil {
+		srv.revocation.Start()
+	}
+}
+
+// stopServices stops the services started with startServices
+func (srv *DirectoryServer) stopServices() {
+	if srv.discovery != nil {
+		srv.discovery.Stop()
+		srv.discovery = nil
+	}
+	if srv.federation != nil {
+		srv.federation.Stop()
+	}
+	if srv.replica != nil {
+		srv.replica.Stop()
+	}
+	if srv.revocation != nil {
+		srv.revocation.Stop()
+	}
+}
+
 // Start the server.
 func (srv *DirectoryServer) Start() error {
 	var err error
@@ -62,30 +450,15 @@ func (srv *DirectoryServer) Start() error {
 
 		logrus.Warningf("Starting directory server on %s:%d", srv.address, srv.port)
 
-		// load the saved directory content from file
-		err = srv.store.Open()
+		err = srv.openStores()
 		if err != nil {
 			return err
 		}
-
-		// srv.address = hubconfig.GetOutboundIP("").String()
-		srv.tlsServer = tlsserver.NewTLSServer(
-			srv.address, srv.port,
-			srv.serverCert, srv.caCert,
-			srv.authenticator)
-		err = srv.tlsServer.Start()
+		err = srv.startTLSServer()
 		if err != nil {
 			return err
 		}
-
-		// setup the handlers for the paths. The GET/PUT/... operations are resolved by the handler
-		srv.tlsServer.AddHandler(dirclient.RouteThings, srv.ServeThings)
-		srv.tlsServer.AddHandler(dirclient.RouteThingID, srv.ServeThingByID)
-
-		// DNS-SD service discovery is optional
-		if srv.discoveryName != "" {
-			srv.discoServer, _ = ServeDirDiscovery(srv.instanceID, srv.discoveryName, srv.address, srv.port)
-		}
+		srv.startServices()
 		// Make sure the server is listening before continuing
 		// Not pretty but it handles it
 		time.Sleep(time.Second)
@@ -93,21 +466,70 @@ func (srv *DirectoryServer) Start() error {
 	return nil
 }
 
+// Takeover starts this server on the listener of a running server and stops the running server
+// This applies a new configuration without closing the listener or the open connections. Requests
+// in progress are completed by the running server and new requests wait until this server has
+// started. Event streams of the running server end and clients resume them with their last event ID.
+// Both servers must use the same address and port. If this server fails to start then the running
+// server continues.
+//  running is the directory server to take over
+func (srv *DirectoryServer) Takeover(running *DirectoryServer) error {
+	if srv.running {
+		return fmt.Errorf("Takeover: the directory server is already running")
+	} else if running == nil || !running.running || running.tlsServer == nil {
+		return fmt.Errorf("Takeover: there is no running directory server to take over")
+	} else if srv.address != running.address || srv.port != running.port {
+		return fmt.Errorf("Takeover: can't take over %s:%d on %s:%d",
+			running.address, running.port, srv.address, srv.port)
+	}
+	logrus.Warningf("Takeover: taking over the directory server on %s:%d", srv.address, srv.port)
+	// the routes are prepared on a TLS server that isn't started and moved to the running server
+	tlsServer := running.tlsServer
+	staging := newDirTLSServer(srv.address, srv.port, srv.authenticator)
+	err := staging.SetCerts(srv.serverCert, srv.caCert)
+	if err != nil {
+		return fmt.Errorf("Takeover: %s", err)
+	}
+	srv.tlsServer = staging
+	srv.addRoutes()
+	err = tlsServer.replaceRoutes(staging, func() error {
+		running.stopServices()
+		running.closeStores()
+		err := srv.openStores()
+		if err != nil {
+			srv.closeStores()
+			err2 := running.openStores()
+			if err2 != nil {
+				logrus.Errorf("Takeover: unable to reopen the stores of the running server: %s", err2)
+			}
+			running.startServices()
+			return err
+		}
+		srv.startServices()
+		srv.tlsServer = tlsServer
+		srv.running = true
+		running.tlsServer = nil
+		running.running = false
+		return nil
+	})
+	if err != nil {
+		srv.tlsServer = nil
+		return fmt.Errorf("Takeover: %s", err)
+	}
+	return nil
+}
+
 // Stop the directory server
 func (srv *DirectoryServer) Stop() {
 	if srv.running {
 		srv.running = false
 		logrus.Warningf("Stopping directory server on %s:%d", srv.address, srv.port)
-		if srv.discoServer != nil {
-			srv.discoServer.Shutdown()
-			srv.discoServer = nil
-		}
+		srv.stopServices()
 		if srv.tlsServer != nil {
 			srv.tlsServer.Stop()
 			srv.tlsServer = nil
 		}
-		srv.store.Close()
-
+		srv.closeStores()
 	}
 }
 
@@ -137,16 +559,29 @@ func NewDirectoryServer(
 		panic("Exit due to invalid args")
 	}
 	storePath := path.Join(storeFolder, DefaultDirectoryStoreFile)
+	changeLogPath := path.Join(storeFolder, DefaultChangeLogFile)
+	modelStorePath := path.Join(storeFolder, DefaultModelStoreFile)
+	trashStorePath := path.Join(storeFolder, DefaultTrashStoreFile)
+	ownerStorePath := path.Join(storeFolder, DefaultOwnerStoreFile)
+	auditLogPath := path.Join(storeFolder, DefaultAuditLogFile)
+	apiKeyStorePath := path.Join(storeFolder, DefaultAPIKeyStoreFile)
 	srv := DirectoryServer{
-		address:       address,
-		serverCert:    serverCert,
-		caCert:        caCert,
-		discoveryName: discoveryName,
-		instanceID:    instanceID,
-		port:          port,
-		store:         dirfilestore.NewDirFileStore(storePath),
-		authenticator: authenticator,
-		authorizer:    authorizer,
+		address:        address,
+		serverCert:     serverCert,
+		caCert:         caCert,
+		discoveryName:  discoveryName,
+		instanceID:     instanceID,
+		port:           port,
+		store:          NewChangeLogStore(storePath, changeLogPath),
+		modelStore:     dirfilestore.NewDirFileStore(modelStorePath),
+		trashStore:     dirfilestore.NewDirFileStore(trashStorePath),
+		ownerStore:     dirfilestore.NewDirFileStore(ownerStorePath),
+		trashRetention: DefaultTrashRetention,
+		auditLog:       NewAuditLog(auditLogPath),
+		apiKeys:        NewAPIKeyStore(apiKeyStorePath),
+		authenticator:  authenticator,
+		authorizer:     authorizer,
+		validationMode: ValidationModeOff,
 	}
 	return &srv
 }
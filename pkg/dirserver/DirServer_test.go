@@ -1,12 +1,34 @@
 package dirserver_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -14,6 +36,7 @@ import (
 	"github.com/wostzone/hubclient-go/pkg/testenv"
 	"github.com/wostzone/hubclient-go/pkg/tlsclient"
 	"github.com/wostzone/hubclient-go/pkg/vocab"
+	"github.com/wostzone/hubserve-go/pkg/certsetup"
 	"github.com/wostzone/thingdir/pkg/dirclient"
 	"github.com/wostzone/thingdir/pkg/dirserver"
 )
@@ -74,6 +97,24 @@ func authorizer(userID string, certOU string,
 	return authorizeResult
 }
 
+// testTDSchema is a subset of the W3C TD 1.1 JSON schema for testing validation against a schema
+const testTDSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "properties": {
+    "title": {"type": "string"},
+    "version": {
+      "type": "object",
+      "properties": {"instance": {"type": "string"}},
+      "required": ["instance"]
+    }
+  },
+  "required": ["@context", "title", "security", "securityDefinitions"]
+}`
+
+// testTDSchemaPath is the file the test schema is written to
+var testTDSchemaPath = path.Join(os.TempDir(), "thingdir-test-td-schema.json")
+
 // TestMain runs a directory server for use by the test cases in this package
 // This uses the directory client in testing
 func TestMain(m *testing.M) {
@@ -93,6 +134,8 @@ func TestMain(m *testing.M) {
 		testCerts.ServerCert, testCerts.CaCert,
 		authenticator,
 		authorizer)
+	_ = ioutil.WriteFile(testTDSchemaPath, []byte(testTDSchema), 0644)
+	_ = directoryServer.SetTDSchema(testTDSchemaPath)
 	directoryServer.Start()
 
 	res := m.Run()
@@ -292,9 +335,9 @@ func TestDelete(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, len(tdDefs)-1, len(tds))
 
-	// deleting a non existing ID is not an error
+	// deleting a non existing ID fails with not found
 	err = dirClient.Delete("notavalidID")
-	require.NoError(t, err)
+	assert.Error(t, err)
 
 	dirClient.Close()
 }
@@ -367,3 +410,2053 @@ func TestNotAuthorized(t *testing.T) {
 
 	dirClient.Close()
 }
+
+// createValidTD returns a TD that passes validation
+func createValidTD(thingID string) td.ThingTD {
+	td1 := td.ThingTD{
+		"@context": []interface{}{dirserver.TDContextV11},
+		"id":       thingID,
+		"title":    "valid thing",
+		"securityDefinitions": map[string]interface{}{
+			"basic_sc": map[string]interface{}{"scheme": "basic"},
+		},
+		"security": "basic_sc",
+		"properties": map[string]interface{}{
+			"status": map[string]interface{}{
+				"title": "status",
+				"forms": []interface{}{
+					map[string]interface{}{"href": "https://127.0.0.1/things/" + thingID + "/status"},
+				},
+			},
+		},
+	}
+	return td1
+}
+
+func TestValidateTD(t *testing.T) {
+	thingID1 := "urn:thing1"
+	td1 := createValidTD(thingID1)
+	errors := dirserver.ValidateTD(thingID1, td1, nil)
+	assert.Empty(t, errors)
+
+	// the id must match
+	errors = dirserver.ValidateTD("urn:thing2", td1, nil)
+	require.Equal(t, 1, len(errors))
+	assert.Equal(t, "/id", errors[0].Path)
+
+	// security must reference an existing definition
+	td1["security"] = []interface{}{"basic_sc", "notasecdef"}
+	errors = dirserver.ValidateTD(thingID1, td1, nil)
+	require.Equal(t, 1, len(errors))
+	assert.Equal(t, "/security", errors[0].Path)
+
+	// missing id, title and forms
+	td2 := createValidTD(thingID1)
+	delete(td2, "id")
+	delete(td2, "title")
+	props := td2["properties"].(map[string]interface{})
+	props["status"].(map[string]interface{})["forms"] = []interface{}{map[string]interface{}{}}
+	errors = dirserver.ValidateTD(thingID1, td2, nil)
+	require.Equal(t, 3, len(errors))
+	assert.Equal(t, "/id", errors[0].Path)
+	assert.Equal(t, "/properties/status/forms/0/href", errors[1].Path)
+	assert.Equal(t, "/title", errors[2].Path)
+
+	// the id must be an absolute URI and hrefs must be URI references
+	td3 := createValidTD("thing3")
+	td3["links"] = []interface{}{map[string]interface{}{"href": "/things/{id}"}}
+	errors = dirserver.ValidateTD("thing3", td3, nil)
+	require.Equal(t, 1, len(errors))
+	assert.Equal(t, "/id", errors[0].Path)
+	td3 = createValidTD(thingID1)
+	td3["links"] = []interface{}{map[string]interface{}{"href": "https://"}}
+	props = td3["properties"].(map[string]interface{})
+	props["status"].(map[string]interface{})["forms"] = []interface{}{
+		map[string]interface{}{"href": "https://127.0.0.1/not a path"}}
+	errors = dirserver.ValidateTD(thingID1, td3, nil)
+	require.Equal(t, 2, len(errors))
+	assert.Equal(t, "/links/0/href", errors[0].Path)
+	assert.Equal(t, "/properties/status/forms/0/href", errors[1].Path)
+
+	// not a TD
+	errors = dirserver.ValidateTD(thingID1, map[string]interface{}{}, nil)
+	assert.NotEmpty(t, errors)
+
+	// names in the error pointers are escaped
+	td4 := createValidTD(thingID1)
+	td4["securityDefinitions"].(map[string]interface{})["a/b~c"] = map[string]interface{}{}
+	errors = dirserver.ValidateTD(thingID1, td4, nil)
+	require.Equal(t, 1, len(errors))
+	assert.Equal(t, "/securityDefinitions/a~1b~0c/scheme", errors[0].Path)
+
+	// the TD is validated against the schema
+	schema, err := dirserver.LoadTDSchema(testTDSchemaPath)
+	require.NoError(t, err)
+	td5 := createValidTD(thingID1)
+	errors = dirserver.ValidateTD(thingID1, td5, schema)
+	assert.Empty(t, errors)
+	td5["version"] = map[string]interface{}{}
+	errors = dirserver.ValidateTD(thingID1, td5, schema)
+	require.Equal(t, 1, len(errors))
+	assert.Equal(t, "/version/instance", errors[0].Path)
+	_, err = dirserver.LoadTDSchema("/not/a/schema.json")
+	assert.Error(t, err)
+}
+
+func TestValidationMode(t *testing.T) {
+	thingID1 := "urn:validthing"
+	thingID2 := "urn:invalidthing"
+
+	dirClient := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := dirClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer directoryServer.SetValidationMode(dirserver.ValidationModeOff)
+
+	err = directoryServer.SetValidationMode("notamode")
+	assert.Error(t, err)
+	// validation requires the TD schema
+	noSchemaServer := dirserver.NewDirectoryServer("noschema", storeFolder, serverAddress, testDirectoryPort+1,
+		"", testCerts.ServerCert, testCerts.CaCert, authenticator, authorizer)
+	err = noSchemaServer.SetValidationMode(dirserver.ValidationModeReject)
+	assert.Error(t, err)
+
+	// patching an unknown thing fails with not found
+	err = dirClient.PatchTD("urn:unknownthing", td.ThingTD{"title": "new title"})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, err.(*dirclient.StatusError).StatusCode)
+
+	// reject mode only accepts valid TDs
+	err = directoryServer.SetValidationMode(dirserver.ValidationModeReject)
+	require.NoError(t, err)
+	err = dirClient.UpdateTD(thingID1, createValidTD(thingID1))
+	assert.NoError(t, err)
+	err = dirClient.UpdateTD(thingID2, createValidTD(thingID1))
+	assert.Error(t, err)
+	_, err = dirClient.GetTD(thingID2)
+	assert.Error(t, err)
+
+	// a patch that invalidates the TD is rejected
+	err = dirClient.PatchTD(thingID1, td.ThingTD{"title": 42})
+	assert.Error(t, err)
+	err = dirClient.PatchTD(thingID1, td.ThingTD{"title": "new title"})
+	assert.NoError(t, err)
+
+	// null members of a patch are removed
+	err = dirClient.PatchTD(thingID1, td.ThingTD{"description": "a description"})
+	assert.NoError(t, err)
+	err = dirClient.PatchTD(thingID1, td.ThingTD{"description": nil})
+	assert.NoError(t, err)
+	td1, err := dirClient.GetTD(thingID1)
+	require.NoError(t, err)
+	assert.Equal(t, "new title", td1["title"])
+	_, found := td1["description"]
+	assert.False(t, found)
+
+	// warn mode stores the invalid TD with the validation errors
+	err = directoryServer.SetValidationMode(dirserver.ValidationModeWarn)
+	require.NoError(t, err)
+	err = dirClient.UpdateTD(thingID2, createValidTD(thingID1))
+	assert.NoError(t, err)
+	td2, err := dirClient.GetTD(thingID2)
+	require.NoError(t, err)
+	assert.NotEmpty(t, td2[dirserver.ValidationAnnotation])
+
+	// the annotation is removed when the TD is fixed
+	err = dirClient.UpdateTD(thingID2, createValidTD(thingID2))
+	assert.NoError(t, err)
+	td2, err = dirClient.GetTD(thingID2)
+	require.NoError(t, err)
+	assert.Nil(t, td2[dirserver.ValidationAnnotation])
+
+	dirClient.Delete(thingID1)
+	dirClient.Delete(thingID2)
+	dirClient.Close()
+}
+
+func TestThingModels(t *testing.T) {
+	const baseModelID = "basemodel"
+	const modelID = "switchmodel"
+	const thingID1 = "urn:switch1"
+	baseModel := map[string]interface{}{
+		"@context": []interface{}{dirserver.TDContextV11},
+		"@type":    dirserver.TMTypeThingModel,
+		"title":    "base model",
+		"version":  map[string]interface{}{"model": "1.0"},
+		"properties": map[string]interface{}{
+			"status": map[string]interface{}{
+				"title": "status",
+				"type":  "string",
+				"forms": []interface{}{map[string]interface{}{"href": "https://{{HOST}}/status"}},
+			},
+		},
+	}
+	switchModel := map[string]interface{}{
+		"@context": []interface{}{dirserver.TDContextV11},
+		"@type":    []interface{}{dirserver.TMTypeThingModel, "switch"},
+		"title":    "{{NAME}}",
+		"links": []interface{}{map[string]interface{}{
+			"rel": dirserver.TMTermExtends, "href": "/models/" + baseModelID, "type": dirserver.TMMediaType}},
+		"properties": map[string]interface{}{
+			"onoff": map[string]interface{}{
+				"tm:ref": baseModelID + "#/properties/status",
+				"title":  "on/off status",
+			},
+		},
+	}
+
+	dirClient := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := dirClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+
+	// the extended model must exist
+	err = dirClient.UpdateModel(modelID, switchModel)
+	assert.Error(t, err)
+	err = dirClient.UpdateModel(baseModelID, baseModel)
+	require.NoError(t, err)
+	err = dirClient.UpdateModel(modelID, switchModel)
+	require.NoError(t, err)
+
+	// not a thing model
+	err = dirClient.UpdateModel("notamodel", createValidTD("notamodel"))
+	assert.Error(t, err)
+
+	models, err := dirClient.ListModels(0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(models))
+	tm, err := dirClient.GetModel(baseModelID, "1.0")
+	require.NoError(t, err)
+	assert.Equal(t, "base model", tm["title"])
+	_, err = dirClient.GetModel(baseModelID, "2.0")
+	assert.Error(t, err)
+
+	// adding an older version doesn't change the latest version
+	olderModel := map[string]interface{}{
+		"@context": baseModel["@context"],
+		"@type":    dirserver.TMTypeThingModel,
+		"title":    "older base model",
+		"version":  map[string]interface{}{"model": "0.9"},
+	}
+	err = dirClient.UpdateModel(baseModelID, olderModel)
+	require.NoError(t, err)
+	tm, err = dirClient.GetModel(baseModelID, "")
+	require.NoError(t, err)
+	assert.Equal(t, "base model", tm["title"])
+	tm, err = dirClient.GetModel(baseModelID, "0.9")
+	require.NoError(t, err)
+	assert.Equal(t, "older base model", tm["title"])
+
+	// all placeholders must have a value
+	_, err = dirClient.InstantiateModel(modelID, "", thingID1, map[string]string{"NAME": "switch 1"})
+	assert.Error(t, err)
+	placeholders := map[string]string{"NAME": "switch 1", "HOST": "127.0.0.1"}
+	td1, err := dirClient.InstantiateModel(modelID, "", thingID1, placeholders)
+	require.NoError(t, err)
+	assert.Equal(t, thingID1, td1["id"])
+	assert.Equal(t, "switch 1", td1["title"])
+	assert.Equal(t, "switch", td1["@type"])
+
+	// the inherited and referenced properties are resolved
+	td2, err := dirClient.GetTD(thingID1)
+	require.NoError(t, err)
+	props := td2["properties"].(map[string]interface{})
+	require.NotNil(t, props["status"])
+	onoff := props["onoff"].(map[string]interface{})
+	assert.Equal(t, "on/off status", onoff["title"])
+	assert.Equal(t, "string", onoff["type"])
+	assert.Nil(t, onoff["tm:ref"])
+	forms := onoff["forms"].([]interface{})
+	assert.Equal(t, "https://127.0.0.1/status", forms[0].(map[string]interface{})["href"])
+
+	// the TD refers to the model it is derived from
+	tdModelID, tdModelVersion := dirserver.GetTDModel(td2)
+	assert.Equal(t, modelID, tdModelID)
+	assert.Equal(t, "1", tdModelVersion)
+
+	// the TDs can be listed by the model they are derived from
+	modelTDs, err := dirClient.ListModelTDs(modelID, "", 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(modelTDs))
+	assert.Equal(t, thingID1, modelTDs[0]["id"])
+	modelTDs, err = dirClient.ListModelTDs(modelID, "2", 0, 0)
+	require.NoError(t, err)
+	assert.Empty(t, modelTDs)
+	modelTDs, err = dirClient.ListModelTDs(baseModelID, "", 0, 0)
+	require.NoError(t, err)
+	assert.Empty(t, modelTDs)
+
+	// model writes are authorized like TD writes
+	userClient := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err = userClient.ConnectWithLoginID("user1", "pass1")
+	require.NoError(t, err)
+	defer userClient.Close()
+	authorizeResult = false
+	err = userClient.UpdateModel(baseModelID, olderModel)
+	assert.Error(t, err)
+	err = userClient.DeleteModel(baseModelID, "")
+	assert.Error(t, err)
+	authorizeResult = true
+
+	// concurrent updates of a model keep all versions
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(version string) {
+			defer wg.Done()
+			versionModel := map[string]interface{}{
+				"@context": baseModel["@context"],
+				"@type":    dirserver.TMTypeThingModel,
+				"title":    "base model " + version,
+				"version":  map[string]interface{}{"model": version},
+			}
+			assert.NoError(t, dirClient.UpdateModel(baseModelID, versionModel))
+		}(fmt.Sprintf("1.%d", i))
+	}
+	wg.Wait()
+	for i := 1; i <= 10; i++ {
+		_, err = dirClient.GetModel(baseModelID, fmt.Sprintf("1.%d", i))
+		assert.NoError(t, err)
+	}
+	err = dirClient.DeleteModel(baseModelID, "1.5")
+	assert.NoError(t, err)
+	_, err = dirClient.GetModel(baseModelID, "1.5")
+	assert.Error(t, err)
+	tm, err = dirClient.GetModel(baseModelID, "")
+	require.NoError(t, err)
+	assert.Equal(t, "base model 1.10", tm["title"])
+
+	err = dirClient.DeleteModel(modelID, "")
+	assert.NoError(t, err)
+	err = dirClient.DeleteModel(baseModelID, "")
+	assert.NoError(t, err)
+	_, err = dirClient.GetModel(baseModelID, "")
+	assert.Error(t, err)
+	dirClient.Delete(thingID1)
+	dirClient.Close()
+}
+
+func TestCreateTD(t *testing.T) {
+	dirClient := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := dirClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+
+	// the server assigns the ID
+	td1 := td.ThingTD{"title": "anonymous thing"}
+	thingID, err := dirClient.CreateTD(td1)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(thingID, "urn:uuid:"))
+
+	td2, err := dirClient.GetTD(thingID)
+	require.NoError(t, err)
+	assert.Equal(t, thingID, td2["id"])
+	assert.Equal(t, "anonymous thing", td2["title"])
+
+	// each TD gets a new ID
+	thingID2, err := dirClient.CreateTD(td1)
+	require.NoError(t, err)
+	assert.NotEqual(t, thingID, thingID2)
+
+	// TDs with an ID must be created with PUT
+	_, err = dirClient.CreateTD(td2)
+	assert.Error(t, err)
+
+	dirClient.Delete(thingID)
+	dirClient.Delete(thingID2)
+	dirClient.Close()
+}
+
+func TestDirectoryTD(t *testing.T) {
+	dirClient := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := dirClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+
+	dirTD, err := dirClient.GetDirectoryTD()
+	require.NoError(t, err)
+	assert.Equal(t, dirserver.ThingDirectoryType, dirTD["@type"])
+	actions := dirTD["actions"].(map[string]interface{})
+	assert.NotNil(t, actions["retrieveThing"])
+	assert.NotNil(t, actions["searchJSONPath"])
+	assert.NotNil(t, actions["retrieveAuditRecords"])
+	// API keys are only described when enabled
+	assert.Nil(t, actions["createAPIKey"])
+	events := dirTD["events"].(map[string]interface{})
+	assert.NotNil(t, events["thingCreated"])
+	assert.NotNil(t, events["thingUpdated"])
+	assert.NotNil(t, events["thingDeleted"])
+	// the server has an authenticator so both certificate and basic auth are supported
+	secDefs := dirTD["securityDefinitions"].(map[string]interface{})
+	assert.NotNil(t, secDefs["basic_sc"])
+
+	// the directory TD itself is a valid TD
+	thingID := dirTD["id"].(string)
+	errors := dirserver.ValidateTD(thingID, dirTD, nil)
+	assert.Empty(t, errors)
+
+	// the TD reflects changes to the features
+	assert.Nil(t, dirTD["wost:tdValidation"])
+	directoryServer.SetValidationMode(dirserver.ValidationModeWarn)
+	dirTD, err = dirClient.GetDirectoryTD()
+	directoryServer.SetValidationMode(dirserver.ValidationModeOff)
+	require.NoError(t, err)
+	assert.Equal(t, string(dirserver.ValidationModeWarn), dirTD["wost:tdValidation"])
+
+	dirClient.Close()
+}
+
+func TestWoTDiscovery(t *testing.T) {
+	logrus.Infof("---TestWoTDiscovery---")
+	const instanceID = "wotdiscoverytest"
+	dd := dirserver.NewDirDiscovery(instanceID, testServiceDiscoveryName, "", testDirectoryPort, nil, false, true)
+	err := dd.Start()
+	require.NoError(t, err)
+	defer dd.Stop()
+
+	resolver, err := zeroconf.NewResolver(nil)
+	require.NoError(t, err)
+	entries := make(chan *zeroconf.ServiceEntry)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err = resolver.Browse(ctx, dirserver.WoTServiceType, "local.", entries)
+	require.NoError(t, err)
+
+	var found *zeroconf.ServiceEntry
+	for entry := range entries {
+		if entry.Instance == instanceID {
+			found = entry
+			cancel()
+			break
+		}
+	}
+	require.NotNil(t, found)
+	assert.Equal(t, testDirectoryPort, found.Port)
+	assert.Contains(t, found.Text, "td="+dirclient.RouteWellKnownWoT)
+	assert.Contains(t, found.Text, "type="+dirserver.WoTDirectoryTXTType)
+	assert.Contains(t, found.Text, "scheme=https")
+
+	// the subtype points at the '_wot._tcp' instance
+	conn, err := net.ListenUDP("udp4", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	query := &dns.Msg{}
+	query.SetQuestion(dirserver.WoTDirectorySubtype+".local.", dns.TypePTR)
+	query.RecursionDesired = false
+	queryMsg, _ := query.Pack()
+	_, err = conn.WriteToUDP(queryMsg, &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353})
+	require.NoError(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 65536)
+	n, _, err := conn.ReadFromUDP(buf)
+	require.NoError(t, err)
+	resp := &dns.Msg{}
+	err = resp.Unpack(buf[:n])
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.Answer))
+	ptr, isPTR := resp.Answer[0].(*dns.PTR)
+	require.True(t, isPTR)
+	assert.Equal(t, instanceID+"."+dirserver.WoTServiceType+".local.", ptr.Ptr)
+	var srvRecord *dns.SRV
+	for _, rr := range resp.Extra {
+		if record, isSRV := rr.(*dns.SRV); isSRV {
+			srvRecord = record
+		}
+	}
+	require.NotNil(t, srvRecord)
+	assert.Equal(t, uint16(testDirectoryPort), srvRecord.Port)
+
+	// unknown interfaces fail
+	dd2 := dirserver.NewDirDiscovery(instanceID, testServiceDiscoveryName, "", testDirectoryPort,
+		[]string{"notaninterface"}, false, true)
+	err = dd2.Start()
+	assert.Error(t, err)
+}
+
+func TestFederatedQuery(t *testing.T) {
+	logrus.Infof("---TestFederatedQuery---")
+	peerFolder, _ := ioutil.TempDir("", "thingdir-peer")
+	defer os.RemoveAll(peerFolder)
+	fedFolder, _ := ioutil.TempDir("", "thingdir-fed")
+	defer os.RemoveAll(fedFolder)
+	peerPort := uint(testDirectoryPort + 2)
+	fedPort := uint(testDirectoryPort + 3)
+	peerHostPort := fmt.Sprintf("%s:%d", serverAddress, peerPort)
+	fedHostPort := fmt.Sprintf("%s:%d", serverAddress, fedPort)
+	const unreachablePeer = "127.0.0.1:1"
+
+	// the peer directory has thing1 and thing2. The federated directory has thing2 and thing3
+	peerServer := dirserver.NewDirectoryServer("peer", peerFolder, serverAddress, peerPort, "",
+		testCerts.ServerCert, testCerts.CaCert, authenticator, authorizer)
+	err := peerServer.Start()
+	require.NoError(t, err)
+	defer peerServer.Stop()
+	fedServer := dirserver.NewDirectoryServer("federated", fedFolder, serverAddress, fedPort, "",
+		testCerts.ServerCert, testCerts.CaCert, authenticator, authorizer)
+	fedServer.SetFederation([]string{peerHostPort, unreachablePeer}, false, testCerts.PluginCert, time.Second)
+	err = fedServer.Start()
+	require.NoError(t, err)
+	defer fedServer.Stop()
+
+	peerClient := dirclient.NewDirClient(peerHostPort, testCerts.CaCert)
+	err = peerClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer peerClient.Close()
+	fedClient := dirclient.NewDirClient(fedHostPort, testCerts.CaCert)
+	err = fedClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer fedClient.Close()
+
+	td2 := td.CreateTD("thing2", vocab.DeviceTypeSensor)
+	td.AddTDProperty(td2, "name", td.CreateProperty("local", "", vocab.PropertyTypeAttr))
+	_ = peerClient.UpdateTD("thing1", td.CreateTD("thing1", vocab.DeviceTypeSensor))
+	_ = peerClient.UpdateTD("thing2", td.CreateTD("thing2", vocab.DeviceTypeSensor))
+	_ = fedClient.UpdateTD("thing2", td2)
+	_ = fedClient.UpdateTD("thing3", td.CreateTD("thing3", vocab.DeviceTypeSensor))
+
+	// a local query only returns the local things
+	tdList, err := fedClient.ListTDs(0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(tdList))
+
+	// a federated query merges the peer things and reports the unreachable peer
+	result, err := fedClient.QueryFederated("", 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(result.Things))
+	assert.True(t, result.Partial)
+	require.Equal(t, 2, len(result.Peers))
+	assert.Equal(t, peerHostPort, result.Peers[0].Peer)
+	assert.Equal(t, 2, result.Peers[0].Count)
+	assert.Empty(t, result.Peers[0].Error)
+	assert.Equal(t, unreachablePeer, result.Peers[1].Peer)
+	assert.NotEmpty(t, result.Peers[1].Error)
+	for _, thingTD := range result.Things {
+		// the local TD takes precedence
+		if thingTD["id"] == "thing2" {
+			props := thingTD["properties"].(map[string]interface{})
+			assert.NotNil(t, props["name"])
+		}
+	}
+
+	// paging through the merged list
+	result, err = fedClient.QueryFederated("", 2, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(result.Things))
+
+	// invalid scope
+	_, err = fedClient.QueryTDs("$&scope=notascope", 0, 0)
+	assert.Error(t, err)
+}
+
+func TestChangeLog(t *testing.T) {
+	logFolder, _ := ioutil.TempDir("", "thingdir-changelog")
+	defer os.RemoveAll(logFolder)
+	logPath := path.Join(logFolder, dirserver.DefaultChangeLogFile)
+
+	changeLog := dirserver.NewChangeLog(logPath, 3)
+	err := changeLog.Open()
+	require.NoError(t, err)
+	for i := 1; i <= 5; i++ {
+		seq := changeLog.Append(dirclient.ChangeOpPut, fmt.Sprintf("thing%d", i), map[string]interface{}{"id": i})
+		assert.Equal(t, uint64(i), seq)
+	}
+	changeLog.Append(dirclient.ChangeOpDelete, "thing1", nil)
+	// the log is trimmed to the last 3 changes when it reaches twice its size
+	assert.Equal(t, uint64(4), changeLog.FirstSeq())
+	assert.Equal(t, uint64(6), changeLog.LastSeq())
+	changes, err := changeLog.Since(4, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(changes))
+	assert.Equal(t, "thing5", changes[0].ThingID)
+	assert.Equal(t, dirclient.ChangeOpDelete, changes[1].Op)
+	_, err = changeLog.Since(1, 10)
+	assert.Error(t, err)
+	changeLog.Close()
+
+	// the changes are kept after reopening
+	changeLog = dirserver.NewChangeLog(logPath, 3)
+	err = changeLog.Open()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(6), changeLog.LastSeq())
+	assert.Equal(t, uint64(7), changeLog.Append(dirclient.ChangeOpPut, "thing6", nil))
+	changeLog.Close()
+}
+
+func TestReplication(t *testing.T) {
+	logrus.Infof("---TestReplication---")
+	primaryFolder, _ := ioutil.TempDir("", "thingdir-primary")
+	defer os.RemoveAll(primaryFolder)
+	replicaFolder, _ := ioutil.TempDir("", "thingdir-replica")
+	defer os.RemoveAll(replicaFolder)
+	primaryPort := uint(testDirectoryPort + 4)
+	replicaPort := uint(testDirectoryPort + 5)
+	primaryHostPort := fmt.Sprintf("%s:%d", serverAddress, primaryPort)
+	replicaHostPort := fmt.Sprintf("%s:%d", serverAddress, replicaPort)
+
+	primary := dirserver.NewDirectoryServer("primary", primaryFolder, serverAddress, primaryPort, "",
+		testCerts.ServerCert, testCerts.CaCert, authenticator, authorizer)
+	err := primary.Start()
+	require.NoError(t, err)
+	defer primary.Stop()
+	primaryClient := dirclient.NewDirClient(primaryHostPort, testCerts.CaCert)
+	err = primaryClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer primaryClient.Close()
+
+	// the replica bootstraps from a snapshot of the existing things
+	_ = primaryClient.UpdateTD("thing1", td.CreateTD("thing1", vocab.DeviceTypeSensor))
+	_ = primaryClient.UpdateTD("thing2", td.CreateTD("thing2", vocab.DeviceTypeSensor))
+
+	replica := dirserver.NewDirectoryServer("replica", replicaFolder, serverAddress, replicaPort, "",
+		testCerts.ServerCert, testCerts.CaCert, authenticator, authorizer)
+	replica.SetReplicaOf(primaryHostPort, testCerts.PluginCert, 100*time.Millisecond)
+	err = replica.Start()
+	require.NoError(t, err)
+	replicaClient := dirclient.NewDirClient(replicaHostPort, testCerts.CaCert)
+	err = replicaClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer replicaClient.Close()
+
+	tdList, err := replicaClient.ListTDs(0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(tdList))
+
+	// changes are applied in order
+	_ = primaryClient.UpdateTD("thing3", td.CreateTD("thing3", vocab.DeviceTypeSensor))
+	_ = primaryClient.Delete("thing1")
+	time.Sleep(500 * time.Millisecond)
+	_, err = replicaClient.GetTD("thing3")
+	assert.NoError(t, err)
+	_, err = replicaClient.GetTD("thing1")
+	assert.Error(t, err)
+
+	// writes to the replica are redirected to the primary
+	httpClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      x509.NewCertPool(),
+			Certificates: []tls.Certificate{*testCerts.PluginCert},
+		}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	httpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs.AddCert(testCerts.CaCert)
+	req, _ := http.NewRequest("DELETE", "https://"+replicaHostPort+"/things/thing2", nil)
+	resp, err := httpClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "https://"+primaryHostPort+"/things/thing2", resp.Header.Get("Location"))
+
+	// the stores that aren't replicated are served by the primary, including reads
+	for _, route := range []string{dirclient.RouteModels, dirclient.RouteTrash, dirclient.RouteAudit} {
+		req, _ = http.NewRequest("GET", "https://"+replicaHostPort+route, nil)
+		resp, err = httpClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		assert.Equal(t, "https://"+primaryHostPort+route, resp.Header.Get("Location"))
+	}
+
+	// the position is durable. After a restart the replica continues where it left off
+	replica.Stop()
+	data, err := ioutil.ReadFile(path.Join(replicaFolder, dirserver.DefaultReplicaPositionFile))
+	require.NoError(t, err)
+	position := dirserver.ReplicationPosition{}
+	err = json.Unmarshal(data, &position)
+	require.NoError(t, err)
+	assert.Equal(t, "primary", position.Primary)
+	assert.Equal(t, uint64(4), position.Seq)
+
+	_ = primaryClient.UpdateTD("thing4", td.CreateTD("thing4", vocab.DeviceTypeSensor))
+	replica = dirserver.NewDirectoryServer("replica", replicaFolder, serverAddress, replicaPort, "",
+		testCerts.ServerCert, testCerts.CaCert, authenticator, authorizer)
+	replica.SetReplicaOf(primaryHostPort, testCerts.PluginCert, 100*time.Millisecond)
+	err = replica.Start()
+	require.NoError(t, err)
+	defer replica.Stop()
+	time.Sleep(500 * time.Millisecond)
+	tdList, err = replicaClient.ListTDs(0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(tdList))
+}
+
+func TestThingChanges(t *testing.T) {
+	logrus.Infof("---TestThingChanges---")
+	const thingID5 = "thing5"
+	client := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := client.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer client.Close()
+	AddTds(client)
+
+	// the first sync gets all TDs
+	cache := dirclient.SyncCache{}
+	_, err = client.Sync(&cache)
+	require.NoError(t, err)
+	assert.NotEmpty(t, cache.SyncToken)
+	assert.NotNil(t, cache.Things[tdDefs[0].id])
+	nrThings := len(cache.Things)
+
+	// only the changes are returned on the next sync
+	_ = client.UpdateTD(thingID5, td.CreateTD(thingID5, vocab.DeviceTypeSensor))
+	_ = client.UpdateTD(thingID5, td.CreateTD(thingID5, vocab.DeviceTypeBeacon))
+	_ = client.Delete(tdDefs[0].id)
+	syncResp, err := client.GetChangesSince(cache.SyncToken, 0)
+	require.NoError(t, err)
+	assert.False(t, syncResp.Reset)
+	assert.Equal(t, 1, len(syncResp.Changed))
+	assert.NotNil(t, syncResp.Changed[thingID5])
+	assert.Equal(t, []string{tdDefs[0].id}, syncResp.Deleted)
+
+	count, err := client.Sync(&cache)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, nrThings, len(cache.Things))
+	assert.NotNil(t, cache.Things[thingID5])
+	assert.Nil(t, cache.Things[tdDefs[0].id])
+
+	// nothing changed
+	count, err = client.Sync(&cache)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// the cache is keyed by the ID of the thing in the directory, not the ID in its TD
+	const thingID6 = "thing6"
+	_ = client.UpdateTD(thingID6, td.CreateTD("otherid", vocab.DeviceTypeSensor))
+	count, err = client.Sync(&cache)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.NotNil(t, cache.Things[thingID6])
+	_ = client.Delete(thingID6)
+	_, err = client.Sync(&cache)
+	require.NoError(t, err)
+	assert.Nil(t, cache.Things[thingID6])
+
+	// a token of another directory resets the cache
+	cache.SyncToken = dirserver.EncodeSyncToken("otherdirectory", 1)
+	_, err = client.Sync(&cache)
+	require.NoError(t, err)
+	assert.Equal(t, nrThings, len(cache.Things))
+
+	// an invalid token fails
+	_, err = client.GetChangesSince("notatoken", 0)
+	assert.Error(t, err)
+
+	// users only get the IDs of deleted things they could read
+	userClient := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err = userClient.ConnectWithLoginID("user1", "pass1")
+	require.NoError(t, err)
+	defer userClient.Close()
+	syncResp, err = userClient.GetChangesSince("", 0)
+	require.NoError(t, err)
+	assert.NotEmpty(t, syncResp.Changed)
+	_ = client.Delete(thingID5)
+	syncResp, err = userClient.GetChangesSince(syncResp.SyncToken, 0)
+	require.NoError(t, err)
+	assert.False(t, syncResp.Reset)
+	assert.Equal(t, []string{thingID5}, syncResp.Deleted)
+	_ = client.UpdateTD(thingID5, td.CreateTD(thingID5, vocab.DeviceTypeSensor))
+	_ = client.Delete(thingID5)
+	syncResp, err = userClient.GetChangesSince(syncResp.SyncToken, 0)
+	require.NoError(t, err)
+	assert.False(t, syncResp.Reset)
+	assert.Empty(t, syncResp.Deleted)
+
+	// an ACL change that removes read access resets the cache of the user
+	authorizeResult = false
+	defer func() { authorizeResult = true }()
+	syncResp, err = userClient.GetChangesSince(syncResp.SyncToken, 0)
+	require.NoError(t, err)
+	assert.True(t, syncResp.Reset)
+	assert.Empty(t, syncResp.Changed)
+	assert.Empty(t, syncResp.Deleted)
+	authorizeResult = true
+
+	AddTds(client)
+}
+
+// readEvents reads the server-sent events from the response into the channel
+// Each event is a map of its fields: event, id and data.
+func readEvents(resp *http.Response, events chan map[string]string) {
+	reader := bufio.NewReader(resp.Body)
+	event := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			close(events)
+			return
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			events <- event
+			event = make(map[string]string)
+		} else if parts := strings.SplitN(line, ": ", 2); len(parts) == 2 {
+			event[parts[0]] = parts[1]
+		}
+	}
+}
+
+// nextEvent returns the next event or nil if none is received in time
+func nextEvent(events chan map[string]string) map[string]string {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(3 * time.Second):
+		return nil
+	}
+}
+
+func TestEvents(t *testing.T) {
+	logrus.Infof("---TestEvents---")
+	const thingID = "eventthing1"
+	client := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := client.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer client.Close()
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      x509.NewCertPool(),
+			Certificates: []tls.Certificate{*testCerts.PluginCert},
+		}},
+	}
+	httpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs.AddCert(testCerts.CaCert)
+	eventsURL := "https://" + serverHostPort + dirclient.RouteEvents
+
+	// unknown event types don't exist
+	resp, err := httpClient.Get(eventsURL + "/thing_unknown")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = httpClient.Get(eventsURL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	events := make(chan map[string]string, 10)
+	go readEvents(resp, events)
+
+	_ = client.UpdateTD(thingID, td.CreateTD(thingID, vocab.DeviceTypeSensor))
+	_ = client.PatchTD(thingID, map[string]interface{}{"description": "updated"})
+	_ = client.Delete(thingID)
+	created := nextEvent(events)
+	require.NotNil(t, created)
+	assert.Equal(t, dirclient.EventThingCreated, created["event"])
+	assert.Equal(t, `{"id":"`+thingID+`"}`, created["data"])
+	assert.NotEmpty(t, created["id"])
+	updated := nextEvent(events)
+	require.NotNil(t, updated)
+	assert.Equal(t, dirclient.EventThingUpdated, updated["event"])
+	deleted := nextEvent(events)
+	require.NotNil(t, deleted)
+	assert.Equal(t, dirclient.EventThingDeleted, deleted["event"])
+	resp.Body.Close()
+
+	// a client that reconnects receives the events it missed of the requested type
+	req, _ := http.NewRequest("GET", eventsURL+"/"+dirclient.EventThingDeleted, nil)
+	req.Header.Set("Last-Event-ID", created["id"])
+	resp, err = httpClient.Do(req)
+	require.NoError(t, err)
+	events = make(chan map[string]string, 10)
+	go readEvents(resp, events)
+	missed := nextEvent(events)
+	require.NotNil(t, missed)
+	assert.Equal(t, dirclient.EventThingDeleted, missed["event"])
+	assert.Equal(t, deleted["id"], missed["id"])
+	resp.Body.Close()
+
+	// all events require read access, deleted events before the thing was deleted
+	_ = client.UpdateTD(thingID, td.CreateTD(thingID, vocab.DeviceTypeSensor))
+	_ = client.Delete(thingID)
+	authorizeResult = false
+	defer func() { authorizeResult = true }()
+	userClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()}},
+	}
+	userClient.Transport.(*http.Transport).TLSClientConfig.RootCAs.AddCert(testCerts.CaCert)
+	req, _ = http.NewRequest("GET", eventsURL, nil)
+	req.SetBasicAuth("user1", "pass1")
+	req.Header.Set("Last-Event-ID", deleted["id"])
+	resp, err = userClient.Do(req)
+	require.NoError(t, err)
+	events = make(chan map[string]string, 10)
+	go readEvents(resp, events)
+	hidden := nextEvent(events)
+	assert.Nil(t, hidden)
+	resp.Body.Close()
+}
+
+func TestImportExport(t *testing.T) {
+	logrus.Infof("---TestImportExport---")
+	const thingID6 = "thing6"
+	client := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := client.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer client.Close()
+	AddTds(client)
+
+	// export in both formats
+	ndjson := bytes.Buffer{}
+	err = client.ExportTDs(dirclient.FormatNDJSON, &ndjson)
+	require.NoError(t, err)
+	exported, err := dirclient.DecodeTDs(ndjson.Bytes())
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, len(exported), len(tdDefs))
+
+	jsonArray := bytes.Buffer{}
+	err = client.ExportTDs(dirclient.FormatJSONArray, &jsonArray)
+	require.NoError(t, err)
+	exported2, err := dirclient.DecodeTDs(jsonArray.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, len(exported), len(exported2))
+
+	err = client.ExportTDs("badformat", &jsonArray)
+	assert.Error(t, err)
+
+	// a dry run doesn't apply the import
+	tdList := []td.ThingTD{
+		td.CreateTD(tdDefs[0].id, vocab.DeviceTypeSensor),
+		td.CreateTD(thingID6, vocab.DeviceTypeSensor),
+		{"title": "missing id"},
+	}
+	report, err := client.ImportTDs(tdList, dirclient.ImportModeSkip, true)
+	require.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, 3, len(report.Items))
+	assert.Equal(t, dirclient.ImportResultFailed, report.Items[2].Result)
+	_, err = client.GetTD(thingID6)
+	assert.Error(t, err)
+
+	// skip keeps the existing TD
+	report, err = client.ImportTDs(tdList[:2], dirclient.ImportModeSkip, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 1, report.Skipped)
+	td1, err := client.GetTD(tdDefs[0].id)
+	require.NoError(t, err)
+	assert.Equal(t, string(tdDefs[0].deviceType), td1["@type"])
+	props, _ := td1["properties"].(map[string]interface{})
+	assert.NotNil(t, props["name"])
+
+	// upsert merges into the existing TD
+	report, err = client.ImportTDs(tdList[:1], dirclient.ImportModeUpsert, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Updated)
+	td1, err = client.GetTD(tdDefs[0].id)
+	require.NoError(t, err)
+	assert.Equal(t, string(vocab.DeviceTypeSensor), td1["@type"])
+	props, _ = td1["properties"].(map[string]interface{})
+	assert.NotNil(t, props["name"])
+
+	// replace overwrites the existing TD
+	report, err = client.ImportTDs(tdList[:1], dirclient.ImportModeReplace, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Updated)
+	td1, err = client.GetTD(tdDefs[0].id)
+	require.NoError(t, err)
+	props, _ = td1["properties"].(map[string]interface{})
+	assert.Nil(t, props["name"])
+
+	_, err = client.ImportTDs(tdList, "badmode", false)
+	assert.Error(t, err)
+
+	// the paths of the directory API can't be used as thing IDs
+	report, err = client.ImportTDs([]td.ThingTD{td.CreateTD("changes", vocab.DeviceTypeSensor)},
+		dirclient.ImportModeUpsert, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Failed)
+	err = client.UpdateTD("export", td.CreateTD("export", vocab.DeviceTypeSensor))
+	assert.Error(t, err)
+
+	client.Delete(thingID6)
+	AddTds(client)
+}
+
+func TestBatch(t *testing.T) {
+	logrus.Infof("---TestBatch---")
+	const thingID7 = "thing7"
+	const thingID8 = "thing8"
+	client := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := client.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer client.Close()
+	AddTds(client)
+	changes, err := client.GetChanges(0, 1)
+	require.NoError(t, err)
+	lastSeq := changes.Last
+
+	// an atomic batch with a failed operation is not applied
+	ops := []dirclient.BatchOperation{
+		{Op: dirclient.BatchOpPut, ThingID: thingID7, TD: td.CreateTD(thingID7, vocab.DeviceTypeSensor)},
+		{Op: dirclient.BatchOpPatch, ThingID: tdDefs[0].id, TD: td.ThingTD{"title": "patched"}},
+		{Op: dirclient.BatchOpDelete, ThingID: tdDefs[1].id},
+		{Op: dirclient.BatchOpPatch, ThingID: thingID8, TD: td.ThingTD{"title": "unknown thing"}},
+	}
+	batchResp, err := client.WriteBatch(ops, true)
+	require.NoError(t, err)
+	assert.False(t, batchResp.Applied)
+	assert.Equal(t, 1, batchResp.Failed)
+	assert.Equal(t, len(ops), len(batchResp.Results))
+	assert.Equal(t, dirclient.BatchResultFailed, batchResp.Results[3].Result)
+	_, err = client.GetTD(thingID7)
+	assert.Error(t, err)
+	_, err = client.GetTD(tdDefs[1].id)
+	assert.NoError(t, err)
+	changes, _ = client.GetChanges(lastSeq, 0)
+	assert.Equal(t, 0, len(changes.Changes))
+
+	// without atomic the successful operations are applied
+	batchResp, err = client.WriteBatch(ops, false)
+	require.NoError(t, err)
+	assert.True(t, batchResp.Applied)
+	assert.Equal(t, 1, batchResp.Failed)
+	assert.Equal(t, dirclient.BatchResultCreated, batchResp.Results[0].Result)
+	assert.Equal(t, dirclient.BatchResultUpdated, batchResp.Results[1].Result)
+	assert.Equal(t, dirclient.BatchResultDeleted, batchResp.Results[2].Result)
+	_, err = client.GetTD(thingID7)
+	assert.NoError(t, err)
+	td1, err := client.GetTD(tdDefs[0].id)
+	require.NoError(t, err)
+	assert.Equal(t, "patched", td1["title"])
+	_, err = client.GetTD(tdDefs[1].id)
+	assert.Error(t, err)
+	// each change is recorded in the change log
+	changes, _ = client.GetChanges(lastSeq, 0)
+	assert.Equal(t, 3, len(changes.Changes))
+
+	// an atomic batch without failures is applied
+	batchResp, err = client.WriteBatch(ops[:1], true)
+	require.NoError(t, err)
+	assert.True(t, batchResp.Applied)
+	assert.Equal(t, dirclient.BatchResultUpdated, batchResp.Results[0].Result)
+
+	// the paths of the directory API can't be used as thing IDs
+	batchResp, err = client.WriteBatch([]dirclient.BatchOperation{
+		{Op: dirclient.BatchOpPut, ThingID: "batch", TD: td.CreateTD("batch", vocab.DeviceTypeSensor)}}, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, batchResp.Failed)
+
+	client.Delete(thingID7)
+	AddTds(client)
+}
+
+func TestBulkByQuery(t *testing.T) {
+	logrus.Infof("---TestBulkByQuery---")
+	const query = `$[?(@['@type']=='sensor')]`
+	client := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := client.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer client.Close()
+	AddTds(client)
+	// things are matched by their key in the store, not by the ID in their TD
+	const thingID7 = "thing7"
+	err = client.UpdateTD(thingID7, td.CreateTD("otherid7", vocab.DeviceTypeSensor))
+	require.NoError(t, err)
+	changes, err := client.GetChanges(0, 1)
+	require.NoError(t, err)
+	lastSeq := changes.Last
+
+	// a dry run returns the matching things without changing them
+	bulkResp, err := client.PatchByQuery(query, td.ThingTD{"title": "bulk patched"}, true)
+	require.NoError(t, err)
+	assert.True(t, bulkResp.DryRun)
+	assert.GreaterOrEqual(t, bulkResp.Matched, 2)
+	assert.Contains(t, bulkResp.ThingIDs, tdDefs[1].id)
+	assert.Contains(t, bulkResp.ThingIDs, tdDefs[2].id)
+	assert.NotContains(t, bulkResp.ThingIDs, tdDefs[0].id)
+	assert.Contains(t, bulkResp.ThingIDs, thingID7)
+	assert.NotContains(t, bulkResp.ThingIDs, "otherid7")
+	nrMatched := bulkResp.Matched
+	td2, err := client.GetTD(tdDefs[1].id)
+	require.NoError(t, err)
+	assert.NotEqual(t, "bulk patched", td2["title"])
+
+	// write authorization is required for each matching thing
+	authorizeResult = false
+	_, err = client.DeleteByQuery(query, false)
+	authorizeResult = true
+	assert.Error(t, err)
+
+	// patch all matching things
+	bulkResp, err = client.PatchByQuery(query, td.ThingTD{"title": "bulk patched"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, nrMatched, bulkResp.Matched)
+	td2, err = client.GetTD(tdDefs[2].id)
+	require.NoError(t, err)
+	assert.Equal(t, "bulk patched", td2["title"])
+
+	// delete all matching things
+	bulkResp, err = client.DeleteByQuery(query, false)
+	require.NoError(t, err)
+	assert.Equal(t, nrMatched, bulkResp.Matched)
+	_, err = client.GetTD(tdDefs[1].id)
+	assert.Error(t, err)
+	_, err = client.GetTD(tdDefs[0].id)
+	assert.NoError(t, err)
+	_, err = client.GetTD(thingID7)
+	assert.Error(t, err)
+
+	// each change is recorded in the change log
+	changes, _ = client.GetChanges(lastSeq, 0)
+	assert.Equal(t, 2*nrMatched, len(changes.Changes))
+
+	// a query is required and must be valid
+	_, err = client.DeleteByQuery("", false)
+	assert.Error(t, err)
+	_, err = client.DeleteByQuery("$[?(bad", true)
+	assert.Error(t, err)
+
+	AddTds(client)
+}
+
+func TestTrash(t *testing.T) {
+	logrus.Infof("---TestTrash---")
+	client := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := client.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer client.Close()
+	AddTds(client)
+	thingID1 := tdDefs[0].id
+	thingID2 := tdDefs[1].id
+
+	// deleted TDs move to the trash
+	err = client.Delete(thingID1)
+	require.NoError(t, err)
+	err = client.Delete(thingID2)
+	require.NoError(t, err)
+	entries, err := client.ListTrash(0, 0)
+	require.NoError(t, err)
+	var entry1 *dirclient.TrashEntry
+	for i, entry := range entries {
+		if entry.ThingID == thingID1 {
+			entry1 = &entries[i]
+		}
+	}
+	require.NotNil(t, entry1)
+	assert.Equal(t, thingID1, td.GetID(entry1.TD))
+	assert.NotEmpty(t, entry1.Deleted)
+
+	// restore brings the TD back
+	err = client.RestoreTD(thingID1)
+	require.NoError(t, err)
+	td1, err := client.GetTD(thingID1)
+	require.NoError(t, err)
+	props, _ := td1["properties"].(map[string]interface{})
+	assert.NotNil(t, props["name"])
+	// the TD is no longer in the trash and exists so it can't be restored again
+	err = client.RestoreTD(thingID1)
+	assert.Error(t, err)
+	err = client.PurgeTD(thingID1)
+	assert.Error(t, err)
+
+	// a TD can't be restored over an existing TD
+	err = client.Delete(thingID1)
+	require.NoError(t, err)
+	AddTds(client)
+	err = client.RestoreTD(thingID1)
+	assert.Error(t, err)
+
+	// purged TDs can't be restored
+	err = client.PurgeTD(thingID2)
+	require.NoError(t, err)
+	err = client.RestoreTD(thingID2)
+	assert.Error(t, err)
+
+	// empty the trash
+	err = client.EmptyTrash()
+	require.NoError(t, err)
+	entries, err = client.ListTrash(0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entries))
+
+	// expired TDs are purged
+	directoryServer.SetTrashRetention(time.Millisecond)
+	err = client.Delete(thingID1)
+	require.NoError(t, err)
+	time.Sleep(time.Second)
+	entries, err = client.ListTrash(0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entries))
+	directoryServer.SetTrashRetention(dirserver.DefaultTrashRetention)
+
+	AddTds(client)
+}
+
+func TestAuditLog(t *testing.T) {
+	logrus.Infof("---TestAuditLog---")
+	logPath := path.Join(os.TempDir(), "test-audit.ndjson")
+	for _, suffix := range []string{"", ".1", ".2", ".3"} {
+		os.Remove(logPath + suffix)
+	}
+	auditLog := dirserver.NewAuditLog(logPath)
+	auditLog.SetRotation(1000, 2)
+	err := auditLog.Open()
+	require.NoError(t, err)
+
+	// write enough records to rotate more than twice
+	for i := 0; i < 30; i++ {
+		err = auditLog.Append(dirclient.AuditRecord{
+			UserID: fmt.Sprintf("user%d", i%2), ThingID: fmt.Sprintf("thing%d", i), Method: "PUT", Result: 201})
+		require.NoError(t, err)
+	}
+	assert.FileExists(t, logPath+".2")
+	assert.NoFileExists(t, logPath+".3")
+
+	// newest records are returned first
+	records, err := auditLog.Query(dirclient.AuditFilter{}, 0, 3)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(records))
+	assert.Equal(t, "thing29", records[0].ThingID)
+	assert.Equal(t, "thing27", records[2].ThingID)
+	records, err = auditLog.Query(dirclient.AuditFilter{UserID: "user0"}, 1, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, "thing26", records[0].ThingID)
+	records, err = auditLog.Query(dirclient.AuditFilter{Method: "DELETE"}, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(records))
+	records, err = auditLog.Query(dirclient.AuditFilter{Until: "2000-01-01T00:00:00Z"}, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(records))
+	_, err = auditLog.Query(dirclient.AuditFilter{Since: "yesterday"}, 0, 0)
+	assert.Error(t, err)
+
+	auditLog.Close()
+	err = auditLog.Append(dirclient.AuditRecord{})
+	assert.Error(t, err)
+}
+
+func TestAuditThingWrites(t *testing.T) {
+	logrus.Infof("---TestAuditThingWrites---")
+	const thingID9 = "thing9"
+	client := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := client.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer client.Close()
+
+	err = client.UpdateTD(thingID9, td.CreateTD(thingID9, vocab.DeviceTypeSensor))
+	require.NoError(t, err)
+	err = client.PatchTD(thingID9, td.ThingTD{"title": "audited"})
+	require.NoError(t, err)
+	err = client.Delete(thingID9)
+	require.NoError(t, err)
+	err = client.Delete(thingID9)
+	assert.Error(t, err)
+
+	// read the records from the audit log of the test server
+	auditLog := dirserver.NewAuditLog(path.Join(storeFolder, dirserver.DefaultAuditLogFile))
+	records, err := auditLog.Query(dirclient.AuditFilter{ThingID: thingID9}, 0, 4)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(records))
+	// newest first
+	assert.Equal(t, "DELETE", records[0].Method)
+	assert.Equal(t, http.StatusNotFound, records[0].Result)
+	assert.Empty(t, records[0].RevBefore)
+	assert.Equal(t, http.StatusOK, records[1].Result)
+	assert.Empty(t, records[1].RevAfter)
+	assert.Equal(t, "PATCH", records[2].Method)
+	assert.NotEqual(t, records[2].RevBefore, records[2].RevAfter)
+	assert.Equal(t, records[2].RevAfter, records[1].RevBefore)
+	assert.Equal(t, "POST", records[3].Method)
+	assert.Equal(t, http.StatusCreated, records[3].Result)
+	assert.Empty(t, records[3].RevBefore)
+	assert.Equal(t, records[3].RevAfter, records[2].RevBefore)
+	assert.NotEmpty(t, records[3].ClientAddr)
+
+	// restoring and purging from the trash are store writes too
+	err = client.RestoreTD(thingID9)
+	require.NoError(t, err)
+	err = client.Delete(thingID9)
+	require.NoError(t, err)
+	err = client.PurgeTD(thingID9)
+	require.NoError(t, err)
+	records, err = auditLog.Query(dirclient.AuditFilter{ThingID: thingID9}, 0, 3)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(records))
+	assert.Equal(t, "DELETE", records[0].Method)
+	assert.Equal(t, records[1].RevBefore, records[0].RevBefore)
+	assert.Empty(t, records[0].RevAfter)
+	assert.Equal(t, "POST", records[2].Method)
+	assert.Empty(t, records[2].RevBefore)
+	assert.Equal(t, records[1].RevBefore, records[2].RevAfter)
+
+	// created and imported TDs are audited
+	createdID, err := client.CreateTD(td.ThingTD{"title": "created"})
+	require.NoError(t, err)
+	records, err = auditLog.Query(dirclient.AuditFilter{ThingID: createdID}, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, http.StatusCreated, records[0].Result)
+	assert.NotEmpty(t, records[0].RevAfter)
+	_, err = client.ImportTDs([]td.ThingTD{td.CreateTD(thingID9, vocab.DeviceTypeSensor)},
+		dirclient.ImportModeUpsert, false)
+	require.NoError(t, err)
+	records, err = auditLog.Query(dirclient.AuditFilter{ThingID: thingID9}, 0, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, http.StatusOK, records[0].Result)
+	assert.Empty(t, records[0].RevBefore)
+	assert.NotEmpty(t, records[0].RevAfter)
+	client.Delete(thingID9)
+	client.Delete(createdID)
+
+	// the audit API is only for administrators
+	_, err = client.GetAuditRecords(dirclient.AuditFilter{ThingID: thingID9}, 0, 0)
+	assert.Error(t, err)
+}
+
+// groupAcl for testing of group roles of type 'dirserver.IGroupAcl'
+type testGroupAcl struct {
+	groups map[string][]string          // groups of users and things
+	roles  map[string]map[string]string // role of a user by group
+}
+
+func (acl *testGroupAcl) GetGroups(clientID string) []string {
+	return acl.groups[clientID]
+}
+
+func (acl *testGroupAcl) GetRole(clientID string, groupIDs []string) string {
+	role := dirserver.RoleNone
+	for _, groupID := range groupIDs {
+		if groupRole, found := acl.roles[clientID][groupID]; found {
+			role = groupRole
+		}
+	}
+	return role
+}
+
+func TestGroupAclFilter(t *testing.T) {
+	logrus.Infof("---TestGroupAclFilter---")
+	groupAcl := &testGroupAcl{
+		groups: map[string][]string{
+			"user1":  {"group1", "group2", "group3"},
+			"thing1": {"group1"},
+			"thing2": {"group2"},
+			"thing3": {"group1", "group3"},
+			"thing4": {"group4"},
+			"thing5": {"group5"},
+		},
+		roles: map[string]map[string]string{
+			"user1": {"group1": dirserver.RoleViewer, "group2": dirserver.RoleEditor, "group3": dirserver.RoleManager},
+		},
+	}
+	authorizerCalls := 0
+	countingAuthorizer := func(userID string, certOU string, thingID string, writing bool, writeType string) bool {
+		authorizerCalls++
+		return true
+	}
+	aclFilter := dirserver.NewGroupAclFilter("user1", certsetup.OUNone, countingAuthorizer, groupAcl)
+
+	// viewer can only read
+	assert.True(t, aclFilter.Authorize("thing1", dirserver.RightRead))
+	assert.False(t, aclFilter.Authorize("thing1", dirserver.RightPatch))
+	// editor can read and patch
+	assert.True(t, aclFilter.Authorize("thing2", dirserver.RightPatch))
+	assert.False(t, aclFilter.Authorize("thing2", dirserver.RightReplace))
+	// the highest role of the user in the thing's groups applies
+	assert.True(t, aclFilter.Authorize("thing3", dirserver.RightDelete))
+	// not a member of the thing's group
+	assert.False(t, aclFilter.FilterThing("thing4"))
+	assert.Equal(t, 0, authorizerCalls)
+
+	// other roles are left to the authorizer and the decision is cached
+	groupAcl.groups["user1"] = append(groupAcl.groups["user1"], "group5")
+	groupAcl.roles["user1"]["group5"] = "thing"
+	aclFilter = dirserver.NewGroupAclFilter("user1", certsetup.OUNone, countingAuthorizer, groupAcl)
+	assert.True(t, aclFilter.FilterThing("thing5"))
+	assert.True(t, aclFilter.FilterThing("thing5"))
+	assert.Equal(t, 1, authorizerCalls)
+
+	// admin and plugin certificates have full access
+	aclFilter = dirserver.NewGroupAclFilter("admin", certsetup.OUAdmin, countingAuthorizer, groupAcl)
+	assert.True(t, aclFilter.Authorize("thing4", dirserver.RightDelete))
+	aclFilter = dirserver.NewGroupAclFilter("plugin", certsetup.OUPlugin, countingAuthorizer, groupAcl)
+	assert.True(t, aclFilter.Authorize("thing4", dirserver.RightReplace))
+
+	// without group ACL the authorizer decides
+	aclFilter = dirserver.NewAclFilter("user1", certsetup.OUNone, countingAuthorizer)
+	assert.True(t, aclFilter.Authorize("thing4", dirserver.RightPatch))
+	assert.Equal(t, 2, authorizerCalls)
+	aclFilter = dirserver.NewAclFilter("", certsetup.OUNone, countingAuthorizer)
+	assert.False(t, aclFilter.FilterThing("thing1"))
+
+	// without authorizer other roles and users without a group ACL are denied
+	aclFilter = dirserver.NewGroupAclFilter("user1", certsetup.OUNone, nil, groupAcl)
+	assert.False(t, aclFilter.FilterThing("thing5"))
+	assert.False(t, aclFilter.Authorize("thing5", dirserver.RightPatch))
+	assert.True(t, aclFilter.FilterThing("thing1"))
+	aclFilter = dirserver.NewAclFilter("user1", certsetup.OUNone, nil)
+	assert.False(t, aclFilter.FilterThing("thing4"))
+	assert.False(t, aclFilter.Authorize("thing4", dirserver.RightPatch))
+}
+
+func TestPublisherOwnership(t *testing.T) {
+	logrus.Infof("---TestPublisherOwnership---")
+	const thingID10 = "thing10"
+	client := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := client.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer client.Close()
+	directoryServer.SetVerifyPublisher(true)
+	defer directoryServer.SetVerifyPublisher(false)
+
+	// the first publisher becomes the owner
+	thingTD := td.CreateTD(thingID10, vocab.DeviceTypeSensor)
+	err = client.UpdateTDAsPublisher(thingID10, thingTD, "publisher1")
+	require.NoError(t, err)
+	owner, err := client.GetOwner(thingID10)
+	require.NoError(t, err)
+	assert.Equal(t, "publisher1", owner.Owner)
+	assert.NotEmpty(t, owner.Since)
+
+	// other publishers can't update the TD
+	err = client.UpdateTDAsPublisher(thingID10, thingTD, "publisher2")
+	assert.Error(t, err)
+	err = client.UpdateTDAsPublisher(thingID10, thingTD, "publisher1")
+	assert.NoError(t, err)
+
+	// only administrators can transfer ownership
+	err = client.SetOwner(thingID10, "publisher2")
+	assert.Error(t, err)
+
+	// the owner is kept in the trash
+	err = client.Delete(thingID10)
+	require.NoError(t, err)
+	owner, err = client.GetOwner(thingID10)
+	require.NoError(t, err)
+	assert.Empty(t, owner.Owner)
+	err = client.RestoreTD(thingID10)
+	require.NoError(t, err)
+	owner, err = client.GetOwner(thingID10)
+	require.NoError(t, err)
+	assert.Equal(t, "publisher1", owner.Owner)
+	client.Delete(thingID10)
+	client.PurgeTD(thingID10)
+
+	// users are publishers of their own TDs
+	getOwner := func(thingID string) string { return "user1" }
+	aclFilter := dirserver.NewAclFilter("user2", certsetup.OUNone, authorizer)
+	aclFilter.VerifyOwner("user1", getOwner)
+	assert.True(t, aclFilter.Authorize(thingID10, dirserver.RightRead))
+	assert.False(t, aclFilter.Authorize(thingID10, dirserver.RightPatch))
+	aclFilter = dirserver.NewAclFilter("user1", certsetup.OUNone, authorizer)
+	aclFilter.VerifyOwner("", getOwner)
+	assert.True(t, aclFilter.Authorize(thingID10, dirserver.RightDelete))
+	aclFilter = dirserver.NewAclFilter("admin", certsetup.OUAdmin, authorizer)
+	aclFilter.VerifyOwner("", getOwner)
+	assert.True(t, aclFilter.Authorize(thingID10, dirserver.RightReplace))
+}
+
+func TestRedaction(t *testing.T) {
+	logrus.Infof("---TestRedaction---")
+	const thingID11 = "thing11"
+	thingTD := td.CreateTD(thingID11, vocab.DeviceTypeSensor)
+	thingTD["securityDefinitions"] = map[string]interface{}{"basic_sc": map[string]interface{}{"scheme": "basic"}}
+	thingTD["properties"] = map[string]interface{}{
+		"name":     map[string]interface{}{"title": "name", "forms": []interface{}{map[string]interface{}{"href": "/internal"}}},
+		"password": map[string]interface{}{"title": "password", "wost:adminOnly": true},
+	}
+	thingTD["actions"] = map[string]interface{}{"reboot": map[string]interface{}{"title": "reboot"}}
+
+	// invalid rules
+	_, err := dirserver.NewRedactor([]dirserver.RedactionRule{{Pointer: "securityDefinitions"}})
+	assert.Error(t, err)
+	_, err = dirserver.NewRedactor([]dirserver.RedactionRule{{Pointer: "/a", Affordance: "b"}})
+	assert.Error(t, err)
+
+	rules := []dirserver.RedactionRule{
+		{Pointer: "/securityDefinitions", Roles: []string{dirserver.RoleManager}},
+		{Pointer: "/properties/*/forms"},
+		{Affordance: "reboot", CertOUs: []string{certsetup.OUAdmin}},
+		{Annotation: "wost:adminOnly"},
+	}
+	redactor, err := dirserver.NewRedactor(rules)
+	require.NoError(t, err)
+	redacted := redactor.Redact(thingTD, dirserver.RoleViewer, certsetup.OUNone)
+	assert.Nil(t, redacted["securityDefinitions"])
+	props := redacted["properties"].(map[string]interface{})
+	assert.Nil(t, props["name"].(map[string]interface{})["forms"])
+	assert.Nil(t, props["password"])
+	assert.Nil(t, redacted["actions"].(map[string]interface{})["reboot"])
+	// the original TD is unchanged
+	assert.NotNil(t, thingTD["securityDefinitions"])
+	assert.NotNil(t, thingTD["actions"].(map[string]interface{})["reboot"])
+	// exempt roles and OUs see the fields
+	redacted = redactor.Redact(thingTD, dirserver.RoleManager, certsetup.OUAdmin)
+	assert.NotNil(t, redacted["securityDefinitions"])
+	assert.NotNil(t, redacted["actions"].(map[string]interface{})["reboot"])
+
+	// a viewer gets the redacted TD from the server, an editor the full TD
+	pluginClient := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err = pluginClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer pluginClient.Close()
+	err = pluginClient.UpdateTD(thingID11, thingTD)
+	require.NoError(t, err)
+	defer pluginClient.Delete(thingID11)
+
+	err = directoryServer.SetRedactionRules(rules)
+	require.NoError(t, err)
+	defer directoryServer.SetRedactionRules(nil)
+	directoryServer.SetGroupAcl(&testGroupAcl{
+		groups: map[string][]string{"viewer1": {"group1"}, "editor1": {"group1"}, thingID11: {"group1"}},
+		roles: map[string]map[string]string{
+			"viewer1": {"group1": dirserver.RoleViewer}, "editor1": {"group1": dirserver.RoleEditor}},
+	})
+	defer directoryServer.SetGroupAcl(nil)
+	authenticateResult = true
+
+	viewerClient := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err = viewerClient.ConnectWithLoginID("viewer1", "pass1")
+	require.NoError(t, err)
+	defer viewerClient.Close()
+	viewerTD, err := viewerClient.GetTD(thingID11)
+	require.NoError(t, err)
+	assert.Nil(t, viewerTD["securityDefinitions"])
+	assert.Nil(t, viewerTD["actions"].(map[string]interface{})["reboot"])
+	tdList, err := viewerClient.ListTDs(0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tdList))
+	assert.Nil(t, tdList[0]["securityDefinitions"])
+	// redacted fields can't be queried
+	tdList, err = viewerClient.QueryTDs("$..securityDefinitions", 0, 0)
+	require.NoError(t, err)
+	assert.Empty(t, tdList)
+
+	editorClient := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err = editorClient.ConnectWithLoginID("editor1", "pass1")
+	require.NoError(t, err)
+	defer editorClient.Close()
+	editorTD, err := editorClient.GetTD(thingID11)
+	require.NoError(t, err)
+	assert.NotNil(t, editorTD["securityDefinitions"])
+	assert.NotNil(t, editorTD["actions"].(map[string]interface{})["reboot"])
+
+	// the change feed and the export are redacted for the viewer
+	syncResp, err := viewerClient.GetChangesSince("", 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(syncResp.Changed))
+	assert.Nil(t, syncResp.Changed[thingID11]["securityDefinitions"])
+	thingTD["title"] = "changed"
+	err = pluginClient.UpdateTD(thingID11, thingTD)
+	require.NoError(t, err)
+	syncResp, err = viewerClient.GetChangesSince(syncResp.SyncToken, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(syncResp.Changed))
+	assert.Equal(t, "changed", syncResp.Changed[thingID11]["title"])
+	assert.Nil(t, syncResp.Changed[thingID11]["securityDefinitions"])
+	assert.Nil(t, syncResp.Changed[thingID11]["actions"].(map[string]interface{})["reboot"])
+	exported := &bytes.Buffer{}
+	err = viewerClient.ExportTDs(dirclient.FormatNDJSON, exported)
+	require.NoError(t, err)
+	assert.Contains(t, exported.String(), thingID11)
+	assert.NotContains(t, exported.String(), "basic_sc")
+	assert.NotContains(t, exported.String(), "reboot")
+
+	// deleted TDs in the trash are redacted as well
+	err = pluginClient.Delete(thingID11)
+	require.NoError(t, err)
+	defer pluginClient.PurgeTD(thingID11)
+	trash, err := viewerClient.ListTrash(0, 0)
+	require.NoError(t, err)
+	found := false
+	for _, entry := range trash {
+		if entry.ThingID == thingID11 {
+			found = true
+			assert.Nil(t, entry.TD["securityDefinitions"])
+			assert.NotNil(t, entry.TD["properties"])
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestAnonymousRead(t *testing.T) {
+	logrus.Infof("---TestAnonymousRead---")
+	anonFolder, _ := ioutil.TempDir("", "thingdir-anon")
+	defer os.RemoveAll(anonFolder)
+	anonPort := uint(testDirectoryPort + 6)
+	anonHostPort := fmt.Sprintf("%s:%d", serverAddress, anonPort)
+
+	anonServer := dirserver.NewDirectoryServer("anonymous", anonFolder, serverAddress, anonPort, "",
+		testCerts.ServerCert, testCerts.CaCert, authenticator, authorizer)
+	anonServer.SetAnonymousRead(true)
+	err := anonServer.Start()
+	require.NoError(t, err)
+	defer anonServer.Stop()
+
+	// one TD of each visibility
+	pluginClient := dirclient.NewDirClient(anonHostPort, testCerts.CaCert)
+	err = pluginClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer pluginClient.Close()
+	for _, visibility := range []string{
+		dirclient.VisibilityPrivate, dirclient.VisibilityAuthenticated, dirclient.VisibilityPublic} {
+		thingTD := td.CreateTD(visibility, vocab.DeviceTypeSensor)
+		thingTD[dirclient.VisibilityAnnotation] = visibility
+		err = pluginClient.UpdateTD(visibility, thingTD)
+		require.NoError(t, err)
+	}
+	errors := dirserver.ValidateTD("thing1", td.ThingTD{
+		"id": "thing1", "title": "thing1", dirclient.VisibilityAnnotation: "everyone"}, nil)
+	assert.NotEmpty(t, errors)
+
+	// anonymous clients only read public TDs and can't write
+	httpClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()}},
+	}
+	httpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs.AddCert(testCerts.CaCert)
+	anonRequest := func(method string, path string) (int, []byte) {
+		req, _ := http.NewRequest(method, "https://"+anonHostPort+path, nil)
+		resp, err := httpClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+	status, body := anonRequest("GET", "/things")
+	assert.Equal(t, http.StatusOK, status)
+	var tdList []td.ThingTD
+	err = json.Unmarshal(body, &tdList)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tdList))
+	assert.Equal(t, dirclient.VisibilityPublic, tdList[0]["id"])
+	status, _ = anonRequest("GET", "/things/"+dirclient.VisibilityPublic)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = anonRequest("GET", "/things/"+dirclient.VisibilityAuthenticated)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = anonRequest("DELETE", "/things/"+dirclient.VisibilityPublic)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = anonRequest("GET", dirclient.RouteTrash)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// authenticated users without authorization read the authenticated and public TDs
+	authenticateResult = true
+	authorizeResult = false
+	defer func() { authorizeResult = true }()
+	userClient := dirclient.NewDirClient(anonHostPort, testCerts.CaCert)
+	err = userClient.ConnectWithLoginID("user1", "pass1")
+	require.NoError(t, err)
+	defer userClient.Close()
+	tdList, err = userClient.ListTDs(0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(tdList))
+	_, err = userClient.GetTD(dirclient.VisibilityPrivate)
+	assert.Error(t, err)
+
+	// a thing that is no longer visible to the user is deleted from the user's cache
+	syncResp, err := userClient.GetChangesSince("", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(syncResp.Changed))
+	thingTD := td.CreateTD(dirclient.VisibilityAuthenticated, vocab.DeviceTypeSensor)
+	err = pluginClient.UpdateTD(dirclient.VisibilityAuthenticated, thingTD)
+	require.NoError(t, err)
+	syncResp, err = userClient.GetChangesSince(syncResp.SyncToken, 0)
+	require.NoError(t, err)
+	assert.False(t, syncResp.Reset)
+	assert.Empty(t, syncResp.Changed)
+	assert.Equal(t, []string{dirclient.VisibilityAuthenticated}, syncResp.Deleted)
+	authenticateResult = false
+	_, err = userClient.GetTD(dirclient.VisibilityPublic)
+	assert.Error(t, err)
+	authenticateResult = true
+}
+
+func TestTokenAuth(t *testing.T) {
+	logrus.Infof("---TestTokenAuth---")
+	tokenFolder, _ := ioutil.TempDir("", "thingdir-token")
+	defer os.RemoveAll(tokenFolder)
+	tokenPort := uint(testDirectoryPort + 7)
+	tokenHostPort := fmt.Sprintf("%s:%d", serverAddress, tokenPort)
+
+	// key set with the public key of the issuer
+	issuerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keySet := map[string]interface{}{"keys": []interface{}{map[string]interface{}{
+		"kty": "RSA",
+		"kid": "key1",
+		"n":   base64.RawURLEncoding.EncodeToString(issuerKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(issuerKey.E)).Bytes()),
+	}}}
+	keySetPath := path.Join(tokenFolder, "jwks.json")
+	keySetData, _ := json.Marshal(keySet)
+	err = ioutil.WriteFile(keySetPath, keySetData, 0600)
+	require.NoError(t, err)
+	createToken := func(claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key1", "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		hash := sha256.Sum256([]byte(signed))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, issuerKey, crypto.SHA256, hash[:])
+		require.NoError(t, err)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+	validClaims := func(scope string) map[string]interface{} {
+		return map[string]interface{}{
+			"sub":   "user1",
+			"iss":   "https://auth.local",
+			"aud":   []string{"thingdir"},
+			"scope": scope,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	tokenServer := dirserver.NewDirectoryServer("token", tokenFolder, serverAddress, tokenPort, "",
+		testCerts.ServerCert, testCerts.CaCert, authenticator, authorizer)
+	err = tokenServer.SetTokenAuth(dirserver.TokenAuthConfig{
+		KeySetPath: keySetPath, Issuer: "https://auth.local", Audience: "thingdir"})
+	require.NoError(t, err)
+	err = tokenServer.Start()
+	require.NoError(t, err)
+	defer tokenServer.Stop()
+	err = tokenServer.SetTokenAuth(dirserver.TokenAuthConfig{KeySetPath: path.Join(tokenFolder, "missing.json")})
+	assert.Error(t, err)
+	// the issuer and audience are required
+	_, err = dirserver.NewTokenVerifier(dirserver.TokenAuthConfig{KeySetPath: keySetPath, Issuer: "https://auth.local"})
+	assert.Error(t, err)
+	_, err = dirserver.NewTokenVerifier(dirserver.TokenAuthConfig{KeySetPath: keySetPath, Audience: "thingdir"})
+	assert.Error(t, err)
+
+	// the write scope allows writing and reading
+	writeClient := dirclient.NewDirClient(tokenHostPort, testCerts.CaCert)
+	err = writeClient.ConnectWithToken(createToken(validClaims(dirserver.DefaultTokenWriteScope)), nil)
+	require.NoError(t, err)
+	defer writeClient.Close()
+	err = writeClient.UpdateTD("thing1", td.CreateTD("thing1", vocab.DeviceTypeSensor))
+	require.NoError(t, err)
+	_, err = writeClient.GetTD("thing1")
+	assert.NoError(t, err)
+
+	// the read scope only allows reading
+	readClient := dirclient.NewDirClient(tokenHostPort, testCerts.CaCert)
+	err = readClient.ConnectWithToken(createToken(validClaims(dirserver.DefaultTokenReadScope)), nil)
+	require.NoError(t, err)
+	defer readClient.Close()
+	tdList, err := readClient.ListTDs(0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tdList))
+	err = readClient.Delete("thing1")
+	assert.Error(t, err)
+
+	// expired tokens and tokens from other issuers or for other audiences are rejected
+	expiredClaims := validClaims(dirserver.DefaultTokenReadScope)
+	expiredClaims["exp"] = time.Now().Add(-time.Hour).Unix()
+	issuerClaims := validClaims(dirserver.DefaultTokenReadScope)
+	issuerClaims["iss"] = "https://other.local"
+	audienceClaims := validClaims(dirserver.DefaultTokenReadScope)
+	audienceClaims["aud"] = "other"
+	for _, claims := range []map[string]interface{}{expiredClaims, issuerClaims, audienceClaims} {
+		badClient := dirclient.NewDirClient(tokenHostPort, testCerts.CaCert)
+		err = badClient.ConnectWithToken(createToken(claims), nil)
+		require.NoError(t, err)
+		_, err = badClient.GetTD("thing1")
+		assert.Error(t, err)
+		badClient.Close()
+	}
+
+	// the role claim limits a write token to reading
+	err = writeClient.UpdateTD("thing2", td.CreateTD("thing2", vocab.DeviceTypeSensor))
+	require.NoError(t, err)
+	tokenServer.SetGroupAcl(&testGroupAcl{
+		groups: map[string][]string{"user1": {"group1"}, "thing1": {"group1"}, "thing2": {"group2"}},
+		roles:  map[string]map[string]string{"user1": {"group1": dirserver.RoleViewer}},
+	})
+	authorizeResult = false
+	defer func() { authorizeResult = true }()
+	viewerClaims := validClaims(dirserver.DefaultTokenWriteScope)
+	viewerClaims["role"] = dirserver.RoleViewer
+	viewerClient := dirclient.NewDirClient(tokenHostPort, testCerts.CaCert)
+	err = viewerClient.ConnectWithToken(createToken(viewerClaims), nil)
+	require.NoError(t, err)
+	defer viewerClient.Close()
+	_, err = viewerClient.GetTD("thing1")
+	assert.NoError(t, err)
+	err = viewerClient.PatchTD("thing1", td.ThingTD{"title": "viewer"})
+	assert.Error(t, err)
+
+	// the role of a token without groups only applies to the groups of the user
+	managerClaims := validClaims(dirserver.DefaultTokenWriteScope)
+	managerClaims["role"] = dirserver.RoleManager
+	managerClient := dirclient.NewDirClient(tokenHostPort, testCerts.CaCert)
+	err = managerClient.ConnectWithToken(createToken(managerClaims), nil)
+	require.NoError(t, err)
+	defer managerClient.Close()
+	err = managerClient.PatchTD("thing1", td.ThingTD{"title": "manager"})
+	assert.NoError(t, err)
+	_, err = managerClient.GetTD("thing2")
+	assert.Error(t, err)
+	err = managerClient.Delete("thing2")
+	assert.Error(t, err)
+	tokenServer.SetGroupAcl(nil)
+	authorizeResult = true
+
+	// a rejected token is refreshed and the request retried
+	refreshCount := 0
+	refreshClient := dirclient.NewDirClient(tokenHostPort, testCerts.CaCert)
+	err = refreshClient.ConnectWithToken(createToken(expiredClaims), func() (string, error) {
+		refreshCount++
+		return createToken(validClaims(dirserver.DefaultTokenReadScope)), nil
+	})
+	require.NoError(t, err)
+	defer refreshClient.Close()
+	_, err = refreshClient.GetTD("thing1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, refreshCount)
+}
+
+func TestAPIKeys(t *testing.T) {
+	logrus.Infof("---TestAPIKeys---")
+	keyFolder, _ := ioutil.TempDir("", "thingdir-apikeys")
+	defer os.RemoveAll(keyFolder)
+	keyPort := uint(testDirectoryPort + 8)
+	keyHostPort := fmt.Sprintf("%s:%d", serverAddress, keyPort)
+
+	// keys are created by an administrator before the server starts
+	keyStore := dirserver.NewAPIKeyStore(path.Join(keyFolder, dirserver.DefaultAPIKeyStoreFile))
+	err := keyStore.Open()
+	require.NoError(t, err)
+	readKey, err := keyStore.Create(dirclient.APIKey{
+		Name: "reader", Scope: dirclient.APIKeyScopeRead}, "admin")
+	require.NoError(t, err)
+	writeKey, err := keyStore.Create(dirclient.APIKey{
+		Name: "writer", Scope: dirclient.APIKeyScopeReadWrite, ThingPattern: "zone1:*"}, "admin")
+	require.NoError(t, err)
+	expiredKey, err := keyStore.Create(dirclient.APIKey{Name: "expired", Scope: dirclient.APIKeyScopeRead,
+		Expires: time.Now().Add(time.Second).Format(time.RFC3339)}, "admin")
+	require.NoError(t, err)
+	_, err = keyStore.Create(dirclient.APIKey{Name: "bad", Scope: "all"}, "admin")
+	assert.Error(t, err)
+	_, err = keyStore.Create(dirclient.APIKey{Name: "bad", Scope: dirclient.APIKeyScopeRead,
+		Expires: "2000-01-01T00:00:00Z"}, "admin")
+	assert.Error(t, err)
+	assert.Equal(t, 3, len(keyStore.List()))
+	assert.Empty(t, keyStore.List()[0].Key)
+	_, err = keyStore.Verify(readKey.Key)
+	assert.NoError(t, err)
+	_, err = keyStore.Verify(readKey.Key + "0")
+	assert.Error(t, err)
+	keyStore.Close()
+
+	keyServer := dirserver.NewDirectoryServer("apikeys", keyFolder, serverAddress, keyPort, "",
+		testCerts.ServerCert, testCerts.CaCert, authenticator, authorizer)
+	keyServer.SetAPIKeys(true)
+	err = keyServer.Start()
+	require.NoError(t, err)
+	defer keyServer.Stop()
+
+	// only administrators manage keys
+	pluginClient := dirclient.NewDirClient(keyHostPort, testCerts.CaCert)
+	err = pluginClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer pluginClient.Close()
+	_, err = pluginClient.ListAPIKeys()
+	assert.Error(t, err)
+	_, err = pluginClient.CreateAPIKey("plugin", dirclient.APIKeyScopeReadWrite, "", time.Time{})
+	assert.Error(t, err)
+	dirTD, err := pluginClient.GetDirectoryTD()
+	require.NoError(t, err)
+	actions := dirTD["actions"].(map[string]interface{})
+	assert.NotNil(t, actions["listAPIKeys"])
+	assert.NotNil(t, actions["createAPIKey"])
+	assert.NotNil(t, actions["revokeAPIKey"])
+	err = pluginClient.UpdateTD("zone2:thing1", td.CreateTD("zone2:thing1", vocab.DeviceTypeSensor))
+	require.NoError(t, err)
+
+	// a read-write key can only write the things that match its pattern
+	authorizeResult = false
+	defer func() { authorizeResult = true }()
+	writeClient := dirclient.NewDirClient(keyHostPort, testCerts.CaCert)
+	err = writeClient.ConnectWithAPIKey(writeKey.Key)
+	require.NoError(t, err)
+	defer writeClient.Close()
+	err = writeClient.UpdateTD("zone1:thing1", td.CreateTD("zone1:thing1", vocab.DeviceTypeSensor))
+	assert.NoError(t, err)
+	err = writeClient.UpdateTD("zone2:thing2", td.CreateTD("zone2:thing2", vocab.DeviceTypeSensor))
+	assert.Error(t, err)
+	tdList, err := writeClient.ListTDs(0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(tdList))
+
+	// a read-only key reads all things and can't write
+	readClient := dirclient.NewDirClient(keyHostPort, testCerts.CaCert)
+	err = readClient.ConnectWithAPIKey(readKey.Key)
+	require.NoError(t, err)
+	defer readClient.Close()
+	tdList, err = readClient.ListTDs(0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(tdList))
+	err = readClient.Delete("zone1:thing1")
+	assert.Error(t, err)
+
+	// expired and invalid keys are rejected
+	time.Sleep(time.Second * 2)
+	for _, key := range []string{expiredKey.Key, dirclient.APIKeyPrefix + "unknown.key"} {
+		badClient := dirclient.NewDirClient(keyHostPort, testCerts.CaCert)
+		err = badClient.ConnectWithAPIKey(key)
+		require.NoError(t, err)
+		_, err = badClient.ListTDs(0, 0)
+		assert.Error(t, err)
+		badClient.Close()
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	logrus.Infof("---TestRevocation---")
+	revFolder, _ := ioutil.TempDir("", "thingdir-revocation")
+	defer os.RemoveAll(revFolder)
+	revPort := uint(testDirectoryPort + 9)
+	revHostPort := fmt.Sprintf("%s:%d", serverAddress, revPort)
+
+	// a CRL signed by a CA revokes a certificate until the CRL is replaced
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	crlCA, _ := x509.ParseCertificate(caDer)
+	crlPath := path.Join(revFolder, "test.crl")
+	writeCRL := func(serial int64, modTime time.Time) {
+		revoked := []pkix.RevokedCertificate{{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()}}
+		crlDer, err := crlCA.CreateCRL(rand.Reader, caKey, revoked, time.Now(), time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		err = ioutil.WriteFile(crlPath, crlDer, 0600)
+		require.NoError(t, err)
+		os.Chtimes(crlPath, modTime, modTime)
+	}
+	writeCRL(100, time.Now())
+	revocationList, err := dirserver.NewRevocationList(crlCA, dirserver.RevocationConfig{
+		CRLPath: crlPath, RevokedSerials: []string{"01:F4"}})
+	require.NoError(t, err)
+	assert.True(t, revocationList.IsRevoked(&x509.Certificate{SerialNumber: big.NewInt(100)}))
+	assert.True(t, revocationList.IsRevoked(&x509.Certificate{SerialNumber: big.NewInt(500)}))
+	assert.False(t, revocationList.IsRevoked(&x509.Certificate{SerialNumber: big.NewInt(200)}))
+	writeCRL(200, time.Now().Add(time.Minute))
+	err = revocationList.Reload()
+	require.NoError(t, err)
+	assert.False(t, revocationList.IsRevoked(&x509.Certificate{SerialNumber: big.NewInt(100)}))
+	assert.True(t, revocationList.IsRevoked(&x509.Certificate{SerialNumber: big.NewInt(200)}))
+	err = revocationList.SetRevokedSerials([]string{"not-a-serial"})
+	assert.Error(t, err)
+	// CRLs not signed by the CA are rejected
+	_, err = dirserver.NewRevocationList(testCerts.CaCert, dirserver.RevocationConfig{CRLPath: crlPath})
+	assert.Error(t, err)
+
+	// the directory rejects a revoked device certificate
+	deviceCert, err := x509.ParseCertificate(testCerts.DeviceCert.Certificate[0])
+	require.NoError(t, err)
+	revServer := dirserver.NewDirectoryServer("revocation", revFolder, serverAddress, revPort, "",
+		testCerts.ServerCert, testCerts.CaCert, authenticator, authorizer)
+	err = revServer.SetRevocation(dirserver.RevocationConfig{
+		RevokedSerials: []string{deviceCert.SerialNumber.Text(16)}})
+	require.NoError(t, err)
+	err = revServer.Start()
+	require.NoError(t, err)
+	defer revServer.Stop()
+
+	deviceClient := dirclient.NewDirClient(revHostPort, testCerts.CaCert)
+	err = deviceClient.ConnectWithClientCert(testCerts.DeviceCert)
+	require.NoError(t, err)
+	defer deviceClient.Close()
+	_, err = deviceClient.ListTDs(0, 0)
+	assert.Error(t, err)
+	pluginClient := dirclient.NewDirClient(revHostPort, testCerts.CaCert)
+	err = pluginClient.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer pluginClient.Close()
+	_, err = pluginClient.ListTDs(0, 0)
+	assert.NoError(t, err)
+
+	// the rejection is audited
+	auditLog, err := ioutil.ReadFile(path.Join(revFolder, dirserver.DefaultAuditLogFile))
+	require.NoError(t, err)
+	assert.Contains(t, string(auditLog), deviceCert.Subject.CommonName)
+	assert.Contains(t, string(auditLog), `"result":401`)
+
+	// the revoked serials can be changed while running
+	err = revServer.SetRevokedSerials(nil)
+	require.NoError(t, err)
+	_, err = deviceClient.ListTDs(0, 0)
+	assert.NoError(t, err)
+}
+
+func TestSetServerCert(t *testing.T) {
+	logrus.Infof("---TestSetServerCert---")
+	client := dirclient.NewDirClient(serverHostPort, testCerts.CaCert)
+	err := client.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.ListTDs(0, 0)
+	require.NoError(t, err)
+
+	// a connection that is open while the certificate is replaced
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(testCerts.CaCert)
+	conn, err := tls.Dial("tcp", serverHostPort, &tls.Config{
+		RootCAs: rootCAs, Certificates: []tls.Certificate{*testCerts.PluginCert}})
+	require.NoError(t, err)
+	defer conn.Close()
+	connReader := bufio.NewReader(conn)
+	getThings := func() int {
+		_, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", dirclient.RouteThings, serverHostPort)
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(connReader, nil)
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, getThings())
+
+	// a server certificate of another CA
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "renewed CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	renewedCA, _ := x509.ParseCertificate(caDer)
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "renewed server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP(serverAddress)},
+		DNSNames:     []string{serverAddress},
+	}
+	serverDer, err := x509.CreateCertificate(rand.Reader, serverTemplate, renewedCA, &serverKey.PublicKey, caKey)
+	require.NoError(t, err)
+	renewedCert := &tls.Certificate{Certificate: [][]byte{serverDer}, PrivateKey: serverKey}
+
+	// the open connection keeps working and new connections use the renewed certificate
+	err = directoryServer.SetServerCert(renewedCert, testCerts.CaCert)
+	require.NoError(t, err)
+	defer directoryServer.SetServerCert(testCerts.ServerCert, testCerts.CaCert)
+	assert.Equal(t, http.StatusOK, getThings())
+	renewedRoots := x509.NewCertPool()
+	renewedRoots.AddCert(renewedCA)
+	conn2, err := tls.Dial("tcp", serverHostPort, &tls.Config{
+		RootCAs: renewedRoots, Certificates: []tls.Certificate{*testCerts.PluginCert}})
+	require.NoError(t, err)
+	conn2.Close()
+	_, err = tls.Dial("tcp", serverHostPort, &tls.Config{RootCAs: rootCAs})
+	assert.Error(t, err)
+
+	err = directoryServer.SetServerCert(nil, testCerts.CaCert)
+	assert.Error(t, err)
+}
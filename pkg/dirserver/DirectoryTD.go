@@ -0,0 +1,404 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// WoT Discovery context and type of a Thing Directory
+const (
+	DiscoveryContext    = "https://www.w3.org/2022/wot/discovery"
+	ThingDirectoryType  = "ThingDirectory"
+	DirectoryTDIDPrefix = "urn:wost:directory:"
+)
+
+// Security definition names used in the directory TD
+const (
+	securityNameCert   = "cert_sc"
+	securityNameBasic  = "basic_sc"
+	securityNameBearer = "bearer_sc"
+	securityNameCombo  = "combo_sc"
+)
+
+// newAffordance returns an affordance with description and a form with href, HTTP method and content type
+func newAffordance(description string, href string, method string, contentType string) map[string]interface{} {
+	form := map[string]interface{}{
+		"href":           href,
+		"htv:methodName": method,
+	}
+	if contentType != "" {
+		form["contentType"] = contentType
+	}
+	return map[string]interface{}{
+		"description": description,
+		"forms":       []interface{}{form},
+	}
+}
+
+// pagingVariables returns the URI variables for paging through a list
+func pagingVariables() map[string]interface{} {
+	return map[string]interface{}{
+		"offset": map[string]interface{}{
+			"type": "integer", "minimum": 0, "description": "Offset of the first result in the list"},
+		"limit": map[string]interface{}{
+			"type": "integer", "minimum": 1, "description": "Maximum number of results to return"},
+	}
+}
+
+// idVariable returns the URI variable for a thing or model ID
+func idVariable(name string, description string) map[string]interface{} {
+	return map[string]interface{}{
+		name: map[string]interface{}{
+			"type": "string", "format": "iri-reference", "description": description},
+	}
+}
+
+// securityDefinitions returns the security definitions and security of the directory API.
+// Clients authenticate with a certificate signed by the CA, with basic authentication
+// if the server has an authenticator, or with a bearer token or API key if these are enabled.
+func (srv *DirectoryServer) securityDefinitions() (secDefs map[string]interface{}, security string) {
+	secDefs = map[string]interface{}{
+		securityNameCert: map[string]interface{}{
+			"scheme":      "wost:clientcert",
+			"description": "TLS client certificate signed by the hub CA",
+		},
+	}
+	oneOf := []interface{}{securityNameCert}
+	if srv.authenticator != nil {
+		secDefs[securityNameBasic] = map[string]interface{}{
+			"scheme": "basic",
+			"in":     "header",
+		}
+		oneOf = append(oneOf, securityNameBasic)
+	}
+	if srv.acceptsBearer() {
+		secDefs[securityNameBearer] = map[string]interface{}{
+			"scheme":      "bearer",
+			"in":          "header",
+			"description": "JWT access token or API key of a service account",
+		}
+		oneOf = append(oneOf, securityNameBearer)
+	}
+	if len(oneOf) == 1 {
+		return secDefs, securityNameCert
+	}
+	secDefs[securityNameCombo] = map[string]interface{}{
+		"scheme": "combo",
+		"oneOf":  oneOf,
+	}
+	return secDefs, securityNameCombo
+}
+
+// CreateDirectoryTD returns the Thing Description of this directory server.
+// This follows the ThingDirectory model of the WoT Discovery specification. The TD is
+// created on each request so it always reflects the features that are enabled.
+func (srv *DirectoryServer) CreateDirectoryTD() map[string]interface{} {
+	secDefs, security := srv.securityDefinitions()
+
+	things := newAffordance("Retrieve all Thing Descriptions",
+		"/things{?offset,limit}", "GET", "application/json")
+	things["uriVariables"] = pagingVariables()
+	things["readOnly"] = true
+	things["type"] = "array"
+	things["items"] = map[string]interface{}{"type": "object"}
+
+	models := newAffordance("Retrieve the latest version of all Thing Models",
+		"/models{?offset,limit}", "GET", "application/json")
+	models["uriVariables"] = pagingVariables()
+	models["readOnly"] = true
+	models["type"] = "array"
+	models["items"] = map[string]interface{}{"type": "object"}
+
+	createThing := newAffordance("Create a Thing Description without ID. The directory assigns the ID",
+		"/things", "POST", "application/td+json")
+	createThing["input"] = map[string]interface{}{"type": "object"}
+	createThing["output"] = map[string]interface{}{"type": "object", "description": "TD with the new ID"}
+
+	retrieveThing := newAffordance("Retrieve a Thing Description",
+		"/things/{id}", "GET", "application/td+json")
+	retrieveThing["uriVariables"] = idVariable("id", "ID of the Thing")
+	retrieveThing["output"] = map[string]interface{}{"type": "object"}
+	retrieveThing["safe"] = true
+	retrieveThing["idempotent"] = true
+
+	updateThing := newAffordance("Create or replace a Thing Description",
+		"/things/{id}", "PUT", "application/td+json")
+	updateThing["uriVariables"] = idVariable("id", "ID of the Thing")
+	updateThing["input"] = map[string]interface{}{"type": "object"}
+	updateThing["idempotent"] = true
+
+	patchThing := newAffordance("Partially update a Thing Description",
+		"/things/{id}", "PATCH", "application/merge-patch+json")
+	patchThing["uriVariables"] = idVariable("id", "ID of the Thing")
+	patchThing["input"] = map[string]interface{}{"type": "object"}
+
+	deleteThing := newAffordance("Delete a Thing Description and move it to the trash",
+		"/things/{id}", "DELETE", "")
+	deleteThing["uriVariables"] = idVariable("id", "ID of the Thing")
+	deleteThing["idempotent"] = true
+
+	retrieveTrash := newAffordance("Retrieve the deleted Thing Descriptions that can be restored",
+		"/trash{?offset,limit}", "GET", "application/json")
+	retrieveTrash["uriVariables"] = pagingVariables()
+	retrieveTrash["output"] = map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}}
+	retrieveTrash["safe"] = true
+
+	restoreThing := newAffordance("Restore a deleted Thing Description from the trash",
+		"/trash/{id}/restore", "POST", "")
+	restoreThing["uriVariables"] = idVariable("id", "ID of the deleted Thing")
+
+	purgeThing := newAffordance("Permanently remove a deleted Thing Description from the trash",
+		"/trash/{id}", "DELETE", "")
+	purgeThing["uriVariables"] = idVariable("id", "ID of the deleted Thing")
+
+	emptyTrash := newAffordance("Permanently remove all deleted Thing Descriptions from the trash",
+		"/trash", "DELETE", "")
+
+	retrieveOwner := newAffordance("Retrieve the publisher that owns a Thing",
+		"/things/{id}/owner", "GET", "application/json")
+	retrieveOwner["uriVariables"] = idVariable("id", "ID of the Thing")
+	retrieveOwner["safe"] = true
+
+	transferOwner := newAffordance("Transfer a Thing to another publisher",
+		"/things/{id}/owner", "PUT", "application/json")
+	transferOwner["uriVariables"] = idVariable("id", "ID of the Thing")
+
+	searchJSONPath := newAffordance("JSONPath syntactic search",
+		"/things{?queryparams,offset,limit}", "GET", "application/json")
+	searchVars := pagingVariables()
+	searchVars["queryparams"] = map[string]interface{}{
+		"type": "string", "description": "A valid JSONPath expression"}
+	if srv.federation != nil {
+		searchJSONPath["forms"].([]interface{})[0].(map[string]interface{})["href"] =
+			"/things{?queryparams,scope,offset,limit}"
+		searchVars["scope"] = map[string]interface{}{
+			"type": "string", "enum": []interface{}{dirclient.ScopeLocal, dirclient.ScopeFederated},
+			"description": "Use 'federated' to include the results of the peer directories"}
+	}
+	searchJSONPath["uriVariables"] = searchVars
+	searchJSONPath["output"] = map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}}
+	searchJSONPath["safe"] = true
+	searchJSONPath["idempotent"] = true
+
+	retrieveChanges := newAffordance("Retrieve the changed TDs and deleted thing IDs since the previous sync",
+		"/things/changes{?since,limit}", "GET", "application/json")
+	retrieveChanges["uriVariables"] = map[string]interface{}{
+		"since": map[string]interface{}{
+			"type": "string", "description": "Sync token of the previous sync. Omit to retrieve all TDs"},
+		"limit": map[string]interface{}{
+			"type": "integer", "minimum": 1, "description": "Maximum number of changes to return"},
+	}
+	retrieveChanges["output"] = map[string]interface{}{"type": "object"}
+	retrieveChanges["safe"] = true
+
+	exportThings := newAffordance("Export the Thing Descriptions as NDJSON or JSON array",
+		"/things/export{?format}", "GET", "application/x-ndjson")
+	exportThings["uriVariables"] = map[string]interface{}{
+		"format": map[string]interface{}{
+			"type": "string", "enum": []interface{}{dirclient.FormatNDJSON, dirclient.FormatJSONArray}},
+	}
+	exportThings["safe"] = true
+
+	importThings := newAffordance("Import Thing Descriptions from NDJSON or a JSON array",
+		"/things/import{?mode,dryrun}", "POST", "application/x-ndjson")
+	importThings["uriVariables"] = map[string]interface{}{
+		"mode": map[string]interface{}{
+			"type": "string", "description": "What to do with existing TDs",
+			"enum": []interface{}{dirclient.ImportModeUpsert, dirclient.ImportModeSkip, dirclient.ImportModeReplace}},
+		"dryrun": map[string]interface{}{
+			"type": "boolean", "description": "Report the result without importing"},
+	}
+	importThings["output"] = map[string]interface{}{"type": "object", "description": "Import report"}
+
+	bulkVars := map[string]interface{}{
+		"queryparams": map[string]interface{}{
+			"type": "string", "description": "A valid JSONPath expression selecting the things"},
+		"dryrun": map[string]interface{}{
+			"type": "boolean", "description": "Return the matching thing IDs without changing them"},
+	}
+	deleteByQuery := newAffordance("Delete all things matching a JSONPath query",
+		"/things{?queryparams,dryrun}", "DELETE", "application/json")
+	deleteByQuery["uriVariables"] = bulkVars
+	deleteByQuery["output"] = map[string]interface{}{"type": "object", "description": "IDs of the matching things"}
+
+	patchByQuery := newAffordance("Merge a partial TD into all things matching a JSONPath query",
+		"/things{?queryparams,dryrun}", "PATCH", "application/merge-patch+json")
+	patchByQuery["uriVariables"] = bulkVars
+	patchByQuery["input"] = map[string]interface{}{"type": "object"}
+	patchByQuery["output"] = map[string]interface{}{"type": "object", "description": "IDs of the matching things"}
+
+	writeBatch := newAffordance("Apply a list of put, patch and delete operations, optionally as all or nothing",
+		"/things/batch", "POST", "application/json")
+	writeBatch["input"] = map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"atomic":     map[string]interface{}{"type": "boolean"},
+			"operations": map[string]interface{}{"type": "array"},
+		},
+		"required": []interface{}{"operations"},
+	}
+	writeBatch["output"] = map[string]interface{}{"type": "object", "description": "Result of each operation"}
+
+	retrieveAudit := newAffordance("Retrieve the audit records of writes to the directory",
+		"/audit{?userID,thingID,method,since,until,offset,limit}", "GET", "application/json")
+	auditVars := pagingVariables()
+	auditVars[dirclient.ParamUserID] = map[string]interface{}{
+		"type": "string", "description": "Only include writes by this user"}
+	auditVars[dirclient.ParamThingID] = map[string]interface{}{
+		"type": "string", "description": "Only include writes to this thing"}
+	auditVars[dirclient.ParamMethod] = map[string]interface{}{
+		"type": "string", "description": "Only include writes with this HTTP method"}
+	auditVars[dirclient.ParamSince] = map[string]interface{}{
+		"type": "string", "format": "date-time", "description": "Only include writes at or after this time"}
+	auditVars[dirclient.ParamUntil] = map[string]interface{}{
+		"type": "string", "format": "date-time", "description": "Only include writes before this time"}
+	retrieveAudit["uriVariables"] = auditVars
+	retrieveAudit["output"] = map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}}
+	retrieveAudit["safe"] = true
+
+	retrieveModel := newAffordance("Retrieve a version of a Thing Model. The default is the latest version",
+		"/models/{modelID}{?version}", "GET", "application/tm+json")
+	retrieveModel["uriVariables"] = idVariable("modelID", "ID of the Thing Model")
+	retrieveModel["safe"] = true
+	retrieveModel["idempotent"] = true
+
+	updateModel := newAffordance("Add a version of a Thing Model",
+		"/models/{modelID}", "PUT", "application/tm+json")
+	updateModel["uriVariables"] = idVariable("modelID", "ID of the Thing Model")
+	updateModel["input"] = map[string]interface{}{"type": "object"}
+
+	instantiateModel := newAffordance("Create a Thing Description from a Thing Model",
+		"/models/{modelID}/instantiate", "POST", "application/json")
+	instantiateModel["uriVariables"] = idVariable("modelID", "ID of the Thing Model")
+	instantiateModel["input"] = map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"thingID":      map[string]interface{}{"type": "string"},
+			"version":      map[string]interface{}{"type": "string"},
+			"placeholders": map[string]interface{}{"type": "object"},
+		},
+		"required": []interface{}{"thingID"},
+	}
+	instantiateModel["output"] = map[string]interface{}{"type": "object"}
+
+	// events are streamed from the change feed as server-sent events
+	events := make(map[string]interface{})
+	eventNames := map[string]string{
+		"thingCreated": dirclient.EventThingCreated,
+		"thingUpdated": dirclient.EventThingUpdated,
+		"thingDeleted": dirclient.EventThingDeleted,
+	}
+	for name, eventType := range eventNames {
+		event := newAffordance("Notification that a Thing Description is "+strings.TrimPrefix(eventType, "thing_"),
+			strings.Replace(dirclient.RouteEventType, "{eventType}", eventType, 1), "GET", "text/event-stream")
+		event["forms"].([]interface{})[0].(map[string]interface{})["subprotocol"] = "sse"
+		event["data"] = map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"id": map[string]interface{}{"type": "string", "description": "ID of the thing"},
+			},
+		}
+		events[name] = event
+	}
+
+	dirTD := map[string]interface{}{
+		"@context":            []interface{}{TDContextV11, DiscoveryContext},
+		"@type":               ThingDirectoryType,
+		"id":                  DirectoryTDIDPrefix + srv.instanceID,
+		"title":               "WoST Thing Directory",
+		"base":                fmt.Sprintf("https://%s:%d", srv.address, srv.port),
+		"securityDefinitions": secDefs,
+		"security":            security,
+		"properties": map[string]interface{}{
+			"things": things,
+			"models": models,
+		},
+		"actions": map[string]interface{}{
+			"createThing":          createThing,
+			"retrieveThing":        retrieveThing,
+			"updateThing":          updateThing,
+			"partiallyUpdateThing": patchThing,
+			"deleteThing":          deleteThing,
+			"retrieveTrash":        retrieveTrash,
+			"restoreThing":         restoreThing,
+			"purgeThing":           purgeThing,
+			"emptyTrash":           emptyTrash,
+			"retrieveOwner":        retrieveOwner,
+			"transferOwner":        transferOwner,
+			"searchJSONPath":       searchJSONPath,
+			"retrieveChanges":      retrieveChanges,
+			"exportThings":         exportThings,
+			"importThings":         importThings,
+			"writeBatch":           writeBatch,
+			"deleteByQuery":        deleteByQuery,
+			"patchByQuery":         patchByQuery,
+			"retrieveModel":        retrieveModel,
+			"updateModel":          updateModel,
+			"instantiateModel":     instantiateModel,
+			"retrieveAuditRecords": retrieveAudit,
+		},
+		"events": events,
+	}
+	if srv.apiKeysEnabled {
+		actions := dirTD["actions"].(map[string]interface{})
+		listAPIKeys := newAffordance("List the API keys without the keys themselves. Requires an administrator",
+			dirclient.RouteAPIKeys, "GET", "application/json")
+		listAPIKeys["output"] = map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}}
+		listAPIKeys["safe"] = true
+		actions["listAPIKeys"] = listAPIKeys
+
+		createAPIKey := newAffordance("Create an API key for a service account. Requires an administrator",
+			dirclient.RouteAPIKeys, "POST", "application/json")
+		createAPIKey["input"] = map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"name": map[string]interface{}{"type": "string"},
+				"scope": map[string]interface{}{
+					"type": "string", "enum": []interface{}{dirclient.APIKeyScopeRead, dirclient.APIKeyScopeReadWrite}},
+				"thingPattern": map[string]interface{}{"type": "string"},
+				"expires":      map[string]interface{}{"type": "string", "format": "date-time"},
+			},
+			"required": []interface{}{"name", "scope"},
+		}
+		createAPIKey["output"] = map[string]interface{}{"type": "object", "description": "API key with the key"}
+		actions["createAPIKey"] = createAPIKey
+
+		revokeAPIKey := newAffordance("Revoke an API key. Requires an administrator",
+			dirclient.RouteAPIKeyID, "DELETE", "")
+		revokeAPIKey["uriVariables"] = map[string]interface{}{
+			"keyID": map[string]interface{}{"type": "string", "description": "ID of the API key"}}
+		actions["revokeAPIKey"] = revokeAPIKey
+	}
+	if srv.replica != nil {
+		dirTD["wost:replicaOf"] = srv.replica.Primary()
+	}
+	if srv.anonymousRead {
+		dirTD["wost:anonymousRead"] = true
+	}
+	if srv.validationMode != ValidationModeOff && srv.validationMode != "" {
+		dirTD["wost:tdValidation"] = string(srv.validationMode)
+	}
+	return dirTD
+}
+
+// ServeDirectoryTD returns the Thing Description of the directory
+// This does not require authentication so clients can learn how to use the directory.
+func (srv *DirectoryServer) ServeDirectoryTD(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeDirectoryTD: Invalid method %s", request.Method))
+		return
+	}
+	logrus.Infof("ServeDirectoryTD: from %s", request.RemoteAddr)
+	msg, err := json.Marshal(srv.CreateDirectoryTD())
+	if err != nil {
+		srv.tlsServer.WriteInternalError(response, fmt.Sprintf("ServeDirectoryTD: Marshal error %s", err))
+		return
+	}
+	response.Header().Set("Content-Type", "application/td+json")
+	response.Write(msg)
+}
@@ -0,0 +1,273 @@
+package dirserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// mDNS multicast group addresses
+var (
+	mdnsIPv4Addr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsIPv6Addr = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// subtypeTTL is the TTL in seconds of the subtype records. This is the zeroconf default.
+const subtypeTTL = 3200
+
+// qClassUnicast is the top bit of the question class that requests a unicast response
+const qClassUnicast = 1 << 15
+
+// subtypeResponder publishes a DNS-SD subtype of a service instance as described in RFC 6763
+// section 7.1. It answers the PTR queries of the subtype with the instance of the service, eg
+// '_directory._sub._wot._tcp.local.' -> 'instance._wot._tcp.local.'. The SRV, TXT and address
+// records of the instance are added to the answer so browsers can resolve it in one response.
+// The service instance itself is published by zeroconf, which doesn't support subtypes.
+type subtypeResponder struct {
+	subtypeName  string // eg '_directory._sub._wot._tcp.local.'
+	instanceName string // eg 'instance._wot._tcp.local.'
+	hostName     string // eg 'hostname.local.'
+	port         uint
+	txtRecords   []string
+	ips          []net.IP
+	ifaces       []net.Interface
+
+	ipv4conn  *ipv4.PacketConn
+	ipv6conn  *ipv6.PacketConn
+	waitGroup sync.WaitGroup
+}
+
+// answer returns the response with the subtype PTR record and the records of the instance
+// Use a ttl of 0 to withdraw the records.
+func (sr *subtypeResponder) answer(ttl uint32) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.Response = true
+	resp.Authoritative = true
+	resp.Compress = true
+	resp.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: sr.subtypeName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+		Ptr: sr.instanceName,
+	}}
+	resp.Extra = []dns.RR{
+		&dns.SRV{
+			Hdr:  dns.RR_Header{Name: sr.instanceName, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+			Port: uint16(sr.port), Target: sr.hostName,
+		},
+		&dns.TXT{
+			Hdr: dns.RR_Header{Name: sr.instanceName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+			Txt: sr.txtRecords,
+		},
+	}
+	for _, ip := range sr.ips {
+		if ip.To4() != nil {
+			resp.Extra = append(resp.Extra, &dns.A{
+				Hdr: dns.RR_Header{Name: sr.hostName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   ip,
+			})
+		} else {
+			resp.Extra = append(resp.Extra, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: sr.hostName, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+				AAAA: ip,
+			})
+		}
+	}
+	return resp
+}
+
+// isSubtypeQuery returns true if the message queries the subtype PTR record
+// The second result is true if the question requests a unicast response.
+func (sr *subtypeResponder) isSubtypeQuery(packet []byte) (isQuery bool, unicast bool) {
+	query := dns.Msg{}
+	if err := query.Unpack(packet); err != nil || query.Response || len(query.Ns) > 0 {
+		return false, false
+	}
+	for _, q := range query.Question {
+		if strings.EqualFold(q.Name, sr.subtypeName) && (q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY) {
+			return true, q.Qclass&qClassUnicast != 0
+		}
+	}
+	return false, false
+}
+
+// multicast sends the response to the mDNS group on the given interface, or on all interfaces if 0
+func (sr *subtypeResponder) multicast(resp *dns.Msg, ifIndex int) {
+	buf, err := resp.Pack()
+	if err != nil {
+		logrus.Errorf("subtypeResponder.multicast: %s", err)
+		return
+	}
+	for _, iface := range sr.ifaces {
+		if ifIndex != 0 && iface.Index != ifIndex {
+			continue
+		}
+		if sr.ipv4conn != nil {
+			_, _ = sr.ipv4conn.WriteTo(buf, &ipv4.ControlMessage{IfIndex: iface.Index}, mdnsIPv4Addr)
+		}
+		if sr.ipv6conn != nil {
+			_, _ = sr.ipv6conn.WriteTo(buf, &ipv6.ControlMessage{IfIndex: iface.Index}, mdnsIPv6Addr)
+		}
+	}
+}
+
+// respond answers a subtype query
+// Queries from a port other than 5353 are one-shot queries that are answered by unicast, as are
+// the questions that request a unicast response.
+func (sr *subtypeResponder) respond(packet []byte, ifIndex int, from net.Addr,
+	writeTo func(buf []byte, ifIndex int, to net.Addr) error) {
+
+	isQuery, unicast := sr.isSubtypeQuery(packet)
+	if !isQuery {
+		return
+	}
+	resp := sr.answer(subtypeTTL)
+	if udpAddr, ok := from.(*net.UDPAddr); ok && (unicast || udpAddr.Port != mdnsIPv4Addr.Port) {
+		query := dns.Msg{}
+		_ = query.Unpack(packet)
+		resp.Id = query.Id
+		resp.Question = query.Question
+		buf, err := resp.Pack()
+		if err == nil {
+			err = writeTo(buf, ifIndex, from)
+		}
+		if err != nil {
+			logrus.Warningf("subtypeResponder.respond: unicast response to %s failed: %s", from, err)
+		}
+		return
+	}
+	sr.multicast(resp, ifIndex)
+}
+
+// receive4 answers the queries received on the IPv4 connection until it is closed
+func (sr *subtypeResponder) receive4() {
+	defer sr.waitGroup.Done()
+	buf := make([]byte, 65536)
+	writeTo := func(resp []byte, ifIndex int, to net.Addr) error {
+		_, err := sr.ipv4conn.WriteTo(resp, &ipv4.ControlMessage{IfIndex: ifIndex}, to)
+		return err
+	}
+	for {
+		n, cm, from, err := sr.ipv4conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		sr.respond(buf[:n], ifIndex, from, writeTo)
+	}
+}
+
+// receive6 answers the queries received on the IPv6 connection until it is closed
+func (sr *subtypeResponder) receive6() {
+	defer sr.waitGroup.Done()
+	buf := make([]byte, 65536)
+	writeTo := func(resp []byte, ifIndex int, to net.Addr) error {
+		_, err := sr.ipv6conn.WriteTo(resp, &ipv6.ControlMessage{IfIndex: ifIndex}, to)
+		return err
+	}
+	for {
+		n, cm, from, err := sr.ipv6conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		sr.respond(buf[:n], ifIndex, from, writeTo)
+	}
+}
+
+// Shutdown withdraws the subtype records and stops answering queries
+func (sr *subtypeResponder) Shutdown() {
+	sr.multicast(sr.answer(0), 0)
+	if sr.ipv4conn != nil {
+		sr.ipv4conn.Close()
+	}
+	if sr.ipv6conn != nil {
+		sr.ipv6conn.Close()
+	}
+	sr.waitGroup.Wait()
+}
+
+// newSubtypeResponder starts answering the queries for the subtype of a service instance
+// The records are announced when the responder starts.
+//  instanceID is the instance name of the service
+//  subtype is the subtype service, eg '_directory._sub._wot._tcp'
+//  serviceType of the instance, eg '_wot._tcp'
+//  hostName of the server. The '.local.' domain is added.
+//  port the server listens on
+//  ips with the addresses of the server
+//  txtRecords of the instance
+//  ifaces to listen on. nil for all multicast interfaces.
+// Returns an error if none of the interfaces can be listened on
+func newSubtypeResponder(instanceID string, subtype string, serviceType string, hostName string,
+	port uint, ips []string, txtRecords []string, ifaces []net.Interface) (*subtypeResponder, error) {
+
+	sr := &subtypeResponder{
+		subtypeName:  subtype + ".local.",
+		instanceName: fmt.Sprintf("%s.%s.local.", instanceID, serviceType),
+		hostName:     strings.TrimSuffix(hostName, ".") + ".local.",
+		port:         port,
+		txtRecords:   txtRecords,
+		ifaces:       ifaces,
+	}
+	hasIPv6 := false
+	for _, ip := range ips {
+		if parsedIP := net.ParseIP(ip); parsedIP != nil {
+			sr.ips = append(sr.ips, parsedIP)
+			hasIPv6 = hasIPv6 || parsedIP.To4() == nil
+		}
+	}
+	if len(sr.ifaces) == 0 {
+		allIfaces, _ := net.Interfaces()
+		for _, iface := range allIfaces {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+				sr.ifaces = append(sr.ifaces, iface)
+			}
+		}
+	}
+	udpConn, err := net.ListenUDP("udp4", mdnsIPv4Addr)
+	if err != nil {
+		return nil, fmt.Errorf("subtypeResponder: unable to listen for mDNS queries: %s", err)
+	}
+	sr.ipv4conn = ipv4.NewPacketConn(udpConn)
+	_ = sr.ipv4conn.SetControlMessage(ipv4.FlagInterface, true)
+	joined := 0
+	for i := range sr.ifaces {
+		if sr.ipv4conn.JoinGroup(&sr.ifaces[i], &net.UDPAddr{IP: mdnsIPv4Addr.IP}) == nil {
+			joined++
+		}
+	}
+	if joined == 0 {
+		sr.ipv4conn.Close()
+		return nil, fmt.Errorf("subtypeResponder: failed joining the mDNS group on interfaces %v", sr.ifaces)
+	}
+	if hasIPv6 {
+		udpConn6, err := net.ListenUDP("udp6", mdnsIPv6Addr)
+		if err == nil {
+			sr.ipv6conn = ipv6.NewPacketConn(udpConn6)
+			_ = sr.ipv6conn.SetControlMessage(ipv6.FlagInterface, true)
+			for i := range sr.ifaces {
+				_ = sr.ipv6conn.JoinGroup(&sr.ifaces[i], &net.UDPAddr{IP: mdnsIPv6Addr.IP})
+			}
+		} else {
+			logrus.Warningf("newSubtypeResponder: IPv6 queries are not answered: %s", err)
+		}
+	}
+	sr.waitGroup.Add(1)
+	go sr.receive4()
+	if sr.ipv6conn != nil {
+		sr.waitGroup.Add(1)
+		go sr.receive6()
+	}
+	sr.multicast(sr.answer(subtypeTTL), 0)
+	return sr, nil
+}
@@ -0,0 +1,221 @@
+package dirserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubclient-go/pkg/td"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// Federation defaults
+const (
+	DefaultPeerTimeout       = 5 * time.Second // max time to wait for a peer to respond to a query
+	DefaultPeerDiscoveryTime = 3 * time.Second // time to browse for peers using DNS-SD
+	DefaultPeerRefresh       = 5 * time.Minute // interval to refresh the discovered peers
+)
+
+// peerResponse holds the TDs or error returned by a peer
+type peerResponse struct {
+	tdList []td.ThingTD
+	err    error
+}
+
+// Federation manages the peer directories used in federated queries
+// Peers are configured statically or discovered with DNS-SD. Peers are queried using the client
+// certificate of the directory. The peers authorize the directory and the results are filtered
+// by the directory using the permissions of the user that made the request.
+type Federation struct {
+	address     string           // listening address of this directory, to exclude itself from discovery
+	port        uint             // listening port of this directory
+	serviceName string           // DNS-SD service name of the peers
+	staticPeers []string         // configured address:port of the peers
+	discover    bool             // discover peers using DNS-SD
+	clientCert  *tls.Certificate // client certificate to authenticate with the peers
+	caCert      *x509.Certificate
+	timeout     time.Duration // max time to wait for a peer
+
+	mutex           sync.RWMutex
+	discoveredPeers []string // address:port of peers found with DNS-SD
+	stopChan        chan bool
+}
+
+// isOwnAddress returns true if the address:port is that of this directory
+func (fed *Federation) isOwnAddress(hostPort string) bool {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return false
+	}
+	port, _ := strconv.Atoi(portStr)
+	if uint(port) != fed.port {
+		return false
+	} else if host == fed.address {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.String() == host {
+			return true
+		}
+	}
+	return false
+}
+
+// discoverPeers browses for peer directories and updates the discovered peers
+func (fed *Federation) discoverPeers() {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultPeerDiscoveryTime)
+	defer cancel()
+	candidates, err := dirclient.DiscoverDirectory(ctx, fed.serviceName)
+	if err != nil {
+		logrus.Warningf("Federation.discoverPeers: %s", err)
+		return
+	}
+	peers := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if !fed.isOwnAddress(candidate.HostPort) {
+			peers = append(peers, candidate.HostPort)
+		}
+	}
+	logrus.Infof("Federation.discoverPeers: found %d peer directories", len(peers))
+	fed.mutex.Lock()
+	fed.discoveredPeers = peers
+	fed.mutex.Unlock()
+}
+
+// discoveryLoop periodically refreshes the discovered peers until stopped
+func (fed *Federation) discoveryLoop(stopChan chan bool) {
+	fed.discoverPeers()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-time.After(DefaultPeerRefresh):
+			fed.discoverPeers()
+		}
+	}
+}
+
+// Peers returns the address:port of the configured and discovered peers
+func (fed *Federation) Peers() []string {
+	fed.mutex.RLock()
+	defer fed.mutex.RUnlock()
+	peers := make([]string, 0, len(fed.staticPeers)+len(fed.discoveredPeers))
+	for _, peer := range append(append([]string{}, fed.staticPeers...), fed.discoveredPeers...) {
+		if !containsString(peers, peer) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// queryPeer lists or queries the TDs of a peer directory
+// The peer is queried with a local scope so queries are not forwarded between peers.
+func (fed *Federation) queryPeer(peer string, jsonPath string, limit int) ([]td.ThingTD, error) {
+	dirClient := dirclient.NewDirClient(peer, fed.caCert)
+	defer dirClient.Close()
+	err := dirClient.ConnectWithClientCert(fed.clientCert)
+	if err != nil {
+		return nil, err
+	}
+	if jsonPath == "" {
+		return dirClient.ListTDs(0, limit)
+	}
+	return dirClient.QueryTDs(jsonPath, 0, limit)
+}
+
+// QueryPeers runs the query on all peers in parallel
+// Peers that don't respond within the timeout are reported with an error.
+// Returns the result and TDs of each peer, in the order of Peers()
+func (fed *Federation) QueryPeers(jsonPath string, limit int) ([]dirclient.PeerResult, [][]td.ThingTD) {
+	peers := fed.Peers()
+	results := make([]dirclient.PeerResult, len(peers))
+	tdLists := make([][]td.ThingTD, len(peers))
+	waitGroup := sync.WaitGroup{}
+
+	for i, peer := range peers {
+		waitGroup.Add(1)
+		go func(i int, peer string) {
+			defer waitGroup.Done()
+			results[i].Peer = peer
+			// the response channel is buffered so the query can finish after a timeout
+			respChan := make(chan peerResponse, 1)
+			go func() {
+				tdList, err := fed.queryPeer(peer, jsonPath, limit)
+				respChan <- peerResponse{tdList: tdList, err: err}
+			}()
+			select {
+			case resp := <-respChan:
+				if resp.err != nil {
+					results[i].Error = resp.err.Error()
+				} else {
+					tdLists[i] = resp.tdList
+					results[i].Count = len(resp.tdList)
+				}
+			case <-time.After(fed.timeout):
+				results[i].Error = fmt.Sprintf("no response within %s", fed.timeout)
+			}
+			if results[i].Error != "" {
+				logrus.Warningf("Federation.QueryPeers: peer %s: %s", peer, results[i].Error)
+			}
+		}(i, peer)
+	}
+	waitGroup.Wait()
+	return results, tdLists
+}
+
+// Start the discovery of peers, if enabled
+func (fed *Federation) Start() {
+	fed.mutex.Lock()
+	defer fed.mutex.Unlock()
+	if fed.discover && fed.stopChan == nil {
+		fed.stopChan = make(chan bool)
+		go fed.discoveryLoop(fed.stopChan)
+	}
+}
+
+// Stop the discovery of peers
+func (fed *Federation) Stop() {
+	fed.mutex.Lock()
+	defer fed.mutex.Unlock()
+	if fed.stopChan != nil {
+		close(fed.stopChan)
+		fed.stopChan = nil
+	}
+}
+
+// NewFederation creates the peer management for federated queries
+//  address and port this directory listens on, used to exclude itself from discovered peers
+//  serviceName of the DNS-SD '_{serviceName}._tcp' service of the peers
+//  peers with the address:port of the static peers
+//  discover peers using DNS-SD
+//  clientCert to authenticate with the peers
+//  caCert to verify the peer server certificates
+//  timeout to wait for a peer. Use 0 for DefaultPeerTimeout
+func NewFederation(address string, port uint, serviceName string, peers []string, discover bool,
+	clientCert *tls.Certificate, caCert *x509.Certificate, timeout time.Duration) *Federation {
+
+	if timeout <= 0 {
+		timeout = DefaultPeerTimeout
+	}
+	if serviceName == "" {
+		serviceName = dirclient.DefaultServiceName
+	}
+	fed := &Federation{
+		address:     address,
+		port:        port,
+		serviceName: serviceName,
+		staticPeers: peers,
+		discover:    discover,
+		clientCert:  clientCert,
+		caCert:      caCert,
+		timeout:     timeout,
+	}
+	return fed
+}
@@ -0,0 +1,119 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubserve-go/pkg/certsetup"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// DefaultOwnerStoreFile is the file with the owning publisher of each thing
+const DefaultOwnerStoreFile = "directory-owners.json"
+
+// claimOwnership makes the publisher of a write the owner of the thing, if it has no owner yet
+// This does nothing if publishers aren't verified or the write isn't by a publisher.
+func (srv *DirectoryServer) claimOwnership(aclFilter *AclFilter, thingID string) {
+	publisherID := aclFilter.Publisher()
+	if !srv.verifyPublisher || publisherID == "" || srv.getOwner(thingID) != "" {
+		return
+	}
+	srv.setOwner(thingID, publisherID)
+}
+
+// getOwner returns the publisher that owns a thing, or "" if the thing has no owner
+func (srv *DirectoryServer) getOwner(thingID string) string {
+	record, err := srv.ownerStore.Get(thingID)
+	if err != nil {
+		return ""
+	}
+	recordMap, _ := record.(map[string]interface{})
+	owner, _ := recordMap["owner"].(string)
+	return owner
+}
+
+// newWriteAclFilter returns the filter to authorize writes to things during a request
+// When publishers are verified, only the owner of a thing can write it. Plugins can write on
+// behalf of a publisher using the publisher query parameter.
+func (srv *DirectoryServer) newWriteAclFilter(userID string, request *http.Request) *AclFilter {
+	aclFilter := srv.newAclFilter(userID, request)
+	if srv.verifyPublisher {
+		publisherID := srv.tlsServer.GetQueryString(request, dirclient.ParamPublisher, "")
+		aclFilter.VerifyOwner(publisherID, srv.getOwner)
+	}
+	return aclFilter
+}
+
+// setOwner records the publisher that owns a thing
+//  thingID of the thing
+//  owner is the ID of the publisher, or "" to remove the owner
+func (srv *DirectoryServer) setOwner(thingID string, owner string) {
+	var err error
+	if owner == "" {
+		srv.ownerStore.Remove(thingID)
+	} else {
+		record := map[string]interface{}{
+			"thingID": thingID,
+			"owner":   owner,
+			"since":   time.Now().Format(time.RFC3339),
+		}
+		err = srv.ownerStore.Replace(thingID, record)
+	}
+	if err != nil {
+		logrus.Errorf("setOwner: Unable to set the owner of '%s' to '%s': %s", thingID, owner, err)
+	}
+}
+
+// ServeThingOwner serves a request for the owner of a thing
+// GET returns the dirclient.ThingOwner. PUT transfers the thing to another owner and is only
+// available to administrators.
+func (srv *DirectoryServer) ServeThingOwner(userID string, response http.ResponseWriter, request *http.Request) {
+	certOU := getCertOU(request)
+	parts := strings.Split(request.URL.Path, "/")
+	thingID := parts[len(parts)-2] // expect /things/{thingID}/owner
+
+	switch request.Method {
+	case "GET":
+		if !srv.newAclFilter(userID, request).Authorize(thingID, RightRead) {
+			srv.tlsServer.WriteUnauthorized(response, "ServeThingOwner: permission denied")
+			return
+		}
+		owner := dirclient.ThingOwner{ThingID: thingID}
+		record, err := srv.ownerStore.Get(thingID)
+		if err == nil {
+			recordMap, _ := record.(map[string]interface{})
+			owner.Owner, _ = recordMap["owner"].(string)
+			owner.Since, _ = recordMap["since"].(string)
+		}
+		msg, _ := json.Marshal(owner)
+		response.Header().Set("Content-Type", "application/json")
+		response.Write(msg)
+	case "PUT":
+		if certOU != certsetup.OUAdmin {
+			srv.tlsServer.WriteUnauthorized(response, "ServeThingOwner: permission denied")
+			return
+		}
+		var owner dirclient.ThingOwner
+		body, err := ioutil.ReadAll(request.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &owner)
+		}
+		if err != nil {
+			srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeThingOwner: %s", err))
+			return
+		}
+		previous := srv.getOwner(thingID)
+		srv.setOwner(thingID, owner.Owner)
+		logrus.Infof("ServeThingOwner: user '%s' transferred '%s' from '%s' to '%s'",
+			userID, thingID, previous, owner.Owner)
+		thingTD, _ := srv.store.Get(thingID)
+		srv.audit(userID, request, thingID, tdRevision(thingTD), tdRevision(thingTD), http.StatusOK)
+	default:
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("Invalid method %s by %s", request.Method, userID))
+	}
+}
@@ -0,0 +1,200 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ohler55/ojg/jp"
+)
+
+// affordanceTypes are the TD attributes that hold the interaction affordances
+var affordanceTypes = []string{"properties", "actions", "events"}
+
+// RedactionRule describes a part of a TD that is removed for callers that can't edit the TD
+// Set one of pointer, affordance or annotation.
+type RedactionRule struct {
+	// JSON pointer of the field to remove, eg "/securityDefinitions". A "*" segment matches all
+	// members of an object or elements of an array, eg "/properties/*/forms".
+	Pointer string `yaml:"pointer" json:"pointer,omitempty"`
+	// Name of the property, action or event to remove
+	Affordance string `yaml:"affordance" json:"affordance,omitempty"`
+	// Remove the properties, actions and events that have this annotation set to true, eg "wost:adminOnly"
+	Annotation string `yaml:"annotation" json:"annotation,omitempty"`
+	// Roles that can see the redacted part, eg "manager"
+	Roles []string `yaml:"roles" json:"roles,omitempty"`
+	// Client certificate OUs that can see the redacted part, eg "admin"
+	CertOUs []string `yaml:"certOUs" json:"certOUs,omitempty"`
+}
+
+// appliesTo returns true if the rule redacts the TD for a caller with the role and cert OU
+func (rule *RedactionRule) appliesTo(role string, certOU string) bool {
+	for _, exempt := range rule.Roles {
+		if exempt == role {
+			return false
+		}
+	}
+	for _, exempt := range rule.CertOUs {
+		if exempt == certOU {
+			return false
+		}
+	}
+	return true
+}
+
+// redact removes the part of the TD described by the rule
+func (rule *RedactionRule) redact(thingTD map[string]interface{}) {
+	if rule.Pointer != "" {
+		segments := strings.Split(rule.Pointer, "/")[1:]
+		for i, segment := range segments {
+			segments[i] = strings.Replace(strings.Replace(segment, "~1", "/", -1), "~0", "~", -1)
+		}
+		removePointer(thingTD, segments)
+		return
+	}
+	for _, affType := range affordanceTypes {
+		affordances, _ := thingTD[affType].(map[string]interface{})
+		if rule.Affordance != "" {
+			delete(affordances, rule.Affordance)
+			continue
+		}
+		for name, affordance := range affordances {
+			affMap, _ := affordance.(map[string]interface{})
+			if isSet, _ := affMap[rule.Annotation].(bool); isSet {
+				delete(affordances, name)
+			}
+		}
+	}
+}
+
+// removePointer removes the object members at the path of JSON pointer segments
+// Array elements can be traversed but not removed.
+func removePointer(node interface{}, segments []string) {
+	if len(segments) == 0 {
+		return
+	}
+	segment := segments[0]
+	switch nodeValue := node.(type) {
+	case map[string]interface{}:
+		for key, child := range nodeValue {
+			if segment != "*" && segment != key {
+				continue
+			} else if len(segments) == 1 {
+				delete(nodeValue, key)
+			} else {
+				removePointer(child, segments[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range nodeValue {
+			if segment == "*" || segment == strconv.Itoa(i) {
+				removePointer(child, segments[1:])
+			}
+		}
+	}
+}
+
+// Redactor removes the parts of TDs that callers are not allowed to see
+type Redactor struct {
+	rules []RedactionRule
+}
+
+// Query runs a JSONPATH query on the redacted TDs of the readable things
+// This ensures that redacted fields can't be obtained with a query. The TDs of things the user
+// can edit are not redacted.
+//  docs with the TDs by thing ID
+//  offset and limit of the results to return
+//  aclFilter of the user
+func (redactor *Redactor) Query(jsonPath string, docs map[string]interface{}, offset int, limit int,
+	aclFilter *AclFilter) ([]interface{}, error) {
+
+	jpExpr, err := jp.ParseString(jsonPath)
+	if err != nil {
+		return nil, err
+	}
+	docsToQuery := make(map[string]interface{}, len(docs))
+	for thingID, doc := range docs {
+		if aclFilter.FilterThing(thingID) {
+			docsToQuery[thingID] = redactor.RedactFor(aclFilter, doc)
+		}
+	}
+	results := jpExpr.Get(docsToQuery)
+	if offset >= len(results) {
+		return []interface{}{}, nil
+	} else if limit > 0 && offset+limit < len(results) {
+		return results[offset : offset+limit], nil
+	}
+	return results[offset:], nil
+}
+
+// Redact returns a copy of the TD without the parts that are hidden for the role and cert OU
+// The TD itself is not modified. If nothing is hidden then the TD is returned as is.
+//  thingTD to redact
+//  role of the caller in the groups of the thing, or "" if not known
+//  certOU of the caller's client certificate
+func (redactor *Redactor) Redact(thingTD map[string]interface{}, role string, certOU string) map[string]interface{} {
+	var redacted map[string]interface{}
+	for i := range redactor.rules {
+		rule := &redactor.rules[i]
+		if !rule.appliesTo(role, certOU) {
+			continue
+		}
+		if redacted == nil {
+			// copy the TD as the stored TD must remain intact
+			data, _ := json.Marshal(thingTD)
+			if json.Unmarshal(data, &redacted) != nil {
+				return thingTD
+			}
+		}
+		rule.redact(redacted)
+	}
+	if redacted == nil {
+		return thingTD
+	}
+	return redacted
+}
+
+// RedactFor redacts a TD for the user of the ACL filter
+// Users that can patch the TD see the full TD so they can round-trip it. Items that aren't
+// TDs are returned as is.
+func (redactor *Redactor) RedactFor(aclFilter *AclFilter, item interface{}) interface{} {
+	thingTD, ok := item.(map[string]interface{})
+	if !ok {
+		return item
+	}
+	thingID, _ := thingTD["id"].(string)
+	if aclFilter.Authorize(thingID, RightPatch) {
+		return item
+	}
+	return redactor.Redact(thingTD, aclFilter.Role(thingID), aclFilter.certOU)
+}
+
+// redactFor redacts a TD for the user of the ACL filter if redaction rules are set
+func (srv *DirectoryServer) redactFor(aclFilter *AclFilter, item interface{}) interface{} {
+	if srv.redactor == nil {
+		return item
+	}
+	return srv.redactor.RedactFor(aclFilter, item)
+}
+
+// NewRedactor creates a redactor with the given rules
+// Returns an error if a rule doesn't have exactly one of pointer, affordance or annotation, or
+// the pointer doesn't start with '/'.
+func NewRedactor(rules []RedactionRule) (*Redactor, error) {
+	for i, rule := range rules {
+		nrSet := 0
+		for _, field := range []string{rule.Pointer, rule.Affordance, rule.Annotation} {
+			if field != "" {
+				nrSet++
+			}
+		}
+		if nrSet != 1 {
+			return nil, fmt.Errorf("NewRedactor: rule %d must have one of pointer, affordance or annotation", i)
+		} else if rule.Pointer != "" && !strings.HasPrefix(rule.Pointer, "/") {
+			return nil, fmt.Errorf("NewRedactor: rule %d pointer '%s' must start with '/'", i, rule.Pointer)
+		}
+	}
+	redactor := &Redactor{rules: rules}
+	return redactor, nil
+}
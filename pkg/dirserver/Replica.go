@@ -0,0 +1,242 @@
+package dirserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+const DefaultReplicaPositionFile = "replication.json"
+
+// DefaultReplicationInterval is the interval to poll the primary for changes
+const DefaultReplicationInterval = 5 * time.Second
+
+// ReplicationPosition is the durable position of a replica in the change log of the primary
+type ReplicationPosition struct {
+	Primary string `json:"primary"` // instance ID of the primary
+	Seq     uint64 `json:"seq"`     // sequence number of the last applied change
+	Updated string `json:"updated"` // time the position was last updated
+}
+
+// Replica keeps a read-only copy of a primary directory
+// The replica follows the ordered change log of the primary. If it is too far behind, or the
+// primary is replaced, then it bootstraps from a snapshot of the primary. The position is saved
+// after the changes are written to the store so a restart continues where it left off.
+type Replica struct {
+	primary      string // address:port of the primary
+	clientCert   *tls.Certificate
+	caCert       *x509.Certificate
+	interval     time.Duration
+	store        *ChangeLogStore
+	positionPath string
+
+	mutex     sync.Mutex
+	position  ReplicationPosition
+	dirClient *dirclient.DirClient
+	stopChan  chan bool
+}
+
+// apply the changes to the store
+func (replica *Replica) apply(changes []dirclient.ThingChange) {
+	for _, change := range changes {
+		switch change.Op {
+		case dirclient.ChangeOpPut:
+			if change.TD != nil {
+				replica.store.Replace(change.ThingID, change.TD)
+			}
+		case dirclient.ChangeOpDelete:
+			replica.store.Remove(change.ThingID)
+		}
+	}
+}
+
+// bootstrap replaces the content of the store with a snapshot of the primary
+func (replica *Replica) bootstrap() error {
+	snapshot, err := replica.dirClient.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	logrus.Warningf("Replica.bootstrap: loading snapshot of primary '%s' with %d things at change %d",
+		snapshot.Primary, len(snapshot.Things), snapshot.Seq)
+	docs, _ := replica.store.Snapshot()
+	for thingID := range docs {
+		if _, found := snapshot.Things[thingID]; !found {
+			replica.store.Remove(thingID)
+		}
+	}
+	for thingID, doc := range snapshot.Things {
+		replica.store.Replace(thingID, doc)
+	}
+	return replica.savePosition(snapshot.Primary, snapshot.Seq)
+}
+
+// loadPosition loads the saved replication position
+// A missing or invalid position file results in an empty position, which causes a bootstrap.
+func (replica *Replica) loadPosition() {
+	data, err := os.ReadFile(replica.positionPath)
+	if err == nil {
+		err = json.Unmarshal(data, &replica.position)
+	}
+	if err != nil {
+		logrus.Infof("Replica.loadPosition: no replication position in '%s'. Starting from scratch", replica.positionPath)
+		replica.position = ReplicationPosition{}
+	}
+}
+
+// savePosition saves the replication position after the store is saved
+func (replica *Replica) savePosition(primary string, seq uint64) error {
+	err := replica.store.Save()
+	if err != nil {
+		return err
+	}
+	replica.position = ReplicationPosition{
+		Primary: primary,
+		Seq:     seq,
+		Updated: time.Now().Format(time.RFC3339),
+	}
+	data, _ := json.MarshalIndent(replica.position, "", "  ")
+	tmpPath := replica.positionPath + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, replica.positionPath)
+	}
+	if err != nil {
+		logrus.Errorf("Replica.savePosition: failed saving position to '%s': %s", replica.positionPath, err)
+	}
+	return err
+}
+
+// Position returns the current replication position
+func (replica *Replica) Position() ReplicationPosition {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	return replica.position
+}
+
+// Primary returns the address:port of the primary directory
+func (replica *Replica) Primary() string {
+	return replica.primary
+}
+
+// RedirectToPrimary responds to a write request with a redirect to the same path on the primary
+func (replica *Replica) RedirectToPrimary(response http.ResponseWriter, request *http.Request) {
+	location := fmt.Sprintf("https://%s%s", replica.primary, request.URL.RequestURI())
+	logrus.Infof("Replica.RedirectToPrimary: %s %s redirected to %s", request.Method, request.URL.Path, location)
+	http.Redirect(response, request, location, http.StatusTemporaryRedirect)
+}
+
+// Sync applies the changes of the primary since the last position
+// This bootstraps from a snapshot if there is no position, the primary changed, or the primary no
+// longer has the changes since the position.
+// Returns the nr of changes applied
+func (replica *Replica) Sync() (int, error) {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	count := 0
+	if replica.dirClient == nil {
+		dirClient := dirclient.NewDirClient(replica.primary, replica.caCert)
+		err := dirClient.ConnectWithClientCert(replica.clientCert)
+		if err != nil {
+			return 0, err
+		}
+		replica.dirClient = dirClient
+	}
+	for {
+		changes, err := replica.dirClient.GetChanges(replica.position.Seq, dirclient.MaxLimit)
+		if err != nil {
+			return count, err
+		}
+		if replica.position.Primary == "" || changes.Truncated ||
+			changes.Primary != replica.position.Primary || changes.Last < replica.position.Seq {
+			err = replica.bootstrap()
+			if err != nil {
+				return count, err
+			}
+			continue
+		}
+		if len(changes.Changes) == 0 {
+			return count, nil
+		}
+		replica.apply(changes.Changes)
+		count += len(changes.Changes)
+		lastSeq := changes.Changes[len(changes.Changes)-1].Seq
+		err = replica.savePosition(changes.Primary, lastSeq)
+		if err != nil {
+			return count, err
+		}
+	}
+}
+
+// syncLoop periodically syncs with the primary until stopped
+func (replica *Replica) syncLoop(stopChan chan bool) {
+	for {
+		count, err := replica.Sync()
+		if err != nil {
+			logrus.Warningf("Replica.syncLoop: sync with primary %s failed: %s", replica.primary, err)
+		} else if count > 0 {
+			logrus.Infof("Replica.syncLoop: applied %d changes from primary %s", count, replica.primary)
+		}
+		select {
+		case <-stopChan:
+			return
+		case <-time.After(replica.interval):
+		}
+	}
+}
+
+// Start following the primary
+func (replica *Replica) Start() {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	if replica.stopChan == nil {
+		replica.loadPosition()
+		replica.stopChan = make(chan bool)
+		go replica.syncLoop(replica.stopChan)
+	}
+}
+
+// Stop following the primary
+func (replica *Replica) Stop() {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	if replica.stopChan != nil {
+		close(replica.stopChan)
+		replica.stopChan = nil
+	}
+	if replica.dirClient != nil {
+		replica.dirClient.Close()
+		replica.dirClient = nil
+	}
+}
+
+// NewReplica creates a replica of the primary directory
+//  primary is the address:port of the primary directory server
+//  clientCert to authenticate with the primary. This must be a plugin certificate
+//  caCert to verify the primary server certificate
+//  interval to poll the primary for changes. Use 0 for DefaultReplicationInterval
+//  store to replicate into
+//  positionPath is the file to save the replication position
+func NewReplica(primary string, clientCert *tls.Certificate, caCert *x509.Certificate,
+	interval time.Duration, store *ChangeLogStore, positionPath string) *Replica {
+
+	if interval <= 0 {
+		interval = DefaultReplicationInterval
+	}
+	replica := &Replica{
+		primary:      primary,
+		clientCert:   clientCert,
+		caCert:       caCert,
+		interval:     interval,
+		store:        store,
+		positionPath: positionPath,
+	}
+	return replica
+}
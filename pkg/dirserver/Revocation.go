@@ -0,0 +1,191 @@
+package dirserver
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRevocationReloadInterval is the default interval in seconds to check the CRL file for changes
+const DefaultRevocationReloadInterval = 60
+
+// RevocationConfig configures the revoked client certificates
+type RevocationConfig struct {
+	// path of the CRL file in PEM or DER format, signed by the CA. "" to not use a CRL
+	CRLPath string `yaml:"crlFile"`
+	// serial numbers of revoked certificates in hex, eg "1f:a0:03" or "1fa003"
+	RevokedSerials []string `yaml:"revokedSerials"`
+	// interval in seconds to check the CRL file for changes. Default is 60
+	ReloadInterval int `yaml:"reloadInterval"`
+}
+
+// RevocationList holds the serial numbers of the revoked client certificates
+// The serials come from the CRL file and the configured list. The CRL file is reloaded when it
+// changes.
+type RevocationList struct {
+	caCert         *x509.Certificate
+	crlPath        string
+	crlModTime     time.Time
+	crlSerials     map[string]bool // serials of revoked certificates from the CRL
+	configSerials  map[string]bool // serials of revoked certificates from the configuration
+	reloadInterval time.Duration
+	stopChannel    chan bool
+	mutex          sync.RWMutex
+}
+
+// normalizeSerial returns the serial number as lower case hex without separators or leading zeros
+func normalizeSerial(serial string) (string, error) {
+	hexSerial := strings.ToLower(strings.Replace(strings.TrimSpace(serial), ":", "", -1))
+	value, ok := new(big.Int).SetString(hexSerial, 16)
+	if !ok {
+		return "", fmt.Errorf("invalid serial number '%s'", serial)
+	}
+	return value.Text(16), nil
+}
+
+// IsRevoked returns true if the certificate has been revoked
+func (rl *RevocationList) IsRevoked(cert *x509.Certificate) bool {
+	serial := cert.SerialNumber.Text(16)
+	rl.mutex.RLock()
+	defer rl.mutex.RUnlock()
+	return rl.crlSerials[serial] || rl.configSerials[serial]
+}
+
+// Reload reloads the CRL file if it has changed since it was last loaded
+// The previous CRL remains in use if the file can't be read or its signature is invalid.
+func (rl *RevocationList) Reload() error {
+	if rl.crlPath == "" {
+		return nil
+	}
+	fileInfo, err := os.Stat(rl.crlPath)
+	if err != nil {
+		return fmt.Errorf("RevocationList.Reload: %s", err)
+	}
+	rl.mutex.RLock()
+	isLoaded := rl.crlSerials != nil && fileInfo.ModTime().Equal(rl.crlModTime)
+	rl.mutex.RUnlock()
+	if isLoaded {
+		return nil
+	}
+	data, err := ioutil.ReadFile(rl.crlPath)
+	if err != nil {
+		return fmt.Errorf("RevocationList.Reload: %s", err)
+	}
+	rl.mutex.RLock()
+	caCert := rl.caCert
+	rl.mutex.RUnlock()
+	crl, err := x509.ParseCRL(data)
+	if err == nil && caCert != nil {
+		err = caCert.CheckCRLSignature(crl)
+	}
+	if err != nil {
+		return fmt.Errorf("RevocationList.Reload: invalid CRL '%s': %s", rl.crlPath, err)
+	}
+	if crl.HasExpired(time.Now()) {
+		logrus.Warningf("RevocationList.Reload: CRL '%s' has expired. Using it until it is renewed.", rl.crlPath)
+	}
+	crlSerials := make(map[string]bool)
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		crlSerials[revoked.SerialNumber.Text(16)] = true
+	}
+	rl.mutex.Lock()
+	rl.crlSerials = crlSerials
+	rl.crlModTime = fileInfo.ModTime()
+	rl.mutex.Unlock()
+	logrus.Infof("RevocationList.Reload: loaded %d revoked certificates from '%s'", len(crlSerials), rl.crlPath)
+	return nil
+}
+
+// reloadLoop periodically reloads the CRL file until stopped
+func (rl *RevocationList) reloadLoop(stopChannel chan bool) {
+	ticker := time.NewTicker(rl.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopChannel:
+			return
+		case <-ticker.C:
+			err := rl.Reload()
+			if err != nil {
+				logrus.Errorf("%s", err)
+			}
+		}
+	}
+}
+
+// SetCACert replaces the CA that signs the CRL and reloads the CRL on the next check
+//  caCert that signs the CRL. nil to not verify the CRL signature
+func (rl *RevocationList) SetCACert(caCert *x509.Certificate) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.caCert = caCert
+	rl.crlModTime = time.Time{}
+}
+
+// SetRevokedSerials replaces the serial numbers of revoked certificates from the configuration
+// Returns an error if a serial number isn't a hex number. The list isn't changed in that case.
+//  serials of revoked certificates in hex, eg "1f:a0:03"
+func (rl *RevocationList) SetRevokedSerials(serials []string) error {
+	configSerials := make(map[string]bool)
+	for _, serial := range serials {
+		normalized, err := normalizeSerial(serial)
+		if err != nil {
+			return fmt.Errorf("RevocationList.SetRevokedSerials: %s", err)
+		}
+		configSerials[normalized] = true
+	}
+	rl.mutex.Lock()
+	rl.configSerials = configSerials
+	rl.mutex.Unlock()
+	return nil
+}
+
+// Start checking the CRL file for changes
+func (rl *RevocationList) Start() {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.crlPath != "" && rl.stopChannel == nil {
+		rl.stopChannel = make(chan bool)
+		go rl.reloadLoop(rl.stopChannel)
+	}
+}
+
+// Stop checking the CRL file for changes
+func (rl *RevocationList) Stop() {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.stopChannel != nil {
+		close(rl.stopChannel)
+		rl.stopChannel = nil
+	}
+}
+
+// NewRevocationList creates a list of revoked certificates and loads the CRL file
+// Returns an error if the CRL can't be loaded or a revoked serial number is invalid.
+//  caCert that signs the CRL. nil to not verify the CRL signature
+//  config with the CRL file and revoked serial numbers
+func NewRevocationList(caCert *x509.Certificate, config RevocationConfig) (*RevocationList, error) {
+	if config.ReloadInterval <= 0 {
+		config.ReloadInterval = DefaultRevocationReloadInterval
+	}
+	rl := &RevocationList{
+		caCert:         caCert,
+		crlPath:        config.CRLPath,
+		reloadInterval: time.Duration(config.ReloadInterval) * time.Second,
+	}
+	err := rl.SetRevokedSerials(config.RevokedSerials)
+	if err == nil {
+		err = rl.Reload()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
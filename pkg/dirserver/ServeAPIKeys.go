@@ -0,0 +1,115 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubserve-go/pkg/certsetup"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// verifyAPIKey verifies an API key and returns the claims of the service account
+// Read-only keys have the viewer role and read-write keys the manager role in the things that
+// match the thing pattern of the key.
+func (srv *DirectoryServer) verifyAPIKey(key string) (*TokenClaims, error) {
+	apiKey, err := srv.apiKeys.Verify(key)
+	if err != nil {
+		return nil, err
+	}
+	claims := &TokenClaims{
+		UserID:       APIKeyUserPrefix + apiKey.ID,
+		Role:         RoleViewer,
+		CanRead:      true,
+		CanWrite:     apiKey.Scope == dirclient.APIKeyScopeReadWrite,
+		ThingPattern: apiKey.ThingPattern,
+		IsAPIKey:     true,
+	}
+	if claims.CanWrite {
+		claims.Role = RoleManager
+	}
+	if apiKey.Expires != "" {
+		claims.Expiry, _ = time.Parse(time.RFC3339, apiKey.Expires)
+	}
+	return claims, nil
+}
+
+// ServeAPIKeys serves a request for the collection of API keys
+// GET lists the API keys without the keys themselves. POST creates a dirclient.APIKey and
+// returns it with the key. This is only available to administrators.
+func (srv *DirectoryServer) ServeAPIKeys(userID string, response http.ResponseWriter, request *http.Request) {
+	if getCertOU(request) != certsetup.OUAdmin {
+		srv.tlsServer.WriteUnauthorized(response, "ServeAPIKeys: permission denied")
+		return
+	}
+	var msg []byte
+	var err error
+	switch request.Method {
+	case "GET":
+		msg, err = json.Marshal(srv.apiKeys.List())
+	case "POST":
+		var apiKey dirclient.APIKey
+		var newKey *dirclient.APIKey
+		var body []byte
+		body, err = ioutil.ReadAll(request.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &apiKey)
+		}
+		if err == nil {
+			newKey, err = srv.apiKeys.Create(apiKey, userID)
+		}
+		if err != nil {
+			srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeAPIKeys: %s", err))
+			return
+		}
+		logrus.Infof("ServeAPIKeys: user '%s' created API key '%s' for '%s' with scope '%s'",
+			userID, newKey.ID, newKey.Name, newKey.Scope)
+		msg, err = json.Marshal(newKey)
+	default:
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeAPIKeys: Invalid method %s", request.Method))
+		return
+	}
+	if err != nil {
+		srv.tlsServer.WriteInternalError(response, fmt.Sprintf("ServeAPIKeys: Marshal error %s", err))
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(msg)
+}
+
+// ServeAPIKeyByID serves a request for a single API key
+// GET returns the API key without the key itself. DELETE revokes the key. This is only available
+// to administrators.
+func (srv *DirectoryServer) ServeAPIKeyByID(userID string, response http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(request.URL.Path, "/")
+	keyID := parts[len(parts)-1] // expect /admin/apikeys/{keyID}
+
+	if getCertOU(request) != certsetup.OUAdmin {
+		srv.tlsServer.WriteUnauthorized(response, "ServeAPIKeyByID: permission denied")
+		return
+	}
+	switch request.Method {
+	case "GET":
+		apiKey, err := srv.apiKeys.Get(keyID)
+		if err != nil {
+			srv.tlsServer.WriteNotFound(response, fmt.Sprintf("ServeAPIKeyByID: %s", err))
+			return
+		}
+		msg, _ := json.Marshal(apiKey)
+		response.Header().Set("Content-Type", "application/json")
+		response.Write(msg)
+	case "DELETE":
+		err := srv.apiKeys.Revoke(keyID)
+		if err != nil {
+			srv.tlsServer.WriteNotFound(response, fmt.Sprintf("ServeAPIKeyByID: %s", err))
+			return
+		}
+		logrus.Infof("ServeAPIKeyByID: user '%s' revoked API key '%s'", userID, keyID)
+	default:
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeAPIKeyByID: Invalid method %s", request.Method))
+	}
+}
@@ -0,0 +1,108 @@
+package dirserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubserve-go/pkg/certsetup"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// statusRecorder keeps the status code written to the response for the audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status and writes it to the response
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// tdRevision returns the revision of a TD, based on a hash of its content
+// Returns "" if the TD is nil.
+func tdRevision(thingTD interface{}) string {
+	if thingTD == nil {
+		return ""
+	}
+	data, err := json.Marshal(thingTD)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:8])
+}
+
+// audit adds a record of a modification of a thing to the audit log
+//  request that modified the thing
+//  thingID of the modified thing
+//  revBefore and revAfter are the revisions of the TD before and after the modification, see tdRevision
+//  result is the HTTP status of the request
+func (srv *DirectoryServer) audit(userID string, request *http.Request, thingID string,
+	revBefore string, revAfter string, result int) {
+
+	record := dirclient.AuditRecord{
+		UserID:     userID,
+		CertOU:     getCertOU(request),
+		ClientAddr: request.RemoteAddr,
+		Method:     request.Method,
+		Path:       request.URL.Path,
+		ThingID:    thingID,
+		RevBefore:  revBefore,
+		RevAfter:   revAfter,
+		Result:     result,
+	}
+	err := srv.auditLog.Append(record)
+	if err != nil {
+		logrus.Errorf("audit: Unable to record %s of '%s' by '%s': %s", request.Method, thingID, userID, err)
+	}
+}
+
+// ServeAudit returns the audit records that match the query parameters, newest first
+// Records can be filtered by userID, thingID, method, since and until. This is only available
+// to administrators. The response is a list of dirclient.AuditRecord.
+func (srv *DirectoryServer) ServeAudit(userID string, response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeAudit: Invalid method %s", request.Method))
+		return
+	} else if getCertOU(request) != certsetup.OUAdmin {
+		srv.tlsServer.WriteUnauthorized(response, "ServeAudit: permission denied")
+		return
+	}
+	limit, err := srv.tlsServer.GetQueryInt(request, dirclient.ParamLimit, dirclient.DefaultLimit)
+	offset := 0
+	if err == nil {
+		offset, err = srv.tlsServer.GetQueryInt(request, dirclient.ParamOffset, 0)
+	}
+	if err != nil || offset < 0 {
+		srv.tlsServer.WriteBadRequest(response, "ServeAudit: offset or limit incorrect")
+		return
+	}
+	if limit <= 0 || limit > dirclient.MaxLimit {
+		limit = dirclient.MaxLimit
+	}
+	filter := dirclient.AuditFilter{
+		UserID:  srv.tlsServer.GetQueryString(request, dirclient.ParamUserID, ""),
+		ThingID: srv.tlsServer.GetQueryString(request, dirclient.ParamThingID, ""),
+		Method:  srv.tlsServer.GetQueryString(request, dirclient.ParamMethod, ""),
+		Since:   srv.tlsServer.GetQueryString(request, dirclient.ParamSince, ""),
+		Until:   srv.tlsServer.GetQueryString(request, dirclient.ParamUntil, ""),
+	}
+	records, err := srv.auditLog.Query(filter, offset, limit)
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeAudit: %s", err))
+		return
+	}
+	msg, err := json.Marshal(records)
+	if err != nil {
+		srv.tlsServer.WriteInternalError(response, fmt.Sprintf("ServeAudit: Marshal error %s", err))
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(msg)
+}
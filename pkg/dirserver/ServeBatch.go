@@ -0,0 +1,161 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+	"github.com/wostzone/thingdir/pkg/dirstore"
+)
+
+// errBatchFailed aborts an atomic batch transaction
+var errBatchFailed = fmt.Errorf("batch has failed operations")
+
+// writeBatchOp applies a single batch operation in the store transaction
+// Returns the result of the operation and the error if it failed
+func (srv *DirectoryServer) writeBatchOp(aclFilter *AclFilter, tx dirstore.IDirTx,
+	op dirclient.BatchOperation) (result string, err error) {
+
+	if op.ThingID == "" {
+		return dirclient.BatchResultFailed, fmt.Errorf("missing thingID")
+	} else if err = checkThingID(op.ThingID); err != nil {
+		return dirclient.BatchResultFailed, err
+	}
+	right := RightReplace
+	if op.Op == dirclient.BatchOpPatch {
+		right = RightPatch
+	} else if op.Op == dirclient.BatchOpDelete {
+		right = RightDelete
+	}
+	if !aclFilter.Authorize(op.ThingID, right) {
+		return dirclient.BatchResultFailed, fmt.Errorf("permission denied")
+	}
+	existingTD, err := tx.Get(op.ThingID)
+	exists := err == nil
+
+	var thingTD map[string]interface{}
+	switch op.Op {
+	case dirclient.BatchOpDelete:
+		if !exists {
+			return dirclient.BatchResultFailed, fmt.Errorf("unknown Thing with ID '%s'", op.ThingID)
+		}
+		tx.Remove(op.ThingID)
+		return dirclient.BatchResultDeleted, nil
+	case dirclient.BatchOpPut:
+		if op.TD == nil {
+			return dirclient.BatchResultFailed, fmt.Errorf("missing td")
+		}
+		thingTD = op.TD
+	case dirclient.BatchOpPatch:
+		if op.TD == nil {
+			return dirclient.BatchResultFailed, fmt.Errorf("missing td")
+		} else if !exists {
+			return dirclient.BatchResultFailed, fmt.Errorf("unknown Thing with ID '%s'", op.ThingID)
+		}
+		thingTD, err = mergeTD(existingTD, op.TD)
+		if err != nil {
+			return dirclient.BatchResultFailed, err
+		}
+	default:
+		return dirclient.BatchResultFailed, fmt.Errorf("invalid op '%s'", op.Op)
+	}
+	validation, accepted := srv.checkTD(op.ThingID, thingTD)
+	if !accepted {
+		return dirclient.BatchResultFailed, fmt.Errorf("TD has %d validation error(s)", len(validation.Errors))
+	}
+	err = tx.Replace(op.ThingID, thingTD)
+	if err != nil {
+		return dirclient.BatchResultFailed, err
+	}
+	if exists {
+		return dirclient.BatchResultUpdated, nil
+	}
+	return dirclient.BatchResultCreated, nil
+}
+
+// ServeThingsBatch applies a list of put, patch and delete operations in a single store transaction
+// Each operation is authorized and validated separately. An atomic batch is only applied if all
+// operations succeed, otherwise the successful operations are applied. Deleted TDs are moved to
+// the trash. The response is a dirclient.BatchResponse with the result of each operation.
+func (srv *DirectoryServer) ServeThingsBatch(userID string, response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeThingsBatch: Invalid method %s", request.Method))
+		return
+	} else if srv.isReplicaWrite(request) {
+		srv.replica.RedirectToPrimary(response, request)
+		return
+	}
+	var batchReq dirclient.BatchRequest
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &batchReq)
+	}
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeThingsBatch: %s", err))
+		return
+	}
+	batchResp := dirclient.BatchResponse{
+		Atomic:  batchReq.Atomic,
+		Results: make([]dirclient.BatchItemResult, 0, len(batchReq.Operations)),
+	}
+	aclFilter := srv.newWriteAclFilter(userID, request)
+	// deleted TDs move to the trash after the batch is applied
+	deletedTDs := make(map[string]interface{})
+	revisions := make([][2]string, 0, len(batchReq.Operations))
+	err = srv.store.Transaction(func(tx dirstore.IDirTx) error {
+		for i, op := range batchReq.Operations {
+			itemResult := dirclient.BatchItemResult{Index: i, ThingID: op.ThingID, Op: op.Op}
+			existingTD, _ := tx.Get(op.ThingID)
+			revBefore := tdRevision(existingTD)
+			itemResult.Result, err = srv.writeBatchOp(aclFilter, tx, op)
+			newTD, _ := tx.Get(op.ThingID)
+			revisions = append(revisions, [2]string{revBefore, tdRevision(newTD)})
+			if err != nil {
+				itemResult.Error = err.Error()
+				batchResp.Failed++
+			} else if itemResult.Result == dirclient.BatchResultDeleted {
+				deletedTDs[op.ThingID] = existingTD
+			}
+			batchResp.Results = append(batchResp.Results, itemResult)
+		}
+		if batchReq.Atomic && batchResp.Failed > 0 {
+			return errBatchFailed
+		}
+		return nil
+	})
+	batchResp.Applied = err == nil
+	if batchResp.Applied {
+		for thingID, deletedTD := range deletedTDs {
+			srv.moveToTrash(userID, thingID, deletedTD)
+		}
+		for _, itemResult := range batchResp.Results {
+			if itemResult.Result == dirclient.BatchResultCreated || itemResult.Result == dirclient.BatchResultUpdated {
+				srv.claimOwnership(aclFilter, itemResult.ThingID)
+			}
+		}
+	}
+	for i, itemResult := range batchResp.Results {
+		revBefore, revAfter := revisions[i][0], revisions[i][1]
+		status := http.StatusOK
+		if itemResult.Result == dirclient.BatchResultFailed {
+			status = http.StatusBadRequest
+		}
+		if !batchResp.Applied {
+			revAfter = revBefore
+		}
+		srv.audit(userID, request, itemResult.ThingID, revBefore, revAfter, status)
+	}
+	logrus.Infof("ServeThingsBatch: %d operations, atomic=%v, applied=%v, %d failed",
+		len(batchReq.Operations), batchReq.Atomic, batchResp.Applied, batchResp.Failed)
+
+	msg, err := json.Marshal(batchResp)
+	if err != nil {
+		srv.tlsServer.WriteInternalError(response, fmt.Sprintf("ServeThingsBatch: Marshal error %s", err))
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(msg)
+}
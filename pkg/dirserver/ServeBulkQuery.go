@@ -0,0 +1,151 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/ohler55/ojg/jp"
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+	"github.com/wostzone/thingdir/pkg/dirstore"
+)
+
+// queryThingIDs returns the sorted IDs of the readable things that match the JSONPATH query
+// Unlike the store query this is not paged as all matching things are needed. The results are
+// mapped back to their store key by identity as the ID in a TD can differ from its key.
+func (srv *DirectoryServer) queryThingIDs(jsonPath string, aclFilter *AclFilter) ([]string, error) {
+	jpExpr, err := jp.ParseString(jsonPath)
+	if err != nil {
+		return nil, err
+	}
+	docs, _ := srv.store.Snapshot()
+	docsToQuery := make(map[string]interface{}, len(docs))
+	// the query returns the stored TD maps themselves, indexed here by their address
+	keysByDoc := make(map[uintptr]string, len(docs))
+	for thingID, doc := range docs {
+		thingTD, ok := doc.(map[string]interface{})
+		if ok && aclFilter.FilterThing(thingID) {
+			docsToQuery[thingID] = thingTD
+			keysByDoc[reflect.ValueOf(thingTD).Pointer()] = thingID
+		}
+	}
+	matched := make(map[string]bool)
+	for _, result := range jpExpr.Get(docsToQuery) {
+		thingTD, ok := result.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if thingID, found := keysByDoc[reflect.ValueOf(thingTD).Pointer()]; found {
+			matched[thingID] = true
+		}
+	}
+	thingIDs := make([]string, 0, len(matched))
+	for thingID := range matched {
+		thingIDs = append(thingIDs, thingID)
+	}
+	sort.Strings(thingIDs)
+	return thingIDs, nil
+}
+
+// ServeBulkByQuery deletes or patches all things that match the JSONPATH query
+// This requires write authorization for each matching thing. If one of the things can't be
+// written then nothing is changed. The changes are applied in a single store transaction.
+// Deleted TDs are moved to the trash.
+// With 'dryrun=true' the matching thing IDs are returned without changing them.
+// The response is a dirclient.BulkResponse.
+func (srv *DirectoryServer) ServeBulkByQuery(userID, certOU string, response http.ResponseWriter, request *http.Request) {
+	jsonPath := srv.tlsServer.GetQueryString(request, dirclient.ParamQuery, "")
+	dryRun := srv.tlsServer.GetQueryString(request, dirclient.ParamDryRun, "false") == "true"
+	if jsonPath == "" {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeBulkByQuery: %s requires a query", request.Method))
+		return
+	}
+	var patch map[string]interface{}
+	if request.Method == "PATCH" {
+		body, err := ioutil.ReadAll(request.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &patch)
+		}
+		if err == nil && patch == nil {
+			err = fmt.Errorf("missing patch")
+		}
+		if err != nil {
+			srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeBulkByQuery: %s", err))
+			return
+		}
+	}
+	aclFilter := srv.newWriteAclFilter(userID, request)
+	thingIDs, err := srv.queryThingIDs(jsonPath, aclFilter)
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeBulkByQuery: query error: %s", err))
+		return
+	}
+	right := RightPatch
+	if request.Method == "DELETE" {
+		right = RightDelete
+	}
+	for _, thingID := range thingIDs {
+		if !aclFilter.Authorize(thingID, right) {
+			srv.tlsServer.WriteUnauthorized(response,
+				fmt.Sprintf("ServeBulkByQuery: permission denied for Thing '%s'", thingID))
+			return
+		}
+	}
+	logrus.Infof("ServeBulkByQuery: %s of %d things matching '%s', dryRun=%v",
+		request.Method, len(thingIDs), jsonPath, dryRun)
+
+	if !dryRun {
+		deletedTDs := make(map[string]interface{})
+		revisions := make(map[string][2]string)
+		err = srv.store.Transaction(func(tx dirstore.IDirTx) error {
+			for _, thingID := range thingIDs {
+				existingTD, err := tx.Get(thingID)
+				if err != nil {
+					continue
+				} else if request.Method == "DELETE" {
+					tx.Remove(thingID)
+					deletedTDs[thingID] = existingTD
+					revisions[thingID] = [2]string{tdRevision(existingTD), ""}
+					continue
+				}
+				mergedTD, err := mergeTD(existingTD, patch)
+				if err != nil {
+					return err
+				}
+				validation, accepted := srv.checkTD(thingID, mergedTD)
+				if !accepted {
+					return fmt.Errorf("patched TD '%s' has %d validation error(s)", thingID, len(validation.Errors))
+				}
+				err = tx.Replace(thingID, mergedTD)
+				if err != nil {
+					return err
+				}
+				revisions[thingID] = [2]string{tdRevision(existingTD), tdRevision(mergedTD)}
+			}
+			return nil
+		})
+		if err != nil {
+			srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeBulkByQuery: %s", err))
+			return
+		}
+		for thingID, deletedTD := range deletedTDs {
+			srv.moveToTrash(userID, thingID, deletedTD)
+		}
+		for _, thingID := range thingIDs {
+			if revision, found := revisions[thingID]; found {
+				srv.audit(userID, request, thingID, revision[0], revision[1], http.StatusOK)
+			}
+		}
+	}
+	msg, _ := json.Marshal(dirclient.BulkResponse{
+		DryRun:   dryRun,
+		Matched:  len(thingIDs),
+		ThingIDs: thingIDs,
+	})
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(msg)
+}
@@ -0,0 +1,221 @@
+package dirserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubclient-go/pkg/td"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// EncodeSyncToken returns the sync token for a position in the change log of a directory
+// The token is opaque to clients. It includes the directory instance ID so a token of another
+// directory, or of a directory that was reinstalled, is not mistaken for a position in its log.
+func EncodeSyncToken(instanceID string, seq uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d", instanceID, seq)))
+}
+
+// DecodeSyncToken returns the directory instance ID and change log position of a sync token
+// Returns an error if the token is invalid
+func DecodeSyncToken(syncToken string) (instanceID string, seq uint64, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(syncToken)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid sync token")
+	}
+	sep := strings.LastIndex(string(raw), ":")
+	if sep < 0 {
+		return "", 0, fmt.Errorf("invalid sync token")
+	}
+	seq, err = strconv.ParseUint(string(raw[sep+1:]), 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid sync token")
+	}
+	return string(raw[:sep]), seq, nil
+}
+
+// encodeChangesToken returns the sync token of the change feed
+// The token holds the position in the change log and the fingerprint of the things the user
+// could read at that position.
+func encodeChangesToken(instanceID string, seq uint64, fingerprint uint64) string {
+	return EncodeSyncToken(instanceID, seq) + "." + strconv.FormatUint(fingerprint, 16)
+}
+
+// decodeChangesToken returns the directory instance ID, change log position and fingerprint of
+// the readable things of a change feed sync token. Tokens without a fingerprint have fingerprint 0.
+// Returns an error if the token is invalid
+func decodeChangesToken(syncToken string) (instanceID string, seq uint64, fingerprint uint64, err error) {
+	if sep := strings.LastIndex(syncToken, "."); sep >= 0 {
+		fingerprint, err = strconv.ParseUint(syncToken[sep+1:], 16, 64)
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("invalid sync token")
+		}
+		syncToken = syncToken[:sep]
+	}
+	instanceID, seq, err = DecodeSyncToken(syncToken)
+	return instanceID, seq, fingerprint, err
+}
+
+// hashThingID returns the hash of a thing ID that is included in the fingerprint of readable things
+func hashThingID(thingID string) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(thingID))
+	return hash.Sum64()
+}
+
+// readableBefore returns true if the user could read the thing before the change
+// The ACL is applied as it is now, with the visibility the thing had before the change.
+func readableBefore(aclFilter *AclFilter, change dirclient.ThingChange) bool {
+	return !change.Created && aclFilter.FilterThingWithVisibility(change.ThingID, change.PrevVisibility)
+}
+
+// readableAfter returns true if the user can read the thing after the change
+func readableAfter(aclFilter *AclFilter, change dirclient.ThingChange) bool {
+	return change.Op != dirclient.ChangeOpDelete && change.TD != nil &&
+		aclFilter.FilterThingWithVisibility(change.ThingID, tdVisibility(change.TD))
+}
+
+// readableFingerprint returns the fingerprint of the things the user could read at a position in
+// the change log. Things that changed after the position are readable if they were readable
+// before their first change, the other things if their current TD is readable. As the ACL is
+// applied as it is now, the fingerprint of a position changes when an ACL change affects what
+// the user could read.
+//  aclFilter of the user
+//  seq is the position in the change log
+// Returns an error if the changes after the position are no longer in the log
+func (srv *DirectoryServer) readableFingerprint(aclFilter *AclFilter, seq uint64) (uint64, error) {
+	var fingerprint uint64
+	docs, lastSeq := srv.store.Snapshot()
+	changes, err := srv.store.ChangeLog().Since(seq, math.MaxInt32)
+	if err != nil {
+		return 0, err
+	}
+	firstChanges := make(map[string]dirclient.ThingChange)
+	for _, change := range changes {
+		if change.Seq > lastSeq {
+			break
+		} else if _, found := firstChanges[change.ThingID]; !found {
+			firstChanges[change.ThingID] = change
+		}
+	}
+	for thingID, doc := range docs {
+		docMap, _ := doc.(map[string]interface{})
+		if _, changed := firstChanges[thingID]; !changed &&
+			aclFilter.FilterThingWithVisibility(thingID, tdVisibility(docMap)) {
+			fingerprint ^= hashThingID(thingID)
+		}
+	}
+	for thingID, change := range firstChanges {
+		if readableBefore(aclFilter, change) {
+			fingerprint ^= hashThingID(thingID)
+		}
+	}
+	return fingerprint, nil
+}
+
+// ServeThingChanges returns the TDs that changed and the IDs of the things that were deleted
+// since the sync token. Without a sync token, or if the changes since the token are no longer
+// available, all TDs are returned with the reset flag set.
+// Only things that the user can read are included and their TDs are redacted for the user.
+// The IDs of deleted things are only included if the user could read the thing before it was
+// deleted. Things that the user could read but no longer can after a change of their visibility
+// are included as deleted. As the ACL itself isn't in the change log, the sync token holds a
+// fingerprint of the things the user could read. If an ACL change affects these things, all TDs
+// are returned with the reset flag set so the client discards the TDs it can no longer read.
+// The response is a dirclient.SyncResponse.
+func (srv *DirectoryServer) ServeThingChanges(userID string, response http.ResponseWriter, request *http.Request) {
+	var seq uint64
+	var fingerprint uint64
+	var changes []dirclient.ThingChange
+
+	if request.Method != "GET" {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeThingChanges: Invalid method %s", request.Method))
+		return
+	}
+	limit, err := srv.tlsServer.GetQueryInt(request, dirclient.ParamLimit, dirclient.DefaultLimit)
+	if err != nil || limit <= 0 {
+		srv.tlsServer.WriteBadRequest(response, "ServeThingChanges: limit incorrect")
+		return
+	} else if limit > dirclient.MaxLimit {
+		limit = dirclient.MaxLimit
+	}
+	aclFilter := srv.newAclFilter(userID, request)
+	syncToken := srv.tlsServer.GetQueryString(request, dirclient.ParamSyncToken, "")
+	reset := syncToken == ""
+	if !reset {
+		var instanceID string
+		instanceID, seq, fingerprint, err = decodeChangesToken(syncToken)
+		if err != nil {
+			srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeThingChanges: %s", err))
+			return
+		}
+		changeLog := srv.store.ChangeLog()
+		if instanceID != srv.instanceID || seq > changeLog.LastSeq() {
+			reset = true
+		} else if changes, err = changeLog.Since(seq, limit); err != nil {
+			reset = true
+		} else if current, err := srv.readableFingerprint(aclFilter, seq); err != nil || current != fingerprint {
+			logrus.Infof("ServeThingChanges: the things user '%s' can read have changed", userID)
+			reset = true
+		}
+	}
+	result := dirclient.SyncResponse{
+		Changed: make(map[string]td.ThingTD),
+		Deleted: make([]string, 0),
+	}
+	if reset {
+		// the full list of TDs
+		var docs map[string]interface{}
+		docs, seq = srv.store.Snapshot()
+		fingerprint = 0
+		for thingID, doc := range docs {
+			docMap, ok := doc.(map[string]interface{})
+			if ok && aclFilter.FilterThingWithVisibility(thingID, tdVisibility(docMap)) {
+				result.Changed[thingID] = srv.redactFor(aclFilter, docMap).(map[string]interface{})
+				fingerprint ^= hashThingID(thingID)
+			}
+		}
+		result.Reset = true
+	} else if len(changes) > 0 {
+		// only the latest change of each thing is returned
+		firstChanges := make(map[string]dirclient.ThingChange)
+		latest := make(map[string]dirclient.ThingChange)
+		for _, change := range changes {
+			if _, found := firstChanges[change.ThingID]; !found {
+				firstChanges[change.ThingID] = change
+			}
+			latest[change.ThingID] = change
+		}
+		for _, change := range changes {
+			if latest[change.ThingID].Seq != change.Seq {
+				continue
+			} else if readableAfter(aclFilter, change) {
+				result.Changed[change.ThingID] =
+					srv.redactFor(aclFilter, map[string]interface{}(change.TD)).(map[string]interface{})
+			} else if readableBefore(aclFilter, firstChanges[change.ThingID]) {
+				result.Deleted = append(result.Deleted, change.ThingID)
+			}
+		}
+		seq = changes[len(changes)-1].Seq
+		result.More = seq < srv.store.ChangeLog().LastSeq()
+		// this only fails if the log was trimmed meanwhile, in which case the next sync resets
+		fingerprint, _ = srv.readableFingerprint(aclFilter, seq)
+	}
+	result.SyncToken = encodeChangesToken(srv.instanceID, seq, fingerprint)
+	logrus.Infof("ServeThingChanges: %d changed and %d deleted things for user '%s'. Reset=%v",
+		len(result.Changed), len(result.Deleted), userID, result.Reset)
+
+	msg, err := json.Marshal(result)
+	if err != nil {
+		srv.tlsServer.WriteInternalError(response, fmt.Sprintf("ServeThingChanges: Marshal error %s", err))
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(msg)
+}
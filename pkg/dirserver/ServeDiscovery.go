@@ -1,19 +1,268 @@
 package dirserver
 
 import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/grandcat/zeroconf"
 	"github.com/sirupsen/logrus"
 	"github.com/wostzone/hubserve-go/pkg/discovery"
+	"github.com/wostzone/thingdir/pkg/dirclient"
 )
 
 const ThingDirServiceDiscoveryType = "thingdir"
 
+// WoT Discovery DNS-SD service type and subtype of a Thing Directory
+const (
+	WoTServiceType          = dirclient.WoTServiceType
+	WoTDirectorySubtype     = dirclient.WoTDirectoryServiceType
+	WoTDirectoryTXTType     = "Directory"
+	WoTDirectoryTXTScheme   = "https"
+	DefaultDiscoveryRefresh = 30 * time.Second // interval to check for address changes
+)
+
+// DirDiscoveryTXT returns the TXT record parameters of the directory service as defined in WoT Discovery
+func DirDiscoveryTXT() map[string]string {
+	return map[string]string{
+		"td":     dirclient.RouteWellKnownWoT,
+		"type":   WoTDirectoryTXTType,
+		"scheme": WoTDirectoryTXTScheme,
+	}
+}
+
 // ServeDirDiscovery publishes a discovery record of the IDProv server
 // Returns the discovery service instance. Use Shutdown() when done.
 func ServeDirDiscovery(instanceID string, serviceName string, address string, port uint) (*zeroconf.Server, error) {
 
 	logrus.Infof("ServeDirDiscovery serviceID='%s;, address='%s:%d'", serviceName, address, port)
 
-	return discovery.ServeDiscovery(instanceID, serviceName, address, port, nil)
+	return discovery.ServeDiscovery(instanceID, serviceName, address, port, DirDiscoveryTXT())
+
+}
+
+// DirDiscovery publishes the directory using DNS-SD under the directory service name and,
+// when enabled, as a WoT Discovery '_wot._tcp' service with the '_directory' subtype.
+// The records are re-announced when the address of the network interfaces change.
+type DirDiscovery struct {
+	instanceID   string
+	serviceName  string   // directory service name, eg 'thingdir' for _thingdir._tcp
+	address      string   // server listening address. "" or 0.0.0.0 to use the interface addresses
+	port         uint     // server listening port
+	interfaces   []string // names of the network interfaces to publish on. Default is all multicast interfaces
+	enableIPv6   bool     // include the interface IPv6 addresses
+	wotDiscovery bool     // also publish the WoT Discovery service records
+	refresh      time.Duration
+
+	mutex    sync.Mutex
+	ips      []string // currently published addresses
+	servers  []*zeroconf.Server
+	subtype  *subtypeResponder // answers the '_directory._sub._wot._tcp' queries
+	stopChan chan bool
+}
+
+// getInterfaces returns the network interfaces to publish on.
+// Returns nil if no interfaces are configured, in which case zeroconf uses all multicast interfaces
+func (dd *DirDiscovery) getInterfaces() ([]net.Interface, error) {
+	if len(dd.interfaces) == 0 {
+		return nil, nil
+	}
+	ifaces := make([]net.Interface, 0, len(dd.interfaces))
+	for _, name := range dd.interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("DirDiscovery: unknown network interface '%s': %s", name, err)
+		}
+		ifaces = append(ifaces, *iface)
+	}
+	return ifaces, nil
+}
+
+// getAddresses returns the sorted IP addresses to publish.
+// If the server listens on a specific address then only that address is used, plus the IPv6
+// addresses of the interfaces if IPv6 is enabled.
+func (dd *DirDiscovery) getAddresses(ifaces []net.Interface) ([]string, error) {
+	ips := make([]string, 0)
+	specificAddress := dd.address != "" && dd.address != "0.0.0.0" && dd.address != "::"
+	if specificAddress {
+		ips = append(ips, dd.address)
+	}
+	if ifaces == nil {
+		allIfaces, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range allIfaces {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 &&
+				iface.Flags&net.FlagLoopback == 0 {
+				ifaces = append(ifaces, iface)
+			}
+		}
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() {
+				continue
+			}
+			ip := ipNet.IP.String()
+			if ipNet.IP.To4() != nil {
+				if !specificAddress {
+					ips = append(ips, ip)
+				}
+			} else if dd.enableIPv6 {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("DirDiscovery: no IP addresses to publish")
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
+
+// register publishes the service records on the given addresses
+func (dd *DirDiscovery) register(ifaces []net.Interface, ips []string) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	txtParams := DirDiscoveryTXT()
+	txtRecords := make([]string, 0, len(txtParams))
+	for key, value := range txtParams {
+		txtRecords = append(txtRecords, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(txtRecords)
+
+	serviceTypes := []string{"_" + dd.serviceName + "._tcp"}
+	if dd.wotDiscovery {
+		serviceTypes = append(serviceTypes, WoTServiceType)
+	}
+	for _, serviceType := range serviceTypes {
+		server, err := zeroconf.RegisterProxy(dd.instanceID, serviceType, "local.", int(dd.port),
+			hostname, ips, txtRecords, ifaces)
+		if err != nil {
+			logrus.Errorf("DirDiscovery.register: failed publishing '%s': %s", serviceType, err)
+			return err
+		}
+		dd.servers = append(dd.servers, server)
+	}
+	// the subtype points at the '_wot._tcp' instance instead of being a service of its own
+	if dd.wotDiscovery {
+		dd.subtype, err = newSubtypeResponder(dd.instanceID, WoTDirectorySubtype, WoTServiceType,
+			hostname, dd.port, ips, txtRecords, ifaces)
+		if err != nil {
+			logrus.Errorf("DirDiscovery.register: failed publishing '%s': %s", WoTDirectorySubtype, err)
+			return err
+		}
+		serviceTypes = append(serviceTypes, WoTDirectorySubtype)
+	}
+	dd.ips = ips
+	logrus.Infof("DirDiscovery.register: published %s for instance '%s' on %s:%d",
+		strings.Join(serviceTypes, ", "), dd.instanceID, strings.Join(ips, ","), dd.port)
+	return nil
+}
+
+// shutdown removes the published service records
+func (dd *DirDiscovery) shutdown() {
+	for _, server := range dd.servers {
+		server.Shutdown()
+	}
+	dd.servers = nil
+	if dd.subtype != nil {
+		dd.subtype.Shutdown()
+		dd.subtype = nil
+	}
+}
+
+// refreshLoop periodically checks the addresses and re-announces the service when they change
+func (dd *DirDiscovery) refreshLoop(ifaces []net.Interface, stopChan chan bool) {
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-time.After(dd.refresh):
+			ips, err := dd.getAddresses(ifaces)
+			if err != nil {
+				logrus.Warningf("DirDiscovery.refreshLoop: %s", err)
+				continue
+			}
+			dd.mutex.Lock()
+			if dd.stopChan == stopChan && strings.Join(ips, ",") != strings.Join(dd.ips, ",") {
+				logrus.Warningf("DirDiscovery.refreshLoop: address changed from %v to %v. Re-announcing", dd.ips, ips)
+				dd.shutdown()
+				err = dd.register(ifaces, ips)
+				if err != nil {
+					logrus.Errorf("DirDiscovery.refreshLoop: re-announcing failed: %s", err)
+				}
+			}
+			dd.mutex.Unlock()
+		}
+	}
+}
+
+// Start publishing the directory service records
+func (dd *DirDiscovery) Start() error {
+	ifaces, err := dd.getInterfaces()
+	if err != nil {
+		return err
+	}
+	ips, err := dd.getAddresses(ifaces)
+	if err != nil {
+		return err
+	}
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+	err = dd.register(ifaces, ips)
+	if err != nil {
+		dd.shutdown()
+		return err
+	}
+	dd.stopChan = make(chan bool)
+	go dd.refreshLoop(ifaces, dd.stopChan)
+	return nil
+}
+
+// Stop publishing the directory service records
+func (dd *DirDiscovery) Stop() {
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+	if dd.stopChan != nil {
+		close(dd.stopChan)
+		dd.stopChan = nil
+	}
+	dd.shutdown()
+}
+
+// NewDirDiscovery creates a DNS-SD publisher for the directory service
+//  instanceID is the unique ID of the service instance
+//  serviceName for use in '_{serviceName}._tcp'
+//  address the server listens on. Use "" or "0.0.0.0" to publish the interface addresses
+//  port the server listens on
+//  interfaces with the names of the network interfaces to publish on, nil for all
+//  enableIPv6 includes the IPv6 addresses of the interfaces
+//  wotDiscovery also publishes the WoT Discovery '_wot._tcp' service with the '_directory' subtype
+func NewDirDiscovery(instanceID string, serviceName string, address string, port uint,
+	interfaces []string, enableIPv6 bool, wotDiscovery bool) *DirDiscovery {
 
+	dd := &DirDiscovery{
+		instanceID:   instanceID,
+		serviceName:  serviceName,
+		address:      address,
+		port:         port,
+		interfaces:   interfaces,
+		enableIPv6:   enableIPv6,
+		wotDiscovery: wotDiscovery,
+		refresh:      DefaultDiscoveryRefresh,
+	}
+	return dd
 }
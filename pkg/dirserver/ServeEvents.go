@@ -0,0 +1,112 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// eventPollInterval is the interval to check the change log for new events
+const eventPollInterval = time.Second
+
+// eventType returns the event type of a change
+func eventType(change dirclient.ThingChange) string {
+	if change.Op == dirclient.ChangeOpDelete {
+		return dirclient.EventThingDeleted
+	} else if change.Created {
+		return dirclient.EventThingCreated
+	}
+	return dirclient.EventThingUpdated
+}
+
+// ServeEvents streams the thing_created, thing_updated and thing_deleted events as server-sent
+// events. The events are read from the change log. Use /events/{eventType} for a single type.
+// Created and updated events are only sent for things the user can read. Deleted events are only
+// sent for things the user could read before they were deleted. A thing that the user could read
+// but no longer can after a change of its visibility is sent as deleted, like in the change feed.
+// The event ID is the sync token of the change. Clients that reconnect with the Last-Event-ID
+// header receive the events they missed, if these are still in the change log.
+func (srv *DirectoryServer) ServeEvents(userID string, response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeEvents: Invalid method %s", request.Method))
+		return
+	}
+	filterType := ""
+	if request.URL.Path != dirclient.RouteEvents {
+		parts := strings.Split(request.URL.Path, "/")
+		filterType = parts[len(parts)-1]
+		if filterType != dirclient.EventThingCreated && filterType != dirclient.EventThingUpdated &&
+			filterType != dirclient.EventThingDeleted {
+			srv.tlsServer.WriteNotFound(response, fmt.Sprintf("ServeEvents: Unknown event type '%s'", filterType))
+			return
+		}
+	}
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		srv.tlsServer.WriteInternalError(response, "ServeEvents: streaming is not supported")
+		return
+	}
+	changeLog := srv.store.ChangeLog()
+	seq := changeLog.LastSeq()
+	if lastEventID := request.Header.Get("Last-Event-ID"); lastEventID != "" {
+		instanceID, lastSeq, err := DecodeSyncToken(lastEventID)
+		if err == nil && instanceID == srv.instanceID && lastSeq <= seq {
+			seq = lastSeq
+		}
+	}
+	done := srv.tlsServer.Done()
+	logrus.Infof("ServeEvents: user '%s' subscribed to events '%s'", userID, filterType)
+
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		changes, err := changeLog.Since(seq, dirclient.MaxLimit)
+		if err != nil {
+			// the missed changes are no longer available so continue with the latest
+			logrus.Warningf("ServeEvents: events for user '%s' are lost: %s", userID, err)
+			seq = changeLog.LastSeq()
+			continue
+		} else if len(changes) == 0 {
+			continue
+		}
+		// the ACL can change so authorize each batch of events with a new filter
+		aclFilter := srv.newAclFilter(userID, request)
+		for _, change := range changes {
+			seq = change.Seq
+			evType := eventType(change)
+			if !readableAfter(aclFilter, change) {
+				if !readableBefore(aclFilter, change) {
+					continue
+				}
+				evType = dirclient.EventThingDeleted
+			}
+			if filterType != "" && evType != filterType {
+				continue
+			}
+			data, _ := json.Marshal(dirclient.ThingEvent{ID: change.ThingID})
+			_, err = fmt.Fprintf(response, "event: %s\nid: %s\ndata: %s\n\n",
+				evType, EncodeSyncToken(srv.instanceID, change.Seq), data)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,190 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// ServeThingsExport streams the TDs the user can read as NDJSON or as a JSON array
+// The format is set with the 'format' query parameter. The TDs are sorted by thing ID and
+// redacted for the user.
+func (srv *DirectoryServer) ServeThingsExport(userID string, response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeThingsExport: Invalid method %s", request.Method))
+		return
+	}
+	format := srv.tlsServer.GetQueryString(request, dirclient.ParamFormat, dirclient.FormatNDJSON)
+	if format != dirclient.FormatNDJSON && format != dirclient.FormatJSONArray {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeThingsExport: Invalid format '%s'", format))
+		return
+	}
+	aclFilter := srv.newAclFilter(userID, request)
+	docs, _ := srv.store.Snapshot()
+	thingIDs := make([]string, 0, len(docs))
+	for thingID := range docs {
+		if aclFilter.FilterThing(thingID) {
+			thingIDs = append(thingIDs, thingID)
+		}
+	}
+	sort.Strings(thingIDs)
+	logrus.Infof("ServeThingsExport: exporting %d TDs as %s for user '%s'", len(thingIDs), format, userID)
+
+	flusher, _ := response.(http.Flusher)
+	if format == dirclient.FormatNDJSON {
+		response.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		response.Header().Set("Content-Type", "application/json")
+		response.Write([]byte("["))
+	}
+	for i, thingID := range thingIDs {
+		msg, err := json.Marshal(srv.redactFor(aclFilter, docs[thingID]))
+		if err != nil {
+			logrus.Errorf("ServeThingsExport: Unable to marshal TD '%s': %s", thingID, err)
+			continue
+		}
+		if format == dirclient.FormatNDJSON {
+			msg = append(msg, '\n')
+		} else if i > 0 {
+			response.Write([]byte(","))
+		}
+		response.Write(msg)
+		// stream large directories in chunks
+		if flusher != nil && i%100 == 99 {
+			flusher.Flush()
+		}
+	}
+	if format == dirclient.FormatJSONArray {
+		response.Write([]byte("]"))
+	}
+}
+
+// importTD imports a single TD using the conflict mode
+// Returns the result of the import and the error if it failed
+func (srv *DirectoryServer) importTD(aclFilter *AclFilter, thingTD map[string]interface{},
+	mode string, dryRun bool) (result string, err error) {
+
+	thingID, _ := thingTD["id"].(string)
+	if thingID == "" {
+		return dirclient.ImportResultFailed, fmt.Errorf("missing id")
+	} else if err = checkThingID(thingID); err != nil {
+		return dirclient.ImportResultFailed, err
+	}
+	existingTD, err := srv.store.Get(thingID)
+	exists := err == nil
+	right := RightReplace
+	if exists && mode == dirclient.ImportModeUpsert {
+		right = RightPatch
+	}
+	if !aclFilter.Authorize(thingID, right) {
+		return dirclient.ImportResultFailed, fmt.Errorf("permission denied")
+	}
+	if exists && mode == dirclient.ImportModeSkip {
+		return dirclient.ImportResultSkipped, nil
+	} else if exists && mode == dirclient.ImportModeUpsert {
+		thingTD, err = mergeTD(existingTD, thingTD)
+		if err != nil {
+			return dirclient.ImportResultFailed, err
+		}
+	}
+	validation, accepted := srv.checkTD(thingID, thingTD)
+	if !accepted {
+		return dirclient.ImportResultFailed, fmt.Errorf("TD has %d validation error(s)", len(validation.Errors))
+	}
+	if !dryRun {
+		err = srv.store.Replace(thingID, thingTD)
+		if err != nil {
+			return dirclient.ImportResultFailed, err
+		}
+		srv.claimOwnership(aclFilter, thingID)
+	}
+	if exists {
+		return dirclient.ImportResultUpdated, nil
+	}
+	return dirclient.ImportResultCreated, nil
+}
+
+// ServeThingsImport imports TDs from a NDJSON document or JSON array
+// The 'mode' query parameter determines what to do with existing TDs: upsert, skip or replace.
+// With 'dryrun=true' the import is checked but not applied. Each TD is authorized and validated
+// separately. The response is a dirclient.ImportReport with the result of each TD. Each TD that
+// is imported or fails to import is recorded in the audit log.
+func (srv *DirectoryServer) ServeThingsImport(userID string, response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeThingsImport: Invalid method %s", request.Method))
+		return
+	} else if srv.isReplicaWrite(request) {
+		srv.replica.RedirectToPrimary(response, request)
+		return
+	}
+	mode := srv.tlsServer.GetQueryString(request, dirclient.ParamMode, dirclient.ImportModeUpsert)
+	dryRun := srv.tlsServer.GetQueryString(request, dirclient.ParamDryRun, "false") == "true"
+	if mode != dirclient.ImportModeUpsert && mode != dirclient.ImportModeSkip && mode != dirclient.ImportModeReplace {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeThingsImport: Invalid mode '%s'", mode))
+		return
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	var items []json.RawMessage
+	if err == nil {
+		items, err = dirclient.SplitTDs(body)
+	}
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeThingsImport: %s", err))
+		return
+	}
+	aclFilter := srv.newWriteAclFilter(userID, request)
+	report := dirclient.ImportReport{
+		Mode:   mode,
+		DryRun: dryRun,
+		Items:  make([]dirclient.ImportItemResult, 0, len(items)),
+	}
+	for i, item := range items {
+		itemResult := dirclient.ImportItemResult{Index: i}
+		thingTD := make(map[string]interface{})
+		err = json.Unmarshal(item, &thingTD)
+		revBefore := ""
+		if err == nil {
+			itemResult.ThingID, _ = thingTD["id"].(string)
+			existingTD, _ := srv.store.Get(itemResult.ThingID)
+			revBefore = tdRevision(existingTD)
+			itemResult.Result, err = srv.importTD(aclFilter, thingTD, mode, dryRun)
+		}
+		if err != nil {
+			itemResult.Result = dirclient.ImportResultFailed
+			itemResult.Error = err.Error()
+		}
+		if !dryRun && itemResult.Result != dirclient.ImportResultSkipped {
+			status := http.StatusOK
+			if itemResult.Result == dirclient.ImportResultFailed {
+				status = http.StatusBadRequest
+			}
+			newTD, _ := srv.store.Get(itemResult.ThingID)
+			srv.audit(userID, request, itemResult.ThingID, revBefore, tdRevision(newTD), status)
+		}
+		switch itemResult.Result {
+		case dirclient.ImportResultCreated:
+			report.Created++
+		case dirclient.ImportResultUpdated:
+			report.Updated++
+		case dirclient.ImportResultSkipped:
+			report.Skipped++
+		default:
+			report.Failed++
+		}
+		report.Items = append(report.Items, itemResult)
+	}
+	logrus.Infof("ServeThingsImport: mode=%s, dryRun=%v: %d created, %d updated, %d skipped, %d failed",
+		mode, dryRun, report.Created, report.Updated, report.Skipped, report.Failed)
+	msg, err := json.Marshal(report)
+	if err != nil {
+		srv.tlsServer.WriteInternalError(response, fmt.Sprintf("ServeThingsImport: Marshal error %s", err))
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(msg)
+}
@@ -0,0 +1,280 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// ServeModels lists the latest version of the available Thing Models
+func (srv *DirectoryServer) ServeModels(userID string, response http.ResponseWriter, request *http.Request) {
+	var offset = 0
+	if request.Method != "GET" {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeModels: Invalid method %s", request.Method))
+		return
+	}
+	limit, err := srv.tlsServer.GetQueryInt(request, dirclient.ParamLimit, dirclient.DefaultLimit)
+	if limit > dirclient.MaxLimit {
+		limit = dirclient.MaxLimit
+	}
+	if err == nil {
+		offset, err = srv.tlsServer.GetQueryInt(request, dirclient.ParamOffset, 0)
+	}
+	if err != nil || offset < 0 {
+		srv.tlsServer.WriteBadRequest(response, "ServeModels: offset or limit incorrect")
+		return
+	}
+	logrus.Infof("ServeModels: list offset=%d, limit=%d", offset, limit)
+	records := srv.modelStore.List(offset, limit, nil)
+	modelList := make([]interface{}, 0, len(records))
+	for _, rec := range records {
+		record, ok := rec.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		thingModel, err := getModelVersion(record, "")
+		if err == nil {
+			modelList = append(modelList, thingModel)
+		}
+	}
+	msg, err := json.Marshal(modelList)
+	if err != nil {
+		msg := fmt.Sprintf("ServeModels: Marshal error %s", err)
+		srv.tlsServer.WriteInternalError(response, msg)
+		return
+	}
+	response.Write(msg)
+}
+
+// ServeModelByID serves a request for a particular Thing Model by its ID
+// This splits the request by its REST method: GET, POST, PUT, DELETE
+func (srv *DirectoryServer) ServeModelByID(userID string, response http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(request.URL.Path, "/")
+	modelID := parts[len(parts)-1] // expect the model ID
+	version := srv.tlsServer.GetQueryString(request, dirclient.ParamVersion, "")
+
+	logrus.Infof("ServeModelByID: %s for model with ID %s", request.Method, modelID)
+	switch request.Method {
+	case "GET":
+		srv.ServeGetModel(modelID, version, response)
+	case "POST", "PUT":
+		srv.ServeUpdateModel(userID, modelID, response, request)
+	case "DELETE":
+		srv.ServeDeleteModel(userID, modelID, version, response, request)
+	default:
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("Invalid method %s by %s", request.Method, userID))
+	}
+}
+
+// ServeGetModel returns the requested version of the Thing Model. Use "" for the latest version.
+func (srv *DirectoryServer) ServeGetModel(modelID string, version string, response http.ResponseWriter) {
+	thingModel, err := srv.getModel(modelID, version)
+	if err != nil {
+		srv.tlsServer.WriteNotFound(response, fmt.Sprintf("ServeGetModel: %s", err))
+		return
+	}
+	msg, err := json.Marshal(thingModel)
+	if err != nil {
+		msg := fmt.Sprintf("ServeGetModel: Unable to marshal model with ID %s", modelID)
+		srv.tlsServer.WriteInternalError(response, msg)
+		return
+	}
+	response.Write(msg)
+}
+
+// ServeUpdateModel adds a new version of a Thing Model
+// The version is taken from the model's 'version.model' attribute. If the model has no version then
+// the next revision number is used. An existing version is replaced.
+// The user needs the replace right for the model ID, which is authorized like a TD write.
+func (srv *DirectoryServer) ServeUpdateModel(userID, modelID string, response http.ResponseWriter, request *http.Request) {
+	if !srv.newAclFilter(userID, request).Authorize(modelID, RightReplace) {
+		srv.tlsServer.WriteUnauthorized(response, "ServeUpdateModel: permission denied")
+		return
+	}
+	thingModel := make(map[string]interface{})
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &thingModel)
+	}
+	if err == nil {
+		if atTypes, _ := stringList(thingModel["@type"]); !containsString(atTypes, TMTypeThingModel) {
+			err = fmt.Errorf("@type must include '%s'", TMTypeThingModel)
+		}
+	}
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeUpdateModel: %s", err))
+		return
+	}
+	// verify the references can be resolved
+	_, err = ResolveModel(thingModel, srv.getModel)
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeUpdateModel: %s", err))
+		return
+	}
+	srv.modelMutex.Lock()
+	defer srv.modelMutex.Unlock()
+	// the store holds the record that readers use, so change a copy
+	recordMap, err := srv.copyModelRecord(modelID)
+	if err != nil || recordMap == nil {
+		recordMap = newModelRecord(modelID)
+	}
+	version := addModelVersion(recordMap, thingModel)
+	err = srv.modelStore.Replace(modelID, recordMap)
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeUpdateModel: %s", err))
+		return
+	}
+	logrus.Infof("ServeUpdateModel: stored model '%s' version '%s'", modelID, version)
+	response.WriteHeader(http.StatusCreated)
+}
+
+// ServeDeleteModel deletes a version of a Thing Model, or all versions if version is ""
+// The user needs the delete right for the model ID, which is authorized like a TD delete.
+func (srv *DirectoryServer) ServeDeleteModel(userID, modelID string, version string,
+	response http.ResponseWriter, request *http.Request) {
+	if !srv.newAclFilter(userID, request).Authorize(modelID, RightDelete) {
+		srv.tlsServer.WriteUnauthorized(response, "ServeDeleteModel: permission denied")
+		return
+	}
+	srv.modelMutex.Lock()
+	defer srv.modelMutex.Unlock()
+	if version == "" {
+		srv.modelStore.Remove(modelID)
+		return
+	}
+	// the store holds the record that readers use, so change a copy
+	recordMap, err := srv.copyModelRecord(modelID)
+	if err != nil || recordMap == nil {
+		srv.tlsServer.WriteNotFound(response, fmt.Sprintf("ServeDeleteModel: Unknown model '%s'", modelID))
+		return
+	}
+	versions, _ := recordMap[modelRecordVersions].(map[string]interface{})
+	delete(versions, version)
+	if len(versions) == 0 {
+		srv.modelStore.Remove(modelID)
+		return
+	}
+	// the latest version is the most recent one that is left
+	if recordMap[modelRecordLatest] == version {
+		latest := ""
+		for v := range versions {
+			if compareVersions(v, latest) > 0 {
+				latest = v
+			}
+		}
+		recordMap[modelRecordLatest] = latest
+	}
+	srv.modelStore.Replace(modelID, recordMap)
+}
+
+// ServeInstantiateModel creates a TD from a Thing Model and adds it to the directory
+// The request body contains a dirclient.InstantiateRequest. The response contains the new TD.
+// The creation is recorded in the audit log.
+func (srv *DirectoryServer) ServeInstantiateModel(userID string, response http.ResponseWriter, request *http.Request) {
+	var instReq dirclient.InstantiateRequest
+	parts := strings.Split(request.URL.Path, "/")
+	modelID := parts[len(parts)-2] // expect /models/{modelID}/instantiate
+
+	if request.Method != "POST" {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeInstantiateModel: Invalid method %s", request.Method))
+		return
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &instReq)
+	}
+	if err == nil && instReq.ThingID == "" {
+		err = fmt.Errorf("missing thingID")
+	} else if err == nil {
+		err = checkThingID(instReq.ThingID)
+	}
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeInstantiateModel: %s", err))
+		return
+	}
+	thingID := instReq.ThingID
+	before, _ := srv.store.Get(thingID)
+	revBefore := tdRevision(before)
+	recorder := &statusRecorder{ResponseWriter: response, status: http.StatusOK}
+	response = recorder
+	defer func() {
+		after, _ := srv.store.Get(thingID)
+		srv.audit(userID, request, thingID, revBefore, tdRevision(after), recorder.status)
+	}()
+	aclFilter := srv.newWriteAclFilter(userID, request)
+	if !aclFilter.Authorize(thingID, RightReplace) {
+		srv.tlsServer.WriteUnauthorized(response, "ServeInstantiateModel: permission denied")
+		return
+	}
+	thingModel, err := srv.getModel(modelID, instReq.Version)
+	if err != nil {
+		srv.tlsServer.WriteNotFound(response, fmt.Sprintf("ServeInstantiateModel: %s", err))
+		return
+	}
+	// refer to the actual version used, not 'latest'
+	version := instReq.Version
+	if version == "" {
+		record, _ := srv.modelStore.Get(modelID)
+		recordMap, _ := record.(map[string]interface{})
+		version, _ = recordMap[modelRecordLatest].(string)
+	}
+	var thingTD map[string]interface{}
+	resolvedModel, err := ResolveModel(thingModel, srv.getModel)
+	if err == nil {
+		thingTD, err = InstantiateModel(resolvedModel, modelID, version, thingID, instReq.Placeholders)
+	}
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeInstantiateModel: %s", err))
+		return
+	}
+	result, accepted := srv.validateTD(thingID, thingTD, response)
+	if !accepted {
+		return
+	}
+	err = srv.store.Replace(thingID, thingTD)
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeInstantiateModel: %s", err))
+		return
+	}
+	srv.claimOwnership(aclFilter, thingID)
+	if result != nil {
+		logrus.Warningf("ServeInstantiateModel: TD '%s' from model '%s' is stored with validation errors", thingID, modelID)
+	}
+	logrus.Infof("ServeInstantiateModel: created TD '%s' from model '%s' version '%s'", thingID, modelID, version)
+	msg, _ := json.Marshal(thingTD)
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusCreated)
+	response.Write(msg)
+}
+
+// copyModelRecord returns a copy of the record with the versions of a model
+// Returns nil if the model doesn't exist.
+func (srv *DirectoryServer) copyModelRecord(modelID string) (map[string]interface{}, error) {
+	record, err := srv.modelStore.Get(modelID)
+	if err != nil {
+		return nil, err
+	}
+	return deepCopy(record)
+}
+
+// getModel returns the given version of a Thing Model, or the latest version if version is ""
+func (srv *DirectoryServer) getModel(modelID string, version string) (map[string]interface{}, error) {
+	record, err := srv.modelStore.Get(modelID)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown model '%s'", modelID)
+	}
+	recordMap, ok := record.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid model record for '%s'", modelID)
+	}
+	thingModel, err := getModelVersion(recordMap, version)
+	if err != nil {
+		return nil, fmt.Errorf("model '%s': %s", modelID, err)
+	}
+	return thingModel, nil
+}
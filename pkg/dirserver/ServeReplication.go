@@ -0,0 +1,91 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubserve-go/pkg/certsetup"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// authorizeReplication returns true if the client can read the replication API
+// Replicas connect using a plugin certificate. Administrators can also read the change log.
+func authorizeReplication(certOU string) bool {
+	return certOU == certsetup.OUPlugin || certOU == certsetup.OUAdmin
+}
+
+// ServeReplicationChanges returns the changes of the change log since the given sequence number
+// The response is a dirclient.ChangesResponse.
+func (srv *DirectoryServer) ServeReplicationChanges(userID string, response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeReplicationChanges: Invalid method %s", request.Method))
+		return
+	} else if !authorizeReplication(getCertOU(request)) {
+		srv.tlsServer.WriteUnauthorized(response, "ServeReplicationChanges: permission denied")
+		return
+	}
+	since, err := srv.tlsServer.GetQueryInt(request, dirclient.ParamSince, 0)
+	limit := dirclient.DefaultLimit
+	if err == nil {
+		limit, err = srv.tlsServer.GetQueryInt(request, dirclient.ParamLimit, dirclient.DefaultLimit)
+	}
+	if err != nil || since < 0 || limit <= 0 {
+		srv.tlsServer.WriteBadRequest(response, "ServeReplicationChanges: since or limit incorrect")
+		return
+	}
+	if limit > dirclient.MaxLimit {
+		limit = dirclient.MaxLimit
+	}
+	changeLog := srv.store.ChangeLog()
+	result := dirclient.ChangesResponse{
+		Primary: srv.instanceID,
+		First:   changeLog.FirstSeq(),
+		Last:    changeLog.LastSeq(),
+	}
+	result.Changes, err = changeLog.Since(uint64(since), limit)
+	if err != nil {
+		logrus.Warningf("ServeReplicationChanges: %s. Replica %s must bootstrap", err, userID)
+		result.Truncated = true
+		result.Changes = make([]dirclient.ThingChange, 0)
+	}
+	msg, err := json.Marshal(result)
+	if err != nil {
+		srv.tlsServer.WriteInternalError(response, fmt.Sprintf("ServeReplicationChanges: Marshal error %s", err))
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(msg)
+}
+
+// ServeReplicationSnapshot returns a full copy of the directory
+// The response is a dirclient.SnapshotResponse.
+func (srv *DirectoryServer) ServeReplicationSnapshot(userID string, response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeReplicationSnapshot: Invalid method %s", request.Method))
+		return
+	} else if !authorizeReplication(getCertOU(request)) {
+		srv.tlsServer.WriteUnauthorized(response, "ServeReplicationSnapshot: permission denied")
+		return
+	}
+	docs, seq := srv.store.Snapshot()
+	result := dirclient.SnapshotResponse{
+		Primary: srv.instanceID,
+		Seq:     seq,
+		Things:  make(map[string]map[string]interface{}, len(docs)),
+	}
+	for thingID, doc := range docs {
+		if docMap, ok := doc.(map[string]interface{}); ok {
+			result.Things[thingID] = docMap
+		}
+	}
+	logrus.Infof("ServeReplicationSnapshot: snapshot of %d things at change %d for %s", len(result.Things), seq, userID)
+	msg, err := json.Marshal(result)
+	if err != nil {
+		srv.tlsServer.WriteInternalError(response, fmt.Sprintf("ServeReplicationSnapshot: Marshal error %s", err))
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(msg)
+}
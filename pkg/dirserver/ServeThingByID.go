@@ -8,8 +8,7 @@ import (
 	"strings"
 
 	"github.com/sirupsen/logrus"
-	"github.com/wostzone/hubclient-go/pkg/td"
-	"github.com/wostzone/hubserve-go/pkg/certsetup"
+	"github.com/wostzone/thingdir/pkg/dirclient"
 )
 
 // AclReadFilter determines read access to a thing TD. Intended for querying things.
@@ -20,22 +19,33 @@ import (
 
 // ServeThingID serves a request for a particular Thing by its ID
 // This splits the request by its REST method: GET, POST, PUT, PATCH, DELETE
+// Writes are recorded in the audit log with the revision of the TD before and after the write.
 func (srv *DirectoryServer) ServeThingByID(userID string, response http.ResponseWriter, request *http.Request) {
 	// determine the ID
 	parts := strings.Split(request.URL.Path, "/")
 	thingID := parts[len(parts)-1] // expect the thing ID
-	certOU := certsetup.OUNone
-	if len(request.TLS.PeerCertificates) > 0 {
-		cert := request.TLS.PeerCertificates[0]
-		if len(cert.Subject.OrganizationalUnit) > 0 {
-			certOU = cert.Subject.OrganizationalUnit[0]
-		}
-	}
+	certOU := getCertOU(request)
 
+	if srv.isReplicaWrite(request) {
+		srv.replica.RedirectToPrimary(response, request)
+		return
+	}
 	logrus.Infof("ServeThingByID: %s for TD with ID %s", request.Method, thingID)
+	if request.Method == "GET" {
+		srv.ServeGetTD(userID, certOU, thingID, response, request)
+		return
+	}
+	// patch modifies the stored TD so determine its revision before the write
+	before, _ := srv.store.Get(thingID)
+	revBefore := tdRevision(before)
+	recorder := &statusRecorder{ResponseWriter: response, status: http.StatusOK}
+	response = recorder
+	defer func() {
+		after, _ := srv.store.Get(thingID)
+		srv.audit(userID, request, thingID, revBefore, tdRevision(after), recorder.status)
+	}()
+
 	switch request.Method {
-	case "GET":
-		srv.ServeGetTD(userID, certOU, thingID, response)
 	case "PATCH":
 		srv.ServePatchTD(userID, certOU, thingID, response, request)
 	case "POST":
@@ -43,17 +53,17 @@ func (srv *DirectoryServer) ServeThingByID(userID string, response http.Response
 	case "PUT":
 		srv.ServeReplaceTD(userID, certOU, thingID, response, request)
 	case "DELETE":
-		srv.ServeDeleteTD(userID, certOU, thingID, response)
+		srv.ServeDeleteTD(userID, certOU, thingID, response, request)
 	default:
 		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("Invalid method %s by %s", request.Method, userID))
 	}
 }
 
 // serveGetThing retrieve the requested TD
-func (srv *DirectoryServer) ServeGetTD(userID, certOU, thingID string, response http.ResponseWriter) {
-
-	if srv.authorizer != nil &&
-		!srv.authorizer(userID, certOU, thingID, false, td.MessageTypeTD) {
+// Fields are redacted if the user can't edit the TD.
+func (srv *DirectoryServer) ServeGetTD(userID, certOU, thingID string, response http.ResponseWriter, request *http.Request) {
+	aclFilter := srv.newAclFilter(userID, request)
+	if !aclFilter.Authorize(thingID, RightRead) {
 		srv.tlsServer.WriteUnauthorized(response, "ServeGetTD: permission denied")
 		return
 	}
@@ -64,6 +74,9 @@ func (srv *DirectoryServer) ServeGetTD(userID, certOU, thingID string, response
 		srv.tlsServer.WriteNotFound(response, msg)
 		return
 	}
+	if srv.redactor != nil {
+		td = srv.redactor.RedactFor(aclFilter, td)
+	}
 	msg, err := json.Marshal(td)
 	if err != nil {
 		msg := fmt.Sprintf("ServeGetTD: Unable to marshal thing with ID %s", thingID)
@@ -73,21 +86,27 @@ func (srv *DirectoryServer) ServeGetTD(userID, certOU, thingID string, response
 	response.Write(msg)
 }
 
-// ServeDeleteTD deletes the requested TD
-func (srv *DirectoryServer) ServeDeleteTD(userID, certOU, thingID string, response http.ResponseWriter) {
-	if srv.authorizer != nil && !srv.authorizer(userID, certOU, thingID, true, td.MessageTypeTD) {
+// ServeDeleteTD deletes the requested TD and moves it to the trash
+// Returns 404 if the thing doesn't exist
+func (srv *DirectoryServer) ServeDeleteTD(userID, certOU, thingID string, response http.ResponseWriter, request *http.Request) {
+	if !srv.newWriteAclFilter(userID, request).Authorize(thingID, RightDelete) {
 		srv.tlsServer.WriteUnauthorized(response, "ServeDeleteTD: permission denied")
 		return
 	}
-
+	existingTD, err := srv.store.Get(thingID)
+	if err != nil {
+		srv.tlsServer.WriteNotFound(response, fmt.Sprintf("ServeDeleteTD: Unknown Thing with ID '%s'", thingID))
+		return
+	}
 	srv.store.Remove(thingID)
+	srv.moveToTrash(userID, thingID, existingTD)
 	// should we return the original? no, return 204
 }
 
 // ServeUpdateThing update only the provided parts of a thing's TD
 func (srv *DirectoryServer) ServePatchTD(userID, certOU, thingID string, response http.ResponseWriter, request *http.Request) {
-
-	if srv.authorizer != nil && !srv.authorizer(userID, certOU, thingID, true, td.MessageTypeTD) {
+	aclFilter := srv.newWriteAclFilter(userID, request)
+	if !aclFilter.Authorize(thingID, RightPatch) {
 		srv.tlsServer.WriteUnauthorized(response, "ServePatchTD: permission denied")
 		return
 	}
@@ -98,18 +117,68 @@ func (srv *DirectoryServer) ServePatchTD(userID, certOU, thingID string, respons
 	if err == nil {
 		err = json.Unmarshal(body, &td)
 	}
-	if err == nil {
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServePatchTD: %s", err))
+		return
+	}
+	existingTD, err := srv.store.Get(thingID)
+	if err != nil {
+		srv.tlsServer.WriteNotFound(response, fmt.Sprintf("ServePatchTD: Unknown Thing with ID '%s'", thingID))
+		return
+	}
+	if srv.validationMode == ValidationModeOff || srv.validationMode == "" {
 		err = srv.store.Patch(thingID, td)
+		if err != nil {
+			srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServePatchTD: %s", err))
+			return
+		}
+		srv.claimOwnership(aclFilter, thingID)
+		return
 	}
+	// validate the result of the patch before storing it
+	mergedTD, err := mergeTD(existingTD, td)
 	if err != nil {
 		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServePatchTD: %s", err))
 		return
 	}
+	result, accepted := srv.validateTD(thingID, mergedTD, response)
+	if !accepted {
+		return
+	}
+	err = srv.store.Replace(thingID, mergedTD)
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServePatchTD: %s", err))
+		return
+	}
+	srv.claimOwnership(aclFilter, thingID)
+	srv.writeValidationResult(result, http.StatusOK, response)
+}
+
+// reservedThingIDs are the IDs that can't be used by things as they are paths of the directory
+// API, eg /things/changes
+var reservedThingIDs = map[string]bool{
+	strings.TrimPrefix(dirclient.RouteThingChanges, dirclient.RouteThings+"/"): true,
+	strings.TrimPrefix(dirclient.RouteThingsExport, dirclient.RouteThings+"/"): true,
+	strings.TrimPrefix(dirclient.RouteThingsImport, dirclient.RouteThings+"/"): true,
+	strings.TrimPrefix(dirclient.RouteThingsBatch, dirclient.RouteThings+"/"):  true,
+}
+
+// checkThingID returns an error if the thing ID is reserved for the directory API
+func checkThingID(thingID string) error {
+	if reservedThingIDs[thingID] {
+		return fmt.Errorf("thing ID '%s' is reserved", thingID)
+	}
+	return nil
 }
 
 // Create or replace a TD
 func (srv *DirectoryServer) ServeReplaceTD(userID, certOU, thingID string, response http.ResponseWriter, request *http.Request) {
-	if srv.authorizer != nil && !srv.authorizer(userID, certOU, thingID, true, td.MessageTypeTD) {
+	if err := checkThingID(thingID); err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeReplaceTD: %s", err))
+		return
+	}
+	aclFilter := srv.newWriteAclFilter(userID, request)
+	if !aclFilter.Authorize(thingID, RightReplace) {
 		srv.tlsServer.WriteUnauthorized(response, "ServeReplaceTD: permission denied")
 		return
 	}
@@ -123,6 +192,10 @@ func (srv *DirectoryServer) ServeReplaceTD(userID, certOU, thingID string, respo
 		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeReplaceTD: %s", err))
 		return
 	}
+	result, accepted := srv.validateTD(thingID, td, response)
+	if !accepted {
+		return
+	}
 	existingTD, _ := srv.store.Get(thingID)
 
 	err = srv.store.Replace(thingID, td)
@@ -130,11 +203,64 @@ func (srv *DirectoryServer) ServeReplaceTD(userID, certOU, thingID string, respo
 		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeReplaceTD: %s", err))
 		return
 	}
+	srv.claimOwnership(aclFilter, thingID)
 	if existingTD != nil {
 		// return 200 (OK)
-		// default
+		srv.writeValidationResult(result, http.StatusOK, response)
 	} else {
 		// return 201 (Created)
-		response.WriteHeader(http.StatusCreated)
+		srv.writeValidationResult(result, http.StatusCreated, response)
+	}
+}
+
+// validateTD validates the TD using the server's validation mode.
+// In warn mode the errors are added to the TD under the ValidationAnnotation attribute.
+// In reject mode a bad request with the list of errors is written to the response.
+// Returns the validation result if errors were found, and false if the TD is rejected.
+func (srv *DirectoryServer) validateTD(thingID string, thingTD map[string]interface{},
+	response http.ResponseWriter) (result *ValidationResult, accepted bool) {
+
+	result, accepted = srv.checkTD(thingID, thingTD)
+	if !accepted {
+		srv.writeValidationResult(result, http.StatusBadRequest, response)
+	}
+	return result, accepted
+}
+
+// checkTD validates the TD using the server's validation mode without writing a response.
+// In warn mode the errors are added to the TD under the ValidationAnnotation attribute.
+// Returns the validation result if errors were found, and false if the TD is rejected.
+func (srv *DirectoryServer) checkTD(thingID string, thingTD map[string]interface{}) (result *ValidationResult, accepted bool) {
+	if srv.validationMode == ValidationModeOff || srv.validationMode == "" {
+		return nil, true
+	}
+	// clients can't provide their own validation results
+	delete(thingTD, ValidationAnnotation)
+
+	errors := ValidateTD(thingID, thingTD, srv.tdSchema)
+	if len(errors) == 0 {
+		return nil, true
+	}
+	result = &ValidationResult{ThingID: thingID, Errors: errors}
+	logrus.Warningf("checkTD: TD with ID '%s' has %d validation error(s)", thingID, len(errors))
+
+	if srv.validationMode == ValidationModeReject {
+		return result, false
 	}
+	thingTD[ValidationAnnotation] = errors
+	return result, true
+}
+
+// writeValidationResult writes the response status and the validation errors, if any, as JSON
+func (srv *DirectoryServer) writeValidationResult(result *ValidationResult, status int, response http.ResponseWriter) {
+	if result == nil {
+		if status != http.StatusOK {
+			response.WriteHeader(status)
+		}
+		return
+	}
+	msg, _ := json.Marshal(result)
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	response.Write(msg)
 }
@@ -1,27 +1,99 @@
 package dirserver
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/sirupsen/logrus"
-	"github.com/wostzone/hubserve-go/pkg/certsetup"
+	"github.com/wostzone/hubclient-go/pkg/td"
 	"github.com/wostzone/thingdir/pkg/dirclient"
 )
 
-// ServeThings lists or queries available TDs
-// If a queryparam is provided then run a query, otherwise get the list
+// ServeThings serves a request for the collection of things
+// This splits the request by its REST method: GET to list or query, POST to create an anonymous TD,
+// DELETE or PATCH to delete or patch the things matching a query.
 func (srv *DirectoryServer) ServeThings(userID string, response http.ResponseWriter, request *http.Request) {
+	certOU := getCertOU(request)
+
+	if srv.isReplicaWrite(request) {
+		srv.replica.RedirectToPrimary(response, request)
+		return
+	}
+	switch request.Method {
+	case "GET":
+		srv.ServeQueryThings(userID, certOU, response, request)
+	case "POST":
+		srv.ServeCreateTD(userID, certOU, response, request)
+	case "DELETE", "PATCH":
+		srv.ServeBulkByQuery(userID, certOU, response, request)
+	default:
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("Invalid method %s by %s", request.Method, userID))
+	}
+}
+
+// ServeCreateTD adds a TD without an ID to the directory
+// The server assigns a 'urn:uuid:' ID, stores it in the TD and returns 201 (Created) with the
+// location of the new TD. The response body contains the TD with its new ID. The creation is
+// recorded in the audit log.
+func (srv *DirectoryServer) ServeCreateTD(userID, certOU string, response http.ResponseWriter, request *http.Request) {
+	thingTD := make(map[string]interface{})
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &thingTD)
+	}
+	if err == nil && thingTD["id"] != nil {
+		err = fmt.Errorf("TD already has an ID. Use PUT %s to create it", dirclient.RouteThingID)
+	}
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeCreateTD: %s", err))
+		return
+	}
+	thingID, err := NewThingUUID()
+	if err != nil {
+		srv.tlsServer.WriteInternalError(response, fmt.Sprintf("ServeCreateTD: %s", err))
+		return
+	}
+	recorder := &statusRecorder{ResponseWriter: response, status: http.StatusOK}
+	response = recorder
+	defer func() {
+		after, _ := srv.store.Get(thingID)
+		srv.audit(userID, request, thingID, "", tdRevision(after), recorder.status)
+	}()
+	aclFilter := srv.newWriteAclFilter(userID, request)
+	if !aclFilter.Authorize(thingID, RightReplace) {
+		srv.tlsServer.WriteUnauthorized(response, "ServeCreateTD: permission denied")
+		return
+	}
+	thingTD["id"] = thingID
+	_, accepted := srv.validateTD(thingID, thingTD, response)
+	if !accepted {
+		return
+	}
+	err = srv.store.Replace(thingID, thingTD)
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeCreateTD: %s", err))
+		return
+	}
+	srv.claimOwnership(aclFilter, thingID)
+	logrus.Infof("ServeCreateTD: created TD with ID '%s'", thingID)
+	msg, _ := json.Marshal(thingTD)
+	response.Header().Set("Location", strings.Replace(dirclient.RouteThingID, "{thingID}", thingID, 1))
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusCreated)
+	response.Write(msg)
+}
+
+// ServeQueryThings lists or queries available TDs
+// If a queryparam is provided then run a query, otherwise get the list. With the model parameter
+// only the TDs derived from that Thing Model are included, optionally of the given model version.
+// The model parameter is not supported with the federated scope.
+func (srv *DirectoryServer) ServeQueryThings(userID, certOU string, response http.ResponseWriter, request *http.Request) {
 	var offset = 0
 	var tdList []interface{}
-	certOU := certsetup.OUNone
-	if len(request.TLS.PeerCertificates) > 0 {
-		cert := request.TLS.PeerCertificates[0]
-		if len(cert.Subject.OrganizationalUnit) > 0 {
-			certOU = cert.Subject.OrganizationalUnit[0]
-		}
-	}
 
 	limit, err := srv.tlsServer.GetQueryInt(request, dirclient.ParamLimit, dirclient.DefaultLimit)
 	if limit > dirclient.MaxLimit {
@@ -35,15 +107,63 @@ func (srv *DirectoryServer) ServeThings(userID string, response http.ResponseWri
 		return
 	}
 	jsonPath := srv.tlsServer.GetQueryString(request, dirclient.ParamQuery, "")
+	scope := srv.tlsServer.GetQueryString(request, dirclient.ParamScope, dirclient.ScopeLocal)
+	modelID := srv.tlsServer.GetQueryString(request, dirclient.ParamModel, "")
+	modelVersion := srv.tlsServer.GetQueryString(request, dirclient.ParamVersion, "")
+
+	aclFilter := srv.newAclFilter(userID, request)
+	filter := aclFilter.FilterThing
+	var modelDocs map[string]interface{}
+	if modelID != "" {
+		// the TDs derived from the model
+		modelDocs, _ = srv.store.Snapshot()
+		for thingID, doc := range modelDocs {
+			docMap, _ := doc.(map[string]interface{})
+			tdModelID, tdModelVersion := GetTDModel(docMap)
+			if tdModelID != modelID || (modelVersion != "" && tdModelVersion != modelVersion) {
+				delete(modelDocs, thingID)
+			}
+		}
+		filter = func(thingID string) bool {
+			_, isModelTD := modelDocs[thingID]
+			return isModelTD && aclFilter.FilterThing(thingID)
+		}
+	}
 
-	aclFilter := NewAclFilter(userID, certOU, srv.authorizer)
+	if scope == dirclient.ScopeFederated && modelID != "" {
+		srv.tlsServer.WriteBadRequest(response, "ServeThings: the model parameter is not supported with scope federated")
+		return
+	} else if scope == dirclient.ScopeFederated {
+		srv.ServeFederatedQuery(jsonPath, offset, limit, aclFilter, response)
+		return
+	} else if scope != dirclient.ScopeLocal {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeThings: invalid scope '%s'", scope))
+		return
+	}
 
 	if jsonPath == "" {
 		logrus.Infof("ServeThings: list offset=%d, limit=%d", offset, limit)
-		tdList = srv.store.List(offset, limit, aclFilter.FilterThing)
+		tdList = srv.store.List(offset, limit, filter)
+		if srv.redactor != nil {
+			for i, item := range tdList {
+				tdList[i] = srv.redactor.RedactFor(aclFilter, item)
+			}
+		}
+	} else if srv.redactor != nil {
+		// query the redacted TDs so redacted fields can't be queried
+		logrus.Infof("ServeThings: Query='%s', offset=%d, limit=%d on redacted TDs", jsonPath, offset, limit)
+		docs := modelDocs
+		if docs == nil {
+			docs, _ = srv.store.Snapshot()
+		}
+		tdList, err = srv.redactor.Query(jsonPath, docs, offset, limit, aclFilter)
+		if err != nil {
+			srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeThings: query error: %s", err))
+			return
+		}
 	} else {
 		logrus.Infof("ServeThings: Query='%s', offset=%d, limit=%d", jsonPath, offset, limit)
-		tdList, err = srv.store.Query(jsonPath, offset, limit, aclFilter.FilterThing)
+		tdList, err = srv.store.Query(jsonPath, offset, limit, filter)
 		if err != nil {
 			msg := fmt.Sprintf("ServeThings: query error: %s", err)
 			srv.tlsServer.WriteBadRequest(response, msg)
@@ -59,3 +179,101 @@ func (srv *DirectoryServer) ServeThings(userID string, response http.ResponseWri
 	}
 	response.Write(msg)
 }
+
+// ServeFederatedQuery lists or queries the TDs of this directory and its peer directories
+// The results are merged and de-duplicated by thing ID, where TDs of this directory take precedence
+// over those of the peers, and peers over the peers that follow. TDs from peers are filtered with
+// the permissions of the user and redacted for users that can't edit them. The response is a
+// dirclient.FederatedResult.
+func (srv *DirectoryServer) ServeFederatedQuery(jsonPath string, offset int, limit int,
+	aclFilter *AclFilter, response http.ResponseWriter) {
+	var localList []interface{}
+	var err error
+	var result = dirclient.FederatedResult{
+		Things: make([]td.ThingTD, 0),
+		Peers:  make([]dirclient.PeerResult, 0),
+	}
+	// each source provides up to offset+limit TDs to page through the merged list
+	sourceLimit := offset + limit
+
+	logrus.Infof("ServeFederatedQuery: Query='%s', offset=%d, limit=%d", jsonPath, offset, limit)
+	if jsonPath == "" {
+		localList = srv.store.List(0, sourceLimit, aclFilter.FilterThing)
+		if srv.redactor != nil {
+			for i, item := range localList {
+				localList[i] = srv.redactor.RedactFor(aclFilter, item)
+			}
+		}
+	} else {
+		if srv.redactor != nil {
+			docs, _ := srv.store.Snapshot()
+			localList, err = srv.redactor.Query(jsonPath, docs, 0, sourceLimit, aclFilter)
+		} else {
+			localList, err = srv.store.Query(jsonPath, 0, sourceLimit, aclFilter.FilterThing)
+		}
+		if err != nil {
+			srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeFederatedQuery: query error: %s", err))
+			return
+		}
+	}
+	merged := make([]td.ThingTD, 0, len(localList))
+	thingIDs := make(map[string]bool)
+	for _, item := range localList {
+		var thingTD td.ThingTD
+		switch tdItem := item.(type) {
+		case td.ThingTD:
+			thingTD = tdItem
+		case map[string]interface{}:
+			thingTD = tdItem
+		default:
+			continue
+		}
+		thingID, _ := thingTD["id"].(string)
+		thingIDs[thingID] = true
+		merged = append(merged, thingTD)
+	}
+	if srv.federation != nil {
+		var peerLists [][]td.ThingTD
+		result.Peers, peerLists = srv.federation.QueryPeers(jsonPath, sourceLimit)
+		for i, peerList := range peerLists {
+			result.Partial = result.Partial || result.Peers[i].Error != ""
+			for _, thingTD := range peerList {
+				thingID, _ := thingTD["id"].(string)
+				if thingID == "" || thingIDs[thingID] || !aclFilter.FilterThing(thingID) {
+					continue
+				}
+				thingIDs[thingID] = true
+				if srv.redactor != nil {
+					thingTD = srv.redactor.RedactFor(aclFilter, map[string]interface{}(thingTD)).(map[string]interface{})
+				}
+				merged = append(merged, thingTD)
+			}
+		}
+	}
+	if offset < len(merged) {
+		end := offset + limit
+		if end > len(merged) {
+			end = len(merged)
+		}
+		result.Things = merged[offset:end]
+	}
+	msg, err := json.Marshal(result)
+	if err != nil {
+		srv.tlsServer.WriteInternalError(response, fmt.Sprintf("ServeFederatedQuery: Marshal error %s", err))
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(msg)
+}
+
+// NewThingUUID returns a new random thing ID in the form 'urn:uuid:{uuid}', using a version 4 UUID
+func NewThingUUID() (string, error) {
+	uuid := make([]byte, 16)
+	_, err := rand.Read(uuid)
+	if err != nil {
+		return "", err
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40 // version 4
+	uuid[8] = (uuid[8] & 0x3f) | 0x80 // variant RFC4122
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
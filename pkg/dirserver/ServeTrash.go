@@ -0,0 +1,179 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+)
+
+// DefaultTrashStoreFile is the file with the deleted TDs
+const DefaultTrashStoreFile = "directory-trash.json"
+
+// DefaultTrashRetention is the time deleted TDs are kept in the trash before they are purged
+const DefaultTrashRetention = 7 * 24 * time.Hour
+
+// getTrashEntry returns the trash entry of a deleted thing
+// Returns an error if the thing is not in the trash
+func (srv *DirectoryServer) getTrashEntry(thingID string) (*dirclient.TrashEntry, error) {
+	var entry dirclient.TrashEntry
+	record, err := srv.trashStore.Get(thingID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = json.Unmarshal(data, &entry)
+	}
+	return &entry, err
+}
+
+// moveToTrash adds a deleted TD to the trash
+// The TD must already be removed from the directory. A previous entry with the same ID is replaced.
+// The owner of the thing is kept with the TD until it is restored.
+func (srv *DirectoryServer) moveToTrash(userID string, thingID string, thingTD interface{}) {
+	srv.purgeExpiredTrash()
+	record := map[string]interface{}{
+		"thingID":   thingID,
+		"td":        thingTD,
+		"deleted":   time.Now().Format(time.RFC3339),
+		"deletedBy": userID,
+		"owner":     srv.getOwner(thingID),
+	}
+	srv.setOwner(thingID, "")
+	err := srv.trashStore.Replace(thingID, record)
+	if err != nil {
+		logrus.Errorf("moveToTrash: Unable to keep TD '%s' in the trash: %s", thingID, err)
+	}
+}
+
+// purgeExpiredTrash removes the TDs that have been in the trash longer than the retention period
+func (srv *DirectoryServer) purgeExpiredTrash() {
+	if srv.trashRetention <= 0 {
+		return
+	}
+	oldest := time.Now().Add(-srv.trashRetention)
+	for thingID, record := range srv.trashStore.Snapshot() {
+		recordMap, _ := record.(map[string]interface{})
+		deletedString, _ := recordMap["deleted"].(string)
+		deleted, err := time.Parse(time.RFC3339, deletedString)
+		if err != nil || deleted.Before(oldest) {
+			logrus.Infof("purgeExpiredTrash: purging TD '%s' deleted at '%s'", thingID, deletedString)
+			srv.trashStore.Remove(thingID)
+		}
+	}
+}
+
+// ServeTrash serves a request for the collection of deleted things
+// GET lists the deleted TDs the user can read, redacted for the user. DELETE purges the deleted
+// TDs the user can write and records each purge in the audit log.
+func (srv *DirectoryServer) ServeTrash(userID string, response http.ResponseWriter, request *http.Request) {
+	srv.purgeExpiredTrash()
+	switch request.Method {
+	case "GET":
+		limit, err := srv.tlsServer.GetQueryInt(request, dirclient.ParamLimit, dirclient.DefaultLimit)
+		if limit > dirclient.MaxLimit {
+			limit = dirclient.MaxLimit
+		}
+		offset := 0
+		if err == nil {
+			offset, err = srv.tlsServer.GetQueryInt(request, dirclient.ParamOffset, 0)
+		}
+		if err != nil || offset < 0 {
+			srv.tlsServer.WriteBadRequest(response, "ServeTrash: offset or limit incorrect")
+			return
+		}
+		aclFilter := srv.newAclFilter(userID, request)
+		entries := make([]interface{}, 0)
+		for _, record := range srv.trashStore.List(offset, limit, aclFilter.FilterThing) {
+			recordMap, ok := record.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if srv.redactor != nil {
+				// copy the record as the stored record must remain intact
+				redacted := make(map[string]interface{}, len(recordMap))
+				for key, value := range recordMap {
+					redacted[key] = value
+				}
+				redacted["td"] = srv.redactFor(aclFilter, recordMap["td"])
+				recordMap = redacted
+			}
+			entries = append(entries, recordMap)
+		}
+		msg, err := json.Marshal(entries)
+		if err != nil {
+			srv.tlsServer.WriteInternalError(response, fmt.Sprintf("ServeTrash: Marshal error %s", err))
+			return
+		}
+		response.Header().Set("Content-Type", "application/json")
+		response.Write(msg)
+	case "DELETE":
+		count := 0
+		aclFilter := srv.newWriteAclFilter(userID, request)
+		for thingID, record := range srv.trashStore.Snapshot() {
+			if aclFilter.Authorize(thingID, RightDelete) {
+				recordMap, _ := record.(map[string]interface{})
+				srv.trashStore.Remove(thingID)
+				srv.audit(userID, request, thingID, tdRevision(recordMap["td"]), "", http.StatusOK)
+				count++
+			}
+		}
+		logrus.Infof("ServeTrash: user '%s' purged %d TDs from the trash", userID, count)
+	default:
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("Invalid method %s by %s", request.Method, userID))
+	}
+}
+
+// ServeTrashByID purges a deleted TD from the trash, or restores it when the path ends with /restore
+// The purge or restore is recorded in the audit log.
+func (srv *DirectoryServer) ServeTrashByID(userID string, response http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(request.URL.Path, "/")
+	restore := parts[len(parts)-1] == "restore"
+	thingID := parts[len(parts)-1]
+	if restore {
+		thingID = parts[len(parts)-2] // expect /trash/{thingID}/restore
+	}
+	if (restore && request.Method != "POST") || (!restore && request.Method != "DELETE") {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeTrashByID: Invalid method %s", request.Method))
+		return
+	}
+	right := RightDelete
+	if restore {
+		right = RightReplace
+	}
+	if !srv.newWriteAclFilter(userID, request).Authorize(thingID, right) {
+		srv.tlsServer.WriteUnauthorized(response, "ServeTrashByID: permission denied")
+		return
+	}
+	srv.purgeExpiredTrash()
+	entry, err := srv.getTrashEntry(thingID)
+	if err != nil {
+		srv.tlsServer.WriteNotFound(response, fmt.Sprintf("ServeTrashByID: Thing '%s' is not in the trash", thingID))
+		return
+	}
+	if !restore {
+		logrus.Infof("ServeTrashByID: user '%s' purged TD '%s'", userID, thingID)
+		srv.trashStore.Remove(thingID)
+		srv.audit(userID, request, thingID, tdRevision(entry.TD), "", http.StatusOK)
+		return
+	}
+	if _, err = srv.store.Get(thingID); err == nil {
+		srv.tlsServer.WriteBadRequest(response,
+			fmt.Sprintf("ServeTrashByID: Thing '%s' already exists and can't be restored", thingID))
+		return
+	}
+	err = srv.store.Replace(thingID, entry.TD)
+	if err != nil {
+		srv.tlsServer.WriteBadRequest(response, fmt.Sprintf("ServeTrashByID: %s", err))
+		return
+	}
+	srv.setOwner(thingID, entry.Owner)
+	srv.trashStore.Remove(thingID)
+	srv.audit(userID, request, thingID, "", tdRevision(entry.TD), http.StatusOK)
+	logrus.Infof("ServeTrashByID: user '%s' restored TD '%s'", userID, thingID)
+}
@@ -0,0 +1,414 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wostzone/thingdir/pkg/dirclient"
+	"github.com/wostzone/thingdir/pkg/dirstore/dirfilestore"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ValidationMode determines what the server does with TDs that fail validation
+type ValidationMode string
+
+// Validation modes for updates to TDs
+const (
+	ValidationModeOff    ValidationMode = "off"    // accept TDs without validation
+	ValidationModeWarn   ValidationMode = "warn"   // store invalid TDs and annotate them with the errors
+	ValidationModeReject ValidationMode = "reject" // reject invalid TDs with a bad request
+)
+
+// ValidationAnnotation is the TD attribute that holds the validation errors in warn mode
+const ValidationAnnotation = "wost:validationErrors"
+
+// DefaultTDSchemaFile is the file name of the W3C TD 1.1 JSON schema in the config folder
+// The schema is published as validation/td-json-schema-validation.json in the
+// w3c/wot-thing-description repository, with $id https://www.w3.org/2022/wot/td-schema/v1.1
+const DefaultTDSchemaFile = "td-json-schema-validation.json"
+
+// TD contexts accepted in the @context attribute
+const (
+	TDContextV1  = "https://www.w3.org/2019/wot/td/v1"
+	TDContextV11 = "https://www.w3.org/2022/wot/td/v1.1"
+)
+
+// Security schemes defined in the TD 1.1 specification. Other schemes must use a prefix, eg 'ace:ACESecurityScheme'
+var tdSecuritySchemes = []string{
+	"nosec", "combo", "basic", "digest", "bearer", "psk", "oauth2", "apikey", "auto"}
+
+// ValidationError describes a single problem found in a TD
+type ValidationError struct {
+	Path    string `json:"path"`    // JSON pointer to the offending attribute, "" for the document
+	Message string `json:"message"` // description of the problem
+}
+
+// ValidationResult is the response body of a rejected TD and the value of the warn annotation
+type ValidationResult struct {
+	ThingID string            `json:"thingID"`
+	Errors  []ValidationError `json:"errors"`
+}
+
+// TDSchema is a loaded JSON schema that TDs are validated against
+type TDSchema struct {
+	schema *gojsonschema.Schema
+}
+
+// LoadTDSchema loads the TD JSON schema from file
+//  schemaPath is the path to the W3C TD 1.1 JSON schema file
+// Returns an error if the file can't be read or isn't a valid JSON schema
+func LoadTDSchema(schemaPath string) (*TDSchema, error) {
+	data, err := ioutil.ReadFile(schemaPath)
+	if err != nil {
+		return nil, fmt.Errorf("LoadTDSchema: %s", err)
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return nil, fmt.Errorf("LoadTDSchema: invalid schema '%s': %s", schemaPath, err)
+	}
+	return &TDSchema{schema: schema}, nil
+}
+
+// pointerToken escapes a name for use in a JSON pointer as defined in RFC 6901
+func pointerToken(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
+
+// tdValidator collects the errors found while validating a TD
+type tdValidator struct {
+	errors []ValidationError
+}
+
+// validateSchema adds the errors of the validation of the TD against the JSON schema
+func (v *tdValidator) validateSchema(schema *TDSchema, thingTD map[string]interface{}) {
+	result, err := schema.schema.Validate(gojsonschema.NewGoLoader(thingTD))
+	if err != nil {
+		v.addError("", "schema validation failed: %s", err)
+		return
+	}
+	for _, resultErr := range result.Errors() {
+		// the context is '(root)' followed by the attribute names, separated by NUL to keep
+		// names with dots intact
+		path := ""
+		for _, name := range strings.Split(resultErr.Context().String("\x00"), "\x00")[1:] {
+			path += "/" + pointerToken(name)
+		}
+		if property, found := resultErr.Details()["property"]; found && resultErr.Type() == "required" {
+			path += "/" + pointerToken(fmt.Sprint(property))
+		}
+		v.addError(path, "%s", resultErr.Description())
+	}
+}
+
+// addError adds a validation error for the attribute at the given JSON pointer
+func (v *tdValidator) addError(path string, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// isString returns true if the value is a string. Empty strings fail if notEmpty is set
+func isString(value interface{}, notEmpty bool) bool {
+	s, ok := value.(string)
+	return ok && (!notEmpty || s != "")
+}
+
+// stringList returns the value as a list of strings.
+// A single string is returned as a list with one item. Returns false if the value is neither.
+func stringList(value interface{}) ([]string, bool) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, true
+	case []string:
+		return v, true
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			result = append(result, s)
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+// validateContext checks that @context contains the TD context URI
+func (v *tdValidator) validateContext(thingTD map[string]interface{}) {
+	ctx, found := thingTD["@context"]
+	if !found {
+		v.addError("/@context", "missing required attribute")
+		return
+	}
+	// @context is a URI, or an array that holds URIs and prefix maps
+	var uris []string
+	switch c := ctx.(type) {
+	case string:
+		uris = append(uris, c)
+	case []interface{}:
+		for _, item := range c {
+			if s, ok := item.(string); ok {
+				uris = append(uris, s)
+			} else if _, ok := item.(map[string]interface{}); !ok {
+				v.addError("/@context", "items must be a URI or a prefix map")
+			}
+		}
+	default:
+		v.addError("/@context", "must be a URI or an array")
+		return
+	}
+	for _, uri := range uris {
+		if uri == TDContextV1 || uri == TDContextV11 {
+			return
+		}
+	}
+	v.addError("/@context", "must include '%s' or '%s'", TDContextV11, TDContextV1)
+}
+
+// validateSecurity checks the security definitions and that the security references exist
+func (v *tdValidator) validateSecurity(thingTD map[string]interface{}) map[string]interface{} {
+	secDefs, found := thingTD["securityDefinitions"]
+	secDefMap, isMap := secDefs.(map[string]interface{})
+	if !found {
+		v.addError("/securityDefinitions", "missing required attribute")
+	} else if !isMap || len(secDefMap) == 0 {
+		v.addError("/securityDefinitions", "must be an object with at least one definition")
+	}
+	for name, secDef := range secDefMap {
+		path := "/securityDefinitions/" + pointerToken(name)
+		secScheme, ok := secDef.(map[string]interface{})
+		if !ok {
+			v.addError(path, "must be an object")
+			continue
+		}
+		scheme, ok := secScheme["scheme"].(string)
+		if !ok || scheme == "" {
+			v.addError(path+"/scheme", "missing required attribute")
+		} else if !strings.Contains(scheme, ":") && !containsString(tdSecuritySchemes, scheme) {
+			v.addError(path+"/scheme", "unknown security scheme '%s'", scheme)
+		}
+	}
+
+	if security, found := thingTD["security"]; !found {
+		v.addError("/security", "missing required attribute")
+	} else {
+		v.validateSecurityRefs("/security", security, secDefMap)
+	}
+	return secDefMap
+}
+
+// checkURI returns an error if the value is not a valid URI
+// URI references are relative to the base of the TD. URI templates, eg "/things{?offset}", are
+// allowed in references as TD forms use them.
+//  absolute requires a URI with a scheme, eg "urn:thing1" or "https://host/thing1"
+func checkURI(value string, absolute bool) error {
+	for _, c := range value {
+		if c <= ' ' || c == 0x7f || strings.ContainsRune(`"<>\^|`+"`", c) {
+			return fmt.Errorf("invalid character %q", c)
+		}
+	}
+	uri, err := url.Parse(value)
+	if err != nil {
+		return err
+	} else if absolute && !uri.IsAbs() {
+		return fmt.Errorf("'%s' is not an absolute URI", value)
+	} else if uri.IsAbs() && uri.Opaque == "" && uri.Host == "" && uri.Path == "" {
+		return fmt.Errorf("'%s' has a scheme without a host or path", value)
+	}
+	return nil
+}
+
+// validateSecurityRefs checks that the security value references existing security definitions
+func (v *tdValidator) validateSecurityRefs(path string, security interface{}, secDefs map[string]interface{}) {
+	names, ok := stringList(security)
+	if !ok || len(names) == 0 {
+		v.addError(path, "must be a security definition name or a list of names")
+		return
+	}
+	for _, name := range names {
+		if _, found := secDefs[name]; !found {
+			v.addError(path, "security definition '%s' does not exist", name)
+		}
+	}
+}
+
+// validateForms checks the list of forms of the TD or of an affordance
+//  required is set when at least one form is required
+func (v *tdValidator) validateForms(path string, forms interface{}, required bool,
+	secDefs map[string]interface{}) {
+
+	if forms == nil {
+		if required {
+			v.addError(path, "missing required attribute")
+		}
+		return
+	}
+	formList, ok := forms.([]interface{})
+	if !ok || (required && len(formList) == 0) {
+		v.addError(path, "must be an array with at least one form")
+		return
+	}
+	for i, formItem := range formList {
+		formPath := fmt.Sprintf("%s/%d", path, i)
+		form, ok := formItem.(map[string]interface{})
+		if !ok {
+			v.addError(formPath, "must be an object")
+			continue
+		}
+		href, ok := form["href"].(string)
+		if !ok || href == "" {
+			v.addError(formPath+"/href", "missing required attribute")
+		} else if err := checkURI(href, false); err != nil {
+			v.addError(formPath+"/href", "invalid URI reference: %s", err)
+		}
+		if contentType, found := form["contentType"]; found && !isString(contentType, true) {
+			v.addError(formPath+"/contentType", "must be a media type string")
+		}
+		if security, found := form["security"]; found {
+			v.validateSecurityRefs(formPath+"/security", security, secDefs)
+		}
+	}
+}
+
+// validateAffordances checks the interaction affordances of the given type: properties, actions or events
+func (v *tdValidator) validateAffordances(thingTD map[string]interface{}, affType string,
+	secDefs map[string]interface{}) {
+
+	affordances, found := thingTD[affType]
+	if !found {
+		return
+	}
+	affMap, ok := affordances.(map[string]interface{})
+	if !ok {
+		v.addError("/"+affType, "must be an object")
+		return
+	}
+	for name, aff := range affMap {
+		path := "/" + affType + "/" + pointerToken(name)
+		affordance, ok := aff.(map[string]interface{})
+		if !ok {
+			v.addError(path, "must be an object")
+			continue
+		}
+		if title, found := affordance["title"]; found && !isString(title, false) {
+			v.addError(path+"/title", "must be a string")
+		}
+		v.validateForms(path+"/forms", affordance["forms"], true, secDefs)
+	}
+}
+
+// ValidateTD validates a TD against the W3C TD 1.1 JSON schema and with the semantic checks
+// that the schema can't express. The semantic checks cover:
+//  - the @context, the required attributes and the types of the main TD terms
+//  - the TD 'id' is an absolute URI that matches the thingID it is stored under
+//  - security references point to existing security definitions
+//  - form and link hrefs are valid URI references
+// The errors have a JSON pointer to the offending attribute.
+//
+//  thingID the TD is stored under, taken from the request path
+//  thingTD the TD document to validate
+//  schema is the TD 1.1 JSON schema loaded with LoadTDSchema. nil only applies the semantic checks.
+// Returns a list of validation errors, or nil if the TD is valid
+func ValidateTD(thingID string, thingTD map[string]interface{}, schema *TDSchema) []ValidationError {
+	v := tdValidator{}
+	if thingTD == nil {
+		v.addError("", "TD is missing")
+		return v.errors
+	}
+	if schema != nil {
+		v.validateSchema(schema, thingTD)
+	}
+	v.validateContext(thingTD)
+
+	if title, found := thingTD["title"]; !found {
+		v.addError("/title", "missing required attribute")
+	} else if !isString(title, true) {
+		v.addError("/title", "must be a non-empty string")
+	}
+	if atType, found := thingTD["@type"]; found {
+		if _, ok := stringList(atType); !ok {
+			v.addError("/@type", "must be a string or an array of strings")
+		}
+	}
+	// the directory requires an id that matches the ID used to store the TD
+	if id, found := thingTD["id"]; !found {
+		v.addError("/id", "missing required attribute")
+	} else if idString, ok := id.(string); !ok {
+		v.addError("/id", "must be a string")
+	} else if err := checkURI(idString, true); err != nil {
+		v.addError("/id", "invalid URI: %s", err)
+	} else if idString != thingID {
+		v.addError("/id", "ID '%s' does not match the thing ID '%s'", idString, thingID)
+	}
+	for _, dateTerm := range []string{"created", "modified"} {
+		if date, found := thingTD[dateTerm]; found {
+			dateString, ok := date.(string)
+			if _, err := time.Parse(time.RFC3339, dateString); !ok || err != nil {
+				v.addError("/"+dateTerm, "must be an ISO8601 date-time")
+			}
+		}
+	}
+	if visibility, found := thingTD[dirclient.VisibilityAnnotation]; found &&
+		visibility != dirclient.VisibilityPrivate && visibility != dirclient.VisibilityAuthenticated &&
+		visibility != dirclient.VisibilityPublic {
+		v.addError("/"+dirclient.VisibilityAnnotation, "must be one of private, authenticated or public")
+	}
+	secDefs := v.validateSecurity(thingTD)
+
+	v.validateForms("/forms", thingTD["forms"], false, secDefs)
+	v.validateAffordances(thingTD, "properties", secDefs)
+	v.validateAffordances(thingTD, "actions", secDefs)
+	v.validateAffordances(thingTD, "events", secDefs)
+
+	if links, found := thingTD["links"]; found {
+		linkList, ok := links.([]interface{})
+		if !ok {
+			v.addError("/links", "must be an array")
+		}
+		for i, linkItem := range linkList {
+			link, ok := linkItem.(map[string]interface{})
+			href, _ := link["href"].(string)
+			if !ok || href == "" {
+				v.addError(fmt.Sprintf("/links/%d/href", i), "missing required attribute")
+			} else if err := checkURI(href, false); err != nil {
+				v.addError(fmt.Sprintf("/links/%d/href", i), "invalid URI reference: %s", err)
+			}
+		}
+	}
+	// affordances are maps so sort the errors to return them in a predictable order
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		return v.errors[i].Path < v.errors[j].Path
+	})
+	return v.errors
+}
+
+// containsString returns true if the list contains the given string
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeTD returns a copy of the original TD with the patch merged into it.
+// The patch is a JSON merge patch as defined in RFC 7396, so null members are removed from the TD.
+// This is used to validate the result of a patch before it is applied to the store.
+func mergeTD(original interface{}, patch map[string]interface{}) (map[string]interface{}, error) {
+	merged := make(map[string]interface{})
+	// deep copy the original so it is not modified
+	data, err := json.Marshal(original)
+	if err == nil {
+		err = json.Unmarshal(data, &merged)
+	}
+	if err == nil {
+		dirfilestore.MergePatch(merged, patch)
+	}
+	return merged, err
+}
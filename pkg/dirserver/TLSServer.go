@@ -0,0 +1,255 @@
+package dirserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tlsServerShutdownTimeout is the time to wait for requests in progress when the server stops
+const tlsServerShutdownTimeout = 3 * time.Second
+
+// serverCerts holds the certificate of the server and the CAs of the client certificates
+type serverCerts struct {
+	serverCert *tls.Certificate
+	clientCAs  *x509.CertPool
+}
+
+// tlsRoute is a path with the handler that serves it
+type tlsRoute struct {
+	segments []string // path segments. Segments in {} match any value.
+	handler  http.HandlerFunc
+}
+
+// dirTLSServer is the HTTPS server of the directory
+// It serves handlers the same way as the hub TLS server, but obtains the server certificate and
+// client CAs for each new connection. Renewed certificates are therefore used without closing
+// the listener or the open connections. The routes can also be replaced while running.
+type dirTLSServer struct {
+	address       string
+	port          uint
+	authenticator func(username string, password string) bool
+	certs         atomic.Value // *serverCerts
+	routes        []tlsRoute
+	routesMutex   sync.RWMutex // read locked while a request is served
+	httpServer    *http.Server
+	done          chan struct{} // closed when the server stops or the routes are replaced
+}
+
+// matchRoute returns true if the path matches the route segments
+func matchRoute(segments []string, pathSegments []string) bool {
+	if len(segments) != len(pathSegments) {
+		return false
+	}
+	for i, segment := range segments {
+		isVar := strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+		if (isVar && pathSegments[i] == "") || (!isVar && segment != pathSegments[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// addRoute adds a handler for a path. Routes are matched in the order they are added.
+func (srv *dirTLSServer) addRoute(path string, handler http.HandlerFunc) {
+	srv.routesMutex.Lock()
+	defer srv.routesMutex.Unlock()
+	srv.routes = append(srv.routes, tlsRoute{segments: strings.Split(path, "/"), handler: handler})
+}
+
+// AddHandler adds a handler for a path that requires authentication with a client certificate
+// signed by the CA, or with basic authentication.
+func (srv *dirTLSServer) AddHandler(path string,
+	handler func(userID string, response http.ResponseWriter, request *http.Request)) {
+
+	srv.addRoute(path, func(response http.ResponseWriter, request *http.Request) {
+		if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 {
+			handler(request.TLS.PeerCertificates[0].Subject.CommonName, response, request)
+			return
+		}
+		username, password, hasCredentials := request.BasicAuth()
+		if !hasCredentials || srv.authenticator == nil || !srv.authenticator(username, password) {
+			srv.WriteUnauthorized(response, "Authentication required")
+			return
+		}
+		handler(username, response, request)
+	})
+}
+
+// AddHandlerNoAuth adds a handler for a path without authentication
+func (srv *dirTLSServer) AddHandlerNoAuth(path string, handler func(response http.ResponseWriter, request *http.Request)) {
+	srv.addRoute(path, handler)
+}
+
+// Done returns a channel that is closed when the server stops or the routes are replaced
+// Handlers that stream responses use this to end the stream.
+func (srv *dirTLSServer) Done() <-chan struct{} {
+	return srv.done
+}
+
+// getConfigForClient returns the TLS configuration with the current certificates
+func (srv *dirTLSServer) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	certs := srv.certs.Load().(*serverCerts)
+	return &tls.Config{
+		Certificates: []tls.Certificate{*certs.serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    certs.clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// GetQueryInt returns the integer value of a query parameter
+// Returns an error if the parameter is not an integer.
+//  defaultValue if the parameter is not provided
+func (srv *dirTLSServer) GetQueryInt(request *http.Request, paramName string, defaultValue int) (int, error) {
+	value := request.URL.Query().Get(paramName)
+	if value == "" {
+		return defaultValue, nil
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultValue, fmt.Errorf("query parameter '%s' is not an integer: %s", paramName, value)
+	}
+	return intValue, nil
+}
+
+// GetQueryString returns the value of a query parameter
+//  defaultValue if the parameter is not provided
+func (srv *dirTLSServer) GetQueryString(request *http.Request, paramName string, defaultValue string) string {
+	values, found := request.URL.Query()[paramName]
+	if !found || len(values) == 0 {
+		return defaultValue
+	}
+	return values[0]
+}
+
+// replaceRoutes replaces the routes and certificates of the running server with those of another server
+// This waits for the requests in progress to complete. Streaming handlers are ended first, see Done.
+// New requests wait until the routes are replaced. The switch function is called in between and
+// the routes are only replaced if it succeeds.
+//  from is the server with the new routes and certificates. It doesn't have to be started
+//  switchFunc is called when no requests are in progress. Returns an error to keep the current routes
+func (srv *dirTLSServer) replaceRoutes(from *dirTLSServer, switchFunc func() error) error {
+	close(srv.done)
+	srv.routesMutex.Lock()
+	defer srv.routesMutex.Unlock()
+	srv.done = make(chan struct{})
+	err := switchFunc()
+	if err != nil {
+		return err
+	}
+	srv.routes = from.routes
+	srv.certs.Store(from.certs.Load())
+	return nil
+}
+
+// ServeHTTP serves the request with the handler of the first route that matches the path
+// The routes are not replaced while the request is served.
+func (srv *dirTLSServer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	pathSegments := strings.Split(request.URL.Path, "/")
+	srv.routesMutex.RLock()
+	defer srv.routesMutex.RUnlock()
+	var handler http.HandlerFunc
+	for _, route := range srv.routes {
+		if matchRoute(route.segments, pathSegments) {
+			handler = route.handler
+			break
+		}
+	}
+	if handler == nil {
+		srv.WriteNotFound(response, fmt.Sprintf("No handler for path '%s'", request.URL.Path))
+		return
+	}
+	handler(response, request)
+}
+
+// SetCerts replaces the server certificate and the CA of the client certificates
+// New connections use the new certificates. Open connections are not affected.
+//  serverCert is the certificate of the server
+//  caCert is the CA that signs the client certificates
+func (srv *dirTLSServer) SetCerts(serverCert *tls.Certificate, caCert *x509.Certificate) error {
+	if serverCert == nil || caCert == nil {
+		return fmt.Errorf("SetCerts: missing server certificate or CA")
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+	srv.certs.Store(&serverCerts{serverCert: serverCert, clientCAs: clientCAs})
+	return nil
+}
+
+// Start listening for connections
+// Returns an error if the address can't be listened on
+func (srv *dirTLSServer) Start() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", srv.address, srv.port))
+	if err != nil {
+		return fmt.Errorf("dirTLSServer.Start: %s", err)
+	}
+	tlsListener := tls.NewListener(listener, &tls.Config{GetConfigForClient: srv.getConfigForClient})
+	srv.httpServer = &http.Server{Handler: srv}
+	srv.done = make(chan struct{})
+	go func() {
+		err := srv.httpServer.Serve(tlsListener)
+		if err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("dirTLSServer.Start: %s", err)
+		}
+	}()
+	return nil
+}
+
+// Stop the server. Requests in progress are given time to complete.
+func (srv *dirTLSServer) Stop() {
+	if srv.httpServer != nil {
+		close(srv.done)
+		ctx, cancel := context.WithTimeout(context.Background(), tlsServerShutdownTimeout)
+		defer cancel()
+		srv.httpServer.Shutdown(ctx)
+		srv.httpServer = nil
+	}
+}
+
+// WriteBadRequest logs and responds with a bad request error
+func (srv *dirTLSServer) WriteBadRequest(response http.ResponseWriter, errMsg string) {
+	logrus.Warningf("%s", errMsg)
+	http.Error(response, errMsg, http.StatusBadRequest)
+}
+
+// WriteInternalError logs and responds with an internal server error
+func (srv *dirTLSServer) WriteInternalError(response http.ResponseWriter, errMsg string) {
+	logrus.Errorf("%s", errMsg)
+	http.Error(response, errMsg, http.StatusInternalServerError)
+}
+
+// WriteNotFound logs and responds with a not found error
+func (srv *dirTLSServer) WriteNotFound(response http.ResponseWriter, errMsg string) {
+	logrus.Warningf("%s", errMsg)
+	http.Error(response, errMsg, http.StatusNotFound)
+}
+
+// WriteUnauthorized logs and responds with an unauthorized error
+func (srv *dirTLSServer) WriteUnauthorized(response http.ResponseWriter, errMsg string) {
+	logrus.Warningf("%s", errMsg)
+	http.Error(response, errMsg, http.StatusUnauthorized)
+}
+
+// newDirTLSServer creates the HTTPS server of the directory
+// Use SetCerts to set the certificates before Start.
+//  address and port to listen on
+//  authenticator verifies the username and password of basic authentication
+func newDirTLSServer(address string, port uint, authenticator func(string, string) bool) *dirTLSServer {
+	srv := &dirTLSServer{
+		address:       address,
+		port:          port,
+		authenticator: authenticator,
+	}
+	return srv
+}
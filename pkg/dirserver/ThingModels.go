@@ -0,0 +1,387 @@
+package dirserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Thing Model terms as defined in the WoT TD 1.1 specification
+const (
+	TMTypeThingModel = "tm:ThingModel" // @type of a Thing Model
+	TMTermExtends    = "tm:extends"    // link relation of the model that is extended
+	TMTermRef        = "tm:ref"        // affordance reference to a definition in another model
+	TMTermOptional   = "tm:optional"   // list of optional affordances
+	TMMediaType      = "application/tm+json"
+	// link relation in a TD that refers to the model it was derived from
+	TMLinkRelType = "type"
+)
+
+// Attributes of the model records in the model store
+const (
+	modelRecordID       = "id"
+	modelRecordLatest   = "latest"
+	modelRecordVersions = "versions"
+)
+
+// Max depth of tm:extends and tm:ref chains, to catch circular references
+const maxModelRefDepth = 10
+
+// placeholders in a Thing Model have the form {{NAME}}
+var placeholderRegex = regexp.MustCompile(`{{\s*([^{}\s]+)\s*}}`)
+
+// ModelLookup returns the Thing Model with the given ID and version. Use "" for the latest version.
+type ModelLookup func(modelID string, version string) (map[string]interface{}, error)
+
+// GetModelVersion returns the version of a Thing Model from its 'version.model' attribute
+// Returns "" if the model has no version
+func GetModelVersion(thingModel map[string]interface{}) string {
+	version, ok := thingModel["version"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	modelVersion, _ := version["model"].(string)
+	return modelVersion
+}
+
+// ParseModelHref returns the model ID and version from a model reference.
+// Supported are hrefs to the model collection, eg '/models/{modelID}?version={version}', and plain model IDs.
+// The JSON pointer fragment used in tm:ref, eg '#/properties/status', is returned separately.
+func ParseModelHref(href string) (modelID string, version string, pointer string) {
+	if i := strings.Index(href, "#"); i >= 0 {
+		pointer = href[i+1:]
+		href = href[:i]
+	}
+	if i := strings.Index(href, "?"); i >= 0 {
+		query := href[i+1:]
+		href = href[:i]
+		for _, param := range strings.Split(query, "&") {
+			if strings.HasPrefix(param, "version=") {
+				version = strings.TrimPrefix(param, "version=")
+			}
+		}
+	}
+	parts := strings.Split(strings.TrimSuffix(href, "/"), "/")
+	modelID = parts[len(parts)-1]
+	return modelID, version, pointer
+}
+
+// deepCopy returns a copy of a JSON document so it can be modified without changing the original
+func deepCopy(doc interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	data, err := json.Marshal(doc)
+	if err == nil {
+		err = json.Unmarshal(data, &result)
+	}
+	return result, err
+}
+
+// mergeJSON merges the override object into the base object. Objects are merged recursively,
+// other values in the override replace those in the base.
+func mergeJSON(base map[string]interface{}, override map[string]interface{}) {
+	for key, overrideValue := range override {
+		overrideMap, isMap := overrideValue.(map[string]interface{})
+		baseMap, baseIsMap := base[key].(map[string]interface{})
+		if isMap && baseIsMap {
+			mergeJSON(baseMap, overrideMap)
+		} else {
+			base[key] = overrideValue
+		}
+	}
+}
+
+// resolvePointer returns the value at the JSON pointer in the document
+func resolvePointer(doc map[string]interface{}, pointer string) (interface{}, error) {
+	var node interface{} = doc
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		if token == "" {
+			continue
+		}
+		// unescape according to RFC6901
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		nodeMap, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("JSON pointer '%s' not found", pointer)
+		}
+		node, ok = nodeMap[token]
+		if !ok {
+			return nil, fmt.Errorf("JSON pointer '%s' not found", pointer)
+		}
+	}
+	return node, nil
+}
+
+// ResolveModel returns a copy of the Thing Model with its tm:extends and tm:ref references resolved.
+// Extended models are merged first, after which the model's own definitions are applied on top.
+// Affordances with a tm:ref are replaced by the referenced definition, merged with local overrides.
+//  thingModel to resolve
+//  lookup is used to obtain the referenced models
+func ResolveModel(thingModel map[string]interface{}, lookup ModelLookup) (map[string]interface{}, error) {
+	return resolveModel(thingModel, lookup, 0)
+}
+
+// resolveModel resolves the model references up to the maximum depth
+func resolveModel(thingModel map[string]interface{}, lookup ModelLookup, depth int) (map[string]interface{}, error) {
+	if depth > maxModelRefDepth {
+		return nil, fmt.Errorf("ResolveModel: model references are nested too deep or are circular")
+	}
+	model, err := deepCopy(thingModel)
+	if err != nil {
+		return nil, err
+	}
+	// first collect the extended models
+	resolved := make(map[string]interface{})
+	links, _ := model["links"].([]interface{})
+	remainingLinks := make([]interface{}, 0, len(links))
+	for _, linkItem := range links {
+		link, ok := linkItem.(map[string]interface{})
+		if !ok || link["rel"] != TMTermExtends {
+			remainingLinks = append(remainingLinks, linkItem)
+			continue
+		}
+		href, _ := link["href"].(string)
+		baseID, baseVersion, _ := ParseModelHref(href)
+		baseModel, err := lookup(baseID, baseVersion)
+		if err != nil {
+			return nil, fmt.Errorf("ResolveModel: extended model '%s' not found: %s", href, err)
+		}
+		baseModel, err = resolveModel(baseModel, lookup, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		mergeJSON(resolved, baseModel)
+	}
+	if len(links) > 0 {
+		model["links"] = remainingLinks
+	}
+	// the links of extended models are not inherited
+	delete(resolved, "links")
+	mergeJSON(resolved, model)
+
+	// next replace affordances that reference definitions in other models
+	for _, affType := range []string{"properties", "actions", "events"} {
+		affordances, _ := resolved[affType].(map[string]interface{})
+		for name, aff := range affordances {
+			affordance, ok := aff.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ref, ok := affordance[TMTermRef].(string)
+			if !ok {
+				continue
+			}
+			refID, refVersion, pointer := ParseModelHref(ref)
+			var refModel map[string]interface{}
+			if refID == "" {
+				// a reference within the same model
+				refModel = resolved
+			} else {
+				refModel, err = lookup(refID, refVersion)
+				if err == nil {
+					refModel, err = resolveModel(refModel, lookup, depth+1)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("ResolveModel: referenced model '%s' of '%s' not found: %s", ref, name, err)
+				}
+			}
+			definition, err := resolvePointer(refModel, pointer)
+			if err != nil {
+				return nil, fmt.Errorf("ResolveModel: reference '%s' of '%s': %s", ref, name, err)
+			}
+			definitionMap, ok := definition.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("ResolveModel: reference '%s' of '%s' is not an object", ref, name)
+			}
+			newAffordance, err := deepCopy(definitionMap)
+			if err != nil {
+				return nil, err
+			}
+			delete(affordance, TMTermRef)
+			mergeJSON(newAffordance, affordance)
+			affordances[name] = newAffordance
+		}
+	}
+	return resolved, nil
+}
+
+// replacePlaceholders replaces the {{NAME}} placeholders in all strings of the document
+// The names of placeholders without a value are added to the missing map.
+func replacePlaceholders(node interface{}, values map[string]string, missing map[string]bool) interface{} {
+	switch v := node.(type) {
+	case string:
+		return placeholderRegex.ReplaceAllStringFunc(v, func(match string) string {
+			name := placeholderRegex.FindStringSubmatch(match)[1]
+			value, found := values[name]
+			if !found {
+				missing[name] = true
+				return match
+			}
+			return value
+		})
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = replacePlaceholders(item, values, missing)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = replacePlaceholders(item, values, missing)
+		}
+	}
+	return node
+}
+
+// InstantiateModel creates a TD from a resolved Thing Model.
+// This replaces the {{NAME}} placeholders, removes the Thing Model terms, sets the TD 'id' and
+// adds a link of type 'type' that refers to the model the TD is derived from.
+//  resolvedModel is the model whose references are resolved, see ResolveModel
+//  modelID and version of the model to refer to from the TD
+//  thingID of the new TD
+//  placeholders with the values of the placeholders in the model
+// Returns the TD or an error if placeholders are missing
+func InstantiateModel(resolvedModel map[string]interface{}, modelID string, version string,
+	thingID string, placeholders map[string]string) (map[string]interface{}, error) {
+
+	thingTD, err := deepCopy(resolvedModel)
+	if err != nil {
+		return nil, err
+	}
+	missing := make(map[string]bool)
+	replacePlaceholders(thingTD, placeholders, missing)
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("InstantiateModel: missing values for placeholders: %s", strings.Join(names, ", "))
+	}
+
+	// remove the Thing Model type
+	if atTypes, ok := stringList(thingTD["@type"]); ok {
+		tdTypes := make([]interface{}, 0, len(atTypes))
+		for _, atType := range atTypes {
+			if atType != TMTypeThingModel {
+				tdTypes = append(tdTypes, atType)
+			}
+		}
+		if len(tdTypes) == 0 {
+			delete(thingTD, "@type")
+		} else if len(tdTypes) == 1 {
+			thingTD["@type"] = tdTypes[0]
+		} else {
+			thingTD["@type"] = tdTypes
+		}
+	}
+	delete(thingTD, TMTermOptional)
+	thingTD["id"] = thingID
+
+	// refer to the model the TD is derived from
+	links, _ := thingTD["links"].([]interface{})
+	modelHref := "/models/" + modelID
+	if version != "" {
+		modelHref += "?version=" + version
+	}
+	thingTD["links"] = append(links, map[string]interface{}{
+		"rel":  TMLinkRelType,
+		"href": modelHref,
+		"type": TMMediaType,
+	})
+	return thingTD, nil
+}
+
+// GetTDModel returns the ID and version of the model a TD was derived from
+// Returns an empty model ID if the TD has no link to a model
+func GetTDModel(thingTD map[string]interface{}) (modelID string, version string) {
+	links, _ := thingTD["links"].([]interface{})
+	for _, linkItem := range links {
+		link, ok := linkItem.(map[string]interface{})
+		if ok && link["rel"] == TMLinkRelType && link["type"] == TMMediaType {
+			href, _ := link["href"].(string)
+			modelID, version, _ = ParseModelHref(href)
+			return modelID, version
+		}
+	}
+	return "", ""
+}
+
+// newModelRecord returns a new record for storing the versions of a model
+func newModelRecord(modelID string) map[string]interface{} {
+	return map[string]interface{}{
+		modelRecordID:       modelID,
+		modelRecordLatest:   "",
+		modelRecordVersions: make(map[string]interface{}),
+	}
+}
+
+// addModelVersion adds a version of a model to the model record.
+// If the model has no version, the next revision number is used. The version becomes the latest
+// version if it is newer than the current latest version.
+// Returns the version under which the model is stored.
+func addModelVersion(record map[string]interface{}, thingModel map[string]interface{}) string {
+	versions, _ := record[modelRecordVersions].(map[string]interface{})
+	if versions == nil {
+		versions = make(map[string]interface{})
+		record[modelRecordVersions] = versions
+	}
+	version := GetModelVersion(thingModel)
+	for revision := len(versions) + 1; version == ""; revision++ {
+		if versions[strconv.Itoa(revision)] == nil {
+			version = strconv.Itoa(revision)
+		}
+	}
+	versions[version] = thingModel
+	latest, _ := record[modelRecordLatest].(string)
+	if versions[latest] == nil || compareVersions(version, latest) > 0 {
+		record[modelRecordLatest] = version
+	}
+	return version
+}
+
+// compareVersions compares two dot separated version strings, eg "1.10.2" and "1.9".
+// Numeric parts are compared by value, other parts alphabetically.
+// Returns 1 if a is newer than b, -1 if a is older, or 0 if they are the same.
+func compareVersions(a string, b string) int {
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var partA, partB string
+		if i < len(partsA) {
+			partA = partsA[i]
+		}
+		if i < len(partsB) {
+			partB = partsB[i]
+		}
+		numA, errA := strconv.Atoi(partA)
+		numB, errB := strconv.Atoi(partB)
+		if errA == nil && errB == nil {
+			if numA != numB {
+				if numA > numB {
+					return 1
+				}
+				return -1
+			}
+		} else if partA != partB {
+			if partA > partB {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
+
+// getModelVersion returns the given version of a model from the model record, or the latest if version is ""
+func getModelVersion(record map[string]interface{}, version string) (map[string]interface{}, error) {
+	if version == "" {
+		version, _ = record[modelRecordLatest].(string)
+	}
+	versions, _ := record[modelRecordVersions].(map[string]interface{})
+	thingModel, ok := versions[version].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("version '%s' not found", version)
+	}
+	return thingModel, nil
+}
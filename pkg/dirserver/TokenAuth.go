@@ -0,0 +1,254 @@
+package dirserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Default token scopes and claims
+const (
+	DefaultTokenReadScope   = "directory.read"  // scope required to read
+	DefaultTokenWriteScope  = "directory.write" // scope required to write, includes read
+	DefaultTokenGroupsClaim = "groups"          // claim with the groups of the user
+	DefaultTokenRoleClaim   = "role"            // claim with the role of the user
+)
+
+// TokenLeeway is the allowed clock difference when checking the expiry of a token
+const TokenLeeway = 30 * time.Second
+
+// TokenAuthConfig configures the authentication with bearer tokens
+type TokenAuthConfig struct {
+	KeySetPath  string `yaml:"keySet"`      // path of the JSON Web Key Set file with the public keys of the issuer
+	Issuer      string `yaml:"issuer"`      // required 'iss' claim
+	Audience    string `yaml:"audience"`    // required 'aud' claim
+	ReadScope   string `yaml:"readScope"`   // scope required to read. Default is "directory.read"
+	WriteScope  string `yaml:"writeScope"`  // scope required to write. Default is "directory.write"
+	GroupsClaim string `yaml:"groupsClaim"` // claim with the list of groups of the user. Default is "groups"
+	RoleClaim   string `yaml:"roleClaim"`   // claim with the role of the user in the groups. Default is "role"
+}
+
+// TokenClaims are the claims of a verified token or API key as used by the directory
+type TokenClaims struct {
+	UserID       string    // subject of the token
+	Groups       []string  // groups of the user, nil if not in the token
+	Role         string    // role of the user, "" if not in the token
+	CanRead      bool      // the token has the read or write scope
+	CanWrite     bool      // the token has the write scope
+	Expiry       time.Time // expiry of the token
+	ThingPattern string    // pattern of the thing IDs the user can access, "" for all things
+	IsAPIKey     bool      // the role applies to all things matching the pattern, as set by an administrator
+}
+
+// TokenVerifier verifies JWT bearer tokens using a local key set
+// Tokens must be signed with RS256 or ES256 by a key in the key set.
+type TokenVerifier struct {
+	config TokenAuthConfig
+	keys   map[string]crypto.PublicKey // public keys by key ID
+}
+
+// jsonWebKey is a public key in a JSON Web Key Set as defined in RFC7517
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// decodeSegment decodes a base64url encoded JWT segment
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+// publicKey returns the public key of a JSON web key
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeSegment(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeSegment(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve '%s'", jwk.Crv)
+		}
+		x, err := decodeSegment(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeSegment(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", jwk.Kty)
+}
+
+// verifySignature verifies the signature of the signed part of a token
+func (tv *TokenVerifier) verifySignature(alg string, kid string, signed string, signature []byte) error {
+	key, found := tv.keys[kid]
+	if !found && kid == "" && len(tv.keys) == 1 {
+		for _, onlyKey := range tv.keys {
+			key, found = onlyKey, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown key '%s'", kid)
+	}
+	hash := sha256.Sum256([]byte(signed))
+	switch pubKey := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		return rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, hash[:], signature)
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			break
+		}
+		if len(signature) != 64 {
+			return fmt.Errorf("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pubKey, hash[:], r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm '%s' doesn't match key '%s'", alg, kid)
+}
+
+// Verify verifies a token and returns its claims
+// The token must have a valid signature, the configured issuer and audience, a subject and an
+// expiry in the future.
+func (tv *TokenVerifier) Verify(token string) (*TokenClaims, error) {
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims map[string]interface{}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	headerData, err := decodeSegment(parts[0])
+	if err == nil {
+		err = json.Unmarshal(headerData, &header)
+	}
+	var claimsData, signature []byte
+	if err == nil {
+		claimsData, err = decodeSegment(parts[1])
+	}
+	if err == nil {
+		err = json.Unmarshal(claimsData, &claims)
+	}
+	if err == nil {
+		signature, err = decodeSegment(parts[2])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %s", err)
+	}
+	err = tv.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	exp, hasExpiry := claims["exp"].(float64)
+	expiry := time.Unix(int64(exp), 0)
+	if !hasExpiry || now.After(expiry.Add(TokenLeeway)) {
+		return nil, fmt.Errorf("token is expired")
+	}
+	if nbf, found := claims["nbf"].(float64); found && now.Add(TokenLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token is not yet valid")
+	}
+	if iss, _ := claims["iss"].(string); iss != tv.config.Issuer {
+		return nil, fmt.Errorf("invalid issuer '%s'", iss)
+	}
+	if audiences, _ := stringList(claims["aud"]); !containsString(audiences, tv.config.Audience) {
+		return nil, fmt.Errorf("invalid audience")
+	}
+	tokenClaims := &TokenClaims{Expiry: expiry}
+	tokenClaims.UserID, _ = claims["sub"].(string)
+	if tokenClaims.UserID == "" {
+		return nil, fmt.Errorf("missing subject")
+	}
+	// scopes are a space separated string or a list
+	var scopes []string
+	if scope, isString := claims["scope"].(string); isString {
+		scopes = strings.Fields(scope)
+	} else {
+		scopes, _ = stringList(claims["scp"])
+	}
+	tokenClaims.CanWrite = containsString(scopes, tv.config.WriteScope)
+	tokenClaims.CanRead = tokenClaims.CanWrite || containsString(scopes, tv.config.ReadScope)
+	if claims[tv.config.GroupsClaim] != nil {
+		tokenClaims.Groups, _ = stringList(claims[tv.config.GroupsClaim])
+	}
+	tokenClaims.Role, _ = claims[tv.config.RoleClaim].(string)
+	return tokenClaims, nil
+}
+
+// NewTokenVerifier creates a verifier of bearer tokens with the keys from a JSON Web Key Set file
+// Returns an error if the issuer or audience is not set, or the key set can't be read or has no
+// usable keys. The issuer and audience are required so tokens that the issuer signed for other
+// services are not accepted.
+//  config with the key set path and the required claims. Empty scopes and claims use the defaults.
+func NewTokenVerifier(config TokenAuthConfig) (*TokenVerifier, error) {
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, fmt.Errorf("NewTokenVerifier: the issuer and audience of the tokens are required")
+	}
+	if config.ReadScope == "" {
+		config.ReadScope = DefaultTokenReadScope
+	}
+	if config.WriteScope == "" {
+		config.WriteScope = DefaultTokenWriteScope
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = DefaultTokenGroupsClaim
+	}
+	if config.RoleClaim == "" {
+		config.RoleClaim = DefaultTokenRoleClaim
+	}
+	data, err := ioutil.ReadFile(config.KeySetPath)
+	if err == nil {
+		err = json.Unmarshal(data, &keySet)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("NewTokenVerifier: unable to read key set '%s': %s", config.KeySetPath, err)
+	}
+	tv := &TokenVerifier{config: config, keys: make(map[string]crypto.PublicKey)}
+	for _, jwk := range keySet.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("NewTokenVerifier: key '%s' in '%s': %s", jwk.Kid, config.KeySetPath, err)
+		}
+		tv.keys[jwk.Kid] = key
+	}
+	if len(tv.keys) == 0 {
+		return nil, fmt.Errorf("NewTokenVerifier: key set '%s' has no keys", config.KeySetPath)
+	}
+	return tv, nil
+}
@@ -39,4 +39,29 @@ type IDirStore interface {
 	// Replace a document
 	// The document does not have to exist
 	Replace(id string, document map[string]interface{}) error
+
+	// Transaction applies a group of changes while holding the store lock
+	// The changes made through tx are committed when txFunc returns nil and saved together.
+	// If txFunc returns an error then none of the changes are applied and the error is returned.
+	Transaction(txFunc func(tx IDirTx) error) error
+}
+
+// Interface to a transaction on the directory store
+// Changes made in the transaction are only visible to the transaction until it is committed.
+type IDirTx interface {
+	// Get a document by its ID, including changes made in this transaction
+	// Returns an error if it doesn't exist
+	Get(id string) (interface{}, error)
+
+	// Patch part of a document
+	// Returns an error if it doesn't exist
+	Patch(id string, doc map[string]interface{}) error
+
+	// Remove a document
+	// Succeeds if the document doesn't exist
+	Remove(id string)
+
+	// Replace a document
+	// The document does not have to exist
+	Replace(id string, document map[string]interface{}) error
 }
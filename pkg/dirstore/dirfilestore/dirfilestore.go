@@ -20,10 +20,10 @@ import (
 	"sync"
 	"time"
 
-	"github.com/imdario/mergo"
 	"github.com/ohler55/ojg/jp"
 	"github.com/sirupsen/logrus"
 	"github.com/wostzone/hubclient-go/pkg/td"
+	"github.com/wostzone/thingdir/pkg/dirstore"
 )
 
 // Max nr of items to return in list
@@ -208,7 +208,42 @@ func (store *DirFileStore) Open() error {
 	return err
 }
 
+// MergePatch applies a JSON merge patch to a document as defined in RFC 7396
+// Objects in the patch are merged recursively. Members that are null in the patch are removed
+// from the document and other members replace those of the document.
+//  doc is the document to modify
+//  patch with the changes
+func MergePatch(doc map[string]interface{}, patch map[string]interface{}) {
+	for key, patchValue := range patch {
+		patchObject, isObject := patchValue.(map[string]interface{})
+		if patchValue == nil {
+			delete(doc, key)
+		} else if !isObject {
+			doc[key] = patchValue
+		} else {
+			docObject, _ := doc[key].(map[string]interface{})
+			if docObject == nil {
+				docObject = make(map[string]interface{})
+			}
+			MergePatch(docObject, patchObject)
+			doc[key] = docObject
+		}
+	}
+}
+
+// copyDoc returns a deep copy of a document so it can be modified without changing the original
+func copyDoc(doc interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	data, err := json.Marshal(doc)
+	if err == nil {
+		err = json.Unmarshal(data, &result)
+	}
+	return result, err
+}
+
 // Patch a document
+// The patch is merged into a copy that replaces the stored document. Documents that were
+// obtained from the store are therefore never modified.
 // Returns an error if it doesn't exist
 func (store *DirFileStore) Patch(id string, src map[string]interface{}) error {
 	store.mutex.Lock()
@@ -219,12 +254,17 @@ func (store *DirFileStore) Patch(id string, src map[string]interface{}) error {
 		err := fmt.Errorf("DirFileStore.Patch: id='%s' parameter error", id)
 		return err
 	}
-	// the new doc is merged into the original
-	dest := store.docs[id].(map[string]interface{})
-
-	if err := mergo.Map(&dest, src, mergo.WithOverride); err != nil {
-		return err
+	// the new doc is merged into a copy of the original
+	original, found := store.docs[id].(map[string]interface{})
+	if !found {
+		return fmt.Errorf("DirFileStore.Patch: document '%s' not found", id)
+	}
+	dest, err := copyDoc(original)
+	if err != nil {
+		return fmt.Errorf("DirFileStore.Patch: document '%s': %s", id, err)
 	}
+	MergePatch(dest, src)
+	store.docs[id] = dest
 
 	store.updateCount++
 
@@ -250,6 +290,8 @@ func (store *DirFileStore) Query(jsonPath string, offset int, limit int,
 	if limit == 0 {
 		limit = store.maxLimit
 	}
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
 
 	// Before querying the list of available documents must be reduced to those that the
 	// user has access to.
@@ -309,6 +351,116 @@ func (store *DirFileStore) Replace(id string, document map[string]interface{}) e
 	return nil
 }
 
+// Save writes pending changes to file without waiting for the autosave loop
+// Intended for callers that must be sure changes are persisted, eg before recording a replication position.
+func (store *DirFileStore) Save() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.updateCount == 0 {
+		return nil
+	}
+	err := writeStoreFile(store.storePath, store.docs)
+	if err == nil {
+		store.updateCount = 0
+	}
+	return err
+}
+
+// Snapshot returns a copy of the document map, with documents by ID
+// The documents themselves are shared with the store. The store never modifies a stored
+// document, Patch replaces it with a patched copy, so they can be read without holding the lock.
+// They must not be modified.
+func (store *DirFileStore) Snapshot() map[string]interface{} {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	docs := make(map[string]interface{}, len(store.docs))
+	for id, doc := range store.docs {
+		docs[id] = doc
+	}
+	return docs
+}
+
+// Transaction applies a group of changes while holding the store lock
+// The changes are staged in the transaction and applied when txFunc returns nil. A committed
+// transaction counts as a single update for the autosave loop.
+// The store methods must not be used inside txFunc as the store is locked. Use tx instead.
+//  txFunc makes the changes using tx. Return an error to discard all changes.
+func (store *DirFileStore) Transaction(txFunc func(tx dirstore.IDirTx) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tx := &dirFileTx{store: store, changed: make(map[string]interface{})}
+	err := txFunc(tx)
+	if err != nil {
+		logrus.Infof("DirFileStore.Transaction: discarding %d changes: %s", len(tx.changed), err)
+		return err
+	}
+	for id, doc := range tx.changed {
+		if doc == nil {
+			delete(store.docs, id)
+		} else {
+			store.docs[id] = doc
+		}
+	}
+	if len(tx.changed) > 0 {
+		store.updateCount++
+	}
+	logrus.Infof("DirFileStore.Transaction: committed %d changes", len(tx.changed))
+	return nil
+}
+
+// dirFileTx is a transaction on the file store
+// Changed documents are staged by ID. Removed documents are staged as nil.
+type dirFileTx struct {
+	store   *DirFileStore
+	changed map[string]interface{}
+}
+
+// Get a document by its ID, including changes made in this transaction
+func (tx *dirFileTx) Get(id string) (interface{}, error) {
+	doc, staged := tx.changed[id]
+	if !staged {
+		doc = tx.store.docs[id]
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("not found")
+	}
+	return doc, nil
+}
+
+// Patch a document in the transaction
+// The document is copied before patching so the stored document is not modified until commit.
+func (tx *dirFileTx) Patch(id string, src map[string]interface{}) error {
+	if src == nil || id == "" {
+		return fmt.Errorf("DirFileStore.Patch: id='%s' parameter error", id)
+	}
+	original, err := tx.Get(id)
+	if err != nil {
+		return fmt.Errorf("DirFileStore.Patch: document '%s' %s", id, err)
+	}
+	dest, err := copyDoc(original)
+	if err != nil {
+		return err
+	}
+	MergePatch(dest, src)
+	tx.changed[id] = dest
+	return nil
+}
+
+// Remove a document in the transaction
+func (tx *dirFileTx) Remove(id string) {
+	tx.changed[id] = nil
+}
+
+// Replace a document in the transaction
+func (tx *dirFileTx) Replace(id string, document map[string]interface{}) error {
+	if document == nil || id == "" {
+		return fmt.Errorf("DirFileStore.Replace: id='%s' parameter error", id)
+	}
+	tx.changed[id] = document
+	return nil
+}
+
 // Create a new directory file store instance
 //  filePath path to JSON store file
 func NewDirFileStore(jsonFilePath string) *DirFileStore {
@@ -323,6 +323,34 @@ func TestPatch(t *testing.T) {
 	fileStore.Close()
 }
 
+func TestMergePatch(t *testing.T) {
+	doc := map[string]interface{}{
+		"title":       "title1",
+		"description": "description1",
+		"properties": map[string]interface{}{
+			"p1": map[string]interface{}{"title": "p1"},
+			"p2": map[string]interface{}{"title": "p2"},
+		},
+	}
+	patch := map[string]interface{}{
+		"title":       "",
+		"description": nil,
+		"properties": map[string]interface{}{
+			"p1": nil,
+			"p3": map[string]interface{}{"title": "p3", "unit": nil},
+		},
+	}
+	dirfilestore.MergePatch(doc, patch)
+	// empty values replace, null values remove and objects are merged
+	assert.Equal(t, "", doc["title"])
+	_, found := doc["description"]
+	assert.False(t, found)
+	props := doc["properties"].(map[string]interface{})
+	assert.Nil(t, props["p1"])
+	assert.NotNil(t, props["p2"])
+	assert.Equal(t, map[string]interface{}{"title": "p3"}, props["p3"])
+}
+
 func TestBadPatch(t *testing.T) {
 	fileStore := makeFileStore()
 	fileStore.Open()
@@ -340,3 +368,43 @@ func TestBadReplace(t *testing.T) {
 	err := fileStore.Replace(id2, nil)
 	assert.Error(t, err)
 }
+
+func TestSaveAndSnapshot(t *testing.T) {
+	filename := "/tmp/test-dirfilestore.json"
+	fileStore := makeFileStore()
+	fileStore.Open()
+	addTDs(fileStore)
+
+	snapshot := fileStore.Snapshot()
+	assert.Equal(t, 2, len(snapshot))
+	assert.NotNil(t, snapshot[Thing1ID])
+
+	// save without waiting for the autosave loop
+	err := fileStore.Save()
+	assert.NoError(t, err)
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	docs := make(map[string]interface{})
+	err = json.Unmarshal(data, &docs)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(docs))
+
+	// changing the snapshot does not affect the store
+	delete(snapshot, Thing1ID)
+	_, err = fileStore.Get(Thing1ID)
+	assert.NoError(t, err)
+
+	// patching replaces the stored document so the snapshot documents don't change
+	snapshot = fileStore.Snapshot()
+	err = fileStore.Patch(Thing1ID, map[string]interface{}{"title": "patched"})
+	require.NoError(t, err)
+	assert.NotEqual(t, "patched", snapshot[Thing1ID].(map[string]interface{})["title"])
+	patched, _ := fileStore.Get(Thing1ID)
+	assert.Equal(t, "patched", patched.(map[string]interface{})["title"])
+	fileStore.Close()
+}
+
+func TestFileStoreTransaction(t *testing.T) {
+	fileStore := makeFileStore()
+	dirstore.DirStoreTransaction(t, fileStore)
+}
@@ -46,3 +46,53 @@ func DirStoreCrud(t *testing.T, store IDirStore) {
 
 	store.Close()
 }
+
+func DirStoreTransaction(t *testing.T, store IDirStore) {
+	thingID1 := "thing1"
+	thingID2 := "thing2"
+	thingTD1 := map[string]interface{}{"a": "this is a td"}
+	thingTD2 := map[string]interface{}{"b": "this is another td"}
+	err := store.Open()
+	assert.NoError(t, err)
+	_ = store.Replace(thingID1, thingTD1)
+
+	// changes are visible in the transaction and committed together
+	err = store.Transaction(func(tx IDirTx) error {
+		err2 := tx.Replace(thingID2, thingTD2)
+		assert.NoError(t, err2)
+		err2 = tx.Patch(thingID1, map[string]interface{}{"c": "patched"})
+		assert.NoError(t, err2)
+		td1, err2 := tx.Get(thingID1)
+		assert.NoError(t, err2)
+		assert.Equal(t, "patched", td1.(map[string]interface{})["c"])
+		tx.Remove(thingID2)
+		_, err2 = tx.Get(thingID2)
+		assert.Error(t, err2)
+		return nil
+	})
+	assert.NoError(t, err)
+	td1, err := store.Get(thingID1)
+	assert.NoError(t, err)
+	assert.Equal(t, "patched", td1.(map[string]interface{})["c"])
+	_, err = store.Get(thingID2)
+	assert.Error(t, err)
+
+	// a failed transaction doesn't change the store
+	err = store.Transaction(func(tx IDirTx) error {
+		_ = tx.Replace(thingID2, thingTD2)
+		_ = tx.Patch(thingID1, map[string]interface{}{"c": "not committed"})
+		tx.Remove(thingID1)
+		err2 := tx.Patch("notathing", thingTD2)
+		assert.Error(t, err2)
+		return err2
+	})
+	assert.Error(t, err)
+	td1, err = store.Get(thingID1)
+	assert.NoError(t, err)
+	assert.Equal(t, "patched", td1.(map[string]interface{})["c"])
+	_, err = store.Get(thingID2)
+	assert.Error(t, err)
+
+	store.Remove(thingID1)
+	store.Close()
+}
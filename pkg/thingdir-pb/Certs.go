@@ -0,0 +1,96 @@
+package thingdirpb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/wostzone/hubclient-go/pkg/certs"
+)
+
+// pbCerts holds the certificates used by the protocol binding
+type pbCerts struct {
+	serverCert   *tls.Certificate  // directory server certificate, nil if the server is disabled
+	serverCaCert *x509.Certificate // CA of the directory's client certificates, nil if the server is disabled
+	clientCert   *tls.Certificate  // certificate to connect to the directory
+	clientCaCert *x509.Certificate // CA of the directory server
+	msgbusCert   *tls.Certificate  // certificate to connect to the message bus
+	msgbusCaCert *x509.Certificate // CA of the message bus
+}
+
+// loadCert loads and validates a certificate and its key
+//  name of the certificate for use in error messages
+func loadCert(name string, certPath string, keyPath string) (*tls.Certificate, error) {
+	cert, err := certs.LoadTLSCertFromPEM(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the %s certificate '%s' with key '%s': %s", name, certPath, keyPath, err)
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("the %s certificate '%s' is empty", name, certPath)
+	}
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("the %s certificate '%s' is invalid: %s", name, certPath, err)
+	}
+	err = checkValidity(name, certPath, x509Cert)
+	return cert, err
+}
+
+// loadCaCert loads and validates a CA certificate
+//  name of the CA for use in error messages
+func loadCaCert(name string, caPath string) (*x509.Certificate, error) {
+	caCert, err := certs.LoadX509CertFromPEM(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the %s CA certificate '%s': %s", name, caPath, err)
+	} else if !caCert.IsCA {
+		return nil, fmt.Errorf("the %s CA certificate '%s' is not a CA", name, caPath)
+	}
+	err = checkValidity(name+" CA", caPath, caCert)
+	return caCert, err
+}
+
+// checkValidity returns an error if the certificate is expired or not yet valid
+func checkValidity(name string, certPath string, cert *x509.Certificate) error {
+	now := time.Now()
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("the %s certificate '%s' expired at %s", name, certPath, cert.NotAfter.Format(time.RFC3339))
+	} else if now.Before(cert.NotBefore) {
+		return fmt.Errorf("the %s certificate '%s' is not valid until %s", name, certPath, cert.NotBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// loadCerts loads and validates the certificates of the configuration
+// The server certificates are only loaded if the built-in directory server is enabled. In
+// standalone mode the message bus certificates are not loaded and the directory client
+// certificate only if it is used for federation or replication.
+// Returns an error that describes which certificate can't be used.
+func loadCerts(pbConfig *ThingDirPBConfig) (*pbCerts, error) {
+	var err error
+	loaded := &pbCerts{}
+	usesClientCert := !pbConfig.Standalone || pbConfig.ReplicaOf != "" ||
+		len(pbConfig.FederationPeers) > 0 || pbConfig.FederationDiscovery
+	if !pbConfig.DisableDirServer {
+		loaded.serverCert, err = loadCert("directory server", pbConfig.ServerCertPath, pbConfig.ServerKeyPath)
+		if err == nil {
+			loaded.serverCaCert, err = loadCaCert("directory server", pbConfig.ServerCaPath)
+		}
+	}
+	if err == nil && usesClientCert {
+		loaded.clientCert, err = loadCert("directory client", pbConfig.PbClientCertPath, pbConfig.PbClientKeyPath)
+	}
+	if err == nil && !pbConfig.Standalone {
+		loaded.clientCaCert, err = loadCaCert("directory client", pbConfig.PbClientCaPath)
+	}
+	if err == nil && !pbConfig.Standalone {
+		loaded.msgbusCert, err = loadCert("message bus client", pbConfig.MsgbusCertPath, pbConfig.MsgbusKeyPath)
+	}
+	if err == nil && !pbConfig.Standalone {
+		loaded.msgbusCaCert, err = loadCaCert("message bus", pbConfig.MsgbusCaPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ThingDirPB: %s", err)
+	}
+	return loaded, nil
+}
@@ -0,0 +1,284 @@
+package thingdirpb
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubclient-go/pkg/config"
+	"github.com/wostzone/thingdir/pkg/dirserver"
+)
+
+// DefaultReloadInterval is the default interval in seconds to check the certificate and config files for changes
+const DefaultReloadInterval = 10
+
+// certFiles returns the certificate, key and CA files used by the protocol binding
+func (pb *ThingDirPB) certFiles() []string {
+	return []string{
+		pb.config.ServerCertPath, pb.config.ServerKeyPath, pb.config.ServerCaPath,
+		pb.config.PbClientCertPath, pb.config.PbClientKeyPath, pb.config.PbClientCaPath,
+		pb.config.MsgbusCertPath, pb.config.MsgbusKeyPath, pb.config.MsgbusCaPath,
+	}
+}
+
+// changedFiles returns true if any of the files changed since the last check
+// The modification times of the files are updated.
+func (pb *ThingDirPB) changedFiles(files []string) bool {
+	changed := false
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if modTime, found := pb.fileModTimes[file]; found && !modTime.Equal(fileInfo.ModTime()) {
+			changed = true
+		}
+		pb.fileModTimes[file] = fileInfo.ModTime()
+	}
+	return changed
+}
+
+// reloadLoop reloads the certificates and configuration when the files change or on SIGHUP
+func (pb *ThingDirPB) reloadLoop(stopChannel chan bool) {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGHUP)
+	defer signal.Stop(signalChannel)
+	interval := pb.config.ReloadInterval
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer func() { ticker.Stop() }()
+	for {
+		force := false
+		select {
+		case <-stopChannel:
+			return
+		case <-signalChannel:
+			logrus.Warningf("ThingDirPB.reloadLoop: SIGHUP received. Reloading certificates and configuration.")
+			force = true
+		case <-ticker.C:
+		}
+		configChanged := pb.configFile != "" && pb.changedFiles([]string{pb.configFile})
+		if configChanged || force {
+			err := pb.ReloadConfig()
+			if err != nil {
+				logrus.Errorf("ThingDirPB.reloadLoop: %s", err)
+			}
+			if pb.config.ReloadInterval != interval {
+				interval = pb.config.ReloadInterval
+				ticker.Stop()
+				ticker = time.NewTicker(time.Duration(interval) * time.Second)
+			}
+		}
+		if pb.changedFiles(pb.certFiles()) || force {
+			err := pb.ReloadCerts()
+			if err != nil {
+				logrus.Errorf("ThingDirPB.reloadLoop: %s", err)
+			}
+		}
+	}
+}
+
+// ReloadCerts loads the renewed certificates
+// The directory server uses the new server certificate and CA. The directory and message bus
+// clients reconnect with the renewed plugin certificate, unless standalone. The current certificates remain in use
+// if the new certificates can't be loaded.
+func (pb *ThingDirPB) ReloadCerts() error {
+	logrus.Infof("ThingDirPB.ReloadCerts")
+	pb.reloadMutex.Lock()
+	defer pb.reloadMutex.Unlock()
+	loaded, err := loadCerts(&pb.config)
+	if err != nil {
+		return fmt.Errorf("ReloadCerts: %s", err)
+	}
+	if pb.dirServer != nil {
+		err = pb.dirServer.SetServerCert(loaded.serverCert, loaded.serverCaCert)
+		if err != nil {
+			return fmt.Errorf("ReloadCerts: %s", err)
+		}
+	}
+	if pb.config.Standalone {
+		return nil
+	}
+	return pb.connectClients(loaded)
+}
+
+// validateConfig returns an error if the configuration can't be used to start the protocol binding
+// The certificates and the directory server settings are checked without starting anything.
+func validateConfig(pbConfig *ThingDirPBConfig) error {
+	if pbConfig.Standalone && pbConfig.DisableDirServer {
+		return fmt.Errorf("standalone mode requires the built-in directory server")
+	}
+	_, err := loadCerts(pbConfig)
+	if err != nil || pbConfig.DisableDirServer {
+		return err
+	}
+	switch dirserver.ValidationMode(pbConfig.TDValidation) {
+	case dirserver.ValidationModeOff, dirserver.ValidationModeWarn, dirserver.ValidationModeReject:
+	default:
+		return fmt.Errorf("invalid validation mode '%s'", pbConfig.TDValidation)
+	}
+	if len(pbConfig.RedactionRules) > 0 {
+		_, err = dirserver.NewRedactor(pbConfig.RedactionRules)
+	}
+	if err == nil && pbConfig.TokenAuth.KeySetPath != "" {
+		_, err = dirserver.NewTokenVerifier(pbConfig.TokenAuth)
+	}
+	if err == nil && (pbConfig.Revocation.CRLPath != "" || len(pbConfig.Revocation.RevokedSerials) > 0) {
+		_, err = dirserver.NewRevocationList(nil, pbConfig.Revocation)
+	}
+	return err
+}
+
+// ReloadConfig reloads the configuration file
+// The changes are applied while running, see applyConfig. The current configuration remains in
+// use if the file can't be loaded or is invalid. If the new configuration can't be applied then
+// the protocol binding is restarted with the previous configuration.
+func (pb *ThingDirPB) ReloadConfig() error {
+	if pb.configFile == "" {
+		return nil
+	}
+	logrus.Infof("ThingDirPB.ReloadConfig: reloading '%s'", pb.configFile)
+	pb.reloadMutex.Lock()
+	defer pb.reloadMutex.Unlock()
+	newConfig := &ThingDirPBConfig{}
+	err := config.LoadYamlConfig(pb.configFile, newConfig, nil)
+	if err != nil {
+		return fmt.Errorf("ReloadConfig: %s", err)
+	}
+	setConfigDefaults(newConfig, &pb.hubConfig)
+	newConfig.Standalone = newConfig.Standalone || pb.forceStandalone
+
+	if reflect.DeepEqual(pb.config, *newConfig) {
+		return nil
+	}
+	// changes to the revoked certificates don't need a new server if revocation is enabled
+	currentConfig := pb.config
+	currentConfig.Revocation.RevokedSerials = newConfig.Revocation.RevokedSerials
+	if reflect.DeepEqual(currentConfig, *newConfig) && pb.revocationEnabled() {
+		if pb.dirServer != nil {
+			err = pb.dirServer.SetRevokedSerials(newConfig.Revocation.RevokedSerials)
+			if err != nil {
+				return fmt.Errorf("ReloadConfig: %s", err)
+			}
+		}
+		pb.config = *newConfig
+		return nil
+	}
+	err = validateConfig(newConfig)
+	if err != nil {
+		return fmt.Errorf("ReloadConfig: invalid configuration. Keeping the current configuration: %s", err)
+	}
+	previousConfig := pb.config
+	pb.config = *newConfig
+	err = pb.applyConfig(&previousConfig)
+	if err == nil {
+		return nil
+	}
+	logrus.Errorf("ThingDirPB.ReloadConfig: applying the configuration failed: %s. Restoring the previous configuration.", err)
+	pb.stop()
+	pb.config = previousConfig
+	err2 := pb.start()
+	if err2 != nil {
+		return fmt.Errorf("ReloadConfig: unable to restart with the previous configuration: %s", err2)
+	}
+	return fmt.Errorf("ReloadConfig: applying the configuration failed, using the previous configuration: %s", err)
+}
+
+// applyConfig applies the changes to the configuration while running
+// A new address or port of the directory server requires a restart of the protocol binding.
+// Other changes to the directory server are applied by a new server that takes over the listener
+// of the running server, so open connections are kept. The clients reconnect if their
+// configuration changed.
+//  previous is the configuration that is replaced
+func (pb *ThingDirPB) applyConfig(previous *ThingDirPBConfig) error {
+	if previous.DisableDirServer != pb.config.DisableDirServer ||
+		previous.DirAddress != pb.config.DirAddress || previous.DirPort != pb.config.DirPort {
+		logrus.Warningf("ThingDirPB.applyConfig: directory server address changed. Restarting.")
+		pb.stop()
+		return pb.start()
+	}
+	loaded, err := loadCerts(&pb.config)
+	if err != nil {
+		return err
+	}
+	if pb.dirServer != nil && !reflect.DeepEqual(serverSettings(*previous), serverSettings(pb.config)) {
+		logrus.Warningf("ThingDirPB.applyConfig: directory server configuration changed. Replacing the server.")
+		dirServer, err := pb.newDirServer(loaded)
+		if err == nil {
+			err = dirServer.Takeover(pb.dirServer)
+		}
+		if err != nil {
+			return err
+		}
+		pb.mutex.Lock()
+		pb.dirServer = dirServer
+		pb.mutex.Unlock()
+	}
+	if !reflect.DeepEqual(clientSettings(*previous), clientSettings(pb.config)) {
+		logrus.Warningf("ThingDirPB.applyConfig: client configuration changed. Reconnecting.")
+		pb.stopClients()
+		return pb.startClients(loaded)
+	}
+	return nil
+}
+
+// serverSettings returns the configuration without the settings that only the clients use
+func serverSettings(pbConfig ThingDirPBConfig) ThingDirPBConfig {
+	pbConfig.Standalone = false
+	pbConfig.MsgbusCertPath = ""
+	pbConfig.MsgbusKeyPath = ""
+	pbConfig.MsgbusCaPath = ""
+	pbConfig.MsgbusRetryInterval = 0
+	pbConfig.RetryQueueSize = 0
+	pbConfig.RetryMaxInterval = 0
+	pbConfig.ReloadInterval = 0
+	return pbConfig
+}
+
+// clientSettings returns the settings of the configuration that the clients use
+func clientSettings(pbConfig ThingDirPBConfig) ThingDirPBConfig {
+	return ThingDirPBConfig{
+		DirAddress:           pbConfig.DirAddress,
+		DirPort:              pbConfig.DirPort,
+		PbClientCertPath:     pbConfig.PbClientCertPath,
+		PbClientKeyPath:      pbConfig.PbClientKeyPath,
+		PbClientCaPath:       pbConfig.PbClientCaPath,
+		Standalone:           pbConfig.Standalone,
+		MsgbusCertPath:       pbConfig.MsgbusCertPath,
+		MsgbusKeyPath:        pbConfig.MsgbusKeyPath,
+		MsgbusCaPath:         pbConfig.MsgbusCaPath,
+		MsgbusRetryInterval:  pbConfig.MsgbusRetryInterval,
+		RetryQueueSize:       pbConfig.RetryQueueSize,
+		RetryMaxInterval:     pbConfig.RetryMaxInterval,
+		DirectoryStoreFolder: pbConfig.DirectoryStoreFolder,
+	}
+}
+
+// SetConfigFile sets the configuration file to reload when it changes
+// This must be set before Start.
+//  configFile is the path of the thingdir-pb.yaml file
+func (pb *ThingDirPB) SetConfigFile(configFile string) {
+	pb.configFile = configFile
+}
+
+// startReload starts watching the certificate and config files for changes
+func (pb *ThingDirPB) startReload() {
+	pb.fileModTimes = make(map[string]time.Time)
+	pb.changedFiles(append(pb.certFiles(), pb.configFile))
+	pb.reloadStop = make(chan bool)
+	go pb.reloadLoop(pb.reloadStop)
+}
+
+// stopReload stops watching the certificate and config files
+func (pb *ThingDirPB) stopReload() {
+	if pb.reloadStop != nil {
+		close(pb.reloadStop)
+		pb.reloadStop = nil
+	}
+}
@@ -0,0 +1,303 @@
+package thingdirpb
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/thingdir/pkg/dirclient"
+	"github.com/wostzone/thingdir/pkg/dirstore/dirfilestore"
+)
+
+// DefaultRetryQueueFile is the file with the TD updates that wait to be retried
+const DefaultRetryQueueFile = "thingdir-pb-retryqueue.json"
+
+// DefaultRetryQueueSize is the default max nr of things in the retry queue
+const DefaultRetryQueueSize = 1000
+
+// DefaultRetryMaxInterval is the default max interval in seconds between retries of a TD update
+const DefaultRetryMaxInterval = 300
+
+// retryInitialInterval is the interval before the first retry. It doubles with each attempt.
+const retryInitialInterval = time.Second
+
+// retryCheckInterval is the interval to check for TD updates that are due to be retried
+const retryCheckInterval = time.Second
+
+// errDirNotConnected is returned when TDs are received before the directory client is connected
+var errDirNotConnected = errors.New("not connected to the directory")
+
+// RetryQueueMetrics contains the metrics of the retry queue of TD updates
+type RetryQueueMetrics struct {
+	Depth    int    `json:"depth"`    // nr of things with a TD update waiting to be retried
+	Queued   uint64 `json:"queued"`   // nr of TD updates added to the queue, including coalesced updates
+	Retried  uint64 `json:"retried"`  // nr of TD updates that succeeded after a retry
+	Failures uint64 `json:"failures"` // nr of failed attempts to update a TD, including the first attempt
+	Dropped  uint64 `json:"dropped"`  // nr of TD updates dropped because the queue is full
+	Rejected uint64 `json:"rejected"` // nr of TD updates rejected by the directory. These are not retried.
+}
+
+// retryEntry is a TD update that waits to be retried
+type retryEntry struct {
+	ThingID     string                 `json:"thingID"`
+	TD          map[string]interface{} `json:"td"`
+	PublisherID string                 `json:"publisherID"`
+	Attempts    int                    `json:"attempts"`
+	Queued      time.Time              `json:"queued"`
+	NextAttempt time.Time              `json:"nextAttempt"`
+}
+
+// retryQueue holds the TD updates that failed because the directory couldn't be reached
+// Updates are coalesced per thing so only the latest TD of a thing is retried. Retries use an
+// exponential backoff. When the queue is full the thing that is queued the longest is dropped.
+// The queue is persisted so updates are not lost when the service restarts.
+type retryQueue struct {
+	store       *dirfilestore.DirFileStore
+	entries     map[string]*retryEntry
+	maxSize     int
+	maxInterval time.Duration
+	metrics     RetryQueueMetrics
+	updateTD    func(thingID string, td map[string]interface{}, publisherID string) error
+	stopChannel chan bool
+	waitGroup   sync.WaitGroup // running process loop
+	mutex       sync.Mutex
+}
+
+// isRetryable returns true if the update failed because the directory couldn't be reached
+// This includes the directory or a proxy in front of it responding with 502, 503 or 504. TDs that
+// are rejected by the directory fail again and are not retried.
+func isRetryable(err error) bool {
+	var urlErr *url.Error
+	var statusErr *dirclient.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusBadGateway ||
+			statusErr.StatusCode == http.StatusServiceUnavailable ||
+			statusErr.StatusCode == http.StatusGatewayTimeout
+	}
+	return errors.Is(err, errDirNotConnected) || errors.As(err, &urlErr)
+}
+
+// retryInterval returns the interval before the next retry after the given nr of attempts
+func (rq *retryQueue) retryInterval(attempts int) time.Duration {
+	interval := retryInitialInterval
+	for i := 1; i < attempts && interval < rq.maxInterval; i++ {
+		interval *= 2
+	}
+	if interval > rq.maxInterval {
+		interval = rq.maxInterval
+	}
+	return interval
+}
+
+// save the entry in the store
+func (rq *retryQueue) save(entry *retryEntry) {
+	var doc map[string]interface{}
+	data, _ := json.Marshal(entry)
+	json.Unmarshal(data, &doc)
+	err := rq.store.Replace(entry.ThingID, doc)
+	if err != nil {
+		logrus.Errorf("retryQueue.save: unable to save the TD of thing '%s': %s", entry.ThingID, err)
+	}
+}
+
+// Add a failed TD update to the queue
+// If the thing is already queued then its TD is replaced with the new TD.
+func (rq *retryQueue) Add(thingID string, td map[string]interface{}, publisherID string) {
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+	rq.metrics.Queued++
+	entry, found := rq.entries[thingID]
+	if found {
+		// keep the backoff as the directory is still unreachable
+		entry = &retryEntry{ThingID: thingID, TD: td, PublisherID: publisherID,
+			Attempts: entry.Attempts, Queued: entry.Queued, NextAttempt: entry.NextAttempt}
+	} else {
+		if len(rq.entries) >= rq.maxSize {
+			rq.dropOldest()
+		}
+		now := time.Now()
+		entry = &retryEntry{ThingID: thingID, TD: td, PublisherID: publisherID,
+			Attempts: 1, Queued: now, NextAttempt: now.Add(rq.retryInterval(1))}
+	}
+	rq.entries[thingID] = entry
+	rq.save(entry)
+}
+
+// Contains returns true if an update of the thing is waiting to be retried
+func (rq *retryQueue) Contains(thingID string) bool {
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+	_, found := rq.entries[thingID]
+	return found
+}
+
+// dropOldest removes the thing that is queued the longest
+func (rq *retryQueue) dropOldest() {
+	var oldest *retryEntry
+	for _, entry := range rq.entries {
+		if oldest == nil || entry.Queued.Before(oldest.Queued) {
+			oldest = entry
+		}
+	}
+	if oldest != nil {
+		logrus.Warningf("retryQueue.dropOldest: queue is full. Dropping the TD of thing '%s'", oldest.ThingID)
+		delete(rq.entries, oldest.ThingID)
+		rq.store.Remove(oldest.ThingID)
+		rq.metrics.Dropped++
+	}
+}
+
+// GetMetrics returns the metrics of the queue
+func (rq *retryQueue) GetMetrics() RetryQueueMetrics {
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+	metrics := rq.metrics
+	metrics.Depth = len(rq.entries)
+	return metrics
+}
+
+// AddFailure counts a failed update or rejection
+func (rq *retryQueue) AddFailure(rejected bool) {
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+	rq.metrics.Failures++
+	if rejected {
+		rq.metrics.Rejected++
+	}
+}
+
+// Open the queue and load the persisted TD updates
+func (rq *retryQueue) Open() error {
+	err := rq.store.Open()
+	if err != nil {
+		return err
+	}
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+	for thingID, doc := range rq.store.Snapshot() {
+		entry := &retryEntry{}
+		data, err := json.Marshal(doc)
+		if err == nil {
+			err = json.Unmarshal(data, entry)
+		}
+		if err != nil || entry.ThingID != thingID {
+			logrus.Warningf("retryQueue.Open: ignoring invalid entry '%s'", thingID)
+			rq.store.Remove(thingID)
+			continue
+		}
+		rq.entries[thingID] = entry
+	}
+	if len(rq.entries) > 0 {
+		logrus.Infof("retryQueue.Open: %d TD updates to retry", len(rq.entries))
+	}
+	return nil
+}
+
+// Process retries the TD updates that are due
+// Successful and rejected updates are removed from the queue. Failed updates are retried after
+// the next backoff interval.
+func (rq *retryQueue) Process() {
+	now := time.Now()
+	rq.mutex.Lock()
+	due := make([]*retryEntry, 0)
+	for _, entry := range rq.entries {
+		if !entry.NextAttempt.After(now) {
+			due = append(due, entry)
+		}
+	}
+	rq.mutex.Unlock()
+	// retry in the order the things were queued
+	sort.Slice(due, func(i, j int) bool { return due[i].Queued.Before(due[j].Queued) })
+
+	for _, entry := range due {
+		err := rq.updateTD(entry.ThingID, entry.TD, entry.PublisherID)
+		rq.mutex.Lock()
+		if err != nil {
+			rq.metrics.Failures++
+		}
+		if rq.entries[entry.ThingID] != entry {
+			// the entry was replaced or dropped while retrying. The replacement is retried next.
+			rq.mutex.Unlock()
+			continue
+		}
+		if err == nil || !isRetryable(err) {
+			delete(rq.entries, entry.ThingID)
+			rq.store.Remove(entry.ThingID)
+			if err == nil {
+				rq.metrics.Retried++
+			} else {
+				rq.metrics.Rejected++
+				logrus.Warningf("retryQueue.Process: TD '%s' is rejected: %s", entry.ThingID, err)
+			}
+		} else {
+			retried := *entry
+			retried.Attempts++
+			retried.NextAttempt = time.Now().Add(rq.retryInterval(retried.Attempts))
+			rq.entries[entry.ThingID] = &retried
+			rq.save(&retried)
+			logrus.Infof("retryQueue.Process: retry %d of TD '%s' failed: %s", entry.Attempts, entry.ThingID, err)
+		}
+		rq.mutex.Unlock()
+	}
+}
+
+// processLoop retries the TD updates until stopped
+func (rq *retryQueue) processLoop(stopChannel chan bool) {
+	defer rq.waitGroup.Done()
+	ticker := time.NewTicker(retryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopChannel:
+			return
+		case <-ticker.C:
+			rq.Process()
+		}
+	}
+}
+
+// Start retrying the queued TD updates
+func (rq *retryQueue) Start() {
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+	if rq.stopChannel == nil {
+		rq.stopChannel = make(chan bool)
+		rq.waitGroup.Add(1)
+		go rq.processLoop(rq.stopChannel)
+	}
+}
+
+// Stop retrying and save the queue
+// This waits for a retry in progress to finish before the queue is saved.
+func (rq *retryQueue) Stop() {
+	rq.mutex.Lock()
+	if rq.stopChannel != nil {
+		close(rq.stopChannel)
+		rq.stopChannel = nil
+	}
+	rq.mutex.Unlock()
+	rq.waitGroup.Wait()
+	rq.store.Close()
+}
+
+// newRetryQueue creates a queue for TD updates that failed
+//  storePath is the file to persist the queue in
+//  maxSize is the max nr of things in the queue
+//  maxInterval is the max interval between retries of a TD update
+//  updateTD is the function that updates the TD in the directory
+func newRetryQueue(storePath string, maxSize int, maxInterval time.Duration,
+	updateTD func(thingID string, td map[string]interface{}, publisherID string) error) *retryQueue {
+	rq := &retryQueue{
+		store:       dirfilestore.NewDirFileStore(storePath),
+		entries:     make(map[string]*retryEntry),
+		maxSize:     maxSize,
+		maxInterval: maxInterval,
+		updateTD:    updateTD,
+	}
+	return rq
+}
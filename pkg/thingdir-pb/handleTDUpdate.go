@@ -1,6 +1,38 @@
 package thingdirpb
 
+import "github.com/sirupsen/logrus"
+
+// updateTD updates the TD in the directory on behalf of the publisher
+func (pb *ThingDirPB) updateTD(thingID string, thingTD map[string]interface{}, publisherID string) error {
+	dirClient := pb.getDirClient()
+	if dirClient == nil {
+		return errDirNotConnected
+	}
+	return dirClient.UpdateTDAsPublisher(thingID, thingTD, publisherID)
+}
+
 // handleTDUpdate updates the directory with the updated TD
+// The update is made on behalf of the publisher, so the directory can verify that the publisher
+// owns the TD. Updates that fail because the directory can't be reached are queued for retry.
+// If an update of the thing is already queued then the new TD replaces it, so the updates are
+// applied in order.
 func (pb *ThingDirPB) handleTDUpdate(thingID string, thingTD map[string]interface{}, publisherID string) {
-	pb.dirClient.UpdateTD(thingID, thingTD)
+	retryQueue := pb.getRetryQueue()
+	if retryQueue != nil && retryQueue.Contains(thingID) {
+		retryQueue.Add(thingID, thingTD, publisherID)
+		return
+	}
+	err := pb.updateTD(thingID, thingTD, publisherID)
+	if err == nil {
+		return
+	} else if retryQueue == nil {
+		logrus.Warningf("handleTDUpdate: TD '%s' from publisher '%s' is not updated: %s", thingID, publisherID, err)
+	} else if isRetryable(err) {
+		logrus.Warningf("handleTDUpdate: TD '%s' from publisher '%s' is queued for retry: %s", thingID, publisherID, err)
+		retryQueue.AddFailure(false)
+		retryQueue.Add(thingID, thingTD, publisherID)
+	} else {
+		logrus.Warningf("handleTDUpdate: TD '%s' from publisher '%s' is rejected: %s", thingID, publisherID, err)
+		retryQueue.AddFailure(true)
+	}
 }
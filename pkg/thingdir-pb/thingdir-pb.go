@@ -3,13 +3,14 @@ package thingdirpb
 import (
 	"fmt"
 	"path"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/wostzone/hubauth/pkg/aclstore"
 	"github.com/wostzone/hubauth/pkg/authenticate"
 	"github.com/wostzone/hubauth/pkg/authorize"
 	"github.com/wostzone/hubauth/pkg/unpwstore"
-	"github.com/wostzone/hubclient-go/pkg/certs"
 	"github.com/wostzone/hubclient-go/pkg/config"
 	"github.com/wostzone/hubclient-go/pkg/mqttclient"
 	"github.com/wostzone/thingdir/pkg/dirclient"
@@ -18,6 +19,9 @@ import (
 
 const PluginID = "thingdir-pb"
 
+// DefaultMsgbusRetryInterval is the default interval in seconds to retry connecting to the message bus
+const DefaultMsgbusRetryInterval = 30
+
 // ThingDirPBConfig protocol binding configuration
 type ThingDirPBConfig struct {
 	// Directory server settings for the built-in directory server
@@ -27,10 +31,41 @@ type ThingDirPBConfig struct {
 	ServerCertPath   string `yaml:"serverCertPath"`   // server cert location. Default is hub's server
 	ServerKeyPath    string `yaml:"serverKeyPath"`    // server key location. Default is hub's key
 	ServerCaPath     string `yaml:"serverCaPath"`     // server CA cert location for client auth. Default is hub's CA
+	TDValidation     string `yaml:"tdValidation"`     // TD validation mode: off, warn or reject. Default is off
+	TDSchemaFile     string `yaml:"tdSchemaFile"`     // TD 1.1 JSON schema file used for validation. Default is in the config folder
+
+	TombstoneRetention int `yaml:"tombstoneRetention"` // Hours to keep changes for delta sync, -1 for no age limit. Default (0) is 720 (30 days)
+	TrashRetention     int `yaml:"trashRetention"`     // Hours to keep deleted TDs in the trash, -1 until purged. Default (0) is 168 (7 days)
+	AuditLogSize       int `yaml:"auditLogSize"`       // Size in MB at which the audit log is rotated. Default is 10
+	AuditLogFiles      int `yaml:"auditLogFiles"`      // Nr of rotated audit log files to keep. Default is 5
+
+	// Fields to remove from TDs for users that can't edit them
+	RedactionRules []dirserver.RedactionRule `yaml:"redactionRules"`
+	// Allow clients without credentials to read TDs with public visibility. Default is false
+	AnonymousRead bool `yaml:"anonymousRead"`
+	// Accept JWT bearer tokens signed by the keys in the key set. Disabled if no key set is configured
+	TokenAuth dirserver.TokenAuthConfig `yaml:"tokenAuth"`
+	// Accept API keys of service accounts, managed by administrators. Default is false
+	APIKeys bool `yaml:"apiKeys"`
+	// Reject revoked client certificates from a CRL file or a list of serial numbers
+	Revocation dirserver.RevocationConfig `yaml:"revocation"`
 
 	// DNS-SD discovery settings
 	EnableDiscovery bool   `yaml:"enableDiscovery"` // Enable server DNS-SD discovery
 	ServiceName     string `yaml:"serviceName"`     // DNS-SD service name: as used in "_{serviceName}._tcp" when using discovery
+	WoTDiscovery    bool   `yaml:"wotDiscovery"`    // Also publish the WoT Discovery "_wot._tcp" service with the "_directory" subtype
+	DiscoveryIPv6   bool   `yaml:"discoveryIPv6"`   // Publish the IPv6 addresses of the interfaces
+
+	DiscoveryInterfaces []string `yaml:"discoveryInterfaces"` // Network interfaces to publish on. Default is all
+
+	// Federated query settings
+	FederationPeers     []string `yaml:"federationPeers"`     // address:port of peer directories
+	FederationDiscovery bool     `yaml:"federationDiscovery"` // Use DNS-SD to discover peer directories
+	FederationTimeout   int      `yaml:"federationTimeout"`   // Peer query timeout in seconds. Default is 5
+
+	// Replication settings
+	ReplicaOf           string `yaml:"replicaOf"`           // address:port of the primary directory when this is a replica
+	ReplicationInterval int    `yaml:"replicationInterval"` // Interval in seconds to poll the primary. Default is 5
 
 	// protocl binding client settings used to connect the protocol binding to the directory server
 	// If an external directory is used these fields must be set. Defaults to the internal server
@@ -40,13 +75,25 @@ type ThingDirPBConfig struct {
 	PbClientCaPath   string `yaml:"pbClientCaPath"`   // Directory server CA cert location. Default is hub's CA
 
 	// mqtt client settings
-	MsgbusCertPath string `yaml:"msgbusCertPath"`   // Client certificate for connecting to the message bus.
-	MsgbusKeyPath  string `yaml:"msgbusKeyPath"`    // Client key location for connecting to the message bus
-	MsgbusCaPath   string `yaml:"msgbusCaCertPath"` // message bus CA cert location. Default is hub's CA
+	Standalone     bool   `yaml:"standalone"`     // Only run the directory server, without the message bus
+	MsgbusCertPath string `yaml:"msgbusCertPath"` // Client certificate for connecting to the message bus.
+	MsgbusKeyPath  string `yaml:"msgbusKeyPath"`  // Client key location for connecting to the message bus
+	MsgbusCaPath   string `yaml:"msgbusCaPath"`   // message bus CA cert location. Default is hub's CA
+	// Interval in seconds to retry connecting to the message bus. Default is 30
+	MsgbusRetryInterval int `yaml:"msgbusRetryInterval"`
+	// Max nr of things with TD updates waiting to be retried. Default is 1000
+	RetryQueueSize int `yaml:"retryQueueSize"`
+	// Max interval in seconds between retries of a TD update. Default is 300
+	RetryMaxInterval int `yaml:"retryMaxInterval"`
+
+	// publisher ownership settings
+	VerifyPublisherInThingID bool `yaml:"verifyPublisherInThingID"` // Only the owning publisher can update a TD. Default is false
 
-	//	VerifyPublisherInThingID bool   `yaml:"verifyPublisherInThingID"` // publisher must be the ThingID publisher
 	// directory store settings
 	DirectoryStoreFolder string `yaml:"storeFolder"` // location of directory files
+
+	// Interval in seconds to check the certificate and config files for changes. Default is 10
+	ReloadInterval int `yaml:"reloadInterval"`
 }
 
 // Thing Directory Protocol Binding for the WoST Hub
@@ -58,68 +105,302 @@ type ThingDirPB struct {
 	hubClient     *mqttclient.MqttHubClient
 	authenticator authenticate.VerifyUsernamePassword
 	authorizer    authorize.VerifyAuthorization
+	groupAcl      dirserver.IGroupAcl
+	mutex         sync.RWMutex // protects the clients while they are reconnected
+	msgbusRetry   chan bool    // stops retrying the message bus connection, nil if not retrying
+	retryQueue    *retryQueue  // TD updates that wait to be retried, nil if not started
+
+	// reload of certificates and configuration
+	configFile      string               // configuration file to reload, "" to not reload
+	forceStandalone bool                 // standalone regardless of the configuration file
+	fileModTimes    map[string]time.Time // modification time of the watched files
+	reloadStop      chan bool
+	reloadMutex     sync.Mutex
+}
+
+// getDirClient returns the client of the directory server
+func (pb *ThingDirPB) getDirClient() *dirclient.DirClient {
+	pb.mutex.RLock()
+	defer pb.mutex.RUnlock()
+	return pb.dirClient
+}
+
+// revocationEnabled returns true if the configuration has revoked client certificates
+func (pb *ThingDirPB) revocationEnabled() bool {
+	return pb.config.Revocation.CRLPath != "" || len(pb.config.Revocation.RevokedSerials) > 0
+}
+
+// getRetryQueue returns the queue of TD updates that wait to be retried
+func (pb *ThingDirPB) getRetryQueue() *retryQueue {
+	pb.mutex.RLock()
+	defer pb.mutex.RUnlock()
+	return pb.retryQueue
+}
+
+// GetRetryQueueMetrics returns the metrics of the queue of TD updates that wait to be retried
+func (pb *ThingDirPB) GetRetryQueueMetrics() RetryQueueMetrics {
+	retryQueue := pb.getRetryQueue()
+	if retryQueue == nil {
+		return RetryQueueMetrics{}
+	}
+	return retryQueue.GetMetrics()
+}
+
+// IsMsgbusConnected returns true if the protocol binding is connected to the message bus
+func (pb *ThingDirPB) IsMsgbusConnected() bool {
+	pb.mutex.RLock()
+	defer pb.mutex.RUnlock()
+	return pb.hubClient != nil
+}
+
+// SetStandalone only runs the directory server, regardless of the configuration file
+// This must be set before Start.
+func (pb *ThingDirPB) SetStandalone() {
+	pb.forceStandalone = true
+	pb.config.Standalone = true
 }
 
 // Start the ThingDir service.
 //  1. Launches the directory server, if enabled. disable to use an external directory
-//  2. Creates a client to update the directory server
-//  3. Creates a client to subscribe to TD updates on the message bus
-// This automatically captures updates to TD documents published on the message bus
+//  2. Creates a client to update the directory server, unless standalone
+//  3. Creates a client to subscribe to TD updates on the message bus, unless standalone
+// This automatically captures updates to TD documents published on the message bus. Updates that
+// fail because the directory can't be reached are retried from a persistent queue. If the
+// message bus isn't available then the connection is retried in the background. Renewed
+// certificates and changes to the configuration file are reloaded while running.
 func (pb *ThingDirPB) Start() error {
 	logrus.Infof("ThingDirPB.Start")
-	var err error
+	err := pb.start()
+	if err == nil {
+		pb.startReload()
+	}
+	return err
+}
 
-	serverCert, err := certs.LoadTLSCertFromPEM(pb.config.ServerCertPath, pb.config.ServerKeyPath)
+// start the directory server and clients
+func (pb *ThingDirPB) start() error {
+	if pb.config.Standalone && pb.config.DisableDirServer {
+		return fmt.Errorf("ThingDirPB: standalone mode requires the built-in directory server")
+	}
+	loaded, err := loadCerts(&pb.config)
 	if err != nil {
 		return err
 	}
 
 	// First get the directory server up and running, if not disabled
 	if !pb.config.DisableDirServer {
-		pb.dirServer = dirserver.NewDirectoryServer(
-			pb.config.PbClientID,
-			pb.config.DirectoryStoreFolder,
-			pb.config.DirAddress, pb.config.DirPort,
-			pb.config.ServiceName,
-			serverCert, pb.hubConfig.CaCert,
-			pb.authenticator,
-			pb.authorizer)
-
-		err = pb.dirServer.Start()
+		pb.dirServer, err = pb.newDirServer(loaded)
+		if err == nil {
+			err = pb.dirServer.Start()
+		}
 		if err != nil {
 			return err
 		}
 	}
-	// connect a client to the directory server for use by the protocol binding
+	return pb.startClients(loaded)
+}
+
+// newDirServer creates the directory server with the current configuration
+// The server is not started.
+func (pb *ThingDirPB) newDirServer(loaded *pbCerts) (*dirserver.DirectoryServer, error) {
+	dirServer := dirserver.NewDirectoryServer(
+		pb.config.PbClientID,
+		pb.config.DirectoryStoreFolder,
+		pb.config.DirAddress, pb.config.DirPort,
+		pb.config.ServiceName,
+		loaded.serverCert, loaded.serverCaCert,
+		pb.authenticator,
+		pb.authorizer)
+	dirServer.SetGroupAcl(pb.groupAcl)
+	dirServer.SetDiscoveryOptions(
+		pb.config.WoTDiscovery, pb.config.DiscoveryInterfaces, pb.config.DiscoveryIPv6)
+	if len(pb.config.FederationPeers) > 0 || pb.config.FederationDiscovery {
+		dirServer.SetFederation(pb.config.FederationPeers, pb.config.FederationDiscovery,
+			loaded.clientCert, time.Duration(pb.config.FederationTimeout)*time.Second)
+	}
+	if pb.config.ReplicaOf != "" {
+		dirServer.SetReplicaOf(pb.config.ReplicaOf, loaded.clientCert,
+			time.Duration(pb.config.ReplicationInterval)*time.Second)
+	}
+	dirServer.SetTombstoneRetention(retentionHours(pb.config.TombstoneRetention))
+	dirServer.SetAnonymousRead(pb.config.AnonymousRead)
+	dirServer.SetAPIKeys(pb.config.APIKeys)
+	dirServer.SetVerifyPublisher(pb.config.VerifyPublisherInThingID)
+	dirServer.SetTrashRetention(retentionHours(pb.config.TrashRetention))
+	dirServer.SetAuditLogRotation(int64(pb.config.AuditLogSize)*1024*1024, pb.config.AuditLogFiles)
+	if pb.config.TDValidation != string(dirserver.ValidationModeOff) {
+		err := dirServer.SetTDSchema(pb.config.TDSchemaFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := dirServer.SetValidationMode(dirserver.ValidationMode(pb.config.TDValidation))
+	if err != nil {
+		return nil, err
+	}
+	err = dirServer.SetRedactionRules(pb.config.RedactionRules)
+	if err != nil {
+		return nil, err
+	}
+	if pb.revocationEnabled() {
+		err = dirServer.SetRevocation(pb.config.Revocation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pb.config.TokenAuth.KeySetPath != "" {
+		err = dirServer.SetTokenAuth(pb.config.TokenAuth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dirServer, nil
+}
+
+// startClients opens the retry queue and connects the directory and message bus clients
+// Nothing is started in standalone mode.
+func (pb *ThingDirPB) startClients(loaded *pbCerts) error {
+	if pb.config.Standalone {
+		logrus.Warningf("ThingDirPB.start: standalone mode. TDs published on the message bus are not captured.")
+		return nil
+	}
+	retryQueue := newRetryQueue(path.Join(pb.config.DirectoryStoreFolder, DefaultRetryQueueFile),
+		pb.config.RetryQueueSize, time.Duration(pb.config.RetryMaxInterval)*time.Second, pb.updateTD)
+	err := retryQueue.Open()
+	if err != nil {
+		return fmt.Errorf("ThingDirPB: unable to open the retry queue: %s", err)
+	}
+	retryQueue.Start()
+	pb.mutex.Lock()
+	pb.retryQueue = retryQueue
+	pb.mutex.Unlock()
+	return pb.connectClients(loaded)
+}
+
+// connectClients connects the directory and message bus clients and replaces the current clients
+// The directory client is used to update the directory with TDs received from the message bus.
+// If the message bus isn't available then the connection is retried in the background.
+func (pb *ThingDirPB) connectClients(loaded *pbCerts) error {
 	dirHostPort := fmt.Sprintf("%s:%d", pb.config.DirAddress, pb.config.DirPort)
-	pb.dirClient = dirclient.NewDirClient(dirHostPort, pb.hubConfig.CaCert)
-	err = pb.dirClient.ConnectWithClientCert(pb.hubConfig.PluginCert)
+	dirClient := dirclient.NewDirClient(dirHostPort, loaded.clientCaCert)
+	err := dirClient.ConnectWithClientCert(loaded.clientCert)
 	if err != nil {
-		return err
+		return fmt.Errorf("ThingDirPB: unable to connect to the directory at %s: %s", dirHostPort, err)
+	}
+	pb.mutex.Lock()
+	oldDirClient := pb.dirClient
+	pb.dirClient = dirClient
+	pb.mutex.Unlock()
+	if oldDirClient != nil {
+		oldDirClient.Close()
 	}
 
-	// last, start listening to TD updates on the message bus; use the same client certificate
+	// last, start listening to TD updates on the message bus
+	retryStop := make(chan bool)
+	pb.mutex.Lock()
+	if pb.msgbusRetry != nil {
+		close(pb.msgbusRetry)
+	}
+	pb.msgbusRetry = retryStop
+	pb.mutex.Unlock()
+	err = pb.connectMsgbus(loaded, retryStop)
+	if err != nil {
+		logrus.Warningf("ThingDirPB.connectClients: %s. Retrying every %d seconds.", err, pb.config.MsgbusRetryInterval)
+		go pb.msgbusRetryLoop(loaded, retryStop)
+	}
+	return nil
+}
+
+// connectMsgbus connects to the message bus, replaces the current message bus client and
+// subscribes to TD updates.
+// The new client is discarded if the retry is stopped while connecting.
+//  retryStop channel of the connection attempt
+func (pb *ThingDirPB) connectMsgbus(loaded *pbCerts, retryStop chan bool) error {
 	mqttHostPort := fmt.Sprintf("%s:%d", pb.hubConfig.MqttAddress, pb.hubConfig.MqttPortCert)
-	err = pb.hubClient.ConnectWithClientCert(mqttHostPort, pb.hubConfig.PluginCert)
+	hubClient := mqttclient.NewMqttHubClient(PluginID, loaded.msgbusCaCert)
+	err := hubClient.ConnectWithClientCert(mqttHostPort, loaded.msgbusCert)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to connect to the message bus at %s: %s", mqttHostPort, err)
 	}
-	pb.hubClient.SubscribeToTD("", pb.handleTDUpdate)
+	pb.mutex.Lock()
+	if pb.msgbusRetry != retryStop {
+		pb.mutex.Unlock()
+		hubClient.Close()
+		return nil
+	}
+	oldHubClient := pb.hubClient
+	pb.hubClient = hubClient
+	pb.msgbusRetry = nil
+	pb.mutex.Unlock()
+	if oldHubClient != nil {
+		oldHubClient.Close()
+	}
+	hubClient.SubscribeToTD("", pb.handleTDUpdate)
+	return nil
+}
 
-	return err
+// msgbusRetryLoop retries connecting to the message bus until connected or stopped
+func (pb *ThingDirPB) msgbusRetryLoop(loaded *pbCerts, retryStop chan bool) {
+	ticker := time.NewTicker(time.Duration(pb.config.MsgbusRetryInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-retryStop:
+			return
+		case <-ticker.C:
+			err := pb.connectMsgbus(loaded, retryStop)
+			if err == nil {
+				logrus.Infof("ThingDirPB.msgbusRetryLoop: connected to the message bus")
+				return
+			}
+			logrus.Infof("ThingDirPB.msgbusRetryLoop: %s", err)
+		}
+	}
 }
 
 // Stop the ThingDir service
 func (pb *ThingDirPB) Stop() {
 	logrus.Infof("ThingDirPB.Stop")
+	pb.stopReload()
+	pb.stop()
+}
+
+// stop the clients and directory server
+func (pb *ThingDirPB) stop() {
+	pb.stopClients()
+	pb.mutex.Lock()
+	dirServer := pb.dirServer
+	pb.dirServer = nil
+	pb.mutex.Unlock()
+	if dirServer != nil {
+		dirServer.Stop()
+	}
+}
+
+// stopClients stops the retry queue and the directory and message bus clients
+// The retry queue is stopped without holding the lock, as a retry in progress reads the
+// directory client. The directory client is closed after the retry queue has stopped.
+func (pb *ThingDirPB) stopClients() {
+	pb.mutex.Lock()
+	if pb.msgbusRetry != nil {
+		close(pb.msgbusRetry)
+		pb.msgbusRetry = nil
+	}
 	if pb.hubClient != nil {
 		pb.hubClient.Close()
+		pb.hubClient = nil
 	}
-	if pb.dirClient != nil {
-		pb.dirClient.Close()
+	dirClient := pb.dirClient
+	pb.dirClient = nil
+	retryQueue := pb.retryQueue
+	pb.retryQueue = nil
+	pb.mutex.Unlock()
+
+	if retryQueue != nil {
+		retryQueue.Stop()
 	}
-	if pb.dirServer != nil {
-		pb.dirServer.Stop()
+	if dirClient != nil {
+		dirClient.Close()
 	}
 }
 
@@ -129,7 +410,38 @@ func (pb *ThingDirPB) Stop() {
 //  config with the plugin configuration and overrides from the defaults
 //  hubConfig with default server address and certificate folder
 func NewThingDirPB(thingdirconf *ThingDirPBConfig, hubConfig *config.HubConfig) *ThingDirPB {
+	setConfigDefaults(thingdirconf, hubConfig)
+
+	// The file based stores are the only option for now
+	aclFile := aclstore.DefaultAclFile
+	aclStore := aclstore.NewAclFileStore(aclFile, "ThingDirPB")
+
+	unpwFile := unpwstore.DefaultPasswordFile
+	unpwStore := unpwstore.NewPasswordFileStore(unpwFile, "ThingDirPB")
+
+	tdir := ThingDirPB{
+		config:        *thingdirconf,
+		hubConfig:     *hubConfig,
+		authenticator: authenticate.NewAuthenticator(unpwStore).VerifyUsernamePassword,
+		authorizer:    authorize.NewAuthorizer(aclStore).VerifyAuthorization,
+		groupAcl:      aclStore,
+	}
+	return &tdir
+}
 
+// retentionHours returns the retention duration of a configured nr of hours
+// A negative nr of hours, eg -1, returns 0 which means there is no age limit.
+func retentionHours(hours int) time.Duration {
+	if hours < 0 {
+		return 0
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// setConfigDefaults sets the defaults of the configuration fields that are not set
+//  thingdirconf with the plugin configuration to update
+//  hubConfig with default server address and certificate folder
+func setConfigDefaults(thingdirconf *ThingDirPBConfig, hubConfig *config.HubConfig) {
 	// Directory server defaults when using the built-in server
 	if thingdirconf.DirAddress == "" {
 		thingdirconf.DirAddress = hubConfig.MqttAddress
@@ -143,6 +455,30 @@ func NewThingDirPB(thingdirconf *ThingDirPBConfig, hubConfig *config.HubConfig)
 	if thingdirconf.ServiceName == "" {
 		thingdirconf.ServiceName = dirclient.DefaultServiceName
 	}
+	if thingdirconf.TDValidation == "" {
+		thingdirconf.TDValidation = string(dirserver.ValidationModeOff)
+	}
+	if thingdirconf.TDSchemaFile == "" {
+		thingdirconf.TDSchemaFile = path.Join(hubConfig.ConfigFolder, dirserver.DefaultTDSchemaFile)
+	}
+	if thingdirconf.TombstoneRetention == 0 {
+		thingdirconf.TombstoneRetention = int(dirserver.DefaultTombstoneRetention / time.Hour)
+	}
+	if thingdirconf.TrashRetention == 0 {
+		thingdirconf.TrashRetention = int(dirserver.DefaultTrashRetention / time.Hour)
+	}
+	if thingdirconf.AuditLogSize == 0 {
+		thingdirconf.AuditLogSize = dirserver.DefaultAuditLogSize / 1024 / 1024
+	}
+	if thingdirconf.AuditLogFiles == 0 {
+		thingdirconf.AuditLogFiles = dirserver.DefaultAuditLogFiles
+	}
+	if thingdirconf.FederationTimeout == 0 {
+		thingdirconf.FederationTimeout = int(dirserver.DefaultPeerTimeout / time.Second)
+	}
+	if thingdirconf.ReplicationInterval == 0 {
+		thingdirconf.ReplicationInterval = int(dirserver.DefaultReplicationInterval / time.Second)
+	}
 	if !thingdirconf.EnableDiscovery {
 		thingdirconf.ServiceName = ""
 	}
@@ -180,20 +516,16 @@ func NewThingDirPB(thingdirconf *ThingDirPBConfig, hubConfig *config.HubConfig)
 	if thingdirconf.MsgbusCaPath == "" {
 		thingdirconf.MsgbusCaPath = path.Join(hubConfig.CertsFolder, config.DefaultCaCertFile)
 	}
-
-	// The file based stores are the only option for now
-	aclFile := aclstore.DefaultAclFile
-	aclStore := aclstore.NewAclFileStore(aclFile, "ThingDirPB")
-
-	unpwFile := unpwstore.DefaultPasswordFile
-	unpwStore := unpwstore.NewPasswordFileStore(unpwFile, "ThingDirPB")
-
-	tdir := ThingDirPB{
-		config:        *thingdirconf,
-		hubConfig:     *hubConfig,
-		hubClient:     mqttclient.NewMqttHubClient(PluginID, hubConfig.CaCert),
-		authenticator: authenticate.NewAuthenticator(unpwStore).VerifyUsernamePassword,
-		authorizer:    authorize.NewAuthorizer(aclStore).VerifyAuthorization,
+	if thingdirconf.MsgbusRetryInterval == 0 {
+		thingdirconf.MsgbusRetryInterval = DefaultMsgbusRetryInterval
+	}
+	if thingdirconf.RetryQueueSize == 0 {
+		thingdirconf.RetryQueueSize = DefaultRetryQueueSize
+	}
+	if thingdirconf.RetryMaxInterval == 0 {
+		thingdirconf.RetryMaxInterval = DefaultRetryMaxInterval
+	}
+	if thingdirconf.ReloadInterval == 0 {
+		thingdirconf.ReloadInterval = DefaultReloadInterval
 	}
-	return &tdir
 }
@@ -1,9 +1,22 @@
 package thingdirpb_test
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
 	"os"
 	"path"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,6 +31,7 @@ import (
 	"github.com/wostzone/hubclient-go/pkg/td"
 	"github.com/wostzone/hubclient-go/pkg/testenv"
 	"github.com/wostzone/hubclient-go/pkg/vocab"
+	"github.com/wostzone/hubserve-go/pkg/certsetup"
 )
 
 // var certFolder string
@@ -69,6 +83,7 @@ func TestStartStopThingDirectoryService(t *testing.T) {
 	tdirPB := thingdirpb.NewThingDirPB(tdirConfig, &hubConfig)
 	err = tdirPB.Start()
 	assert.NoError(t, err)
+	assert.True(t, tdirPB.IsMsgbusConnected())
 
 	dirHostPort := fmt.Sprintf("%s:%d", testenv.ServerAddress, tdirConfig.DirPort)
 	tdirClient := dirclient.NewDirClient(dirHostPort, hubConfig.CaCert)
@@ -85,13 +100,69 @@ func TestStartStopThingDirectoryService(t *testing.T) {
 
 func TestStartThingDirBadAddress(t *testing.T) {
 	// tdirConfig := &thingdirpb.ThingDirPBConfig{DirAddress: hubConfig.MqttAddress}
-	tdirConfig := &thingdirpb.ThingDirPBConfig{}
+	tdirConfig := &thingdirpb.ThingDirPBConfig{DirAddress: hubConfig.MqttAddress}
 	hc := hubConfig // copy
 	hc.MqttAddress = "wrongaddress"
 
+	// the directory runs while the message bus connection is retried
 	tdirPB := thingdirpb.NewThingDirPB(tdirConfig, &hc)
 	err := tdirPB.Start()
+	require.NoError(t, err)
+	assert.False(t, tdirPB.IsMsgbusConnected())
+	dirHostPort := fmt.Sprintf("%s:%d", tdirConfig.DirAddress, tdirConfig.DirPort)
+	tdirClient := dirclient.NewDirClient(dirHostPort, hubConfig.CaCert)
+	err = tdirClient.ConnectWithClientCert(hubConfig.PluginCert)
+	require.NoError(t, err)
+	_, err = tdirClient.ListTDs(0, 0)
+	assert.NoError(t, err)
+	tdirClient.Close()
+	tdirPB.Stop()
+
+	// the directory server is required
+	tdirConfig = &thingdirpb.ThingDirPBConfig{DirAddress: "wrongaddress"}
+	tdirPB = thingdirpb.NewThingDirPB(tdirConfig, &hubConfig)
+	err = tdirPB.Start()
+	if err == nil {
+		tdirPB.Stop()
+	}
+	assert.Error(t, err)
+}
+
+func TestStandalone(t *testing.T) {
+	certFolder, _ := ioutil.TempDir("", "thingdir-standalone")
+	defer os.RemoveAll(certFolder)
+	tdirConfig := &thingdirpb.ThingDirPBConfig{
+		DirAddress:     hubConfig.MqttAddress,
+		Standalone:     true,
+		MsgbusCertPath: path.Join(certFolder, "missingCert.pem"),
+	}
+	tdirPB := thingdirpb.NewThingDirPB(tdirConfig, &hubConfig)
+	err := tdirPB.Start()
+	require.NoError(t, err)
+	assert.False(t, tdirPB.IsMsgbusConnected())
+
+	dirHostPort := fmt.Sprintf("%s:%d", tdirConfig.DirAddress, tdirConfig.DirPort)
+	tdirClient := dirclient.NewDirClient(dirHostPort, hubConfig.CaCert)
+	err = tdirClient.ConnectWithClientCert(hubConfig.PluginCert)
+	require.NoError(t, err)
+	_, err = tdirClient.ListTDs(0, 0)
+	assert.NoError(t, err)
+	tdirClient.Close()
+	tdirPB.Stop()
+
+	// standalone requires the built-in directory server
+	tdirConfig = &thingdirpb.ThingDirPBConfig{Standalone: true, DisableDirServer: true}
+	err = thingdirpb.NewThingDirPB(tdirConfig, &hubConfig).Start()
 	assert.Error(t, err)
+
+	// the commandline override
+	tdirConfig = &thingdirpb.ThingDirPBConfig{DirAddress: hubConfig.MqttAddress}
+	tdirPB = thingdirpb.NewThingDirPB(tdirConfig, &hubConfig)
+	tdirPB.SetStandalone()
+	err = tdirPB.Start()
+	require.NoError(t, err)
+	assert.False(t, tdirPB.IsMsgbusConnected())
+	tdirPB.Stop()
 }
 
 func TestUpdateTD(t *testing.T) {
@@ -134,3 +205,371 @@ func TestUpdateTD(t *testing.T) {
 	tdirClient.Close()
 	tdirPB.Stop()
 }
+
+func TestReload(t *testing.T) {
+	// watch a copy of the configuration file with revoked certificates
+	configFile := path.Join(hubConfig.ConfigFolder, thingdirpb.PluginID+".yaml")
+	configData, err := ioutil.ReadFile(configFile)
+	require.NoError(t, err)
+	reloadFile := path.Join(os.TempDir(), "thingdir-pb-reload.yaml")
+	writeConfig := func(revokedSerial string, settings string) {
+		data := string(configData) + "\nrevocation:\n  revokedSerials: [\"" + revokedSerial + "\"]\n" + settings
+		err := ioutil.WriteFile(reloadFile, []byte(data), 0600)
+		require.NoError(t, err)
+	}
+	writeConfig("1f", "")
+	defer os.Remove(reloadFile)
+	tdirConfig := &thingdirpb.ThingDirPBConfig{}
+	err = config.LoadYamlConfig(reloadFile, &tdirConfig, nil)
+	require.NoError(t, err)
+
+	tdirPB := thingdirpb.NewThingDirPB(tdirConfig, &hubConfig)
+	tdirPB.SetConfigFile(reloadFile)
+	err = tdirPB.Start()
+	require.NoError(t, err)
+	defer tdirPB.Stop()
+
+	// renewed certificates are used without restarting
+	err = tdirPB.ReloadCerts()
+	assert.NoError(t, err)
+	dirHostPort := fmt.Sprintf("%s:%d", tdirConfig.DirAddress, tdirConfig.DirPort)
+	tdirClient := dirclient.NewDirClient(dirHostPort, hubConfig.CaCert)
+	err = tdirClient.ConnectWithClientCert(hubConfig.PluginCert)
+	require.NoError(t, err)
+	defer tdirClient.Close()
+	_, err = tdirClient.ListTDs(0, 0)
+	assert.NoError(t, err)
+
+	// revoked serials are applied and an invalid configuration is ignored
+	writeConfig("2f", "")
+	err = tdirPB.ReloadConfig()
+	assert.NoError(t, err)
+	writeConfig("not-a-serial", "")
+	err = tdirPB.ReloadConfig()
+	assert.Error(t, err)
+	_, err = tdirClient.ListTDs(0, 0)
+	assert.NoError(t, err)
+
+	// invalid settings and certificates are rejected before restarting
+	writeConfig("2f", "tdValidation: bogus\n")
+	err = tdirPB.ReloadConfig()
+	assert.Error(t, err)
+	writeConfig("2f", "tdValidation: reject\ntdSchemaFile: /not/a/schema.json\n")
+	err = tdirPB.ReloadConfig()
+	assert.Error(t, err)
+	_, err = tdirClient.ListTDs(0, 0)
+	assert.NoError(t, err)
+	writeConfig("2f", "serverCertPath: /not/a/cert.pem\n")
+	err = tdirPB.ReloadConfig()
+	assert.Error(t, err)
+	_, err = tdirClient.ListTDs(0, 0)
+	assert.NoError(t, err)
+
+	// other changes to the directory server keep the open connections
+	caPool := x509.NewCertPool()
+	caPool.AddCert(hubConfig.CaCert)
+	conn, err := tls.Dial("tcp", dirHostPort, &tls.Config{
+		RootCAs: caPool, Certificates: []tls.Certificate{*hubConfig.PluginCert}})
+	require.NoError(t, err)
+	defer conn.Close()
+	connReader := bufio.NewReader(conn)
+	getThings := func() int {
+		_, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", dirclient.RouteThings, dirHostPort)
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(connReader, nil)
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, getThings())
+	anonClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool}}}
+	thingsURL := fmt.Sprintf("https://%s%s", dirHostPort, dirclient.RouteThings)
+	resp, err := anonClient.Get(thingsURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	writeConfig("2f", "anonymousRead: true\n")
+	err = tdirPB.ReloadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, getThings())
+	resp, err = anonClient.Get(thingsURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the previous configuration is restored if the restart fails
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:0", tdirConfig.DirAddress))
+	require.NoError(t, err)
+	defer listener.Close()
+	usedPort := listener.Addr().(*net.TCPAddr).Port
+	writeConfig("2f", fmt.Sprintf("dirPort: %d\n", usedPort))
+	err = tdirPB.ReloadConfig()
+	assert.Error(t, err)
+	_, err = tdirClient.ListTDs(0, 0)
+	assert.NoError(t, err)
+}
+
+// createTestCert creates a certificate signed by the CA, or a self-signed CA if caCert is nil,
+// and saves the certificate and key in PEM format
+// Returns the certificate, key and the cert and key file paths
+func createTestCert(t *testing.T, folder string, name string, ou string, caCert *x509.Certificate,
+	caKey *ecdsa.PrivateKey, hosts []string) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name, OrganizationalUnit: []string{ou}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if caCert == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		caCert, caKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certPath := path.Join(folder, name+"Cert.pem")
+	keyPath := path.Join(folder, name+"Key.pem")
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	require.NoError(t, err)
+	return cert, key, certPath, keyPath
+}
+
+func TestSeparateCA(t *testing.T) {
+	certFolder, _ := ioutil.TempDir("", "thingdir-ca")
+	defer os.RemoveAll(certFolder)
+	storeFolder, _ := ioutil.TempDir("", "thingdir-ca-store")
+	defer os.RemoveAll(storeFolder)
+	dirAddress := hubConfig.MqttAddress
+	dirPort := uint(dirclient.DefaultPort + 10)
+
+	// a directory with its own CA
+	caCert, caKey, caPath, _ := createTestCert(t, certFolder, "ca", "", nil, nil, nil)
+	_, _, serverCertPath, serverKeyPath := createTestCert(
+		t, certFolder, "server", "", caCert, caKey, []string{dirAddress, "localhost", "127.0.0.1"})
+	_, _, clientCertPath, clientKeyPath := createTestCert(
+		t, certFolder, "client", certsetup.OUPlugin, caCert, caKey, nil)
+	serverConfig := &thingdirpb.ThingDirPBConfig{
+		DirAddress:           dirAddress,
+		DirPort:              dirPort,
+		DirectoryStoreFolder: storeFolder,
+		ServerCertPath:       serverCertPath,
+		ServerKeyPath:        serverKeyPath,
+		ServerCaPath:         caPath,
+		PbClientCertPath:     clientCertPath,
+		PbClientKeyPath:      clientKeyPath,
+		PbClientCaPath:       caPath,
+	}
+	serverPB := thingdirpb.NewThingDirPB(serverConfig, &hubConfig)
+	err := serverPB.Start()
+	require.NoError(t, err)
+	defer serverPB.Stop()
+
+	// a protocol binding that uses the external directory
+	externalConfig := &thingdirpb.ThingDirPBConfig{
+		DisableDirServer: true,
+		DirAddress:       dirAddress,
+		DirPort:          dirPort,
+		PbClientID:       "external",
+		PbClientCertPath: clientCertPath,
+		PbClientKeyPath:  clientKeyPath,
+		PbClientCaPath:   caPath,
+	}
+	externalPB := thingdirpb.NewThingDirPB(externalConfig, &hubConfig)
+	err = externalPB.Start()
+	require.NoError(t, err)
+	externalPB.Stop()
+
+	// only clients with a certificate of the directory's CA are accepted
+	clientCert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+	require.NoError(t, err)
+	dirHostPort := fmt.Sprintf("%s:%d", dirAddress, dirPort)
+	dirClient := dirclient.NewDirClient(dirHostPort, caCert)
+	err = dirClient.ConnectWithClientCert(&clientCert)
+	require.NoError(t, err)
+	_, err = dirClient.ListTDs(0, 0)
+	assert.NoError(t, err)
+	dirClient.Close()
+	hubClient := dirclient.NewDirClient(dirHostPort, caCert)
+	err = hubClient.ConnectWithClientCert(hubConfig.PluginCert)
+	if err == nil {
+		_, err = hubClient.ListTDs(0, 0)
+	}
+	assert.Error(t, err)
+	hubClient.Close()
+
+	// invalid certificate settings are reported at startup
+	badConfig := *externalConfig
+	badConfig.PbClientCaPath = clientCertPath
+	err = thingdirpb.NewThingDirPB(&badConfig, &hubConfig).Start()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), clientCertPath)
+	badConfig = *externalConfig
+	badConfig.MsgbusKeyPath = path.Join(certFolder, "missingKey.pem")
+	err = thingdirpb.NewThingDirPB(&badConfig, &hubConfig).Start()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), badConfig.MsgbusKeyPath)
+}
+
+func TestRetryQueue(t *testing.T) {
+	storeFolder, _ := ioutil.TempDir("", "thingdir-retry")
+	defer os.RemoveAll(storeFolder)
+	dirStoreFolder, _ := ioutil.TempDir("", "thingdir-retry-dir")
+	defer os.RemoveAll(dirStoreFolder)
+	thingID := "thing-retry"
+	dirPort := uint(dirclient.DefaultPort + 11)
+
+	// a protocol binding that uses a directory that is down
+	tdirConfig := &thingdirpb.ThingDirPBConfig{
+		DisableDirServer:     true,
+		DirAddress:           hubConfig.MqttAddress,
+		DirPort:              dirPort,
+		DirectoryStoreFolder: storeFolder,
+		PbClientID:           "retry",
+		RetryMaxInterval:     1,
+	}
+	tdirPB := thingdirpb.NewThingDirPB(tdirConfig, &hubConfig)
+	err := tdirPB.Start()
+	require.NoError(t, err)
+
+	// updates of the same thing are coalesced
+	mqttHostPort := fmt.Sprintf("%s:%d", hubConfig.MqttAddress, hubConfig.MqttPortCert)
+	mqttClient := mqttclient.NewMqttHubClient("testRetryQueue", hubConfig.CaCert)
+	err = mqttClient.ConnectWithClientCert(mqttHostPort, hubConfig.PluginCert)
+	require.NoError(t, err)
+	defer mqttClient.Close()
+	td1 := td.CreateTD(thingID, vocab.DeviceTypeButton)
+	err = mqttClient.PublishTD(thingID, td1)
+	assert.NoError(t, err)
+	time.Sleep(time.Second)
+	td2 := td.CreateTD(thingID, vocab.DeviceTypeButton)
+	td2["title"] = "latest"
+	err = mqttClient.PublishTD(thingID, td2)
+	assert.NoError(t, err)
+	time.Sleep(time.Second)
+	metrics := tdirPB.GetRetryQueueMetrics()
+	assert.Equal(t, 1, metrics.Depth)
+	assert.GreaterOrEqual(t, metrics.Queued, uint64(2))
+	assert.GreaterOrEqual(t, metrics.Failures, uint64(1))
+
+	// the queue is persisted
+	tdirPB.Stop()
+	_, err = os.Stat(path.Join(storeFolder, thingdirpb.DefaultRetryQueueFile))
+	require.NoError(t, err)
+
+	// the queued update is applied when the directory is up
+	dirConfig := &thingdirpb.ThingDirPBConfig{
+		Standalone:           true,
+		DirAddress:           hubConfig.MqttAddress,
+		DirPort:              dirPort,
+		DirectoryStoreFolder: dirStoreFolder,
+	}
+	dirPB := thingdirpb.NewThingDirPB(dirConfig, &hubConfig)
+	err = dirPB.Start()
+	require.NoError(t, err)
+	defer dirPB.Stop()
+	err = tdirPB.Start()
+	require.NoError(t, err)
+	defer tdirPB.Stop()
+	for i := 0; i < 10 && tdirPB.GetRetryQueueMetrics().Depth > 0; i++ {
+		time.Sleep(time.Second)
+	}
+	metrics = tdirPB.GetRetryQueueMetrics()
+	assert.Equal(t, 0, metrics.Depth)
+	assert.GreaterOrEqual(t, metrics.Retried, uint64(1))
+
+	dirHostPort := fmt.Sprintf("%s:%d", hubConfig.MqttAddress, dirPort)
+	tdirClient := dirclient.NewDirClient(dirHostPort, hubConfig.CaCert)
+	err = tdirClient.ConnectWithClientCert(hubConfig.PluginCert)
+	require.NoError(t, err)
+	defer tdirClient.Close()
+	thingTD, err := tdirClient.GetTD(thingID)
+	require.NoError(t, err)
+	assert.Equal(t, "latest", thingTD["title"])
+}
+
+func TestRetryUnavailable(t *testing.T) {
+	storeFolder, _ := ioutil.TempDir("", "thingdir-retry503")
+	defer os.RemoveAll(storeFolder)
+	thingID := "thing-retry503"
+	dirPort := uint(dirclient.DefaultPort + 12)
+
+	// a directory behind a proxy that responds with service unavailable
+	var status int32 = http.StatusServiceUnavailable
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{*testCerts.ServerCert}}
+	listener, err := tls.Listen("tcp", fmt.Sprintf("%s:%d", hubConfig.MqttAddress, dirPort), tlsConfig)
+	require.NoError(t, err)
+	dirServer := &http.Server{Handler: http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(int(atomic.LoadInt32(&status)))
+	})}
+	go dirServer.Serve(listener)
+	defer dirServer.Close()
+
+	tdirConfig := &thingdirpb.ThingDirPBConfig{
+		DisableDirServer:     true,
+		DirAddress:           hubConfig.MqttAddress,
+		DirPort:              dirPort,
+		DirectoryStoreFolder: storeFolder,
+		PbClientID:           "retry503",
+		RetryMaxInterval:     1,
+	}
+	tdirPB := thingdirpb.NewThingDirPB(tdirConfig, &hubConfig)
+	err = tdirPB.Start()
+	require.NoError(t, err)
+	defer tdirPB.Stop()
+
+	mqttHostPort := fmt.Sprintf("%s:%d", hubConfig.MqttAddress, hubConfig.MqttPortCert)
+	mqttClient := mqttclient.NewMqttHubClient("testRetryUnavailable", hubConfig.CaCert)
+	err = mqttClient.ConnectWithClientCert(mqttHostPort, hubConfig.PluginCert)
+	require.NoError(t, err)
+	defer mqttClient.Close()
+	err = mqttClient.PublishTD(thingID, td.CreateTD(thingID, vocab.DeviceTypeButton))
+	assert.NoError(t, err)
+
+	// the update is queued and retried while the directory is unavailable
+	time.Sleep(3 * time.Second)
+	metrics := tdirPB.GetRetryQueueMetrics()
+	assert.Equal(t, 1, metrics.Depth)
+	assert.Equal(t, uint64(0), metrics.Rejected)
+	assert.GreaterOrEqual(t, metrics.Failures, uint64(2))
+
+	// the update is applied when the directory is available again
+	atomic.StoreInt32(&status, http.StatusOK)
+	for i := 0; i < 10 && tdirPB.GetRetryQueueMetrics().Depth > 0; i++ {
+		time.Sleep(time.Second)
+	}
+	metrics = tdirPB.GetRetryQueueMetrics()
+	assert.Equal(t, 0, metrics.Depth)
+	assert.GreaterOrEqual(t, metrics.Retried, uint64(1))
+}
+
+func TestRetentionDefaults(t *testing.T) {
+	// 0 uses the default retention
+	tdirConfig := &thingdirpb.ThingDirPBConfig{}
+	thingdirpb.NewThingDirPB(tdirConfig, &hubConfig)
+	assert.Equal(t, 720, tdirConfig.TombstoneRetention)
+	assert.Equal(t, 168, tdirConfig.TrashRetention)
+
+	// -1 removes the age limit and is kept
+	tdirConfig = &thingdirpb.ThingDirPBConfig{TombstoneRetention: -1, TrashRetention: -1}
+	thingdirpb.NewThingDirPB(tdirConfig, &hubConfig)
+	assert.Equal(t, -1, tdirConfig.TombstoneRetention)
+	assert.Equal(t, -1, tdirConfig.TrashRetention)
+}